@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// process the input directory bench_iterations times into a scratch
+// directory and report throughput. The state file and processing cache are
+// left out so every iteration does the full work
+func runBench(cfg *config.Config, log logger.Logger, args []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	notifyShutdown(sigChan)
+	go handleSignals(sigChan, 0, nil, cancel, log)
+
+	imageFiles, err := findImageFiles(cfg, cfg.InputDir)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to list input directory")
+	}
+	if len(imageFiles) == 0 {
+		log.Warn("No images found in input directory")
+		return
+	}
+
+	var inputBytes int64
+	for _, path := range imageFiles {
+		if info, err := os.Stat(path); err == nil {
+			inputBytes += info.Size()
+		}
+	}
+
+	var total, best time.Duration
+	for i := 1; i <= cfg.BenchIterations; i++ {
+		scratch, err := os.MkdirTemp("", "imgproc-bench-")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create scratch directory")
+		}
+
+		benchCfg := *cfg
+		benchCfg.OutputDir = scratch
+		benchCfg.StateFile = ""
+		benchCfg.CacheDir = ""
+		benchCfg.DeadLetterDir = ""
+		benchCfg.ContentAddressed = false
+		benchCfg.InPlace = false
+
+		proc, err := processor.New(processor.WithConfig(&benchCfg), processor.WithLogger(log))
+		if err != nil {
+			os.RemoveAll(scratch)
+			log.WithError(err).Fatal("Failed to initialize processor")
+		}
+
+		start := time.Now()
+		results, err := proc.ProcessImages(ctx, imageFiles)
+		duration := time.Since(start)
+		os.RemoveAll(scratch)
+		if err != nil {
+			log.WithError(err).Fatal("Benchmark interrupted")
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Error != nil {
+				failed++
+			}
+		}
+
+		total += duration
+		if best == 0 || duration < best {
+			best = duration
+		}
+		log.WithFields(map[string]interface{}{
+			"iteration":      i,
+			"duration":       duration,
+			"images_per_sec": throughput(float64(len(imageFiles)), duration),
+			"mb_per_sec":     throughput(float64(inputBytes)/(1<<20), duration),
+			"failed":         failed,
+		}).Info("Benchmark iteration completed")
+	}
+
+	mean := total / time.Duration(cfg.BenchIterations)
+	log.WithFields(map[string]interface{}{
+		"iterations":     cfg.BenchIterations,
+		"images":         len(imageFiles),
+		"input_bytes":    inputBytes,
+		"mean":           mean,
+		"best":           best,
+		"images_per_sec": throughput(float64(len(imageFiles)), mean),
+		"mb_per_sec":     throughput(float64(inputBytes)/(1<<20), mean),
+	}).Info("Benchmark completed")
+}
+
+// amount per second, to two decimals
+func throughput(amount float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return round2(amount / d.Seconds())
+}
+
+// round to two decimals for logging
+func round2(v float64) float64 {
+	return float64(int64(v*100+0.5)) / 100
+}
@@ -0,0 +1,867 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// a subcommand and its flags
+type command struct {
+	name    string
+	args    string
+	summary string
+	// mode the configuration runs in; empty keeps the configured mode
+	mode  string
+	flags func(f *flagSet)
+	run   func(cfg *config.Config, log logger.Logger, args []string)
+}
+
+var commands = []*command{
+	{
+		name:    "process",
+		args:    " [- | url ...]",
+		summary: "Apply the filter pipeline to every image in the input directory",
+		flags:   processFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "serve",
+		summary: "Process images uploaded over HTTP",
+		mode:    "process",
+		flags:   serveFlags,
+		run:     runServe,
+	},
+	{
+		name:    "sign",
+		args:    " path ...",
+		summary: "Print the signed form of transformation paths for serve's GET URLs",
+		run:     runSign,
+	},
+	{
+		name:    "consume",
+		summary: "Process job messages from a message queue and publish their results",
+		mode:    "process",
+		flags:   consumeFlags,
+		run:     runConsume,
+	},
+	{
+		name:    "coordinate",
+		args:    " [url ...]",
+		summary: "Queue the input directory in Redis for a fleet of workers and collect the results",
+		mode:    "process",
+		flags:   coordinateFlags,
+		run:     runCoordinate,
+	},
+	{
+		name:    "work",
+		summary: "Process jobs from the Redis queue filled by coordinate",
+		mode:    "process",
+		flags:   workFlags,
+		run:     runWork,
+	},
+	{
+		name:    "watch",
+		summary: "Process images as they appear in the input directory",
+		mode:    "process",
+		flags:   watchFlags,
+		run:     runWatch,
+	},
+	{
+		name:    "inspect",
+		args:    " [file ...]",
+		summary: "Print the format, dimensions, color model and EXIF of images",
+		mode:    "inspect",
+		flags:   inspectFlags,
+		run:     runInspect,
+	},
+	{
+		name:    "validate",
+		summary: "Report corrupt, truncated and misnamed images",
+		mode:    "validate",
+		flags:   validateFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "stats",
+		args:    " [file ...]",
+		summary: "Print histograms, mean, sharpness and clipping of images as JSON lines",
+		mode:    "stats",
+		flags:   statsFlags,
+		run:     runStats,
+	},
+	{
+		name:    "duplicates",
+		summary: "Group near-duplicate images by perceptual hash",
+		mode:    "duplicates",
+		flags:   duplicatesFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "optimize",
+		summary: "Recompress PNG and JPEG images losslessly, reporting the bytes saved",
+		mode:    "optimize",
+		flags:   optimizeFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "bench",
+		summary: "Measure pipeline throughput on the input directory",
+		mode:    "process",
+		flags:   benchFlags,
+		run:     runBench,
+	},
+	{
+		name:    "convert",
+		summary: "Re-encode images in another format without filtering them",
+		mode:    "process",
+		flags:   convertFlags,
+		run:     runConvert,
+	},
+	{
+		name:    "stack",
+		summary: "Combine aligned frames into one image",
+		mode:    "stack",
+		flags:   stackFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "diff",
+		summary: "Compare the input directory with another one",
+		mode:    "diff",
+		flags:   diffFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "tiles",
+		summary: "List the tiles that changed between two directories",
+		mode:    "tiles",
+		flags:   tilesFlags,
+		run:     runProcess,
+	},
+	{
+		name:    "control",
+		args:    " status | pause | resume | workers [stage=]count ... | drain",
+		summary: "Send a command to a running process over its control socket",
+		flags:   controlFlags,
+		run:     runControl,
+	},
+	{
+		name:    "graph",
+		summary: "Print the pipeline as a dot or mermaid diagram",
+		mode:    "graph",
+		flags:   graphFlags,
+		run:     runGraph,
+	},
+	{
+		name:    "filters",
+		args:    " [filter ...]",
+		summary: "List the filters and the settings each one takes",
+		run:     runFilters,
+	},
+	{
+		name:    "config",
+		args:    " init [file]",
+		summary: "Write a config file with every setting at its default",
+		run:     runConfig,
+	},
+}
+
+// command with the given name, nil if there is none
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// a flag and how it changes the configuration
+type option struct {
+	name string
+	set  func(cfg *config.Config)
+}
+
+// a command's flags. Options are applied to the loaded configuration in the
+// order they were defined, and only when given, so they don't override the
+// config file with their defaults
+type flagSet struct {
+	*flag.FlagSet
+	options []option
+}
+
+func (f *flagSet) stringOption(name, value, usage string, set func(cfg *config.Config, v string)) {
+	p := f.String(name, value, usage)
+	f.options = append(f.options, option{name, func(cfg *config.Config) { set(cfg, *p) }})
+}
+
+func (f *flagSet) intOption(name string, value int, usage string, set func(cfg *config.Config, v int)) {
+	p := f.Int(name, value, usage)
+	f.options = append(f.options, option{name, func(cfg *config.Config) { set(cfg, *p) }})
+}
+
+func (f *flagSet) floatOption(name string, value float64, usage string, set func(cfg *config.Config, v float64)) {
+	p := f.Float64(name, value, usage)
+	f.options = append(f.options, option{name, func(cfg *config.Config) { set(cfg, *p) }})
+}
+
+func (f *flagSet) boolOption(name, usage string, set func(cfg *config.Config, v bool)) {
+	p := f.Bool(name, false, usage)
+	f.options = append(f.options, option{name, func(cfg *config.Config) { set(cfg, *p) }})
+}
+
+func (f *flagSet) durationOption(name string, value time.Duration, usage string, set func(cfg *config.Config, v time.Duration)) {
+	p := f.Duration(name, value, usage)
+	f.options = append(f.options, option{name, func(cfg *config.Config) { set(cfg, *p) }})
+}
+
+// apply the options given on the command line
+func (f *flagSet) apply(cfg *config.Config) {
+	given := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) { given[fl.Name] = true })
+	for _, opt := range f.options {
+		if given[opt.name] {
+			opt.set(cfg)
+		}
+	}
+}
+
+// flags every command takes, needed before the configuration is loaded
+type commonFlags struct {
+	configFile string
+	verbose    bool
+	logFormat  string
+	logFile    string
+}
+
+// the command's flag set, with the flags every command takes
+func (c *command) flagSet() (*flagSet, *commonFlags) {
+	f := &flagSet{FlagSet: flag.NewFlagSet(c.name, flag.ExitOnError)}
+	common := &commonFlags{}
+	f.StringVar(&common.configFile, "config", "", "Configuration file path")
+	f.BoolVar(&common.verbose, "verbose", false, "Enable verbose logging")
+	f.StringVar(&common.logFormat, "log-format", "", "Log output (text, json); defaults to log_format")
+	f.StringVar(&common.logFile, "log-file", "", "Append logs to this file instead of stdout; defaults to log_file")
+	if c.flags != nil {
+		c.flags(f)
+	}
+	f.Usage = func() { c.usage(f) }
+	return f, common
+}
+
+// parse the command's flags and load the configuration they override
+func (c *command) parse(args []string) (*config.Config, logger.Logger, []string) {
+	f, common := c.flagSet()
+	f.Parse(args)
+
+	// in pipe mode stdout carries the image, so logs go to stderr
+	var out io.Writer = os.Stdout
+	if pipeMode(f.Args()) {
+		out = os.Stderr
+	}
+
+	// errors loading the configuration are logged in the format asked for
+	// on the command line, if any
+	log := logger.NewLoggerWithOutput(common.verbose, common.logFormat, out)
+
+	cfg, err := c.load(f, common)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load configuration")
+	}
+	configSource = source{
+		file: common.configFile,
+		load: func() (*config.Config, error) { return c.load(f, common) },
+	}
+
+	if cfg.LogFile != "" {
+		file, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open log file")
+		}
+		out = file
+	}
+	out = dashboardOutput(cfg, f.Args(), out)
+
+	return cfg, logger.NewLoggerWithOutput(common.verbose, cfg.LogFormat, out), f.Args()
+}
+
+// where the running command's configuration comes from, so daemons can
+// load it again
+type source struct {
+	// the config file, empty without one
+	file string
+	load func() (*config.Config, error)
+}
+
+var configSource source
+
+// load the configuration from the config file and the environment, with
+// the command's flags over it
+func (c *command) load(f *flagSet, common *commonFlags) (*config.Config, error) {
+	cfg, err := config.Load(common.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file: %w", err)
+	}
+	if c.mode != "" {
+		cfg.Mode = c.mode
+	}
+	if common.logFormat != "" {
+		cfg.LogFormat = common.logFormat
+	}
+	if common.logFile != "" {
+		cfg.LogFile = common.logFile
+	}
+	if common.verbose {
+		cfg.StripTimings = true
+	}
+	f.apply(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// usage prefix of flags left out of -help, such as fault injection for
+// resilience testing
+const hiddenFlag = "(hidden) "
+
+// print the command's usage and flag defaults without hidden flags
+func (c *command) usage(f *flagSet) {
+	out := f.Output()
+	fmt.Fprintf(out, "Usage: %s %s [flags]%s\n\n%s.\n\nFlags:\n", program(), c.name, c.args, c.summary)
+
+	visible := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	visible.SetOutput(out)
+	f.VisitAll(func(fl *flag.Flag) {
+		if !strings.HasPrefix(fl.Usage, hiddenFlag) {
+			visible.Var(fl.Value, fl.Name, fl.Usage)
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// print the list of commands
+func usage() {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", program())
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\nRun '%s help <command>' for the flags of a command. Without a command,\nthe flags are those of process.\n", program())
+}
+
+// print the usage of the named command, or the list of commands
+func help(args []string) {
+	if len(args) == 0 {
+		usage()
+		return
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+	f, _ := cmd.flagSet()
+	f.Usage()
+}
+
+// name the program was run as
+func program() string {
+	return filepath.Base(os.Args[0])
+}
+
+// flags of the commands
+
+func inputFlag(f *flagSet) {
+	f.stringOption("input", "examples/images", "Input directory containing images", func(cfg *config.Config, v string) {
+		cfg.InputDir = v
+	})
+}
+
+func outputFlag(f *flagSet) {
+	f.stringOption("output", "examples/output", "Output directory for processed images", func(cfg *config.Config, v string) {
+		cfg.OutputDir = v
+	})
+}
+
+func forceFlag(f *flagSet) {
+	f.boolOption("force", "Run even when another run holds the output directory's lock", func(cfg *config.Config, v bool) {
+		cfg.Force = v
+	})
+}
+
+func workersFlag(f *flagSet) {
+	f.intOption("workers", runtime.NumCPU(), "Number of worker goroutines", func(cfg *config.Config, v int) {
+		cfg.Workers = v
+	})
+}
+
+// the filters of the input directory walk
+func discoveryFlags(f *flagSet) {
+	f.stringOption("include", "", "Only process files matching one of these comma-separated globs, e.g. '*.jpg,raw/*'", func(cfg *config.Config, v string) {
+		cfg.Include = splitList(v)
+	})
+	f.stringOption("exclude", "", "Skip files and directories matching any of these comma-separated globs, e.g. '*_thumb.*'", func(cfg *config.Config, v string) {
+		cfg.Exclude = splitList(v)
+	})
+	f.stringOption("ext", "", "Only process these comma-separated extensions, e.g. jpg,png", func(cfg *config.Config, v string) {
+		cfg.Extensions = splitList(v)
+	})
+	f.intOption("min-size", 0, "Skip files smaller than this many bytes", func(cfg *config.Config, v int) {
+		cfg.MinSize = int64(v)
+	})
+	f.intOption("max-size", 0, "Skip files larger than this many bytes", func(cfg *config.Config, v int) {
+		cfg.MaxSize = int64(v)
+	})
+	f.stringOption("newer-than", "", "Only process files modified after this time, date or duration ago (24h)", func(cfg *config.Config, v string) {
+		cfg.NewerThan = v
+	})
+	f.stringOption("older-than", "", "Only process files modified before this time, date or duration ago", func(cfg *config.Config, v string) {
+		cfg.OlderThan = v
+	})
+	f.intOption("walk-workers", 1, "Directories read concurrently while walking the input, for network filesystems", func(cfg *config.Config, v int) {
+		cfg.WalkWorkers = v
+	})
+	f.stringOption("symlinks", "files", "Symbolic links in the input (files: links to files only, follow: enter linked directories too, skip)", func(cfg *config.Config, v string) {
+		cfg.Symlinks = v
+	})
+	f.boolOption("skip-hidden", "Skip files and directories whose names start with a dot", func(cfg *config.Config, v bool) {
+		cfg.SkipHidden = v
+	})
+	f.intOption("max-depth", 0, "Directory levels walked, 1 for the input directory only; 0 walks the whole tree", func(cfg *config.Config, v int) {
+		cfg.MaxDepth = v
+	})
+}
+
+// non-empty items of a comma-separated list
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// the filter, worker counts, low priority mode and fault injection of
+// commands running the pipeline
+func pipelineFlags(f *flagSet) {
+	f.stringOption("filter", "grayscale", "Filter to apply ("+strings.Join(filterspec.Names(), ", ")+"); run filters for their settings", func(cfg *config.Config, v string) {
+		cfg.Filter = v
+	})
+	workersFlag(f)
+	f.intOption("row-workers", runtime.NumCPU()*2, "Number of row processing workers per image", func(cfg *config.Config, v int) {
+		cfg.RowWorkers = v
+	})
+	f.boolOption("low-priority", "Run as a background job: fewer CPUs, yields between strips and a lower OS priority", func(cfg *config.Config, v bool) {
+		cfg.LowPriority = v
+	})
+	f.stringOption("fault-inject", "", hiddenFlag+"Inject faults, e.g. decode=0.1,slow=0.05,delay=2s,panic=0.01", func(cfg *config.Config, v string) {
+		cfg.FaultInject = v
+	})
+}
+
+func deadLetterFlag(f *flagSet) {
+	f.stringOption("dead-letter", "", "Directory failed inputs are copied to with an error record", func(cfg *config.Config, v string) {
+		cfg.DeadLetterDir = v
+	})
+}
+
+// adds a webhook called on every event to those of the config file
+func webhookFlag(f *flagSet) {
+	f.stringOption("webhook", "", "URL notified of job failures and batch completion with a JSON POST", func(cfg *config.Config, v string) {
+		cfg.Webhooks = append(cfg.Webhooks, config.Webhook{URL: v})
+	})
+}
+
+func eventsFlag(f *flagSet) {
+	f.stringOption("events", "", "Append job lifecycle events to this file as JSON lines", func(cfg *config.Config, v string) {
+		cfg.EventsFile = v
+	})
+}
+
+func maxFailuresFlag(f *flagSet) {
+	f.stringOption("max-failures", "0", "Failures tolerated before exiting non-zero, as a count (5) or percentage (10%)", func(cfg *config.Config, v string) {
+		cfg.MaxFailures = v
+	})
+}
+
+func debugListenFlag(f *flagSet) {
+	f.stringOption("debug-listen", "", "Serve pprof and worker pool state on this address, e.g. localhost:6060", func(cfg *config.Config, v string) {
+		cfg.DebugListen = v
+	})
+}
+
+func controlSocketFlag(f *flagSet) {
+	f.stringOption("control-socket", "", "Take status, pause, resume, workers and drain commands on this Unix socket", func(cfg *config.Config, v string) {
+		cfg.ControlSocket = v
+	})
+}
+
+func healthListenFlag(f *flagSet) {
+	f.stringOption("health-listen", "", "Serve the /healthz and /readyz probes on this address, e.g. :8081", func(cfg *config.Config, v string) {
+		cfg.HealthListen = v
+	})
+}
+
+func compareFlag(f *flagSet) {
+	f.stringOption("compare", "", "Directory compared against the input directory", func(cfg *config.Config, v string) {
+		cfg.CompareDir = v
+	})
+}
+
+func processFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	outputFlag(f)
+	forceFlag(f)
+	pipelineFlags(f)
+	f.stringOption("mode", "process", "Run mode (process, stack, diff, tiles, graph, validate, inspect, duplicates, stats, optimize); the commands of the same names are preferred", func(cfg *config.Config, v string) {
+		cfg.Mode = v
+	})
+	// applied after -mode, which decides the format it sets
+	f.stringOption("format", "", "Output format for graph (dot, mermaid) and inspect (table, json) modes", func(cfg *config.Config, v string) {
+		if cfg.Mode == "inspect" {
+			cfg.InspectFormat = v
+		} else {
+			cfg.GraphFormat = v
+		}
+	})
+	compareFlag(f)
+	f.boolOption("debug-dumps", "Write intermediate stages and histograms for a sample of images", func(cfg *config.Config, v bool) {
+		cfg.DebugDumps = v
+	})
+	f.boolOption("ordered", "Report results in input order instead of completion order", func(cfg *config.Config, v bool) {
+		cfg.OrderedResults = v
+	})
+	f.boolOption("deterministic", "Make outputs and reports bit-identical across runs of the same inputs", func(cfg *config.Config, v bool) {
+		cfg.Deterministic = v
+	})
+	f.boolOption("hardened-decode", "Decode inputs in goroutines of their own, given up on after decode_timeout", func(cfg *config.Config, v bool) {
+		cfg.HardenedDecode = v
+	})
+	f.stringOption("duplicates", "", "Skip near-duplicates of earlier inputs, or link their outputs to the earlier input's (skip, link)", func(cfg *config.Config, v string) {
+		cfg.DuplicateAction = v
+	})
+	f.stringOption("dedupe", "", "Process inputs with identical bytes once and copy or link the outputs for the others (copy, link)", func(cfg *config.Config, v string) {
+		cfg.Dedupe = v
+	})
+	f.stringOption("state-file", "", "Record finished jobs here and skip them when the command is re-run", func(cfg *config.Config, v string) {
+		cfg.StateFile = v
+	})
+	f.stringOption("index", "", "Record processed inputs in this index and only process inputs new or changed since", func(cfg *config.Config, v string) {
+		cfg.IncrementalIndex = v
+	})
+	f.boolOption("mirror-delete", "With -index, delete the outputs of inputs that no longer exist", func(cfg *config.Config, v bool) {
+		cfg.MirrorDelete = v
+	})
+	f.boolOption("in-place", "Write each result over its input instead of into the output directory", func(cfg *config.Config, v bool) {
+		cfg.InPlace = v
+	})
+	f.stringOption("in-place-backup", "", "With -in-place, keep each original under its name with this suffix, such as .bak", func(cfg *config.Config, v string) {
+		cfg.InPlaceBackup = v
+	})
+	f.stringOption("collisions", "hash", "Rename outputs whose path another input's output has with a hash of the input's path or a number (hash, number)", func(cfg *config.Config, v string) {
+		cfg.OutputCollisions = v
+	})
+	f.stringOption("manifest", "", "JSON or CSV file listing the jobs to run instead of walking the input directory", func(cfg *config.Config, v string) {
+		cfg.Manifest = v
+	})
+	f.stringOption("urls", "", "File listing http(s) URLs to download and process, one per line", func(cfg *config.Config, v string) {
+		cfg.URLsFile = v
+	})
+	f.stringOption("download-dir", "", "Keep downloads here and reuse them on later runs; empty uses a temporary directory", func(cfg *config.Config, v string) {
+		cfg.DownloadDir = v
+	})
+	f.intOption("download-workers", 4, "Number of concurrent downloads", func(cfg *config.Config, v int) {
+		cfg.DownloadWorkers = v
+	})
+	maxFailuresFlag(f)
+	deadLetterFlag(f)
+	debugListenFlag(f)
+	controlSocketFlag(f)
+	eventsFlag(f)
+	f.boolOption("progress", "Print a line counting finished images to stderr", func(cfg *config.Config, v bool) {
+		cfg.Progress = v
+	})
+	f.boolOption("dashboard", "Show workers, queues, throughput, failures and the log on a terminal dashboard", func(cfg *config.Config, v bool) {
+		cfg.Dashboard = v
+	})
+	f.durationOption("progress-log", 0, "Log the finished count, throughput, ETA and longest running image this often, e.g. 30s", func(cfg *config.Config, v time.Duration) {
+		cfg.ProgressLogInterval = v
+	})
+	webhookFlag(f)
+}
+
+func serveFlags(f *flagSet) {
+	pipelineFlags(f)
+	f.stringOption("listen", ":8080", "Address to listen on", func(cfg *config.Config, v string) {
+		cfg.Listen = v
+	})
+	f.stringOption("tls-cert", "", "Certificate PEM file to serve HTTPS with, together with -tls-key", func(cfg *config.Config, v string) {
+		cfg.TLSCert = v
+	})
+	f.stringOption("tls-key", "", "Private key PEM file of -tls-cert", func(cfg *config.Config, v string) {
+		cfg.TLSKey = v
+	})
+	f.intOption("response-cache-size", 0, "Bytes of responses kept in memory for repeated requests; 0 disables the cache", func(cfg *config.Config, v int) {
+		cfg.ResponseCacheSize = int64(v)
+	})
+	f.floatOption("rate-limit", 0, "Requests per second each client may make; 0 for no limit", func(cfg *config.Config, v float64) {
+		cfg.RateLimit = v
+	})
+	f.intOption("rate-burst", 10, "Requests a client may make at once above the rate limit", func(cfg *config.Config, v int) {
+		cfg.RateBurst = v
+	})
+	deadLetterFlag(f)
+	debugListenFlag(f)
+	controlSocketFlag(f)
+	healthListenFlag(f)
+	eventsFlag(f)
+	webhookFlag(f)
+}
+
+func consumeFlags(f *flagSet) {
+	inputFlag(f)
+	outputFlag(f)
+	pipelineFlags(f)
+	f.stringOption("queue", "nats://localhost:4222", "URL of the broker job messages are received from", func(cfg *config.Config, v string) {
+		cfg.QueueURL = v
+	})
+	f.stringOption("subject", "images.jobs", "Subject job messages are received on", func(cfg *config.Config, v string) {
+		cfg.QueueSubject = v
+	})
+	f.stringOption("group", "image-processor", "Consumers in the same group share the jobs", func(cfg *config.Config, v string) {
+		cfg.QueueGroup = v
+	})
+	f.stringOption("result-subject", "images.results", "Subject result messages are published on", func(cfg *config.Config, v string) {
+		cfg.ResultSubject = v
+	})
+	deadLetterFlag(f)
+	debugListenFlag(f)
+	controlSocketFlag(f)
+	healthListenFlag(f)
+	eventsFlag(f)
+	webhookFlag(f)
+}
+
+// the Redis work queue shared by coordinate and work
+func redisFlags(f *flagSet) {
+	f.stringOption("redis", "redis://localhost:6379", "URL of the Redis server holding the work queue", func(cfg *config.Config, v string) {
+		cfg.RedisURL = v
+	})
+	f.stringOption("redis-queue", "imgproc", "Prefix of the work queue's Redis keys", func(cfg *config.Config, v string) {
+		cfg.RedisQueue = v
+	})
+	f.durationOption("visibility-timeout", 5*time.Minute, "How long a job stays with a worker that stopped renewing it", func(cfg *config.Config, v time.Duration) {
+		cfg.VisibilityTimeout = v
+	})
+}
+
+func coordinateFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	outputFlag(f)
+	f.stringOption("urls", "", "File listing http(s) URLs to queue instead of the input directory", func(cfg *config.Config, v string) {
+		cfg.URLsFile = v
+	})
+	redisFlags(f)
+	maxFailuresFlag(f)
+	webhookFlag(f)
+}
+
+func workFlags(f *flagSet) {
+	inputFlag(f)
+	outputFlag(f)
+	pipelineFlags(f)
+	redisFlags(f)
+	deadLetterFlag(f)
+	debugListenFlag(f)
+	controlSocketFlag(f)
+	healthListenFlag(f)
+	eventsFlag(f)
+	webhookFlag(f)
+}
+
+func watchFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	outputFlag(f)
+	forceFlag(f)
+	pipelineFlags(f)
+	f.durationOption("interval", 2*time.Second, "How often the input directory is scanned", func(cfg *config.Config, v time.Duration) {
+		cfg.WatchInterval = v
+	})
+	deadLetterFlag(f)
+	debugListenFlag(f)
+	controlSocketFlag(f)
+	healthListenFlag(f)
+	eventsFlag(f)
+	webhookFlag(f)
+}
+
+func controlFlags(f *flagSet) {
+	controlSocketFlag(f)
+}
+
+func inspectFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	f.stringOption("format", "table", "Output format (table, json)", func(cfg *config.Config, v string) {
+		cfg.InspectFormat = v
+	})
+}
+
+func validateFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	workersFlag(f)
+	f.stringOption("report", "", "Write the validation report as JSON to this file", func(cfg *config.Config, v string) {
+		cfg.ValidateReport = v
+	})
+}
+
+func statsFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	workersFlag(f)
+	f.boolOption("no-histograms", "Leave the 256-bin histograms out of the output", func(cfg *config.Config, v bool) {
+		cfg.StatsHistograms = !v
+	})
+}
+
+func duplicatesFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	outputFlag(f)
+	forceFlag(f)
+	workersFlag(f)
+	f.stringOption("algorithm", "phash", "Perceptual hash (phash, dhash)", func(cfg *config.Config, v string) {
+		cfg.HashAlgorithm = v
+	})
+	f.intOption("threshold", 8, "Most bits of 64 two hashes may differ in to count as duplicates", func(cfg *config.Config, v int) {
+		cfg.DuplicateThreshold = v
+	})
+	f.stringOption("report", "", "Write the duplicate report to this file instead of the output directory", func(cfg *config.Config, v string) {
+		cfg.DuplicateReport = v
+	})
+}
+
+func optimizeFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	outputFlag(f)
+	forceFlag(f)
+	workersFlag(f)
+	f.stringOption("report", "", "Write the optimize report to this file instead of the output directory", func(cfg *config.Config, v string) {
+		cfg.OptimizeReport = v
+	})
+}
+
+func benchFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	pipelineFlags(f)
+	f.intOption("iterations", 3, "Number of times the input directory is processed", func(cfg *config.Config, v int) {
+		cfg.BenchIterations = v
+	})
+}
+
+func convertFlags(f *flagSet) {
+	inputFlag(f)
+	discoveryFlags(f)
+	outputFlag(f)
+	forceFlag(f)
+	workersFlag(f)
+	f.stringOption("to", "", "Output format (jpeg, png, tiff); empty keeps each input's format", func(cfg *config.Config, v string) {
+		cfg.OutputFormat = v
+	})
+	f.intOption("quality", 95, "JPEG quality", func(cfg *config.Config, v int) {
+		cfg.Quality = v
+	})
+	f.intOption("target-size", 0, "Search each JPEG's quality, up to -quality, for a file of at most this many bytes", func(cfg *config.Config, v int) {
+		cfg.TargetSize = int64(v)
+	})
+	f.floatOption("target-ssim", 0, "Search each JPEG's quality for the smallest file with at least this SSIM (0 to 1)", func(cfg *config.Config, v float64) {
+		cfg.TargetSSIM = v
+	})
+	f.stringOption("png-compression", "best", "PNG compression (default, none, speed, best)", func(cfg *config.Config, v string) {
+		cfg.PNGCompression = v
+	})
+	f.stringOption("tiff-compression", "deflate", "TIFF compression (deflate, none)", func(cfg *config.Config, v string) {
+		cfg.TIFFCompression = v
+	})
+	f.stringOption("background", "#ffffff", "Color transparent pixels are flattened onto for JPEG output", func(cfg *config.Config, v string) {
+		cfg.Background, cfg.BackgroundColor = "color", v
+	})
+	f.boolOption("strip-icc", "Don't carry ICC profiles over to the outputs", func(cfg *config.Config, v bool) {
+		cfg.KeepICCProfile = !v
+	})
+	maxFailuresFlag(f)
+	webhookFlag(f)
+}
+
+func stackFlags(f *flagSet) {
+	inputFlag(f)
+	outputFlag(f)
+	forceFlag(f)
+	workersFlag(f)
+	f.stringOption("method", "mean", "How frames are combined (mean, median)", func(cfg *config.Config, v string) {
+		cfg.StackMethod = v
+	})
+	f.boolOption("align", "Align frames to the first before stacking", func(cfg *config.Config, v bool) {
+		cfg.StackAlign = v
+	})
+}
+
+func diffFlags(f *flagSet) {
+	inputFlag(f)
+	outputFlag(f)
+	forceFlag(f)
+	workersFlag(f)
+	compareFlag(f)
+	f.stringOption("report", "", "Write the diff report to this file instead of the output directory", func(cfg *config.Config, v string) {
+		cfg.DiffReport = v
+	})
+}
+
+func tilesFlags(f *flagSet) {
+	inputFlag(f)
+	outputFlag(f)
+	forceFlag(f)
+	workersFlag(f)
+	compareFlag(f)
+	f.intOption("tile-size", 256, "Tile edge in pixels", func(cfg *config.Config, v int) {
+		cfg.TileSize = v
+	})
+}
+
+func graphFlags(f *flagSet) {
+	f.stringOption("filter", "grayscale", "Filter of the single-step pipeline", func(cfg *config.Config, v string) {
+		cfg.Filter = v
+	})
+	f.stringOption("format", "dot", "Diagram language (dot, mermaid)", func(cfg *config.Config, v string) {
+		cfg.GraphFormat = v
+	})
+	f.stringOption("output", "", "Write the diagram to this file instead of stdout", func(cfg *config.Config, v string) {
+		cfg.GraphOutput = v
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// config init writes a config file with every setting at its default to the
+// named file, which mustn't exist yet, or to stdout
+func runConfig(cfg *config.Config, log logger.Logger, args []string) {
+	if len(args) == 0 || args[0] != "init" || len(args) > 2 {
+		log.Fatal("config takes init and an optional file, e.g. config init config.yaml")
+	}
+	if len(args) == 1 {
+		if err := config.WriteTemplate(os.Stdout); err != nil {
+			log.WithError(err).Fatal("Failed to write config file")
+		}
+		return
+	}
+
+	path := args[1]
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		log.WithField("file", path).Fatal("Config file already exists")
+	}
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create config file")
+	}
+	if err := config.WriteTemplate(file); err != nil {
+		file.Close()
+		log.WithError(err).Fatal("Failed to write config file")
+	}
+	if err := file.Close(); err != nil {
+		log.WithError(err).Fatal("Failed to write config file")
+	}
+	log.WithField("file", path).Info("Config file written")
+}
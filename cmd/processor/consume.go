@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/fetch"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/queue"
+	"github.com/arsalan9702/concurrent-image-processor/internal/remote"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// a job received from the queue: a manifest entry whose input may be an
+// http(s) URL and whose output_dir may be an ftp:// or sftp:// URL, with
+// an id echoed in its result
+type jobMessage struct {
+	ID string `json:"id,omitempty"`
+	config.ManifestEntry
+}
+
+// the outcome of a job, published on result_subject and to the message's
+// reply subject
+type resultMessage struct {
+	ID         string              `json:"id,omitempty"`
+	Input      string              `json:"input"`
+	Outputs    []models.OutputFile `json:"outputs,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	DurationMs float64             `json:"duration_ms"`
+}
+
+// process job messages from queue_url until a shutdown signal, publishing
+// a result message for each. Consumers sharing queue_group split the jobs,
+// so more machines can be added behind the broker
+func runConsume(cfg *config.Config, log logger.Logger, args []string) {
+	rejectInPlace(cfg, log, "consume")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	notifyShutdown(sigChan)
+
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+
+	// jobs are received no faster than the workers take them
+	broker, err := queue.Dial(ctx, cfg.QueueURL, queue.Options{
+		Subject: cfg.QueueSubject,
+		Group:   cfg.QueueGroup,
+		Buffer:  cfg.Workers,
+		Timeout: cfg.RemoteTimeout,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to connect to queue")
+	}
+	defer broker.Close()
+
+	service := proc.StartService(ctx)
+	startDiagnostics(ctx, cfg, proc.Stats, log)
+	stopControl := startControl(ctx, cfg, service, requestShutdown, log)
+	defer stopControl()
+	startJanitor(ctx, cfg, log, cfg.OutputDir)
+	checker := startHealth(ctx, cfg, service, log)
+	checker.Add("queue", func(ctx context.Context) error {
+		return broker.Err()
+	})
+
+	c := &consumer{cfg: cfg, log: log, service: service, broker: broker}
+
+	log.WithFields(map[string]interface{}{
+		"queue":          redact(cfg.QueueURL),
+		"subject":        cfg.QueueSubject,
+		"group":          cfg.QueueGroup,
+		"result_subject": cfg.ResultSubject,
+		"workers":        cfg.Workers,
+	}).Info("Consuming jobs")
+
+	// one goroutine per job in flight, at most workers of them
+	slots := make(chan struct{}, cfg.Workers)
+	var wg sync.WaitGroup
+consume:
+	for {
+		select {
+		case msg, ok := <-broker.Messages():
+			if !ok {
+				if err := broker.Err(); err != nil {
+					log.WithError(err).Error("Lost connection to queue")
+				}
+				break consume
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-sigChan:
+				// the job received is dropped, as at-most-once delivery allows
+				break consume
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				c.handle(ctx, msg)
+			}()
+		case <-sigChan:
+			break consume
+		}
+	}
+
+	// stop receiving, then give jobs in flight drain_timeout to finish
+	checker.Shutdown()
+	broker.Unsubscribe()
+	if cfg.DrainTimeout == 0 {
+		log.Info("Stopping consumer")
+		cancel()
+	} else {
+		log.WithField("drain_timeout", cfg.DrainTimeout).Info("Finishing in-flight jobs")
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-sigChan:
+			log.Warn("Received second shutdown signal, stopping")
+			cancel()
+		case <-time.After(cfg.DrainTimeout):
+			log.Warn("Drain timeout expired, stopping")
+			cancel()
+		}
+	}
+	wg.Wait()
+
+	service.Stop()
+	log.Info("Consumer stopped")
+}
+
+// state shared by the jobs of a consume or work run
+type consumer struct {
+	cfg     *config.Config
+	log     logger.Logger
+	service *processor.Service
+	// where results are published; unused by work
+	broker queue.Broker
+}
+
+// process one job message and publish its result
+func (c *consumer) handle(ctx context.Context, msg queue.Message) {
+	data, err := json.Marshal(c.run(ctx, msg.Data))
+	if err != nil {
+		c.log.WithError(err).Error("Failed to encode result")
+		return
+	}
+	for _, subject := range []string{c.cfg.ResultSubject, msg.Reply} {
+		if subject == "" {
+			continue
+		}
+		if err := c.broker.Publish(subject, data); err != nil {
+			c.log.WithError(err).WithField("subject", subject).Error("Failed to publish result")
+		}
+	}
+}
+
+// process one job message, logging its outcome
+func (c *consumer) run(ctx context.Context, data []byte) resultMessage {
+	start := time.Now()
+	var job jobMessage
+	outputs, err := c.process(ctx, data, &job)
+
+	result := resultMessage{
+		ID:         job.ID,
+		Input:      job.Input,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	fields := map[string]interface{}{"id": job.ID, "input": job.Input}
+	if err != nil {
+		result.Error = err.Error()
+		c.log.WithError(err).WithFields(fields).Error("failed to process job")
+	} else {
+		result.Outputs = outputs
+		fields["outputs"] = len(outputs)
+		fields["duration"] = time.Since(start)
+		c.log.WithFields(fields).Info("Processed job")
+	}
+	return result
+}
+
+// check a job's local paths stay where the consumer was pointed: the input
+// inside input_dir, output_dir inside output_dir and output below it.
+// Senders are trusted with pipelines, not with the files a worker can
+// reach
+func (c *consumer) confine(entry config.ManifestEntry) error {
+	if !fetch.IsURL(entry.Input) {
+		if err := inside(c.cfg.InputDir, entry.Input, false); err != nil {
+			return fmt.Errorf("input %w", err)
+		}
+	}
+	if entry.OutputDir != "" && !remote.IsRemote(entry.OutputDir) {
+		if err := inside(c.cfg.OutputDir, entry.OutputDir, true); err != nil {
+			return fmt.Errorf("output_dir %w", err)
+		}
+	}
+	if entry.Output != "" {
+		if err := inside(c.cfg.OutputDir, entry.Output, false); err != nil {
+			return fmt.Errorf("output %w", err)
+		}
+	}
+	return nil
+}
+
+// an error unless path is below dir, or is dir itself when self is set.
+// Relative paths are taken from the working directory, as in manifests
+func inside(dir, path string, self bool) error {
+	if dir == "" {
+		return fmt.Errorf("%s can't be used without a directory to keep it in", path)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || !filepath.IsLocal(rel) || (rel == "." && !self) {
+		return fmt.Errorf("%s is outside %s", path, dir)
+	}
+	return nil
+}
+
+// decode a job message into job and run it: refuse params a job can't set
+// and paths outside the consumer's directories, download a URL input,
+// process it and upload the outputs to a remote output directory
+func (c *consumer) process(ctx context.Context, data []byte, job *jobMessage) ([]models.OutputFile, error) {
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("invalid job message: %w", err)
+	}
+	entry := job.ManifestEntry
+	if err := config.CheckJobParams(entry); err != nil {
+		return nil, fmt.Errorf("invalid job message: %w", err)
+	}
+	if err := c.confine(entry); err != nil {
+		return nil, fmt.Errorf("invalid job message: %w", err)
+	}
+
+	if fetch.IsURL(entry.Input) {
+		// downloads are kept in download_dir for later jobs with the same
+		// input, or only for the job
+		dir := c.cfg.DownloadDir
+		if dir == "" {
+			tmp, err := os.MkdirTemp("", "imgproc-downloads-")
+			if err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(tmp)
+			dir = tmp
+		}
+		downloader := fetch.NewDownloader(dir, 1, c.cfg.DownloadRetries, c.cfg.DownloadTimeout, c.cfg.MaxFileSize)
+		path, err := downloader.Download(ctx, entry.Input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download input: %w", err)
+		}
+		entry.Input = path
+	}
+
+	var output remote.Backend
+	if remote.IsRemote(entry.OutputDir) {
+		if entry.Output != "" {
+			return nil, errors.New("output can't be set with a remote output_dir")
+		}
+		backend, err := remote.Open(entry.OutputDir, c.cfg.RemoteTimeout)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := os.MkdirTemp("", "imgproc-job-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		output, entry.OutputDir = backend, dir
+	}
+
+	result, err := c.service.ProcessEntry(ctx, entry)
+	if err == nil {
+		err = result.Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if output != nil {
+		if err := output.Upload(ctx, entry.OutputDir); err != nil {
+			return nil, fmt.Errorf("failed to upload outputs: %w", err)
+		}
+		// report where the outputs went rather than the scratch directory
+		for i := range result.Outputs {
+			rel, _ := filepath.Rel(entry.OutputDir, result.Outputs[i].Path)
+			result.Outputs[i].Path = strings.TrimSuffix(redact(job.OutputDir), "/") + "/" + filepath.ToSlash(rel)
+		}
+	}
+	return result.Outputs, nil
+}
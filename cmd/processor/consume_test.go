@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// jobs from a queue can set filter and encoder settings but nothing that
+// runs programs or moves outputs; refused jobs never reach the service
+func TestJobMessageParams(t *testing.T) {
+	c := &consumer{cfg: &config.Config{}, log: logger.NewLoggerWithOutput(false, "text", io.Discard)}
+
+	refused := []string{
+		`{"input": "a.png", "filter": "exec", "params": {"exec_command": ["sh", "-c", "id"]}}`,
+		`{"input": "a.png", "pipeline": [{"filter": "exec", "params": {"command": ["sh", "-c", "id"]}}]}`,
+		`{"input": "a.png", "pipeline": [{"filter": "blur", "params": {"exec_command": ["sh"]}}]}`,
+		`{"input": "a.png", "params": {"pipeline_script": "rules.lua"}}`,
+		`{"input": "a.png", "params": {"plugin_dir": "/tmp"}}`,
+		`{"input": "a.png", "params": {"in_place": true}}`,
+		`{"input": "a.png", "params": {"output_dir": "/etc"}}`,
+		`{"input": "a.png", "params": {"webhooks": [{"url": "http://example.com"}]}}`,
+	}
+	for _, msg := range refused {
+		result := c.run(context.Background(), []byte(msg))
+		if !strings.Contains(result.Error, "can't be set by a job") {
+			t.Errorf("%s: error %q, want the job refused", msg, result.Error)
+		}
+	}
+
+	allowed := []string{
+		`{"input": "a.png", "filter": "resize", "params": {"resize_width": 320, "quality": 80}}`,
+		`{"input": "a.png", "pipeline": [{"filter": "blur", "params": {"radius": 2}}, {"filter": "grayscale"}]}`,
+	}
+	for _, msg := range allowed {
+		var job jobMessage
+		if err := json.Unmarshal([]byte(msg), &job); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.CheckJobParams(job.ManifestEntry); err != nil {
+			t.Errorf("%s: %v", msg, err)
+		}
+	}
+}
+
+// a job's local input stays inside input_dir and its outputs inside
+// output_dir, however the path is spelled
+func TestJobMessagePaths(t *testing.T) {
+	root := t.TempDir()
+	in, out := filepath.Join(root, "in"), filepath.Join(root, "out")
+	c := &consumer{cfg: &config.Config{InputDir: in, OutputDir: out}, log: logger.NewLoggerWithOutput(false, "text", io.Discard)}
+	input := filepath.Join(in, "a.png")
+
+	refused := []config.ManifestEntry{
+		{Input: input, Output: "/home/user/.ssh/authorized_keys"},
+		{Input: input, Output: filepath.Join(out, "..", "a.png")},
+		{Input: input, Output: out},
+		{Input: input, OutputDir: "/tmp"},
+		{Input: input, OutputDir: filepath.Join(out, "..", "in")},
+		{Input: "/etc/passwd"},
+		{Input: filepath.Join(in, "..", "secret.png")},
+		{Input: in},
+	}
+	for _, entry := range refused {
+		msg, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := c.run(context.Background(), msg)
+		if !strings.Contains(result.Error, "is outside") {
+			t.Errorf("%s: error %q, want the job refused", msg, result.Error)
+		}
+	}
+
+	allowed := []config.ManifestEntry{
+		{Input: input},
+		{Input: filepath.Join(in, "sub", "b.png"), OutputDir: out},
+		{Input: input, OutputDir: filepath.Join(out, "sub")},
+		{Input: input, Output: filepath.Join(out, "sub", "a.webp")},
+		{Input: "https://example.com/a.png", OutputDir: "sftp://example.com/images"},
+	}
+	for _, entry := range allowed {
+		if err := c.confine(entry); err != nil {
+			t.Errorf("%+v: %v", entry, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/control"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// serve commands for pool on control_socket, if set, until ctx is done or
+// the returned stop is called, which removes the socket before the process
+// exits. drain runs on the drain command
+func startControl(ctx context.Context, cfg *config.Config, pool control.Target, drain func(), log logger.Logger) (stop func()) {
+	if cfg.ControlSocket == "" {
+		return func() {}
+	}
+	srv, err := control.Start(ctx, cfg.ControlSocket, pool, drain, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to start control socket")
+	}
+	return func() { srv.Close() }
+}
+
+// send a command to the process serving control_socket and print its
+// response, exiting non-zero if the command failed
+func runControl(cfg *config.Config, log logger.Logger, args []string) {
+	if cfg.ControlSocket == "" {
+		log.Fatal("control needs control_socket or -control-socket")
+	}
+	if len(args) == 0 {
+		log.Fatal("control needs a command: status, pause, resume, workers or drain")
+	}
+
+	resp, err := control.Send(cfg.ControlSocket, strings.Join(args, " "))
+	if err != nil {
+		log.WithError(err).Fatal("Control command failed")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+	if !resp.OK {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// re-encode every input without filters. Outputs keep their input's name,
+// so they need a directory of their own
+func runConvert(cfg *config.Config, log logger.Logger, args []string) {
+	cfg.Filter = ""
+	cfg.Pipeline = nil
+	cfg.PipelineOutputs = nil
+	// JPEG has no alpha: without a configured background, transparent
+	// pixels would come out black
+	if cfg.Background == "" {
+		cfg.Background = "color"
+	}
+
+	inputDir, _ := filepath.Abs(cfg.InputDir)
+	outputDir, _ := filepath.Abs(cfg.OutputDir)
+	if inputDir == outputDir {
+		log.Fatal("convert needs an output directory other than the input directory")
+	}
+
+	runProcess(cfg, log, args)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/diagnostics"
+	"github.com/arsalan9702/concurrent-image-processor/internal/health"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/retention"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// keep a daemon's output directories and the processing cache within the
+// retention limits until ctx is done, sparing the run's state files and
+// refusing directories holding the input
+func startJanitor(ctx context.Context, cfg *config.Config, log logger.Logger, dirs ...string) {
+	if cfg.CacheDir != "" {
+		dirs = append(dirs, cfg.CacheDir)
+	}
+	policy := retention.Policy{
+		MaxAge:  cfg.RetentionMaxAge,
+		MaxSize: cfg.RetentionMaxSize,
+	}
+	if cfg.InputDir != "" {
+		policy.Protect = []string{cfg.InputDir}
+	}
+	for _, path := range []string{cfg.IncrementalIndex, cfg.StateFile, cfg.ContentManifest, cfg.RenameReport} {
+		if path != "" {
+			policy.Keep = append(policy.Keep, path)
+		}
+	}
+	if len(dirs) == 0 || !policy.Enabled() {
+		return
+	}
+	go retention.NewJanitor(policy, cfg.RetentionInterval, log, dirs...).Run(ctx)
+}
+
+// serve pprof and the worker pool state from stats on debug_listen, if
+// set, until ctx is done
+func startDiagnostics(ctx context.Context, cfg *config.Config, stats func() processor.PoolStats, log logger.Logger) {
+	if cfg.DebugListen != "" {
+		diagnostics.Start(ctx, cfg.DebugListen, stats, nil, log)
+	}
+}
+
+// check a daemon's worker pool, serving the probes on health_listen, if set,
+// until ctx is done. The daemon adds the checks of its backends
+func startHealth(ctx context.Context, cfg *config.Config, service *processor.Service, log logger.Logger) *health.Checker {
+	checker := health.New(cfg, service)
+	if cfg.HealthListen != "" {
+		health.Start(ctx, cfg.HealthListen, checker, log)
+	}
+	return checker
+}
+
+// a check that dir is still there, such as on an unmounted volume
+func dirCheck(dir string) health.Check {
+	return func(ctx context.Context) error {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+const (
+	// how often the dashboard is redrawn
+	dashboardRedraw = 500 * time.Millisecond
+	// seconds the current throughput is measured over
+	dashboardRateWindow = 10
+	// in-flight jobs and failures listed at most
+	dashboardListed = 5
+	// log lines kept for the dashboard's tail
+	logTailLines = 200
+)
+
+// the log of a run with a dashboard, which covers the terminal, or nil
+var dashboardLog *logTail
+
+// logTail keeps the last lines of the log written to it. Once released,
+// later lines go to after, or nowhere when the log also goes to a file
+type logTail struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	after   io.Writer
+	out     io.Writer
+}
+
+func (t *logTail) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out != nil {
+		return t.out.Write(b)
+	}
+	t.partial = append(t.partial, b...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.lines) > logTailLines {
+		t.lines = append([]string(nil), t.lines[len(t.lines)-logTailLines:]...)
+	}
+	return len(b), nil
+}
+
+// the last n lines
+func (t *logTail) last(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines[max(0, len(t.lines)-n):]...)
+}
+
+// write the last n lines to after, and every later line
+func (t *logTail) release(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.after == nil {
+		t.out = io.Discard
+		return
+	}
+	for _, line := range t.lines[max(0, len(t.lines)-n):] {
+		fmt.Fprintln(t.after, line)
+	}
+	t.out = t.after
+}
+
+// route the log of a process run to a dashboard tail when one is wanted
+// and stdout is a terminal, returning where the log goes instead of out
+func dashboardOutput(cfg *config.Config, args []string, out io.Writer) io.Writer {
+	if !cfg.Dashboard || cfg.Mode != "process" || pipeMode(args) {
+		return out
+	}
+	if _, _, ok := terminalSize(os.Stdout); !ok {
+		return out
+	}
+	dashboardLog = &logTail{}
+	if cfg.LogFile != "" {
+		return io.MultiWriter(out, dashboardLog)
+	}
+	dashboardLog.after = out
+	return dashboardLog
+}
+
+// a job that failed, for the dashboard's list
+type failure struct {
+	input string
+	err   string
+}
+
+// counts, in-flight jobs, recent failures and throughput of a run, from
+// the processor's events
+type dashboard struct {
+	mu        sync.Mutex
+	proc      *processor.Processor
+	start     time.Time
+	queued    int
+	completed int
+	failed    int
+	running   map[string]runningJob
+	failures  []failure
+	// jobs finished in each second since start
+	finished []int
+}
+
+// cover the terminal with a dashboard of proc's workers, queues,
+// throughput, in-flight jobs, failures and log, redrawn until the returned
+// function is called, which restores the terminal and prints the last log
+// lines
+func showDashboard(proc *processor.Processor, tail *logTail) func() {
+	d := &dashboard{proc: proc, start: time.Now(), running: map[string]runningJob{}}
+	unsubscribe := proc.Subscribe(d.observe)
+
+	// the alternate screen keeps the shell's scrollback as it was
+	fmt.Fprint(os.Stdout, "\033[?1049h\033[?25l")
+	ticker := time.NewTicker(dashboardRedraw)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			d.draw(tail)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	restore := func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(stop)
+			<-done
+			unsubscribe()
+			fmt.Fprint(os.Stdout, "\033[?25h\033[?1049l")
+			tail.release(20)
+		})
+	}
+	// a fatal error would otherwise leave its message on the hidden screen
+	logger.OnFatal(restore)
+	return restore
+}
+
+func (d *dashboard) observe(e processor.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch e.Event {
+	case processor.EventQueued:
+		d.queued++
+		return
+	case processor.EventStarted:
+		d.running[e.JobID] = runningJob{input: e.Input, started: e.Time}
+		return
+	case processor.EventCompleted:
+		d.completed++
+	case processor.EventFailed:
+		d.failed++
+		d.failures = append(d.failures, failure{e.Input, e.Error})
+		if len(d.failures) > dashboardListed {
+			d.failures = d.failures[1:]
+		}
+	default:
+		return
+	}
+	delete(d.running, e.JobID)
+	second := int(e.Time.Sub(d.start) / time.Second)
+	for len(d.finished) <= second {
+		d.finished = append(d.finished, 0)
+	}
+	d.finished[second]++
+}
+
+// redraw the whole dashboard at the terminal's current size
+func (d *dashboard) draw(tail *logTail) {
+	width, height, ok := terminalSize(os.Stdout)
+	if !ok {
+		width, height = 80, 24
+	}
+	lines := d.render(width, height)
+	lines = append(lines, tail.last(max(0, height-len(lines)))...)
+
+	var b strings.Builder
+	b.WriteString("\033[H")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(truncate(line, width))
+		b.WriteString("\033[K")
+	}
+	b.WriteString("\033[J")
+	os.Stdout.WriteString(b.String())
+}
+
+// the lines above the log tail, leaving it a few rows on a small terminal
+func (d *dashboard) render(width, height int) []string {
+	stats := d.proc.Stats()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elapsed := time.Since(d.start)
+	seconds := int(elapsed / time.Second)
+	window := min(dashboardRateWindow, seconds)
+	recent := 0
+	for s := seconds - window; s < seconds; s++ {
+		if s < len(d.finished) {
+			recent += d.finished[s]
+		}
+	}
+	rate := 0.0
+	if window > 0 {
+		rate = float64(recent) / float64(window)
+	}
+
+	done := d.completed + d.failed
+	header := fmt.Sprintf("processed %d/%d   failed %d   %.1f images/s   elapsed %s", done, d.queued, d.failed, rate, elapsed.Round(time.Second))
+	if remaining := d.queued - done; remaining > 0 && rate > 0 {
+		header += fmt.Sprintf("   eta %s", time.Duration(float64(remaining)/rate*float64(time.Second)).Round(time.Second))
+	}
+	switch {
+	case stats.Draining:
+		header += "   DRAINING"
+	case stats.Paused:
+		header += "   PAUSED"
+	}
+
+	lines := []string{
+		header,
+		"",
+		"workers  " + workerBar("decode", stats.Decoding, stats.Workers.Decode) +
+			"   " + workerBar("filter", stats.Filtering, stats.Workers.Filter) +
+			"   " + workerBar("encode", stats.Encoding, stats.Workers.Encode),
+		fmt.Sprintf("queues   queued %d   decoded %d   filtered %d   results %d", stats.Queued, stats.Decoded, stats.Filtered, stats.Results),
+	}
+	if stats.MemoryBudget > 0 {
+		lines = append(lines, fmt.Sprintf("memory   %s of %s", mebibytes(stats.MemoryInUse), mebibytes(stats.MemoryBudget)))
+	}
+
+	// one column a second, the latest on the right
+	columns := max(10, width-2)
+	first := max(0, seconds-columns)
+	counts := make([]int, 0, columns)
+	for s := first; s < seconds; s++ {
+		n := 0
+		if s < len(d.finished) {
+			n = d.finished[s]
+		}
+		counts = append(counts, n)
+	}
+	peak := 0
+	for _, n := range counts {
+		peak = max(peak, n)
+	}
+	lines = append(lines, "", fmt.Sprintf("throughput, last %ds, peak %d images/s", len(counts), peak), "  "+sparkline(counts, peak))
+
+	// lists shrink on small terminals so a few log lines still show
+	listed := min(dashboardListed, max(1, (height-len(lines)-8)/2))
+
+	running := make([]runningJob, 0, len(d.running))
+	for _, job := range d.running {
+		running = append(running, job)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].started.Before(running[j].started) })
+	lines = append(lines, "", fmt.Sprintf("in flight (%d)", len(running)))
+	for _, job := range running[:min(listed, len(running))] {
+		lines = append(lines, fmt.Sprintf("  %8s  %s", time.Since(job.started).Round(100*time.Millisecond), job.input))
+	}
+
+	lines = append(lines, "", fmt.Sprintf("recent failures (%d)", d.failed))
+	failures := d.failures[max(0, len(d.failures)-listed):]
+	for i := len(failures) - 1; i >= 0; i-- {
+		lines = append(lines, fmt.Sprintf("  %s: %s", failures[i].input, failures[i].err))
+	}
+	return append(lines, "", "log")
+}
+
+// a stage's workers as a cell each, filled for those busy
+func workerBar(stage string, busy int64, workers int) string {
+	busy = min(max(busy, 0), int64(workers))
+	return fmt.Sprintf("%s %s%s %d/%d", stage, strings.Repeat("█", int(busy)), strings.Repeat("·", workers-int(busy)), busy, workers)
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// counts as bars scaled to peak
+func sparkline(counts []int, peak int) string {
+	var b strings.Builder
+	for _, n := range counts {
+		switch {
+		case n == 0:
+			b.WriteRune(' ')
+		case peak <= 1:
+			b.WriteRune(sparks[len(sparks)-1])
+		default:
+			b.WriteRune(sparks[(n*len(sparks)-1)/peak])
+		}
+	}
+	return b.String()
+}
+
+func mebibytes(n int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+// line cut to width runes
+func truncate(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:max(0, width)])
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/queue"
+	"github.com/arsalan9702/concurrent-image-processor/internal/remote"
+	"github.com/arsalan9702/concurrent-image-processor/internal/webhook"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// how long a worker or coordinator blocks on Redis before checking for a
+// shutdown
+const pollInterval = 2 * time.Second
+
+// queue a job for every image in the input directory, or every URL given,
+// in the Redis work queue, then collect the results of the workers taking
+// them and report the batch like process does
+func runCoordinate(cfg *config.Config, log logger.Logger, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	inputs, err := inputURLs(cfg, args)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read input URLs")
+	}
+	if len(inputs) == 0 {
+		files, err := findImageFiles(cfg, cfg.InputDir)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to list input directory")
+		}
+		// workers share the filesystem but not the working directory
+		for _, file := range files {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				log.WithError(err).Fatal("Failed to resolve input path")
+			}
+			inputs = append(inputs, abs)
+		}
+	}
+	if len(inputs) == 0 {
+		log.Warn("No images found in input directory")
+		return
+	}
+
+	outputDir := cfg.OutputDir
+	if !remote.IsRemote(outputDir) {
+		if outputDir, err = filepath.Abs(outputDir); err != nil {
+			log.WithError(err).Fatal("Failed to resolve output directory")
+		}
+	}
+	jobs := make([]string, len(inputs))
+	for i, input := range inputs {
+		data, err := json.Marshal(jobMessage{
+			ID:            strconv.Itoa(i + 1),
+			ManifestEntry: config.ManifestEntry{Input: input, OutputDir: outputDir},
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to encode job")
+		}
+		jobs[i] = string(data)
+	}
+
+	webhooks, err := webhook.New(cfg, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to set up webhooks")
+	}
+	client, err := queue.DialRedis(ctx, cfg.RedisURL, cfg.RemoteTimeout)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to connect to Redis")
+	}
+	defer client.Close()
+	q := queue.NewWorkQueue(client, cfg.RedisQueue, cfg.VisibilityTimeout)
+
+	// a new batch replaces whatever an earlier coordinator left
+	if err := q.Reset(); err != nil {
+		log.WithError(err).Fatal("Failed to reset work queue")
+	}
+	if err := q.Push(jobs...); err != nil {
+		log.WithError(err).Fatal("Failed to queue jobs")
+	}
+	log.WithFields(map[string]interface{}{
+		"count": len(jobs),
+		"redis": redact(cfg.RedisURL),
+		"queue": cfg.RedisQueue,
+	}).Info("Queued jobs")
+
+	startTime := time.Now()
+	// a job retried after its lease ran out can report twice
+	reported := map[string]bool{}
+	successful, failed, requeued := 0, 0, 0
+	lastReap := time.Now()
+	for len(reported) < len(jobs) && ctx.Err() == nil {
+		data, err := q.Result(pollInterval)
+		switch {
+		case errors.Is(err, queue.ErrNil):
+		case err != nil:
+			log.WithError(err).Fatal("Failed to read results")
+		default:
+			var result resultMessage
+			if err := json.Unmarshal([]byte(data), &result); err != nil {
+				log.WithError(err).Warn("Ignoring invalid result")
+				break
+			}
+			if reported[result.ID] {
+				break
+			}
+			reported[result.ID] = true
+			if result.Error != "" {
+				log.WithField("error", result.Error).WithField("file", result.Input).Error("failed to process image")
+				failed++
+			} else {
+				log.WithFields(map[string]interface{}{"input": result.Input, "outputs": len(result.Outputs)}).Debug("Image processed")
+				successful++
+			}
+		}
+
+		// workers reap too, but the batch shouldn't stall without them
+		if time.Since(lastReap) >= cfg.VisibilityTimeout/4 {
+			n, err := q.Reap()
+			if err != nil {
+				log.WithError(err).Warn("Failed to requeue expired jobs")
+			}
+			if n > 0 {
+				log.WithField("count", n).Warn("Requeued jobs whose worker stopped renewing them")
+			}
+			requeued += n
+			lastReap = time.Now()
+		}
+	}
+
+	summary := map[string]interface{}{
+		"total_duration": time.Since(startTime),
+		"successful":     successful,
+		"failed":         failed,
+		"total":          len(jobs),
+	}
+	if requeued > 0 {
+		summary["requeued"] = requeued
+	}
+	code := exitCode(cfg.MaxFailures, failed, len(jobs))
+	if missing := len(jobs) - len(reported); missing > 0 {
+		// the jobs stay queued for the workers
+		summary["unfinished"] = missing
+		log.WithFields(summary).Warn("Stopped waiting for results")
+		code = 1
+	} else {
+		log.WithFields(summary).Info("Processing completed")
+	}
+
+	// job failures are reported by the workers' webhooks
+	webhooks.BatchCompleted(summary, code)
+	webhooks.Wait()
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// take jobs from the Redis work queue and process them until a shutdown
+// signal, with workers jobs in flight
+func runWork(cfg *config.Config, log logger.Logger, args []string) {
+	rejectInPlace(cfg, log, "work")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	notifyShutdown(sigChan)
+
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+
+	// a connection per worker, since taking a job blocks it, and one for
+	// reaping expired leases
+	queues := make([]*queue.WorkQueue, cfg.Workers+1)
+	for i := range queues {
+		client, err := queue.DialRedis(ctx, cfg.RedisURL, cfg.RemoteTimeout)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to connect to Redis")
+		}
+		defer client.Close()
+		queues[i] = queue.NewWorkQueue(client, cfg.RedisQueue, cfg.VisibilityTimeout)
+	}
+
+	service := proc.StartService(ctx)
+	startDiagnostics(ctx, cfg, proc.Stats, log)
+	stopControl := startControl(ctx, cfg, service, requestShutdown, log)
+	defer stopControl()
+	startJanitor(ctx, cfg, log)
+	checker := startHealth(ctx, cfg, service, log)
+	checker.Add("redis", func(ctx context.Context) error {
+		return queues[0].Ping()
+	})
+	c := &consumer{cfg: cfg, log: log, service: service}
+
+	log.WithFields(map[string]interface{}{
+		"redis":   redact(cfg.RedisURL),
+		"queue":   cfg.RedisQueue,
+		"filter":  cfg.Filter,
+		"workers": cfg.Workers,
+	}).Info("Waiting for jobs")
+
+	stopping := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, q := range queues[1:] {
+		wg.Add(1)
+		go func(q *queue.WorkQueue) {
+			defer wg.Done()
+			work(ctx, c, q, stopping, log)
+		}(q)
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.VisibilityTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n, err := queues[0].Reap(); err != nil {
+					log.WithError(err).Warn("Failed to requeue expired jobs")
+				} else if n > 0 {
+					log.WithField("count", n).Warn("Requeued jobs whose worker stopped renewing them")
+				}
+			case <-stopping:
+				return
+			}
+		}
+	}()
+
+	<-sigChan
+	close(stopping)
+	checker.Shutdown()
+
+	// stop taking jobs, then give jobs in flight drain_timeout to finish;
+	// the leases of unfinished ones run out and other workers take them
+	if cfg.DrainTimeout == 0 {
+		log.Info("Stopping worker")
+		cancel()
+	} else {
+		log.WithField("drain_timeout", cfg.DrainTimeout).Info("Finishing in-flight jobs")
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-sigChan:
+			log.Warn("Received second shutdown signal, stopping")
+			cancel()
+		case <-time.After(cfg.DrainTimeout):
+			log.Warn("Drain timeout expired, stopping")
+			cancel()
+		}
+	}
+	wg.Wait()
+
+	service.Stop()
+	log.Info("Worker stopped")
+}
+
+// take and process jobs one at a time until stopping is closed, renewing
+// each job's lease while it runs
+func work(ctx context.Context, c *consumer, q *queue.WorkQueue, stopping <-chan struct{}, log logger.Logger) {
+	for {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+
+		job, err := q.Take(pollInterval)
+		if errors.Is(err, queue.ErrNil) {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to take job")
+			select {
+			case <-stopping:
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		renewed := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			ticker := time.NewTicker(c.cfg.VisibilityTimeout / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := q.Renew(job); err != nil {
+						log.WithError(err).Warn("Failed to renew job lease")
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		result := c.run(ctx, []byte(job))
+		close(done)
+		<-renewed
+		// a job cut short by the shutdown is left to run out its lease
+		if ctx.Err() != nil {
+			return
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.WithError(err).Error("Failed to encode result")
+			continue
+		}
+		if err := q.Complete(job, string(data)); err != nil {
+			log.WithError(err).Error("Failed to complete job")
+		}
+	}
+}
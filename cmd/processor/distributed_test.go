@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/queue"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// a Redis server keeping lists in memory, enough for a work queue. Sorted
+// sets are acknowledged and dropped, since nothing here reaps leases, and
+// workers wait for jobs briefly so they stop soon
+func fakeRedis(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	lists := map[string][]string{}
+	// pop from the left or right of the list at key, waiting up to wait for
+	// one to be pushed
+	pop := func(key string, right bool, wait time.Duration) (string, bool) {
+		for deadline := time.Now().Add(wait); ; {
+			mu.Lock()
+			if items := lists[key]; len(items) > 0 {
+				var item string
+				if right {
+					item, lists[key] = items[len(items)-1], items[:len(items)-1]
+				} else {
+					item, lists[key] = items[0], items[1:]
+				}
+				mu.Unlock()
+				return item, true
+			}
+			mu.Unlock()
+			if time.Now().After(deadline) {
+				return "", false
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				header, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+				buf := make([]byte, size+2)
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return
+				}
+				args[i] = string(buf[:size])
+			}
+
+			reply := ":1\r\n"
+			switch args[0] {
+			case "LPUSH", "RPUSH":
+				mu.Lock()
+				for _, item := range args[2:] {
+					if args[0] == "LPUSH" {
+						lists[args[1]] = append([]string{item}, lists[args[1]]...)
+					} else {
+						lists[args[1]] = append(lists[args[1]], item)
+					}
+				}
+				mu.Unlock()
+			case "BRPOPLPUSH":
+				item, ok := pop(args[1], true, 100*time.Millisecond)
+				if !ok {
+					reply = "$-1\r\n"
+					break
+				}
+				mu.Lock()
+				lists[args[2]] = append([]string{item}, lists[args[2]]...)
+				mu.Unlock()
+				reply = bulk(item)
+			case "BLPOP":
+				item, ok := pop(args[1], false, 10*time.Second)
+				if !ok {
+					reply = "*-1\r\n"
+					break
+				}
+				reply = "*2\r\n" + bulk(args[1]) + bulk(item)
+			case "LREM":
+				mu.Lock()
+				for i, item := range lists[args[1]] {
+					if item == args[3] {
+						lists[args[1]] = append(lists[args[1]][:i:i], lists[args[1]][i+1:]...)
+						break
+					}
+				}
+				mu.Unlock()
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "redis://" + ln.Addr().String()
+}
+
+// jobs taken from Redis by a worker are held to the consumer's paths: those
+// outside its input and output directories fail, while the coordinator's
+// absolute paths inside them run
+func TestWorkConfinesJobPaths(t *testing.T) {
+	root := t.TempDir()
+	in, out := filepath.Join(root, "in"), filepath.Join(root, "out")
+	if err := os.MkdirAll(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	img.Set(0, 0, color.RGBA{10, 20, 30, 255})
+	f, err := os.Create(filepath.Join(in, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.InputDir, cfg.OutputDir = in, out
+	cfg.Filter, cfg.Workers = "grayscale", 1
+	log := logger.NewLoggerWithOutput(false, "text", io.Discard)
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &consumer{cfg: cfg, log: log, service: proc.StartService(ctx)}
+
+	addr := fakeRedis(t)
+	var queues [2]*queue.WorkQueue
+	for i := range queues {
+		client, err := queue.DialRedis(ctx, addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		queues[i] = queue.NewWorkQueue(client, "test", time.Minute)
+	}
+
+	input := filepath.Join(in, "a.png")
+	jobs := map[string]config.ManifestEntry{
+		"output":     {Input: input, Output: filepath.Join(root, "escaped.png")},
+		"output_dir": {Input: input, OutputDir: filepath.Join(out, "..", "escaped")},
+		"input":      {Input: filepath.Join(root, "secret.png"), OutputDir: out},
+		"ok":         {Input: input, OutputDir: filepath.Join(out, "sub")},
+	}
+	for id, entry := range jobs {
+		data, err := json.Marshal(jobMessage{ID: id, ManifestEntry: entry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := queues[0].Push(string(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stopping := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		work(ctx, c, queues[0], stopping, log)
+	}()
+	defer func() {
+		close(stopping)
+		<-done
+	}()
+
+	for range jobs {
+		data, err := queues[1].Result(10 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result resultMessage
+		if err := json.Unmarshal([]byte(data), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.ID == "ok" {
+			if result.Error != "" || len(result.Outputs) != 1 || !strings.HasPrefix(result.Outputs[0].Path, filepath.Join(out, "sub")) {
+				t.Errorf("ok: got %+v, want one output in out/sub", result)
+			}
+			continue
+		}
+		if !strings.Contains(result.Error, "is outside") {
+			t.Errorf("%s: error %q, want the job refused", result.ID, result.Error)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.png")); !os.IsNotExist(err) {
+		t.Errorf("escaped.png was written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("escaped was created: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/fetch"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// the URLs a process run downloads: its arguments, then the lines of
+// cfg.URLsFile
+func inputURLs(cfg *config.Config, args []string) ([]string, error) {
+	var urls []string
+	for _, arg := range args {
+		if !fetch.IsURL(arg) {
+			return nil, fmt.Errorf("unexpected argument %q: inputs given as arguments must be http or https URLs", arg)
+		}
+		urls = append(urls, arg)
+	}
+	if cfg.URLsFile == "" {
+		return urls, nil
+	}
+
+	file, err := os.Open(cfg.URLsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open URL list: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if !fetch.IsURL(text) {
+			return nil, fmt.Errorf("%s:%d: not an http or https URL: %q", cfg.URLsFile, line, text)
+		}
+		urls = append(urls, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read URL list: %w", err)
+	}
+	return urls, nil
+}
+
+// download urls into dir, streaming the local path of each as it arrives
+// so processing starts on the first downloads while the rest are fetched.
+// paths is closed when every download is done or ctx is, and the failed
+// downloads are then delivered on failed as results, so they count in the
+// summary and exit status like failed jobs
+func streamDownloads(ctx context.Context, cfg *config.Config, dir string, urls []string, log logger.Logger) (<-chan string, <-chan []models.ProcessingResult) {
+	paths := make(chan string)
+	failed := make(chan []models.ProcessingResult, 1)
+
+	go func() {
+		defer close(paths)
+		var failures []models.ProcessingResult
+		downloaded := 0
+		send := func(path string) {
+			select {
+			case paths <- path:
+				downloaded++
+			case <-ctx.Done():
+			}
+		}
+		// deterministic runs queue downloads in the order of the list, so
+		// job indexes and output names don't depend on which finished first
+		var order *downloadOrder
+		if cfg.Deterministic {
+			order = &downloadOrder{ready: map[int]string{}}
+		}
+		downloader := fetch.NewDownloader(dir, cfg.DownloadWorkers, cfg.DownloadRetries, cfg.DownloadTimeout, cfg.MaxFileSize)
+		downloader.Fetch(ctx, urls, func(i int, path string, err error) {
+			if err != nil {
+				failures = append(failures, models.ProcessingResult{
+					Index:     i,
+					InputPath: urls[i],
+					Error:     fmt.Errorf("failed to download: %w", err),
+				})
+			} else {
+				log.WithField("url", urls[i]).WithField("file", path).Debug("Downloaded image")
+			}
+			if order != nil {
+				order.release(i, path, send)
+			} else if err == nil {
+				send(path)
+			}
+		})
+		log.WithFields(map[string]interface{}{
+			"downloaded": downloaded,
+			"failed":     len(failures),
+		}).Info("Finished downloads")
+		failed <- failures
+	}()
+
+	return paths, failed
+}
+
+// downloads finished out of order, held until those before them in the
+// list are done
+type downloadOrder struct {
+	ready map[int]string
+	next  int
+}
+
+// record download i, with an empty path when it failed, and send every
+// path whose turn has come
+func (o *downloadOrder) release(i int, path string, send func(path string)) {
+	o.ready[i] = path
+	for {
+		path, ok := o.ready[o.next]
+		if !ok {
+			return
+		}
+		delete(o.ready, o.next)
+		o.next++
+		if path != "" {
+			send(path)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// filters lists the registered filters, or the named ones, with the
+// settings each takes: their section key, type, default and flat key
+func runFilters(cfg *config.Config, log logger.Logger, args []string) {
+	filters := filterspec.All()
+	if len(args) > 0 {
+		filters = filters[:0]
+		for _, name := range args {
+			f, ok := filterspec.Lookup(name)
+			if !ok {
+				log.WithField("filter", name).Fatal("Unknown filter, run filters to list them")
+			}
+			filters = append(filters, f)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i, f := range filters {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		kind := ""
+		if f.Custom {
+			kind = " (custom)"
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", f.Name, kind, f.Doc)
+		for _, p := range f.Params {
+			key := p.Key
+			if key == "" {
+				key = "-"
+			}
+			doc := p.Doc
+			if p.Required {
+				doc = strings.TrimSuffix("required; "+doc, "; ")
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%v\t%s\t%s\n", p.Name, p.Type, p.Default, key, doc)
+		}
+	}
+	w.Flush()
+}
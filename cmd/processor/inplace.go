@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// stop a process run in_place doesn't apply to. It rewrites the images of
+// the input directory, so it has nothing to write over for piped input and
+// downloads, and the other modes don't write one result per input
+func checkInPlace(cfg *config.Config, log logger.Logger, args []string) {
+	if !cfg.InPlace {
+		return
+	}
+	switch {
+	case pipeMode(args):
+		rejectInPlace(cfg, log, "piped input")
+	case len(args) > 0 || cfg.URLsFile != "":
+		rejectInPlace(cfg, log, "URL input")
+	case cfg.Mode != "process" && cfg.Mode != "validate":
+		rejectInPlace(cfg, log, cfg.Mode+" mode")
+	}
+}
+
+// stop a command that doesn't support in_place when it's set. Daemons would
+// pick the files they rewrite up as new input
+func rejectInPlace(cfg *config.Config, log logger.Logger, what string) {
+	if cfg.InPlace {
+		log.Fatal(fmt.Sprintf("in_place isn't supported with %s", what))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+)
+
+// an in_place walk leaves out its backups, temporary files and lock, so a
+// later run doesn't edit them as inputs
+func TestInputExcludesInPlace(t *testing.T) {
+	cfg := &config.Config{InPlace: true, InPlaceBackup: ".bak", Exclude: []string{"*.tmp"}}
+	excluded := func(name string) bool {
+		for _, pattern := range inputExcludes(cfg) {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, name := range []string{"photo.png.bak", ".photo.in-place.png", ".processor.lock", "scratch.tmp"} {
+		if !excluded(name) {
+			t.Errorf("%s is walked as an input", name)
+		}
+	}
+	if excluded("photo.png") {
+		t.Error("photo.png is left out")
+	}
+
+	cfg.InPlace = false
+	if excluded("photo.png.bak") {
+		t.Error("backups are left out without in_place")
+	}
+}
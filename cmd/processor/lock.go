@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/lockfile"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// lock the output directory against other runs until the returned release
+// is called, or the input directory of an in_place run, which writes there.
+// A directory another run holds is fatal unless force is set; one that
+// can't be locked, such as on a filesystem without locks, is only warned
+// about
+func lockOutput(cfg *config.Config, log logger.Logger) (release func()) {
+	dir, field, name := cfg.OutputDir, "output_dir", "Output directory"
+	if cfg.InPlace {
+		dir, field, name = cfg.InputDir, "input_dir", "Input directory"
+	}
+	lock, err := lockfile.Acquire(dir)
+	if err == nil {
+		return func() { lock.Release() }
+	}
+
+	log = log.WithError(err).WithField(field, dir)
+	switch {
+	case !errors.Is(err, lockfile.ErrLocked):
+		log.Warn("Failed to lock " + strings.ToLower(name) + ", continuing without the lock")
+	case cfg.Force:
+		log.Warn(name + " is in use by another run, continuing because of force")
+	default:
+		log.Fatal(name + " is in use by another run; wait for it to finish or pass -force")
+	}
+	return func() {}
+}
@@ -2,155 +2,1011 @@ package main
 
 import (
 	"context"
-	"flag"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
-	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/discovery"
+	"github.com/arsalan9702/concurrent-image-processor/internal/lockfile"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
 	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
 	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
 )
 
 func main() {
-	var (
-		inputDir   = flag.String("input", "examples/images", "Input directory containing images")
-		outputDir  = flag.String("output", "examples/output", "Output directory for processed images")
-		filter     = flag.String("filter", "grayscale", "Filter to apply (grayscale, blur, birghtness, contrast)")
-		workers    = flag.Int("workers", runtime.NumCPU(), "Number of worker goroutines")
-		rowWorkers = flag.Int("row-workers", runtime.NumCPU()*2, "Number of row processing workers per image")
-		configFile = flag.String("config", "", "Configuration file path")
-		verbose    = flag.Bool("verbose", false, "Enable verbose logging")
-	)
-	flag.Parse()
-
-	log:=logger.NewLogger(*verbose)
+	// without a command the flags are those of process, as before commands
+	// existed
+	name, args := "process", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		help(args)
+		return
+	}
 
-	cfg, err := config.Load(*configFile)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to load config file")
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
 	}
 
-	if *inputDir!="examples/images"{
-		cfg.InputDir = *inputDir
+	cfg, log, args := cmd.parse(args)
+	lowerPriority(cfg, log)
+	if runService(cmd, cfg, log, args) {
+		return
 	}
-	if *outputDir!="examples/output"{
-		cfg.OutputDir = *outputDir
+	cmd.run(cfg, log, args)
+}
+
+// process every image in the input directory, or run the batch mode set by
+// -mode or the config file
+func runProcess(cfg *config.Config, log logger.Logger, args []string) {
+	// graph mode only prints the diagram, so nothing is logged ahead of it
+	if cfg.Mode == "graph" {
+		runGraph(cfg, log, args)
+		return
 	}
-	if *filter!="grayscale"{
-		cfg.Filter = *filter
+	if cfg.Mode == "inspect" {
+		runInspect(cfg, log, args)
+		return
 	}
-	if *workers!=runtime.NumCPU(){
-		cfg.Workers = *workers
+	if cfg.Mode == "stats" {
+		runStats(cfg, log, args)
+		return
 	}
-	if *rowWorkers!=runtime.NumCPU()*2{
-		cfg.RowWorkers = *rowWorkers
+	checkInPlace(cfg, log, args)
+	if pipeMode(args) {
+		runPipe(cfg, log)
+		return
 	}
 
 	log.WithFields(map[string]interface{}{
-		"input_dir":   cfg.InputDir,
-		"output_dir":  cfg.OutputDir,
+		"input_dir":   redact(cfg.InputDir),
+		"output_dir":  redact(cfg.OutputDir),
 		"filter":      cfg.Filter,
 		"workers":     cfg.Workers,
 		"row_workers": cfg.RowWorkers,
+		"mode":        cfg.Mode,
 	}).Info("Starting image processor")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	notifyShutdown(sigChan)
 
-	go func(){
-		<-sigChan
-		log.Info("Received shutdown signal, stopping")
-		cancel()
-	}()
+	// the run works on local copies of remote directories
+	stage, err := stageRemote(ctx, cfg, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to stage remote directories")
+	}
+	defer stage.cleanup()
 
-	if err:=os.MkdirAll(cfg.OutputDir, 0755);err!=nil{
-		log.WithError(err).Fatal("Failed to create output directory")
+	// validate mode only reads
+	if cfg.Mode != "validate" {
+		if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+			log.WithError(err).Fatal("Failed to create output directory")
+		}
 	}
+	// a staged remote output is private to the run
+	release := func() {}
+	if cfg.Mode != "validate" && stage.output == nil {
+		release = lockOutput(cfg, log)
+	}
+	defer release()
 
-	proc, err:= processor.New(cfg, log)
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
 	if err != nil {
 		log.WithError(err).Fatal("Failed to initialize processor")
 	}
 
-	imageFiles, err:= findImageFiles(cfg.InputDir)
-	if err != nil {
-		log.WithError(err).Fatal("No images found in input directory")
+	// only batch processing has a queue to drain
+	drainTimeout := cfg.DrainTimeout
+	if cfg.Mode != "process" {
+		drainTimeout = 0
 	}
+	go handleSignals(sigChan, drainTimeout, proc, cancel, log)
+	startDiagnostics(ctx, cfg, proc.Stats, log)
+	handlePause(ctx, proc, log)
+	stopControl := startControl(ctx, cfg, proc, proc.Drain, log)
+	defer stopControl()
+
+	if cfg.Mode != "process" {
+		imageFiles, err := findImageFiles(cfg, cfg.InputDir)
+		if err != nil {
+			log.WithError(err).Fatal("No images found in input directory")
+		}
 
-	if len(imageFiles)==0{
-		log.Warn("No images found in input directory")
+		if len(imageFiles) == 0 {
+			log.Warn("No images found in input directory")
+			return
+		}
+
+		log.WithField("count", len(imageFiles)).Info("Found image files")
+
+		switch cfg.Mode {
+		case "stack":
+			runStack(ctx, proc, imageFiles, log)
+		case "diff":
+			runDiff(ctx, cfg, proc, imageFiles, log)
+		case "tiles":
+			runTiles(ctx, cfg, proc, imageFiles, log)
+		case "validate":
+			runValidate(ctx, cfg, proc, imageFiles, log)
+		case "duplicates":
+			runDuplicates(ctx, cfg, proc, imageFiles, log)
+		case "optimize":
+			runOptimize(ctx, cfg, proc, imageFiles, log)
+		}
 		return
 	}
 
-	log.WithField("count", len(imageFiles)).Info("Found image files")
-
-	startTime:=time.Now()
-	results, err:= proc.ProcessImages(ctx, imageFiles)
+	urls, err := inputURLs(cfg, args)
 	if err != nil {
+		log.WithError(err).Fatal("Failed to read input URLs")
+	}
+
+	// the dashboard covers the terminal the progress line would be drawn on
+	stopProgress := func() {}
+	switch {
+	case dashboardLog != nil:
+		stopProgress = showDashboard(proc, dashboardLog)
+	case cfg.Dashboard:
+		log.Warn("Not showing the dashboard, stdout isn't a terminal")
+	}
+	if cfg.Progress && dashboardLog == nil {
+		stopProgress = showProgress(proc)
+	}
+	if cfg.ProgressLogInterval > 0 {
+		stopLine := stopProgress
+		stopLog := logProgress(proc, log, cfg.ProgressLogInterval)
+		stopProgress = func() {
+			stopLog()
+			stopLine()
+		}
+	}
+
+	var index *processor.Index
+	if cfg.IncrementalIndex != "" {
+		if index, err = proc.OpenIndex(); err != nil {
+			log.WithError(err).Fatal("Failed to open incremental index")
+		}
+	}
+
+	startTime := time.Now()
+	var results []models.ProcessingResult
+	var discovered int
+	var skips discovery.Skipped
+	// why the outputs of removed inputs are kept, with mirror_delete
+	keepOutputs := ""
+	if cfg.Manifest != "" {
+		entries, loadErr := config.LoadManifest(cfg.Manifest, cfg)
+		if loadErr != nil {
+			log.WithError(loadErr).Fatal("Failed to load manifest")
+		}
+		log.WithFields(map[string]interface{}{"manifest": cfg.Manifest, "count": len(entries)}).Info("Loaded manifest")
+
+		discovered = len(entries)
+		results, err = proc.ProcessManifest(ctx, entries)
+	} else if len(urls) > 0 {
+		dir := cfg.DownloadDir
+		if dir == "" {
+			if dir, err = os.MkdirTemp("", "imgproc-downloads-"); err != nil {
+				log.WithError(err).Fatal("Failed to create download directory")
+			}
+		}
+		log.WithFields(map[string]interface{}{"count": len(urls), "download_dir": dir}).Info("Downloading images")
+
+		// like the walk, downloads feed processing as they finish
+		downloadCtx, stopDownloads := context.WithCancel(ctx)
+		paths, failed := streamDownloads(downloadCtx, cfg, dir, urls, log)
+
+		results, err = processUnique(ctx, cfg, proc, index, paths)
+		stopDownloads()
+		keepOutputs = "inputs are URLs"
+		results = append(results, <-failed...)
+		discovered = len(urls)
+		if cfg.DownloadDir == "" {
+			os.RemoveAll(dir)
+		}
+	} else {
+		// processing starts on the first images while the walk goes on; the
+		// walk is stopped once processing returns, which a drain does early
+		walkCtx, stopWalk := context.WithCancel(ctx)
+		paths, found := streamImageFiles(walkCtx, cfg, cfg.InputDir, log)
+
+		results, err = processUnique(ctx, cfg, proc, index, paths)
+		stopWalk()
+		walk := <-found
+		discovered, skips = walk.found, walk.skipped
+		switch {
+		case walk.err != nil:
+			keepOutputs = "the walk of the input directory didn't finish"
+		case walk.found == 0:
+			keepOutputs = "no images were found"
+		}
+	}
+	if err != nil || ctx.Err() != nil || proc.Stats().Draining {
+		keepOutputs = "the run was stopped"
+	}
+	stopProgress()
+	if err != nil && !errors.Is(err, context.Canceled) {
 		log.WithError(err).Fatal("Failed to process images")
 	}
+	mirrorDeleted := 0
+	if index != nil {
+		proc.UpdateIndex(index, results)
+		if cfg.MirrorDelete && keepOutputs != "" {
+			log.WithField("reason", keepOutputs).Warn("Not deleting the outputs of removed inputs")
+		} else if cfg.MirrorDelete {
+			removed, err := proc.MirrorDelete(index)
+			if err != nil {
+				log.WithError(err).Error("Failed to delete outputs of removed inputs")
+			}
+			mirrorDeleted = len(removed)
+		}
+		if err := index.Save(); err != nil {
+			log.WithError(err).Error("Failed to save incremental index")
+		}
+	}
 
-	duration:=time.Since(startTime)
-	successful:=0
-	failed:=0
+	if discovered == 0 {
+		log.WithFields(skipFields(skips)).Warn("No images found in input directory")
+		return
+	}
+
+	duration := time.Since(startTime)
+	successful := 0
+	failed := 0
+	skipped := 0
+	resumed := 0
+	upToDate := 0
+	cacheHits := 0
+	duplicates := 0
+	deduplicated := 0
+	var dedupBytes int64
+	// failures by class, for the summary
+	failures := map[string]int{}
 
 	for _, result := range results {
-		if result.Error != nil {
+		if result.DuplicateOf != "" && result.Error == nil {
+			fields := map[string]interface{}{
+				"file":     result.InputPath,
+				"original": result.DuplicateOf,
+			}
+			if result.OutputPath != "" {
+				fields["output"] = result.OutputPath
+			}
+			if result.Identical {
+				log.WithFields(fields).Info("Identical to an earlier image, not processed")
+				deduplicated++
+				dedupBytes += result.Metadata.OriginalSize
+			} else {
+				log.WithFields(fields).Info("Near-duplicate of an earlier image, not processed")
+				duplicates++
+			}
+		} else if result.Resumed {
+			log.WithField("file", result.InputPath).Debug("already processed by a previous run")
+			resumed++
+		} else if result.UpToDate {
+			log.WithField("file", result.InputPath).Debug("unchanged since the last run")
+			upToDate++
+		} else if errors.Is(result.Error, processor.ErrSkipped) {
+			log.WithField("file", result.InputPath).Warn("skipped image during shutdown")
+			skipped++
+		} else if result.Error != nil {
 			log.WithError(result.Error).WithField("file", result.InputPath).Error("failed to process image")
 			failed++
+			if class := processor.FailureClass(result.Error); class != "" {
+				failures["failed_"+class]++
+			}
 		} else {
-			log.WithFields(map[string]interface{}{
-				"input": result.InputPath,
-				"output": result.OutputPath,
-				"duration": result.ProcessingTime,
-			}).Info("Successfully processed image")
+			fields := map[string]interface{}{
+				"input":       result.InputPath,
+				"output":      result.OutputPath,
+				"duration":    result.ProcessingTime,
+				"queue_wait":  result.QueueWait,
+				"peak_memory": result.Resources.PeakMemory,
+				"cpu_time":    result.Resources.CPUTime,
+			}
+			if result.Resources.GCCycles > 0 {
+				fields["gc_cycles"] = result.Resources.GCCycles
+				fields["gc_pause"] = result.Resources.GCPause
+			}
+			if len(result.Outputs) > 1 {
+				fields["outputs"] = len(result.Outputs)
+			}
+			if result.Cached {
+				fields["cached"] = true
+				cacheHits++
+			}
+			if result.Unchanged {
+				fields["unchanged"] = true
+			}
+			if geo := result.Metadata.Geo; geo != nil {
+				fields["epsg"] = geo.EPSG
+				fields["tiepoints"] = geo.Tiepoints
+				fields["pixel_scale"] = geo.PixelScale
+			}
+			log.WithFields(fields).Info("Successfully processed image")
+			logTimings(log, result)
 			successful++
 		}
 	}
 
-	log.WithFields(map[string]interface{}{
+	summary := map[string]interface{}{
 		"total_duration": duration,
 		"successful":     successful,
 		"failed":         failed,
 		"total":          len(results),
-	}).Info("Processing completed")
+	}
+	if stats := processor.Summarize(results, duration); stats.Processed > 0 {
+		summary["p50"] = stats.P50
+		summary["p90"] = stats.P90
+		summary["p99"] = stats.P99
+		summary["images_per_sec"] = round2(stats.ImagesPerSec)
+		summary["mb_per_sec"] = round2(stats.MBPerSec)
+		summary["pixels"] = stats.Pixels
+		if stats.CompressionRatio > 0 {
+			summary["compression_ratio"] = round2(stats.CompressionRatio)
+		}
+		if stats.Decode > 0 {
+			summary["decode_time"] = stats.Decode
+			summary["filter_time"] = stats.Filter
+			summary["encode_time"] = stats.Encode
+			summary["write_time"] = stats.Write
+		}
+	}
+	if cfg.ContentAddressed {
+		manifestPath := cfg.ContentManifest
+		if manifestPath == "" {
+			manifestPath = filepath.Join(cfg.OutputDir, "content_manifest.json")
+		}
+		if err := processor.WriteJSON(manifestPath, proc.ContentManifest(results)); err != nil {
+			log.WithError(err).Fatal("Failed to write content manifest")
+		}
+		summary["manifest"] = manifestPath
+	}
+	if renames := proc.Renames(); len(renames) > 0 {
+		reportPath := cfg.RenameReport
+		if reportPath == "" {
+			reportPath = filepath.Join(cfg.OutputDir, "renames.json")
+		}
+		if err := processor.WriteJSON(reportPath, renames); err != nil {
+			log.WithError(err).Fatal("Failed to write rename report")
+		}
+		summary["renamed"] = len(renames)
+		summary["rename_report"] = reportPath
+	}
+	if skipped > 0 {
+		summary["skipped"] = skipped
+	}
+	if resumed > 0 {
+		summary["resumed"] = resumed
+	}
+	if cfg.IncrementalIndex != "" {
+		summary["up_to_date"] = upToDate
+	}
+	if cfg.MirrorDelete {
+		summary["mirror_deleted"] = mirrorDeleted
+	}
+	for field, count := range skipFields(skips) {
+		summary[field] = count
+	}
+	for field, count := range failures {
+		summary[field] = count
+	}
+	if cfg.DuplicateAction != "" {
+		summary["duplicates"] = duplicates
+	}
+	if cfg.Dedupe != "" {
+		summary["deduplicated"] = deduplicated
+		summary["dedup_bytes"] = dedupBytes
+	}
+	if cfg.CacheDir != "" {
+		summary["cache_hits"] = cacheHits
+	}
+	// images found but never reported: in flight when the context was
+	// cancelled, or not yet queued when the pool drained
+	if abandoned := discovered - len(results); abandoned > 0 {
+		summary["abandoned"] = abandoned
+	}
+	if err := stage.finish(log); err != nil {
+		log.WithError(err).Fatal("Failed to upload outputs")
+	}
+	log.WithFields(summary).Info("Processing completed")
+
+	code := exitCode(cfg.MaxFailures, failed, len(results))
+	proc.Webhooks().BatchCompleted(summary, code)
+	proc.Webhooks().Wait()
+	if code != 0 {
+		stopControl()
+		release()
+		os.Exit(code)
+	}
 }
 
-func findImageFiles(dir string) ([]string, error) {
-	var files []string
-	supportedExts:=map[string]bool{
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-		".gif":  true,
-		".bmp":  true,
-		".tiff": true,
-		".webp": true,
+// process the streamed paths, leaving out those up to date in index and
+// holding identical inputs back for dedupe and near-duplicates for
+// duplicate_action, resolved once their originals are done
+func processUnique(ctx context.Context, cfg *config.Config, proc *processor.Processor, index *processor.Index, paths <-chan string) ([]models.ProcessingResult, error) {
+	// the filters stop with processing, which a drain ends before the
+	// stream does
+	filterCtx, stopFilters := context.WithCancel(ctx)
+	defer stopFilters()
+
+	var indexed <-chan []models.ProcessingResult
+	if index != nil {
+		paths, indexed = proc.FilterIndexed(filterCtx, index, paths)
+	}
+	var identical, near <-chan []processor.Duplicate
+	if cfg.Dedupe != "" {
+		paths, identical = proc.FilterIdentical(filterCtx, paths)
+	}
+	if cfg.DuplicateAction != "" {
+		paths, near = proc.FilterDuplicates(filterCtx, paths)
 	}
 
-	err:=filepath.Walk(dir, func(path string, info os.FileInfo, err error) error{
-		if err != nil {
-			return nil
+	results, err := proc.ProcessStream(ctx, paths)
+	stopFilters()
+	if indexed != nil {
+		for _, result := range <-indexed {
+			result.Index = len(results)
+			results = append(results, result)
 		}
+	}
+	if err != nil {
+		return results, err
+	}
+	// an identical input's original may itself be a near-duplicate
+	if near != nil {
+		results = append(results, proc.ResolveDuplicates(<-near, results)...)
+	}
+	if identical != nil {
+		results = append(results, proc.ResolveDuplicates(<-identical, results)...)
+	}
+	return results, nil
+}
 
-		if !info.IsDir() {
-			ext:=strings.ToLower(filepath.Ext(path))
-			if supportedExts[ext]{
-				files=append(files, path)
+// log the time each stage of a processed image took and, with -verbose,
+// its slowest strip of rows
+func logTimings(log logger.Logger, result models.ProcessingResult) {
+	timings := result.Metadata.Timings
+	if timings.Decode == 0 && len(timings.Steps) == 0 && len(timings.Strips) == 0 {
+		return
+	}
+	fields := map[string]interface{}{
+		"file":   result.InputPath,
+		"decode": timings.Decode,
+		"encode": timings.Encode,
+		"write":  timings.Write,
+	}
+	for _, step := range timings.Steps {
+		fields["step_"+step.ID] = step.Duration
+	}
+	if len(timings.Strips) > 0 {
+		slowest := timings.Strips[0]
+		for _, strip := range timings.Strips[1:] {
+			if strip.Duration > slowest.Duration {
+				slowest = strip
 			}
 		}
+		fields["strips"] = len(timings.Strips)
+		fields["slowest_strip"] = fmt.Sprintf("%s rows %d-%d", slowest.Step, slowest.StartRow, slowest.EndRow)
+		fields["slowest_strip_time"] = slowest.Duration
+	}
+	log.WithFields(fields).Debug("Stage timings")
+}
+
+// exit status of a batch run: 0 while failures stay within maxFailures, 3
+// when every job failed and 1 for a partial failure above the threshold
+func exitCode(maxFailures string, failed, total int) int {
+	if failed == 0 {
+		return 0
+	}
+	limit, percent, _ := config.ParseLength(maxFailures)
+	if percent {
+		limit = limit * float64(total) / 100
+	}
+	if float64(failed) <= limit {
+		return 0
+	}
+	if failed == total {
+		return 3
+	}
+	return 1
+}
+
+// on the first signal, drain the processor for up to drainTimeout before
+// cancelling; a second signal, or a zero timeout, cancels immediately
+func handleSignals(sigChan <-chan os.Signal, drainTimeout time.Duration, proc *processor.Processor, cancel context.CancelFunc, log logger.Logger) {
+	<-sigChan
+	if drainTimeout == 0 {
+		log.Info("Received shutdown signal, stopping")
+		cancel()
+		return
+	}
 
-		return nil
+	log.WithField("drain_timeout", drainTimeout).Info("Received shutdown signal, finishing in-flight images")
+	proc.Drain()
+
+	select {
+	case <-sigChan:
+		log.Warn("Received second shutdown signal, stopping")
+	case <-time.After(drainTimeout):
+		log.Warn("Drain timeout expired, stopping")
+	}
+	cancel()
+}
+
+func runGraph(cfg *config.Config, log logger.Logger, args []string) {
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+
+	graph, err := proc.PipelineGraph(cfg.GraphFormat)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to render pipeline graph")
+	}
+
+	if cfg.GraphOutput == "" {
+		os.Stdout.WriteString(graph)
+		return
+	}
+	if err := os.WriteFile(cfg.GraphOutput, []byte(graph), 0644); err != nil {
+		log.WithError(err).Fatal("Failed to write pipeline graph")
+	}
+	log.WithField("output", cfg.GraphOutput).Info("Pipeline graph written")
+}
+
+// print a description of each file named on the command line, or of every
+// image in the input directory, as a table or JSON on stdout
+func runInspect(cfg *config.Config, log logger.Logger, paths []string) {
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+
+	if len(paths) == 0 {
+		paths, err = findImageFiles(cfg, cfg.InputDir)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to list input directory")
+		}
+	}
+
+	infos, err := proc.Inspect(context.Background(), paths)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to inspect images")
+	}
+
+	if cfg.InspectFormat == "json" {
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to encode image info")
+		}
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tFORMAT\tWIDTH\tHEIGHT\tCOLOR\tDEPTH\tSIZE\tEXIF")
+	for _, info := range infos {
+		if info.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%d\terror: %s\n", info.Path, info.Size, info.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%d\t%d\t%s\n",
+			info.Path, info.Format, info.Width, info.Height, info.ColorModel, info.BitDepth, info.Size, exifSummary(info.Exif))
+	}
+	w.Flush()
+}
+
+// print the statistics of the given files, or of every image in the input
+// directory, to stdout as one JSON object per line in completion order
+func runStats(cfg *config.Config, log logger.Logger, paths []string) {
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+
+	if len(paths) == 0 {
+		paths, err = findImageFiles(cfg, cfg.InputDir)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to list input directory")
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	err = proc.ImageStats(context.Background(), paths, func(stats models.ImageStats) {
+		if err := encoder.Encode(stats); err != nil {
+			log.WithError(err).Fatal("Failed to write image statistics")
+		}
 	})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to compute image statistics")
+	}
+}
+
+// one-line EXIF summary for the inspect table
+func exifSummary(exif *models.ExifSummary) string {
+	if exif == nil {
+		return "-"
+	}
+
+	var parts []string
+	if camera := strings.TrimSpace(exif.Make + " " + exif.Model); camera != "" {
+		parts = append(parts, camera)
+	}
+	if exif.DateTime != "" {
+		parts = append(parts, exif.DateTime)
+	}
+	if exif.ExposureTime != "" {
+		parts = append(parts, exif.ExposureTime)
+	}
+	if exif.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", exif.FNumber))
+	}
+	if exif.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", exif.ISO))
+	}
+	if exif.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", exif.FocalLength))
+	}
+	if exif.Orientation > 1 {
+		parts = append(parts, fmt.Sprintf("orientation %d", exif.Orientation))
+	}
+	if exif.GPS {
+		parts = append(parts, "GPS")
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func runStack(ctx context.Context, proc *processor.Processor, imageFiles []string, log logger.Logger) {
+	result, err := proc.Stack(ctx, imageFiles)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to stack images")
+	}
+
+	log.WithFields(map[string]interface{}{
+		"output":   result.OutputPath,
+		"frames":   len(imageFiles),
+		"duration": result.ProcessingTime,
+	}).Info("Stacking completed")
+}
+
+func runDiff(ctx context.Context, cfg *config.Config, proc *processor.Processor, imageFiles []string, log logger.Logger) {
+	compareFiles, err := findImageFiles(cfg, cfg.CompareDir)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to list compare directory")
+	}
+
+	report, err := proc.Diff(ctx, imageFiles, compareFiles)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to compare directories")
+	}
+
+	for _, r := range report.Results {
+		entry := log.WithFields(map[string]interface{}{
+			"file":   r.Name,
+			"status": r.Status,
+		})
+		switch r.Status {
+		case models.DiffUnchanged:
+			entry.Debug("Image unchanged")
+		case models.DiffError:
+			entry.WithField("error", r.Error).Error("Failed to compare image")
+		case models.DiffChanged:
+			entry.WithField("changed_pixels", r.ChangedPixels).Warn("Image differs")
+		default:
+			entry.Warn("Image present in only one directory")
+		}
+	}
+
+	reportPath := cfg.DiffReport
+	if reportPath == "" {
+		reportPath = filepath.Join(cfg.OutputDir, "diff_report.json")
+	}
+	if err := processor.WriteJSON(reportPath, report); err != nil {
+		log.WithError(err).Fatal("Failed to write diff report")
+	}
+
+	log.WithFields(map[string]interface{}{
+		"report":    reportPath,
+		"unchanged": report.Summary[models.DiffUnchanged],
+		"changed":   report.Summary[models.DiffChanged],
+		"missing":   report.Summary[models.DiffMissing],
+		"added":     report.Summary[models.DiffAdded],
+		"errors":    report.Summary[models.DiffError],
+	}).Info("Comparison completed")
+}
+
+// group near-duplicate inputs and write the clusters as a JSON report
+func runDuplicates(ctx context.Context, cfg *config.Config, proc *processor.Processor, imageFiles []string, log logger.Logger) {
+	report, err := proc.Duplicates(ctx, imageFiles)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to hash images")
+	}
+
+	duplicates := 0
+	for _, cluster := range report.Clusters {
+		for _, d := range cluster.Duplicates {
+			log.WithFields(map[string]interface{}{
+				"file":     d.Path,
+				"original": cluster.Original.Path,
+				"distance": d.Distance,
+			}).Info("Near-duplicate")
+		}
+		duplicates += len(cluster.Duplicates)
+	}
+	for _, e := range report.Errors {
+		log.WithField("file", e.Path).WithField("error", e.Error).Error("Failed to hash image")
+	}
+
+	reportPath := cfg.DuplicateReport
+	if reportPath == "" {
+		reportPath = filepath.Join(cfg.OutputDir, "duplicate_report.json")
+	}
+	if err := processor.WriteJSON(reportPath, report); err != nil {
+		log.WithError(err).Fatal("Failed to write duplicate report")
+	}
 
-	return files, err
+	log.WithFields(map[string]interface{}{
+		"report":     reportPath,
+		"images":     report.Images,
+		"clusters":   len(report.Clusters),
+		"duplicates": duplicates,
+		"errors":     len(report.Errors),
+	}).Info("Duplicate detection completed")
+}
+
+// recompress every input losslessly and write the bytes saved as a JSON
+// report
+func runOptimize(ctx context.Context, cfg *config.Config, proc *processor.Processor, imageFiles []string, log logger.Logger) {
+	report, err := proc.Optimize(ctx, imageFiles)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to optimize images")
+	}
+
+	for _, r := range report.Results {
+		if r.Error != "" {
+			log.WithField("file", r.Path).WithField("error", r.Error).Error("Failed to optimize image")
+			continue
+		}
+		if r.Skipped {
+			log.WithField("file", r.Path).WithField("format", r.Format).Debug("Skipping image, only PNG and JPEG are optimized")
+			continue
+		}
+		log.WithFields(map[string]interface{}{
+			"file":           r.Path,
+			"original_size":  r.OriginalSize,
+			"optimized_size": r.OptimizedSize,
+			"saved":          r.Saved,
+		}).Info("Optimized image")
+	}
+
+	reportPath := cfg.OptimizeReport
+	if reportPath == "" {
+		reportPath = filepath.Join(cfg.OutputDir, "optimize_report.json")
+	}
+	if err := processor.WriteJSON(reportPath, report); err != nil {
+		log.WithError(err).Fatal("Failed to write optimize report")
+	}
+
+	log.WithFields(map[string]interface{}{
+		"report":         reportPath,
+		"images":         report.Images,
+		"original_size":  report.OriginalSize,
+		"optimized_size": report.OptimizedSize,
+		"saved":          report.Saved,
+		"skipped":        report.Skipped,
+		"errors":         report.Errors,
+	}).Info("Optimization completed")
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// decode every input and exit with status 1 if any is corrupt or misnamed,
+// so the mode can serve as a health check
+func runValidate(ctx context.Context, cfg *config.Config, proc *processor.Processor, imageFiles []string, log logger.Logger) {
+	report, err := proc.Validate(ctx, imageFiles)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to validate images")
+	}
+
+	for _, r := range report.Results {
+		entry := log.WithFields(map[string]interface{}{
+			"file":   r.Path,
+			"format": r.Format,
+			"size":   r.Size,
+		})
+		switch r.Status {
+		case models.ValidationValid:
+			entry.WithFields(map[string]interface{}{
+				"width":  r.Width,
+				"height": r.Height,
+			}).Debug("Image valid")
+		case models.ValidationMismatched:
+			entry.WithFields(map[string]interface{}{
+				"extension_format": r.ExtensionFormat,
+				"width":            r.Width,
+				"height":           r.Height,
+			}).Warn("Image contents don't match extension")
+		default:
+			entry.WithField("error", r.Error).Error("Image corrupt")
+		}
+	}
+
+	fields := map[string]interface{}{
+		"valid":      report.Summary[models.ValidationValid],
+		"mismatched": report.Summary[models.ValidationMismatched],
+		"corrupt":    report.Summary[models.ValidationCorrupt],
+	}
+	if cfg.ValidateReport != "" {
+		if err := processor.WriteJSON(cfg.ValidateReport, report); err != nil {
+			log.WithError(err).Fatal("Failed to write validation report")
+		}
+		fields["report"] = cfg.ValidateReport
+	}
+	log.WithFields(fields).Info("Validation completed")
+
+	if report.Summary[models.ValidationValid] != len(report.Results) {
+		os.Exit(1)
+	}
+}
+
+func runTiles(ctx context.Context, cfg *config.Config, proc *processor.Processor, imageFiles []string, log logger.Logger) {
+	compareFiles, err := findImageFiles(cfg, cfg.CompareDir)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to list compare directory")
+	}
+
+	report, err := proc.Tiles(ctx, imageFiles, compareFiles)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to detect changed tiles")
+	}
+
+	changedTiles := 0
+	for _, m := range report.Images {
+		if m.Status == models.DiffError {
+			log.WithField("file", m.Name).WithField("error", m.Error).Error("Failed to process image tiles")
+			continue
+		}
+		changedTiles += len(m.Tiles)
+		log.WithFields(map[string]interface{}{
+			"file":    m.Name,
+			"status":  m.Status,
+			"changed": len(m.Tiles),
+			"total":   m.TotalTiles,
+		}).Debug("Tiles compared")
+	}
+
+	manifestPath := cfg.TileManifest
+	if manifestPath == "" {
+		manifestPath = filepath.Join(cfg.OutputDir, "tile_manifest.json")
+	}
+	if err := processor.WriteJSON(manifestPath, report); err != nil {
+		log.WithError(err).Fatal("Failed to write tile manifest")
+	}
+
+	log.WithFields(map[string]interface{}{
+		"manifest":      manifestPath,
+		"images":        len(report.Images),
+		"changed_tiles": changedTiles,
+	}).Info("Tile change detection completed")
+}
+
+// images under dir that pass the include, exclude, extension, size and
+// time filters of cfg
+func findImageFiles(cfg *config.Config, dir string) ([]string, error) {
+	return discovery.Find(dir, inputFilter(cfg), walkOptions(cfg))
+}
+
+// what a streamed walk found: the images sent and the files skipped as
+// too large, unsupported or unreadable
+type walkCount struct {
+	found   int
+	skipped discovery.Skipped
+	// why the walk stopped early, nil when it went through the directory
+	err error
 }
 
+// stream the images under dir, like findImageFiles, as the walk finds them,
+// leaving out files over max_file_size. paths is closed when the walk ends
+// or ctx is done, and the counts are then delivered on found
+func streamImageFiles(ctx context.Context, cfg *config.Config, dir string, log logger.Logger) (<-chan string, <-chan walkCount) {
+	paths := make(chan string)
+	found := make(chan walkCount, 1)
+
+	filter := inputFilter(cfg)
+	filter.MaxFileSize = cfg.MaxFileSize
+
+	go func() {
+		defer close(paths)
+		count := 0
+		skipped, err := discovery.Walk(dir, filter, walkOptions(cfg), func(path string) error {
+			select {
+			case paths <- path:
+				count++
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.WithError(err).Warn("Failed to walk input directory")
+		}
+		log.WithFields(skipFields(skipped)).WithField("count", count).Info("Found image files")
+		found <- walkCount{found: count, skipped: skipped, err: err}
+	}()
+
+	return paths, found
+}
+
+// summary fields for the files a walk skipped, by reason, leaving out
+// reasons nothing was skipped for
+func skipFields(skipped discovery.Skipped) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if skipped.TooLarge > 0 {
+		fields["skipped_too_large"] = skipped.TooLarge
+	}
+	if skipped.Unsupported > 0 {
+		fields["skipped_unsupported"] = skipped.Unsupported
+	}
+	if skipped.Unreadable > 0 {
+		fields["skipped_unreadable"] = skipped.Unreadable
+	}
+	return fields
+}
+
+// the walk filters of cfg, with durations measured from now
+func inputFilter(cfg *config.Config) discovery.Filter {
+	now := time.Now()
+	newerThan, _ := config.ParseTime(cfg.NewerThan, now)
+	olderThan, _ := config.ParseTime(cfg.OlderThan, now)
+
+	return discovery.Filter{
+		Include:    cfg.Include,
+		Exclude:    inputExcludes(cfg),
+		Extensions: cfg.Extensions,
+		MinSize:    cfg.MinSize,
+		MaxSize:    cfg.MaxSize,
+		NewerThan:  newerThan,
+		OlderThan:  olderThan,
+		SkipHidden: cfg.SkipHidden,
+	}
+}
+
+// exclude patterns of the input walk. An in_place run also leaves out its
+// own temporary files, lock and backups
+func inputExcludes(cfg *config.Config) []string {
+	if !cfg.InPlace {
+		return cfg.Exclude
+	}
+	excludes := append([]string{processor.InPlaceTempPattern, lockfile.Name}, cfg.Exclude...)
+	if cfg.InPlaceBackup != "" {
+		excludes = append(excludes, "*"+cfg.InPlaceBackup)
+	}
+	return excludes
+}
+
+// how the input walk traverses the tree
+func walkOptions(cfg *config.Config) discovery.Options {
+	return discovery.Options{
+		Workers:  cfg.WalkWorkers,
+		Symlinks: cfg.Symlinks,
+		MaxDepth: cfg.MaxDepth,
+	}
+}
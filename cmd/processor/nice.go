@@ -0,0 +1,32 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/nice"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// with low_priority set, run on fewer CPUs and at a lower OS priority. A
+// priority that can't be lowered is logged and the run goes on
+func lowerPriority(cfg *config.Config, log logger.Logger) {
+	if !cfg.LowPriority {
+		return
+	}
+	cpus := cfg.LowPriorityCPUs
+	if cpus == 0 {
+		cpus = max(1, runtime.NumCPU()/2)
+	}
+	runtime.GOMAXPROCS(cpus)
+
+	fields := map[string]interface{}{"cpus": cpus}
+	if cfg.LowPriorityNice > 0 {
+		if err := nice.Lower(cfg.LowPriorityNice); err != nil {
+			log.WithError(err).Warn("Failed to lower process priority")
+		} else {
+			fields["nice"] = cfg.LowPriorityNice
+		}
+	}
+	log.WithFields(fields).Info("Running at low priority")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// a worker pool that can hold its queued jobs: a batch run's processor or a
+// daemon's service
+type pauser interface {
+	Pause() bool
+	Resume() bool
+}
+
+// pause pool on pauseSignal and resume it on resumeSignal until ctx is
+// done. In-flight images finish while paused, and queued ones keep their
+// place
+func handlePause(ctx context.Context, pool pauser, log logger.Logger) {
+	if pauseSignal == nil {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, pauseSignal, resumeSignal)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				if sig == pauseSignal {
+					if pool.Pause() {
+						log.Info("Received pause signal, finishing in-flight images and holding the queue")
+					}
+				} else if pool.Resume() {
+					log.Info("Received resume signal, starting queued images again")
+				}
+			}
+		}
+	}()
+}
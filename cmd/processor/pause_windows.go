@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no user signals, so the pool can't be paused by one
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// whether the arguments ask for pipe mode: a lone "-" for stdin
+func pipeMode(args []string) bool {
+	return len(args) == 1 && args[0] == "-"
+}
+
+// read one image from stdin, run the pipeline on it and write its first
+// output to stdout, so the tool composes with shell pipelines
+func runPipe(cfg *config.Config, log logger.Logger) {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+
+	if err := pipe(ctx, proc, os.Stdin, os.Stdout, cfg.MaxFileSize); err != nil {
+		log.WithError(err).Fatal("Failed to process stdin")
+	}
+}
+
+// process the image read from in, of at most maxSize bytes, and copy its
+// first output to out
+func pipe(ctx context.Context, proc *processor.Processor, in io.Reader, out io.Writer, maxSize int64) error {
+	data, err := io.ReadAll(io.LimitReader(in, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return fmt.Errorf("%w: input exceeds maximum size %d", processor.ErrFileTooLarge, maxSize)
+	}
+
+	output, _, err := proc.ProcessBytes(ctx, data, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(output); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
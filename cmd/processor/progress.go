@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// how often the progress line is redrawn on a terminal, and printed again
+// when stderr is a file or pipe
+const (
+	progressRedraw   = 100 * time.Millisecond
+	progressInterval = 5 * time.Second
+)
+
+// counts of a run's jobs, from the processor's events
+type progress struct {
+	mu        sync.Mutex
+	terminal  bool
+	start     time.Time
+	printed   time.Time
+	queued    int
+	completed int
+	failed    int
+}
+
+// print a progress line to stderr as proc's jobs finish, redrawn in place
+// on a terminal. The returned function prints the final counts and stops
+func showProgress(proc *processor.Processor) func() {
+	info, err := os.Stderr.Stat()
+	p := &progress{
+		terminal: err == nil && info.Mode()&os.ModeCharDevice != 0,
+		start:    time.Now(),
+	}
+	unsubscribe := proc.Subscribe(p.observe)
+	return func() {
+		unsubscribe()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.print()
+		if p.terminal {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+// count an event, printing the line when it is due
+func (p *progress) observe(e processor.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Event {
+	case processor.EventQueued:
+		p.queued++
+		return
+	case processor.EventCompleted:
+		p.completed++
+	case processor.EventFailed:
+		p.failed++
+	default:
+		return
+	}
+
+	interval := progressInterval
+	if p.terminal {
+		interval = progressRedraw
+	}
+	if time.Since(p.printed) >= interval {
+		p.print()
+	}
+}
+
+func (p *progress) print() {
+	p.printed = time.Now()
+	done := p.completed + p.failed
+	rate := float64(done) / time.Since(p.start).Seconds()
+	line := fmt.Sprintf("processed %d/%d (%d failed, %.1f images/s)", done, p.queued, p.failed, rate)
+	if p.terminal {
+		// clear what's left of a longer line
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", line)
+		return
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// weight of the last interval in the throughput the ETA is estimated from,
+// so the estimate follows a run that speeds up or slows down without
+// jumping with every interval
+const progressSmoothing = 0.3
+
+// counts and in-flight jobs of a run, logged every interval
+type progressLog struct {
+	mu        sync.Mutex
+	log       logger.Logger
+	queued    int
+	completed int
+	failed    int
+	// finished jobs at the last line, and the smoothed images per second
+	lastDone int
+	rate     float64
+	running  map[string]runningJob
+}
+
+// a job a decode worker admitted that hasn't finished
+type runningJob struct {
+	input   string
+	started time.Time
+}
+
+// log a progress line every interval while proc's jobs run, with the
+// finished count, the current throughput, an ETA and the job running the
+// longest. The returned function stops it
+func logProgress(proc *processor.Processor, log logger.Logger, interval time.Duration) func() {
+	p := &progressLog{log: log, running: map[string]runningJob{}}
+	unsubscribe := proc.Subscribe(p.observe)
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				p.report(interval)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-done
+		unsubscribe()
+	}
+}
+
+func (p *progressLog) observe(e processor.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Event {
+	case processor.EventQueued:
+		p.queued++
+	case processor.EventStarted:
+		p.running[e.JobID] = runningJob{input: e.Input, started: e.Time}
+	case processor.EventCompleted:
+		p.completed++
+		delete(p.running, e.JobID)
+	case processor.EventFailed:
+		p.failed++
+		delete(p.running, e.JobID)
+	}
+}
+
+// log the progress over the interval just ended, unless the run is idle
+func (p *progressLog) report(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done := p.completed + p.failed
+	if done == p.lastDone && len(p.running) == 0 {
+		return
+	}
+
+	current := float64(done-p.lastDone) / interval.Seconds()
+	if p.lastDone == 0 && p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate = progressSmoothing*current + (1-progressSmoothing)*p.rate
+	}
+	p.lastDone = done
+
+	fields := map[string]interface{}{
+		"completed":      p.completed,
+		"failed":         p.failed,
+		"queued":         p.queued,
+		"images_per_sec": round2(current),
+	}
+	if remaining := p.queued - done; remaining > 0 && p.rate > 0 {
+		fields["eta"] = time.Duration(float64(remaining) / p.rate * float64(time.Second)).Round(time.Second)
+	}
+	var slowest runningJob
+	for _, job := range p.running {
+		if slowest.input == "" || job.started.Before(slowest.started) {
+			slowest = job
+		}
+	}
+	if slowest.input != "" {
+		fields["in_flight"] = len(p.running)
+		fields["slowest_input"] = slowest.input
+		fields["slowest_running"] = time.Since(slowest.started).Round(time.Millisecond)
+	}
+	p.log.WithFields(fields).Info("Progress")
+}
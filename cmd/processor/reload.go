@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// load the configuration again on SIGHUP, and when the config file changes
+// with config_watch_interval set, until ctx is done. Each one that loads is
+// sent on the channel returned; one that doesn't is logged, and the daemon
+// keeps the configuration it has. The channel is closed once ctx is done
+func watchConfig(ctx context.Context, cfg *config.Config, log logger.Logger) <-chan *config.Config {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reloads := make(chan *config.Config)
+
+	var poll <-chan time.Time
+	if cfg.ConfigWatchInterval > 0 && configSource.file != "" {
+		ticker := time.NewTicker(cfg.ConfigWatchInterval)
+		poll = ticker.C
+		go func() {
+			<-ctx.Done()
+			ticker.Stop()
+		}()
+	}
+
+	go func() {
+		defer close(reloads)
+		defer signal.Stop(hup)
+		modTime := configModTime()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				// the change that prompted it needn't reload again
+				modTime = configModTime()
+				log.Info("Received SIGHUP, reloading configuration")
+			case <-poll:
+				t := configModTime()
+				if t.Equal(modTime) {
+					continue
+				}
+				modTime = t
+				log.WithField("config", configSource.file).Info("Config file changed, reloading configuration")
+			}
+
+			next, err := configSource.load()
+			if err != nil {
+				log.WithError(err).Error("Failed to reload configuration, keeping the current one")
+				continue
+			}
+			keepStartupSettings(cfg, next, log)
+			select {
+			case reloads <- next:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return reloads
+}
+
+// log the settings a reload applied
+func logReload(log logger.Logger, cfg *config.Config) {
+	log.WithFields(map[string]interface{}{
+		"filter":         cfg.Filter,
+		"pipeline":       len(cfg.Pipeline),
+		"workers":        cfg.Workers,
+		"decode_workers": cfg.DecodeWorkers,
+		"encode_workers": cfg.EncodeWorkers,
+	}).Info("Configuration reloaded")
+}
+
+// modification time of the config file, zero without one
+func configModTime() time.Time {
+	if configSource.file == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(configSource.file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// restore in next the settings a daemon only reads at startup, such as its
+// listeners and directories, warning about any that changed
+func keepStartupSettings(cfg, next *config.Config, log logger.Logger) {
+	keep(log, "listen", cfg.Listen, &next.Listen)
+	keep(log, "tls_cert", cfg.TLSCert, &next.TLSCert)
+	keep(log, "tls_key", cfg.TLSKey, &next.TLSKey)
+	keep(log, "debug_listen", cfg.DebugListen, &next.DebugListen)
+	keep(log, "health_listen", cfg.HealthListen, &next.HealthListen)
+	keep(log, "control_socket", cfg.ControlSocket, &next.ControlSocket)
+	keep(log, "health_stall_timeout", cfg.HealthStallTimeout, &next.HealthStallTimeout)
+	keep(log, "input_dir", cfg.InputDir, &next.InputDir)
+	keep(log, "output_dir", cfg.OutputDir, &next.OutputDir)
+	keep(log, "watch_interval", cfg.WatchInterval, &next.WatchInterval)
+	keep(log, "config_watch_interval", cfg.ConfigWatchInterval, &next.ConfigWatchInterval)
+	keep(log, "drain_timeout", cfg.DrainTimeout, &next.DrainTimeout)
+	keep(log, "retention_max_age", cfg.RetentionMaxAge, &next.RetentionMaxAge)
+	keep(log, "retention_max_size", cfg.RetentionMaxSize, &next.RetentionMaxSize)
+	keep(log, "retention_interval", cfg.RetentionInterval, &next.RetentionInterval)
+	keep(log, "log_format", cfg.LogFormat, &next.LogFormat)
+	keep(log, "log_file", cfg.LogFile, &next.LogFile)
+	keep(log, "plugin_dir", cfg.PluginDir, &next.PluginDir)
+	keep(log, "low_priority", cfg.LowPriority, &next.LowPriority)
+	keep(log, "low_priority_cpus", cfg.LowPriorityCPUs, &next.LowPriorityCPUs)
+	keep(log, "low_priority_nice", cfg.LowPriorityNice, &next.LowPriorityNice)
+}
+
+func keep[T comparable](log logger.Logger, name string, value T, next *T) {
+	if *next != value {
+		log.WithField("setting", name).Warn("Setting only changes on restart, ignoring the new value")
+		*next = value
+	}
+}
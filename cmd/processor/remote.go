@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/remote"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// local copies of the remote input and output directories of a run
+type remoteStage struct {
+	// temporary directory holding both, removed by finish
+	dir string
+	// where the output is uploaded, nil for a local output directory
+	output    remote.Backend
+	outputURL string
+	outputDir string
+}
+
+// download a remote input directory and point cfg at local directories in
+// place of remote ones, so the run works on local disk. Only process
+// uploads an output directory, so other modes can't have a remote one
+func stageRemote(ctx context.Context, cfg *config.Config, log logger.Logger) (*remoteStage, error) {
+	s := &remoteStage{}
+	if !remote.IsRemote(cfg.InputDir) && !remote.IsRemote(cfg.OutputDir) {
+		return s, nil
+	}
+	if remote.IsRemote(cfg.InputDir) && cfg.InPlace {
+		return nil, errors.New("in_place isn't supported with a remote input directory")
+	}
+	if remote.IsRemote(cfg.OutputDir) && cfg.Mode != "process" {
+		return nil, fmt.Errorf("a remote output directory isn't supported in %s mode", cfg.Mode)
+	}
+
+	dir, err := os.MkdirTemp("", "imgproc-remote-")
+	if err != nil {
+		return nil, err
+	}
+	s.dir = dir
+
+	if remote.IsRemote(cfg.InputDir) {
+		input, err := remote.Open(cfg.InputDir, cfg.RemoteTimeout)
+		if err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		local := filepath.Join(dir, "input")
+		log.WithField("input_dir", redact(cfg.InputDir)).Info("Downloading remote input directory")
+		if err := input.Download(ctx, local); err != nil {
+			s.cleanup()
+			return nil, fmt.Errorf("failed to download input directory: %w", err)
+		}
+		cfg.InputDir = local
+	}
+
+	if remote.IsRemote(cfg.OutputDir) {
+		output, err := remote.Open(cfg.OutputDir, cfg.RemoteTimeout)
+		if err != nil {
+			s.cleanup()
+			return nil, err
+		}
+		s.output, s.outputURL = output, cfg.OutputDir
+		s.outputDir = filepath.Join(dir, "output")
+		cfg.OutputDir = s.outputDir
+	}
+	return s, nil
+}
+
+// upload the output directory, if it is remote, and remove the local
+// copies. The upload isn't tied to the run's context, so the outputs of a
+// run stopped by a signal still arrive
+func (s *remoteStage) finish(log logger.Logger) error {
+	defer s.cleanup()
+	if s.output == nil {
+		return nil
+	}
+
+	log.WithField("output_dir", redact(s.outputURL)).Info("Uploading output directory")
+	if err := s.output.Upload(context.Background(), s.outputDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to upload output directory: %w", err)
+	}
+	return nil
+}
+
+func (s *remoteStage) cleanup() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// dir, or another URL, with its password masked, for logs
+func redact(dir string) string {
+	if !strings.Contains(dir, "://") {
+		return dir
+	}
+	u, err := url.Parse(dir)
+	if err != nil {
+		return dir
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/diagnostics"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/server"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// serve the pipeline over HTTP until a shutdown signal; requests in flight
+// get up to drain_timeout to finish
+func runServe(cfg *config.Config, log logger.Logger, args []string) {
+	rejectInPlace(cfg, log, "serve")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+	service := proc.StartService(ctx)
+	srv := server.New(cfg, service, log)
+	if cfg.DebugListen != "" {
+		diagnostics.Start(ctx, cfg.DebugListen, service.Stats, srv.CacheStats, log)
+	}
+	startJanitor(ctx, cfg, log)
+	checker := startHealth(ctx, cfg, service, log)
+
+	tlsConfig, err := server.TLSConfig(cfg, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to set up TLS")
+	}
+
+	mux := http.NewServeMux()
+	checker.Register(mux)
+	httpServer := &http.Server{
+		Addr:      cfg.Listen,
+		Handler:   srv.Handler(mux),
+		TLSConfig: tlsConfig,
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	notifyShutdown(sigChan)
+	stopControl := startControl(ctx, cfg, service, requestShutdown, log)
+	defer stopControl()
+
+	go func() {
+		for next := range watchConfig(ctx, cfg, log) {
+			// requests in flight finish with the old pipeline
+			if err := service.Reload(next); err != nil {
+				log.WithError(err).Error("Failed to apply reloaded configuration")
+				continue
+			}
+			srv.Reload(next)
+			logReload(log, next)
+		}
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-sigChan
+		checker.Shutdown()
+
+		if cfg.DrainTimeout == 0 {
+			log.Info("Received shutdown signal, stopping")
+			httpServer.Close()
+			cancel()
+			return
+		}
+
+		log.WithField("drain_timeout", cfg.DrainTimeout).Info("Received shutdown signal, finishing in-flight requests")
+		drainCtx, cancelDrain := context.WithTimeout(ctx, cfg.DrainTimeout)
+		defer cancelDrain()
+		if err := httpServer.Shutdown(drainCtx); err != nil {
+			log.Warn("Drain timeout expired, stopping")
+			httpServer.Close()
+			cancel()
+		}
+	}()
+
+	log.WithFields(map[string]interface{}{
+		"listen":     cfg.Listen,
+		"filter":     cfg.Filter,
+		"workers":    cfg.Workers,
+		"api_keys":   len(cfg.APIKeys),
+		"rate_limit": cfg.RateLimit,
+		"tls":        tlsConfig != nil,
+	}).Info("Starting image server")
+
+	serve := httpServer.ListenAndServe
+	if tlsConfig != nil {
+		// the certificate comes from TLSConfig
+		serve = func() error { return httpServer.ListenAndServeTLS("", "") }
+	}
+	if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Fatal("Failed to serve")
+	}
+	<-stopped
+
+	service.Stop()
+	log.Info("Image server stopped")
+}
+
+// print each transformation path, such as
+// /resize:800x600/plain/https://example.com/a.jpg, with its signature under
+// url_signing_key, ready to append to serve's address
+func runSign(cfg *config.Config, log logger.Logger, args []string) {
+	if cfg.URLSigningKey == "" {
+		log.Fatal("sign needs url_signing_key")
+	}
+	if len(args) == 0 {
+		log.Fatal("sign needs a transformation path, e.g. /resize:800x600/plain/https://example.com/a.jpg")
+	}
+	for _, path := range args {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		fmt.Println("/" + server.SignPath(cfg.URLSigningKey, path) + path)
+	}
+}
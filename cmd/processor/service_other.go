@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// only Windows has a service control manager, see service_windows.go
+func runService(cmd *command, cfg *config.Config, log logger.Logger, args []string) bool {
+	return false
+}
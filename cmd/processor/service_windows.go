@@ -0,0 +1,89 @@
+//go:build windows
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// how long past drain_timeout the service control manager is asked to
+// wait for a stopping service before giving up on it
+const serviceStopMargin = 30 * time.Second
+
+// run cmd under the service control manager when it started the process,
+// reporting whether it did. Stop and shutdown requests shut the command
+// down as SIGTERM does
+func runService(cmd *command, cfg *config.Config, log logger.Logger, args []string) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.WithError(err).Warn("Failed to detect the Windows service control manager")
+		return false
+	}
+	if !isService {
+		return false
+	}
+
+	service := &windowsService{
+		run:  func() { cmd.run(cfg, log, args) },
+		wait: cfg.DrainTimeout + serviceStopMargin,
+		log:  log,
+	}
+	// the name is ignored for a service running in its own process
+	if err := svc.Run(cmd.name, service); err != nil {
+		log.WithError(err).Fatal("Failed to run as a Windows service")
+	}
+	return true
+}
+
+// a command run as a Windows service
+type windowsService struct {
+	run func()
+	// how long the command may take to stop
+	wait time.Duration
+	log  logger.Logger
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run()
+	}()
+
+	// preshutdown gives a draining service more time than shutdown when
+	// Windows shuts down
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	s.log.Info("Running as a Windows service")
+
+	for {
+		select {
+		case <-done:
+			// the command stopped on its own, such as a finished batch
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown, svc.PreShutdown:
+				s.log.Info("Received Windows service stop request")
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(s.wait.Milliseconds())}
+				requestShutdown()
+				select {
+				case <-done:
+				case <-time.After(s.wait):
+					s.log.Warn("Service did not stop in time, exiting")
+				}
+				return false, 0
+			}
+		}
+	}
+}
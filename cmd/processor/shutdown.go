@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// channels notifyShutdown relays shutdown requests to
+var shutdownChans struct {
+	sync.Mutex
+	chans []chan<- os.Signal
+}
+
+// relay requests to shut down to c: SIGINT and SIGTERM, which on Windows
+// also stand for Ctrl+C and Ctrl+Break, closing the console, logging off
+// and shutting down, and a stop request when running as a Windows service
+func notifyShutdown(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	shutdownChans.Lock()
+	defer shutdownChans.Unlock()
+	shutdownChans.chans = append(shutdownChans.chans, c)
+}
+
+// ask the running command to shut down as on SIGTERM
+func requestShutdown() {
+	shutdownChans.Lock()
+	defer shutdownChans.Unlock()
+	for _, c := range shutdownChans.chans {
+		select {
+		case c <- syscall.SIGTERM:
+		default:
+			// a shutdown is already pending
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// size and modification time of a watched file
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// process images added to or changed in the input directory until a
+// shutdown signal. A file is picked up once it looks the same on two scans
+// in a row, so one still being written is left alone
+func runWatch(cfg *config.Config, log logger.Logger, args []string) {
+	rejectInPlace(cfg, log, "watch")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	notifyShutdown(sigChan)
+
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		log.WithError(err).Fatal("Failed to create output directory")
+	}
+	release := lockOutput(cfg, log)
+	defer release()
+
+	proc, err := processor.New(processor.WithConfig(cfg), processor.WithLogger(log))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to initialize processor")
+	}
+	service := proc.StartService(ctx)
+	// the pool is replaced on reloads
+	startDiagnostics(ctx, cfg, service.Stats, log)
+	handlePause(ctx, service, log)
+	stopControl := startControl(ctx, cfg, service, requestShutdown, log)
+	defer stopControl()
+	startJanitor(ctx, cfg, log, cfg.OutputDir)
+	checker := startHealth(ctx, cfg, service, log)
+	checker.Add("input_dir", dirCheck(cfg.InputDir))
+	checker.Add("output_dir", dirCheck(cfg.OutputDir))
+
+	log.WithFields(map[string]interface{}{
+		"input_dir":  cfg.InputDir,
+		"output_dir": cfg.OutputDir,
+		"filter":     cfg.Filter,
+		"interval":   cfg.WatchInterval,
+	}).Info("Watching input directory")
+
+	// outputs written inside the input directory aren't inputs
+	outputDir, _ := filepath.Abs(cfg.OutputDir)
+
+	reloads := watchConfig(ctx, cfg, log)
+	// the discovery settings of the current configuration
+	discovery := cfg
+
+	seen := map[string]fileState{}
+	done := map[string]fileState{}
+	var wg sync.WaitGroup
+
+	ticker := time.NewTicker(cfg.WatchInterval)
+	defer ticker.Stop()
+
+scan:
+	for {
+		files, err := findImageFiles(discovery, cfg.InputDir)
+		if err != nil {
+			log.WithError(err).Warn("Failed to scan input directory")
+		}
+
+		for _, path := range files {
+			if abs, err := filepath.Abs(path); err == nil && strings.HasPrefix(abs, outputDir+string(filepath.Separator)) {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			state := fileState{size: info.Size(), modTime: info.ModTime()}
+			if done[path] == state {
+				continue
+			}
+			if seen[path] != state {
+				seen[path] = state
+				continue
+			}
+
+			done[path] = state
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				result, err := service.Process(ctx, path, cfg.OutputDir)
+				if err != nil {
+					log.WithError(err).WithField("file", path).Warn("Image not processed")
+					return
+				}
+				logWatchResult(log, result)
+			}(path)
+		}
+
+		select {
+		case <-sigChan:
+			break scan
+		case next := <-reloads:
+			// images in flight finish with the old pipeline
+			if err := service.Reload(next); err != nil {
+				log.WithError(err).Error("Failed to apply reloaded configuration")
+				continue
+			}
+			discovery = next
+			logReload(log, next)
+		case <-ticker.C:
+		}
+	}
+
+	// stop scanning, then give images in flight drain_timeout to finish
+	checker.Shutdown()
+	if cfg.DrainTimeout == 0 {
+		log.Info("Received shutdown signal, stopping")
+		cancel()
+	} else {
+		log.WithField("drain_timeout", cfg.DrainTimeout).Info("Received shutdown signal, finishing in-flight images")
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-sigChan:
+			log.Warn("Received second shutdown signal, stopping")
+			cancel()
+		case <-time.After(cfg.DrainTimeout):
+			log.Warn("Drain timeout expired, stopping")
+			cancel()
+		}
+	}
+	wg.Wait()
+
+	service.Stop()
+	log.Info("Watch stopped")
+}
+
+// log the outcome of one watched image
+func logWatchResult(log logger.Logger, result models.ProcessingResult) {
+	if result.Error != nil {
+		log.WithError(result.Error).WithField("file", result.InputPath).Error("failed to process image")
+		return
+	}
+	log.WithFields(map[string]interface{}{
+		"input":    result.InputPath,
+		"output":   result.OutputPath,
+		"duration": result.ProcessingTime,
+		"cached":   result.Cached,
+	}).Info("Successfully processed image")
+}
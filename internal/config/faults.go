@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FaultSpec sets how often fault injection fails decodes, delays jobs by
+// SlowDelay and panics inside a filter worker. Rates are probabilities per
+// job; a non-zero Seed fails the same jobs on every run
+type FaultSpec struct {
+	DecodeRate float64
+	SlowRate   float64
+	SlowDelay  time.Duration
+	PanicRate  float64
+	Seed       int64
+}
+
+// ParseFaultSpec parses comma-separated key=value pairs such as
+// "decode=0.1,slow=0.05,delay=2s,panic=0.01,seed=42"
+func ParseFaultSpec(s string) (FaultSpec, error) {
+	spec := FaultSpec{SlowDelay: time.Second}
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return spec, fmt.Errorf("invalid fault %q: expected key=value", field)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "decode":
+			spec.DecodeRate, err = parseRate(value)
+		case "slow":
+			spec.SlowRate, err = parseRate(value)
+		case "panic":
+			spec.PanicRate, err = parseRate(value)
+		case "delay":
+			spec.SlowDelay, err = time.ParseDuration(value)
+			if err == nil && spec.SlowDelay < 0 {
+				err = fmt.Errorf("delay cannot be negative")
+			}
+		case "seed":
+			spec.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return spec, fmt.Errorf("unknown fault %q: must be decode, slow, delay, panic, or seed", key)
+		}
+		if err != nil {
+			return spec, fmt.Errorf("invalid fault %s: %w", key, err)
+		}
+	}
+
+	return spec, nil
+}
+
+// probability between 0 and 1
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate %v must be between 0 and 1", rate)
+	}
+	return rate, nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/expr"
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+	"github.com/arsalan9702/concurrent-image-processor/internal/plugins"
+)
+
+// default every setting of the registered filters
+func setFilterDefaults(v *viper.Viper) {
+	for _, p := range filterspec.Params() {
+		v.SetDefault(p.Key, p.Default)
+	}
+}
+
+// the index in Config of the field with each mapstructure key
+var configFields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("mapstructure")] = i
+	}
+	return fields
+}()
+
+// check the settings of every registered filter against their schema. The
+// required ones are only checked for the configured filter
+func (c *Config) validateFilters(v *validator) {
+	values := reflect.ValueOf(c).Elem()
+	for _, f := range filterspec.All() {
+		used := c.Filter == f.Name
+		for _, p := range f.Params {
+			if p.Key == "" {
+				continue
+			}
+			i, ok := configFields[p.Key]
+			if !ok {
+				continue
+			}
+			checkParam(v, p.Key, p, values.Field(i).Interface(), used, f.Name)
+		}
+		if f.Custom {
+			settings := c.CustomParams(f.Name)
+			for _, p := range f.Params {
+				checkParam(v, "filters."+f.Name+"."+p.Name, p, settings[p.Name], used, f.Name)
+			}
+		}
+	}
+}
+
+// check value, which has the Go type of the setting or is a string for
+// custom filters, as a setting of type p.Type
+func checkParam(v *validator, field string, p filterspec.Param, value interface{}, used bool, filter string) {
+	switch p.Type {
+	case filterspec.Int, filterspec.Float, filterspec.Duration:
+		n, ok := number(value)
+		if !ok {
+			v.check(false, field, value, "must be a number")
+			return
+		}
+		if reason := p.CheckRange(n); reason != "" {
+			v.check(false, field, value, reason)
+		}
+		return
+	case filterspec.Command:
+		command, _ := value.([]string)
+		if s, ok := value.(string); ok && s != "" {
+			command = []string{s}
+		}
+		v.check(!used || !p.Required || len(command) > 0 && command[0] != "", field, nil, "is required by "+filter)
+		return
+	}
+
+	s := fmt.Sprint(value)
+	if s == "" && len(p.Values) == 0 {
+		v.check(!used || !p.Required, field, nil, "is required by "+filter)
+		return
+	}
+	switch p.Type {
+	case filterspec.Length:
+		_, _, err := ParseLength(s)
+		v.check(err == nil, field, value, "must be a non-negative pixel value or percentage")
+	case filterspec.Color:
+		_, err := ParseColor(s)
+		v.parsed(field, value, err)
+	case filterspec.Aspect:
+		_, err := ParseAspect(s)
+		v.parsed(field, value, err)
+	case filterspec.Expression:
+		_, err := expr.Compile(s)
+		v.parsed(field, value, err)
+	default:
+		if len(p.Values) > 0 {
+			v.oneOf(field, s, p.Values...)
+		}
+	}
+}
+
+// value as a number, durations in nanoseconds
+func number(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case time.Duration:
+		return float64(n), true
+	case string:
+		if d, err := time.ParseDuration(n); err == nil {
+			return float64(d), true
+		}
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// CustomParams returns the settings a custom filter runs with: the
+// defaults it declares, overridden by those of its filters section and
+// pipeline step
+func (c *Config) CustomParams(filter string) map[string]string {
+	f, _ := filterspec.Lookup(filter)
+	if len(f.Params) == 0 {
+		return c.PluginParams[filter]
+	}
+	settings := map[string]string{}
+	for _, p := range f.Params {
+		if p.Key == "" {
+			settings[p.Name] = fmt.Sprint(p.Default)
+		}
+	}
+	for key, value := range c.PluginParams[filter] {
+		settings[key] = value
+	}
+	return settings
+}
+
+// the settings of the filters section, by filter then by setting, built
+// from the registry. Custom filters' settings have no flat key, so they
+// aren't among them
+func filterSections() map[string]map[string]sectionSetting {
+	groups := map[string]map[string]sectionSetting{}
+	for _, f := range filterspec.All() {
+		for _, p := range f.Params {
+			if p.Key == "" {
+				continue
+			}
+			if groups[f.Name] == nil {
+				groups[f.Name] = map[string]sectionSetting{}
+			}
+			groups[f.Name][p.Name] = sectionSetting{p.Key, p.Doc}
+		}
+	}
+	return groups
+}
+
+// register the filters of the loaded plugins, as custom filters with the
+// settings they describe. Plugins are only loaded once, so filters already
+// registered by an earlier load are left alone
+func registerPluginFilters() error {
+	for _, name := range plugins.Names() {
+		if f, ok := filterspec.Lookup(name); ok {
+			if f.Custom {
+				continue
+			}
+			return fmt.Errorf("plugin filter %q has the name of a built-in filter", name)
+		}
+
+		f := filterspec.Filter{Name: name, Doc: "plugin filter", Custom: true}
+		filter, _ := plugins.Lookup(name)
+		if d, ok := filter.(plugins.Describer); ok {
+			f.Doc = d.Doc()
+			settings := d.Settings()
+			names := make([]string, 0, len(settings))
+			for setting := range settings {
+				names = append(names, setting)
+			}
+			sort.Strings(names)
+			for _, setting := range names {
+				f.Params = append(f.Params, filterspec.Param{Name: setting, Type: filterspec.String, Default: settings[setting]})
+			}
+		}
+		if err := filterspec.Register(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
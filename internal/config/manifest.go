@@ -0,0 +1,200 @@
+package config
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+)
+
+// ManifestEntry is one job of a manifest: an input with its own output
+// path or directory, filter or pipeline, and parameter overrides. Params
+// uses the keys of the top-level configuration; unset fields fall back to
+// the configuration
+type ManifestEntry struct {
+	Input     string                 `json:"input"`
+	Output    string                 `json:"output,omitempty"`
+	OutputDir string                 `json:"output_dir,omitempty"`
+	Filter    string                 `json:"filter,omitempty"`
+	Pipeline  []PipelineStep         `json:"pipeline,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	// high, normal or low; empty keeps the configured priority
+	Priority string `json:"priority,omitempty"`
+}
+
+// LoadManifest reads the jobs of a JSON or CSV manifest, chosen by the
+// file's extension, and validates each against c. A JSON manifest is an
+// array of entries; a CSV manifest has a header row naming input, output,
+// output_dir, filter, priority and parameter columns, and empty cells are
+// left unset
+func LoadManifest(path string, c *Config) ([]ManifestEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []ManifestEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(file)
+		decoder.UseNumber()
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON manifest: %w", err)
+		}
+	case ".csv":
+		if entries, err = readCSVManifest(file); err != nil {
+			return nil, fmt.Errorf("invalid CSV manifest: %w", err)
+		}
+	default:
+		return nil, errors.New("manifest must be a .json or .csv file")
+	}
+
+	for i, entry := range entries {
+		if _, err := c.JobConfig(entry); err != nil {
+			return nil, fmt.Errorf("manifest entry %d: %w", i+1, err)
+		}
+	}
+	return entries, nil
+}
+
+func readCSVManifest(r io.Reader) ([]ManifestEntry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var entries []ManifestEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := ManifestEntry{Params: map[string]interface{}{}}
+		for i, value := range record {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			switch header[i] {
+			case "input":
+				entry.Input = value
+			case "output":
+				entry.Output = value
+			case "output_dir":
+				entry.OutputDir = value
+			case "filter":
+				entry.Filter = value
+			case "priority":
+				entry.Priority = value
+			default:
+				entry.Params[header[i]] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// settings a job message may set besides the filter, encoder and decoder
+// settings of the sections
+var jobKeys = []string{"output_format", "keep_icc_profile"}
+
+// CheckJobParams reports params of entry, and of its pipeline steps, that a
+// job from a queue mustn't set. Only filter, encoder and decoder settings
+// are taken, leaving out commands such as exec_command, so whoever can
+// publish a job can't run programs, load plugins, or change where files
+// are written or sent
+func CheckJobParams(entry ManifestEntry) error {
+	allowed := map[string]bool{}
+	for _, key := range jobKeys {
+		allowed[key] = true
+	}
+	for _, section := range sectionList {
+		for group, settings := range sectionGroups(section) {
+			for name, setting := range settings {
+				if jobSetting(section, group, name) {
+					allowed[setting.key] = true
+				}
+			}
+		}
+	}
+
+	v := &validator{}
+	for key := range entry.Params {
+		v.check(allowed[key], "params."+key, nil, "can't be set by a job")
+	}
+	for i, step := range entry.Pipeline {
+		custom := false
+		if f, ok := filterspec.Lookup(step.Filter); ok {
+			custom = f.Custom
+		}
+		for key := range step.Params {
+			flat := key
+			if setting, ok := filterSections()[step.Filter][key]; ok {
+				flat = setting.key
+			}
+			// a custom filter's own settings aren't configuration keys
+			ok := allowed[flat] || custom && !configKeys[key]
+			v.check(ok, fmt.Sprintf("pipeline[%d].params.%s", i, key), nil, "can't be set by a job")
+		}
+	}
+	return v.err()
+}
+
+// whether a job may set a section setting: every one but commands
+func jobSetting(section, group, name string) bool {
+	if section != "filters" {
+		return true
+	}
+	f, ok := filterspec.Lookup(group)
+	if !ok {
+		return false
+	}
+	p, ok := f.Param(name)
+	return ok && p.Type != filterspec.Command
+}
+
+// JobConfig returns a validated copy of the configuration with the entry's
+// filter or pipeline and parameters applied. A filter or pipeline replaces
+// the configured pipeline and its outputs
+func (c *Config) JobConfig(entry ManifestEntry) (*Config, error) {
+	if entry.Input == "" {
+		return nil, errors.New("input is required")
+	}
+
+	jobCfg := *c
+	if entry.Filter != "" || len(entry.Pipeline) > 0 {
+		jobCfg.Filter = entry.Filter
+		jobCfg.Pipeline = entry.Pipeline
+		jobCfg.PipelineOutputs = nil
+	}
+	if err := jobCfg.override(entry.Params); err != nil {
+		return nil, err
+	}
+	if entry.Priority != "" {
+		jobCfg.Priority = entry.Priority
+	}
+
+	if err := jobCfg.Validate(); err != nil {
+		return nil, err
+	}
+	if entry.Output != "" && len(jobCfg.Outputs()) > 1 {
+		return nil, errors.New("output can't be set for a pipeline with several outputs, use output_dir")
+	}
+	return &jobCfg, nil
+}
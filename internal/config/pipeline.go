@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// SourceNode is the id of the decoded input in a pipeline
+const SourceNode = "decode"
+
+// PipelineStep is one filter of a pipeline. Params uses the same keys as the
+// top-level configuration, such as blur_radius or resize_width, or those of
+// the filter's section, such as radius for blur, and overrides them for this
+// step only. Input names the step whose result it filters,
+// defaulting to the previous step, so steps form a DAG that can branch after
+// shared work
+type PipelineStep struct {
+	ID     string                 `mapstructure:"id"`
+	Input  string                 `mapstructure:"input"`
+	Filter string                 `mapstructure:"filter"`
+	Params map[string]interface{} `mapstructure:"params"`
+}
+
+// PipelineOutput writes the result of a step, or of decode, as a separate
+// file named <input>_<name>. Format is jpeg, png or tiff; empty keeps the
+// input format
+type PipelineOutput struct {
+	Name   string `mapstructure:"name"`
+	From   string `mapstructure:"from"`
+	Format string `mapstructure:"format"`
+}
+
+// Steps returns the configured pipeline, or the single configured filter,
+// with ids and inputs filled in
+func (c *Config) Steps() []PipelineStep {
+	if len(c.Pipeline) == 0 {
+		// an empty filter only converts images
+		if c.Filter == "" {
+			return nil
+		}
+		return []PipelineStep{{ID: "step1", Input: SourceNode, Filter: c.Filter}}
+	}
+
+	steps := make([]PipelineStep, len(c.Pipeline))
+	previous := SourceNode
+	for i, step := range c.Pipeline {
+		if step.ID == "" {
+			step.ID = fmt.Sprintf("step%d", i+1)
+		}
+		if step.Input == "" {
+			step.Input = previous
+		}
+		steps[i] = step
+		previous = step.ID
+	}
+	return steps
+}
+
+// Outputs returns the configured outputs, or a single unnamed output of the
+// last step, or of the decoded image without steps, in output_format
+func (c *Config) Outputs() []PipelineOutput {
+	if len(c.PipelineOutputs) > 0 {
+		return c.PipelineOutputs
+	}
+
+	from := SourceNode
+	if steps := c.Steps(); len(steps) > 0 {
+		from = steps[len(steps)-1].ID
+	}
+	return []PipelineOutput{{From: from, Format: c.OutputFormat}}
+}
+
+// StepConfig returns a validated copy of the configuration with the step's
+// filter and parameter overrides applied
+func (c *Config) StepConfig(step PipelineStep) (*Config, error) {
+	stepCfg := *c
+	stepCfg.Filter = step.Filter
+	stepCfg.Pipeline = nil
+	stepCfg.PipelineOutputs = nil
+
+	if err := stepCfg.override(c.filterParams(step.Filter, step.Params)); err != nil {
+		return nil, err
+	}
+
+	if err := stepCfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &stepCfg, nil
+}
+
+// set the fields named by the configuration keys in params
+func (c *Config) override(params map[string]interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		// slices and maps are shared with the copied configuration, so
+		// they're replaced rather than written into
+		ZeroFields: true,
+		Result:     c,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(params)
+}
+
+// filters whose result differs in size from their input, which tiles mode
+// can't cut into the tiles of the input
+var resizingFilters = map[string]bool{
+	"resize":      true,
+	"crop":        true,
+	"smart-crop":  true,
+	"drop-shadow": true,
+	"outer-glow":  true,
+}
+
+// validate step parameters and that every input and output refers to an
+// earlier step, which keeps the graph acyclic
+func (c *Config) validatePipeline(v *validator) {
+	// invalid settings a step inherits are reported once, for the
+	// configuration
+	invalid := map[string]interface{}{}
+	for _, err := range v.errs {
+		invalid[err.Field] = err.Value
+	}
+
+	known := map[string]bool{SourceNode: true}
+	for i, step := range c.Steps() {
+		field := fmt.Sprintf("pipeline[%d]", i)
+		v.check(!known[step.ID], field+".id", step.ID, "must be unique")
+		v.check(known[step.Input], field+".input", step.Input, "must be an earlier step")
+		// the implicit single-filter step is the configuration itself
+		if len(c.Pipeline) > 0 {
+			v.check(step.Filter != "", field+".filter", nil, "is required")
+			if _, err := c.StepConfig(step); err != nil {
+				var errs ValidationErrors
+				if !errors.As(err, &errs) {
+					v.parsed(field+".params", nil, err)
+				}
+				for _, e := range errs {
+					if value, ok := invalid[e.Field]; !ok || value != e.Value {
+						e.Field = field + "." + e.Field
+						v.errs = append(v.errs, e)
+					}
+				}
+			}
+		}
+		filterField := field + ".filter"
+		if len(c.Pipeline) == 0 {
+			filterField = "filter"
+		}
+		v.check(c.Mode != "tiles" || !resizingFilters[step.Filter], filterField, step.Filter, "changes the image size, which tiles mode doesn't support")
+		known[step.ID] = true
+	}
+
+	names := map[string]bool{}
+	for i, output := range c.PipelineOutputs {
+		field := fmt.Sprintf("outputs[%d]", i)
+		v.check(output.Name != "", field+".name", nil, "is required")
+		v.check(output.Name == "" || !names[output.Name], field+".name", output.Name, "must be unique")
+		names[output.Name] = true
+
+		v.check(known[output.From], field+".from", output.From, "must be a pipeline step or "+SourceNode)
+		v.oneOf(field+".format", output.Format, "", "jpeg", "png", "tiff")
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+	"github.com/arsalan9702/concurrent-image-processor/internal/plugins"
+)
+
+// sections groups settings by the encoder, decoder or filter they belong
+// to, as nested keys such as encoders.jpeg.quality or filters.blur.radius.
+// Each stands for a flat key, which still works and is what pipeline step
+// params and flags set; the nested key wins when both are given. The
+// filters section comes from the filter registry, see sectionGroups
+var sections = map[string]map[string]map[string]sectionSetting{
+	"encoders": {
+		"jpeg": {"quality": {"quality", "1 to 100"}},
+		"png":  {"compression": {"png_compression", "default, none, speed or best"}},
+		"tiff": {"compression": {"tiff_compression", "deflate or none"}},
+	},
+	"decoders": {
+		"dicom": {
+			"window_center": {"dicom_window_center", "window/level override"},
+			"window_width":  {"dicom_window_width", "0 uses the window stored in the file"},
+		},
+		"fits": {
+			"stretch":   {"fits_stretch", "linear, log or asinh"},
+			"bit_depth": {"fits_bit_depth", "8 or 16"},
+		},
+	},
+}
+
+// the flat key a section setting stands for, and what values it takes
+type sectionSetting struct {
+	key string
+	doc string
+}
+
+// the names of the sections, in the order of generated config files
+var sectionList = []string{"encoders", "decoders", "filters"}
+
+// the groups of a section, nil for names that aren't sections
+func sectionGroups(section string) map[string]map[string]sectionSetting {
+	if section == "filters" {
+		return filterSections()
+	}
+	return sections[section]
+}
+
+// the nested section key a flat key has, such as filters.blur.radius for
+// blur_radius
+func sectionName(key string) (string, bool) {
+	for _, section := range sectionList {
+		for group, settings := range sectionGroups(section) {
+			for name, setting := range settings {
+				if setting.key == key {
+					return section + "." + group + "." + name, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// apply the nested keys set in the config file over the flat fields they
+// stand for. Keys the sections don't define are reported together. A custom
+// filter's section holds whatever settings it takes
+func (c *Config) applySections(v *viper.Viper) error {
+	params := map[string]interface{}{}
+	pluginParams := map[string]map[string]string{}
+	unknown := &validator{}
+	for _, key := range v.AllKeys() {
+		section, _, _ := strings.Cut(key, ".")
+		if section != "filters" && sections[section] == nil {
+			continue
+		}
+		if parts := strings.SplitN(key, ".", 3); section == "filters" && len(parts) == 3 {
+			if f, ok := filterspec.Lookup(parts[1]); ok && f.Custom {
+				if pluginParams[parts[1]] == nil {
+					pluginParams[parts[1]] = map[string]string{}
+				}
+				pluginParams[parts[1]][parts[2]] = fmt.Sprint(v.Get(key))
+				continue
+			}
+		}
+		flat, ok := sectionKey(key)
+		unknown.check(ok, key, nil, "is not a setting")
+		params[flat] = v.Get(key)
+	}
+	if err := unknown.err(); err != nil {
+		return err
+	}
+	if err := c.override(params); err != nil {
+		return fmt.Errorf("invalid section settings: %w", err)
+	}
+	for filter, settings := range pluginParams {
+		c.PluginParams = withPluginParams(c.PluginParams, filter, settings)
+	}
+	return nil
+}
+
+// open the plugins of dir and register their filters, which mustn't shadow
+// built-in ones
+func loadPlugins(dir string) error {
+	if err := plugins.Load(dir); err != nil {
+		return fmt.Errorf("failed to load plugins: %w", err)
+	}
+	return registerPluginFilters()
+}
+
+// a copy of all with settings over the settings of filter, so a step's
+// params don't change the configuration it was copied from
+func withPluginParams(all map[string]map[string]string, filter string, settings map[string]string) map[string]map[string]string {
+	merged := make(map[string]map[string]string, len(all)+1)
+	for name, s := range all {
+		merged[name] = s
+	}
+	combined := map[string]string{}
+	for key, value := range all[filter] {
+		combined[key] = value
+	}
+	for key, value := range settings {
+		combined[key] = value
+	}
+	merged[filter] = combined
+	return merged
+}
+
+// the flat key a nested key such as filters.blur.radius stands for
+func sectionKey(key string) (string, bool) {
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	setting, ok := sectionGroups(parts[0])[parts[1]][parts[2]]
+	return setting.key, ok
+}
+
+// the step params of a filter with its section's keys, such as radius for
+// blur, replaced by the flat keys they stand for. Params of a custom filter
+// that aren't configuration keys are its own settings
+func (c *Config) filterParams(filter string, params map[string]interface{}) map[string]interface{} {
+	if f, ok := filterspec.Lookup(filter); ok && f.Custom && len(params) > 0 {
+		translated := map[string]interface{}{}
+		settings := map[string]string{}
+		for key, value := range params {
+			if configKeys[key] {
+				translated[key] = value
+			} else {
+				settings[key] = fmt.Sprint(value)
+			}
+		}
+		translated["plugin_params"] = withPluginParams(c.PluginParams, filter, settings)
+		return translated
+	}
+
+	keys := filterSections()[filter]
+	if len(keys) == 0 || len(params) == 0 {
+		return params
+	}
+	translated := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		if setting, ok := keys[key]; ok {
+			key = setting.key
+		}
+		translated[key] = value
+	}
+	return translated
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+)
+
+// WriteTemplate writes a YAML config file with every setting at its
+// default, commented out so uncommenting a line changes that setting alone.
+// Settings with a section are written in it, with the values they take,
+// and the filter setting lists every filter, so the file follows the code
+func WriteTemplate(w io.Writer) error {
+	cfg, err := Default()
+	if err != nil {
+		return err
+	}
+	defaults := *cfg
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "# image processor configuration, every setting at its default")
+	fmt.Fprintln(out, "# uncomment a line to change it; see the README for what each one does")
+	fmt.Fprintln(out, "# worker counts default to this machine's number of CPUs")
+	fmt.Fprintln(out)
+
+	values := map[string]string{}
+	t := reflect.TypeOf(defaults)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" || key == "-" {
+			continue
+		}
+		value := yamlValue(reflect.ValueOf(defaults).Field(i))
+		values[key] = value
+		if _, ok := sectionName(key); ok {
+			continue
+		}
+
+		line := "# " + key + ": " + value
+		if key == "filter" {
+			line += " # " + list(filterspec.Names()) + "; empty only converts"
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	for _, section := range sectionList {
+		fmt.Fprintf(out, "\n# %s:\n", section)
+		groups := sectionGroups(section)
+		for _, group := range sortedKeys(groups) {
+			fmt.Fprintf(out, "#   %s:\n", group)
+			settings := groups[group]
+			for _, name := range sortedKeys(settings) {
+				setting := settings[name]
+				fmt.Fprintf(out, "#     %s: %s # %s\n", name, values[setting.key], setting.doc)
+			}
+		}
+	}
+	// custom filters' settings are kept as strings, with no flat key
+	for _, f := range filterspec.All() {
+		if !f.Custom || len(f.Params) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "#   %s:\n", f.Name)
+		for _, p := range f.Params {
+			line := fmt.Sprintf("#     %s: %s", p.Name, strconv.Quote(fmt.Sprint(p.Default)))
+			if p.Doc != "" {
+				line += " # " + p.Doc
+			}
+			fmt.Fprintln(out, line)
+		}
+	}
+	return out.Flush()
+}
+
+// the mapstructure keys of Config
+var configKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		keys[t.Field(i).Tag.Get("mapstructure")] = true
+	}
+	return keys
+}()
+
+// v as a YAML value
+func yamlValue(v reflect.Value) string {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return strconv.Quote(d.String())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Float32, reflect.Float64:
+		s := strconv.FormatFloat(v.Float(), 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return "[]"
+		}
+	case reflect.Map:
+		if v.Len() == 0 {
+			return "{}"
+		}
+	}
+	// JSON is YAML too
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+	return string(data)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
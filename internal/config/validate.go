@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldError is an invalid setting: its key, the value it has and what it
+// must be instead
+type FieldError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	field := e.Field
+	if nested, ok := sectionName(e.Field); ok {
+		field += " (" + nested + ")"
+	}
+	switch v := e.Value.(type) {
+	case nil:
+		return field + " " + e.Reason
+	case string:
+		return fmt.Sprintf("%s %s, got %q", field, e.Reason, v)
+	case time.Duration:
+		return fmt.Sprintf("%s %s, got %s", field, e.Reason, v)
+	default:
+		return fmt.Sprintf("%s %s, got %v", field, e.Reason, v)
+	}
+}
+
+// ValidationErrors lists every invalid setting of a configuration, so they
+// can all be fixed at once
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d invalid settings: %s", len(e), strings.Join(messages, "; "))
+}
+
+// validator collects the invalid settings of a configuration
+type validator struct {
+	errs ValidationErrors
+}
+
+// record field as invalid unless ok, with the reason saying what it must be
+func (v *validator) check(ok bool, field string, value interface{}, reason string) {
+	if !ok {
+		v.errs = append(v.errs, FieldError{Field: field, Value: value, Reason: reason})
+	}
+}
+
+// record field as invalid unless value is one of allowed
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.check(false, field, value, "must be "+list(allowed))
+}
+
+// record field as invalid when parsing its value failed with err
+func (v *validator) parsed(field string, value interface{}, err error) {
+	if err != nil {
+		v.check(false, field, value, "is invalid: "+err.Error())
+	}
+}
+
+// the errors collected, nil when there are none
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// allowed values as "a, b, or c", with "" shown as (empty)
+func list(allowed []string) string {
+	quoted := make([]string, len(allowed))
+	for i, a := range allowed {
+		if a == "" {
+			a = "(empty)"
+		}
+		quoted[i] = a
+	}
+	switch len(quoted) {
+	case 1:
+		return quoted[0]
+	case 2:
+		return quoted[0] + " or " + quoted[1]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + ", or " + quoted[len(quoted)-1]
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"text/template"
+)
+
+// events webhooks are called on
+const (
+	// a job failed
+	WebhookJobFailed = "job_failed"
+	// a batch run ended, with its summary
+	WebhookBatchCompleted = "batch_completed"
+)
+
+// Webhook is an HTTP endpoint notified of job failures and batch
+// completion. Template is a text/template of the request body, executed
+// with the event payload; empty sends the payload as JSON. The json
+// function encodes a value as JSON, for strings inside a JSON template
+type Webhook struct {
+	URL string `mapstructure:"url"`
+	// events the webhook is called on; empty for all of them
+	Events   []string          `mapstructure:"events"`
+	Headers  map[string]string `mapstructure:"headers"`
+	Template string            `mapstructure:"template"`
+}
+
+// ParseTemplate parses the webhook's body template, nil if it has none
+func (w Webhook) ParseTemplate() (*template.Template, error) {
+	if w.Template == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(w.Template)
+}
+
+// check the webhooks' URLs, events and templates
+func (c *Config) validateWebhooks(v *validator) {
+	v.check(c.WebhookTimeout > 0, "webhook_timeout", c.WebhookTimeout, "must be positive")
+	v.check(c.WebhookRetries >= 0, "webhook_retries", c.WebhookRetries, "cannot be negative")
+
+	for i, hook := range c.Webhooks {
+		field := fmt.Sprintf("webhooks[%d]", i)
+		u, err := url.Parse(hook.URL)
+		v.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", field+".url", hook.URL, "must be an http or https URL")
+		for j, event := range hook.Events {
+			v.oneOf(fmt.Sprintf("%s.events[%d]", field, j), event, WebhookJobFailed, WebhookBatchCompleted)
+		}
+		_, err = hook.ParseTemplate()
+		v.parsed(field+".template", nil, err)
+	}
+}
@@ -0,0 +1,229 @@
+// Package control serves commands for a running process on a Unix domain
+// socket, so operators and tooling can inspect and steer a long-lived watch
+// or serve instance without signals or restarts
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// how long Send waits for the process to answer
+const sendTimeout = 10 * time.Second
+
+// Target is the worker pool commands act on: a batch run's processor or a
+// daemon's service
+type Target interface {
+	Stats() processor.PoolStats
+	Pause() bool
+	Resume() bool
+	Resize(sizes processor.PoolSizes) (processor.PoolSizes, error)
+}
+
+// Response is the JSON line answering each command
+type Response struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// whether pause or resume changed the pool's state
+	Changed *bool `json:"changed,omitempty"`
+	// pool state, for status
+	Pool *processor.PoolStats `json:"pool,omitempty"`
+	// worker counts after workers
+	Workers *processor.PoolSizes `json:"workers,omitempty"`
+}
+
+// Server answers the commands of one socket
+type Server struct {
+	listener net.Listener
+	target   Target
+	drain    func()
+	log      logger.Logger
+}
+
+// Start listens on the socket at path, readable only by its owner, and
+// serves commands on target until ctx is done or Close. drain runs on the
+// drain command. A socket left behind by a process that died is replaced;
+// one still answering is an error, as is failing to listen
+func Start(ctx context.Context, path string, target Target, drain func(), log logger.Logger) (*Server, error) {
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	s := &Server{
+		listener: listener,
+		target:   target,
+		drain:    drain,
+		log:      log.WithField("control_socket", path),
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	go func() {
+		s.log.Info("Serving control socket")
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.log.WithError(err).Error("Control socket failed")
+				}
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// Close stops taking commands and removes the socket. Commands being run
+// finish
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// remove a socket at path that nothing answers on
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("control socket %s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+	return nil
+}
+
+// answer each line of conn with a Response line until the client hangs up
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := enc.Encode(s.run(line)); err != nil {
+			return
+		}
+	}
+}
+
+// run one command line
+func (s *Server) run(line string) Response {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+	log := s.log.WithField("command", line)
+
+	switch name {
+	case "status":
+		stats := s.target.Stats()
+		return Response{OK: true, Pool: &stats}
+	case "pause":
+		changed := s.target.Pause()
+		if changed {
+			log.Info("Paused over control socket, finishing in-flight images and holding the queue")
+		}
+		return Response{OK: true, Changed: &changed}
+	case "resume":
+		changed := s.target.Resume()
+		if changed {
+			log.Info("Resumed over control socket, starting queued images again")
+		}
+		return Response{OK: true, Changed: &changed}
+	case "workers":
+		sizes, err := ParseSizes(args)
+		if err != nil {
+			return Response{Error: err.Error()}
+		}
+		workers, err := s.target.Resize(sizes)
+		if err != nil {
+			return Response{Error: err.Error()}
+		}
+		return Response{OK: true, Workers: &workers}
+	case "drain":
+		log.Info("Drain requested over control socket")
+		s.drain()
+		return Response{OK: true}
+	default:
+		return Response{Error: fmt.Sprintf("unknown command %q, expected status, pause, resume, workers or drain", name)}
+	}
+}
+
+// ParseSizes reads the arguments of the workers command: stage=count pairs
+// such as decode=2 filter=8, or a bare count of filter workers. Stages not
+// given are left at zero
+func ParseSizes(args []string) (processor.PoolSizes, error) {
+	var sizes processor.PoolSizes
+	if len(args) == 0 {
+		return sizes, errors.New("workers needs counts, e.g. workers decode=2 filter=8 encode=2")
+	}
+	for _, arg := range args {
+		stage, value, found := strings.Cut(arg, "=")
+		if !found {
+			stage, value = "filter", arg
+		}
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return sizes, fmt.Errorf("invalid worker count %q, expected a positive number", value)
+		}
+		switch stage {
+		case "decode":
+			sizes.Decode = count
+		case "filter":
+			sizes.Filter = count
+		case "encode":
+			sizes.Encode = count
+		default:
+			return sizes, fmt.Errorf("unknown stage %q, expected decode, filter or encode", stage)
+		}
+	}
+	return sizes, nil
+}
+
+// Send runs command on the process serving the socket at path and returns
+// its response
+func Send(path, command string) (Response, error) {
+	var resp Response
+	conn, err := net.DialTimeout("unix", path, sendTimeout)
+	if err != nil {
+		return resp, fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return resp, fmt.Errorf("failed to send command: %w", err)
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,97 @@
+// Package diagnostics serves net/http/pprof together with runtime and worker
+// pool state on a separate listener, for diagnosing stalls in long runs
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/server"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// Stats is the state reported at /debug/stats
+type Stats struct {
+	Uptime     string              `json:"uptime"`
+	Goroutines int                 `json:"goroutines"`
+	GOMAXPROCS int                 `json:"gomaxprocs"`
+	Memory     MemoryStats         `json:"memory"`
+	Pool       processor.PoolStats `json:"pool"`
+	// metrics of the serve command's response cache, when it has one
+	ResponseCache *server.CacheStats `json:"response_cache,omitempty"`
+}
+
+// MemoryStats is the part of runtime.MemStats useful for spotting leaks and
+// GC pressure
+type MemoryStats struct {
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+}
+
+// Handler serves the pprof profiles under /debug/pprof/ and Stats, with the
+// pool state from pool and, when not nil, the response cache metrics from
+// cache, at /debug/stats
+func Handler(pool func() processor.PoolStats, cache func() *server.CacheStats) http.Handler {
+	started := time.Now()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("GET /debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		stats := Stats{
+			Uptime:     time.Since(started).Round(time.Second).String(),
+			Goroutines: runtime.NumGoroutine(),
+			GOMAXPROCS: runtime.GOMAXPROCS(0),
+			Memory: MemoryStats{
+				HeapAlloc:    m.HeapAlloc,
+				HeapInuse:    m.HeapInuse,
+				Sys:          m.Sys,
+				NumGC:        m.NumGC,
+				PauseTotalNs: m.PauseTotalNs,
+			},
+			Pool: pool(),
+		}
+		if cache != nil {
+			stats.ResponseCache = cache()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+	})
+	return mux
+}
+
+// Start serves Handler on addr until ctx is done. Failing to listen is
+// logged, not fatal, since diagnostics are optional
+func Start(ctx context.Context, addr string, pool func() processor.PoolStats, cache func() *server.CacheStats, log logger.Logger) {
+	srv := &http.Server{Addr: addr, Handler: Handler(pool, cache)}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		log.WithField("listen", addr).Info("Serving diagnostics")
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("Diagnostics listener failed")
+		}
+	}()
+}
@@ -0,0 +1,396 @@
+// Package dicom decodes the pixel data of uncompressed DICOM files into
+// 8-bit images, applying the window/level transform and stripping patient
+// identifying tags from the parsed dataset
+package dicom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// transfer syntaxes with uncompressed little-endian pixel data
+const (
+	ImplicitVRLittleEndian = "1.2.840.10008.1.2"
+	ExplicitVRLittleEndian = "1.2.840.10008.1.2.1"
+)
+
+// Tag identifies a data element by group and element number
+type Tag struct {
+	Group   uint16
+	Element uint16
+}
+
+func (t Tag) String() string {
+	return fmt.Sprintf("(%04X,%04X)", t.Group, t.Element)
+}
+
+var (
+	tagTransferSyntax   = Tag{0x0002, 0x0010}
+	tagModality         = Tag{0x0008, 0x0060}
+	tagSamplesPerPixel  = Tag{0x0028, 0x0002}
+	tagPhotometric      = Tag{0x0028, 0x0004}
+	tagRows             = Tag{0x0028, 0x0010}
+	tagColumns          = Tag{0x0028, 0x0011}
+	tagBitsAllocated    = Tag{0x0028, 0x0100}
+	tagPixelRepr        = Tag{0x0028, 0x0103}
+	tagWindowCenter     = Tag{0x0028, 0x1050}
+	tagWindowWidth      = Tag{0x0028, 0x1051}
+	tagRescaleIntercept = Tag{0x0028, 0x1052}
+	tagRescaleSlope     = Tag{0x0028, 0x1053}
+	tagPixelData        = Tag{0x7FE0, 0x0010}
+
+	tagItem          = Tag{0xFFFE, 0xE000}
+	tagItemDelim     = Tag{0xFFFE, 0xE00D}
+	tagSequenceDelim = Tag{0xFFFE, 0xE0DD}
+)
+
+// identifying tags outside the patient group that are removed on anonymization
+var identifyingTags = map[Tag]bool{
+	{0x0008, 0x0050}: true, // accession number
+	{0x0008, 0x0080}: true, // institution name
+	{0x0008, 0x0081}: true, // institution address
+	{0x0008, 0x0090}: true, // referring physician
+	{0x0008, 0x1010}: true, // station name
+	{0x0008, 0x1048}: true, // physician of record
+	{0x0008, 0x1050}: true, // performing physician
+	{0x0008, 0x1070}: true, // operator
+	{0x0020, 0x0010}: true, // study id
+}
+
+var (
+	ErrNotDICOM          = errors.New("not a DICOM file")
+	ErrUnsupportedSyntax = errors.New("unsupported DICOM transfer syntax")
+)
+
+// Dataset holds the top-level data elements of a file, except pixel data
+type Dataset struct {
+	Elements map[Tag][]byte
+	VRs      map[Tag]string
+}
+
+// String returns a text element with padding removed
+func (d *Dataset) String(tag Tag) string {
+	return strings.TrimRight(string(d.Elements[tag]), " \x00")
+}
+
+// Uint16 returns a US element
+func (d *Dataset) Uint16(tag Tag) int {
+	v := d.Elements[tag]
+	if len(v) < 2 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(v))
+}
+
+// Float returns the first value of a decimal string element
+func (d *Dataset) Float(tag Tag, fallback float64) float64 {
+	s := d.String(tag)
+	if i := strings.IndexByte(s, '\\'); i >= 0 {
+		s = s[:i]
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+// Anonymize removes patient identifying elements: the whole patient group
+// (0010,xxxx) and a set of institution, physician and study identifiers
+func (d *Dataset) Anonymize() {
+	for tag := range d.Elements {
+		if tag.Group == 0x0010 || identifyingTags[tag] {
+			delete(d.Elements, tag)
+			delete(d.VRs, tag)
+		}
+	}
+}
+
+// Options controls how stored values are mapped to 8-bit output
+type Options struct {
+	// window centre and width override the values stored in the file when
+	// WindowWidth is positive; without either, the full value range is used
+	WindowCenter float64
+	WindowWidth  float64
+	// leave the identifying elements in the returned dataset instead of
+	// anonymizing it
+	KeepIdentifiers bool
+}
+
+// Decode reads a DICOM file and returns its first frame as an 8-bit image
+// together with its anonymized dataset, unless opts keeps the identifiers
+func Decode(r io.Reader, opts Options) (image.Image, *Dataset, error) {
+	ds, pixels, err := parse(r, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !opts.KeepIdentifiers {
+		ds.Anonymize()
+	}
+
+	img, err := render(ds, pixels, opts)
+	return img, ds, err
+}
+
+// DecodeConfig returns the dimensions without reading pixel data
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	ds, _, err := parse(r, false)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	model := color.Model(color.GrayModel)
+	if ds.Uint16(tagSamplesPerPixel) == 3 {
+		model = color.RGBAModel
+	}
+	return image.Config{ColorModel: model, Width: ds.Uint16(tagColumns), Height: ds.Uint16(tagRows)}, nil
+}
+
+// parse reads the file meta header and dataset up to the pixel data
+func parse(r io.Reader, withPixels bool) (*Dataset, []byte, error) {
+	br := bufio.NewReader(r)
+
+	preamble := make([]byte, 132)
+	if _, err := io.ReadFull(br, preamble); err != nil || string(preamble[128:]) != "DICM" {
+		return nil, nil, ErrNotDICOM
+	}
+
+	ds := &Dataset{Elements: map[Tag][]byte{}, VRs: map[Tag]string{}}
+	p := &parser{r: br, explicit: true, skipPixels: !withPixels}
+
+	// the file meta group is always explicit VR little endian
+	for {
+		next, err := br.Peek(2)
+		if err != nil || binary.LittleEndian.Uint16(next) != 0x0002 {
+			break
+		}
+		if _, err := p.element(ds); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch syntax := ds.String(tagTransferSyntax); syntax {
+	case ExplicitVRLittleEndian, "":
+	case ImplicitVRLittleEndian:
+		p.explicit = false
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedSyntax, syntax)
+	}
+
+	for {
+		tag, err := p.element(ds)
+		if err == io.EOF {
+			return nil, nil, errors.New("no pixel data")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if tag == tagPixelData {
+			if !withPixels {
+				return ds, nil, nil
+			}
+			pixels := ds.Elements[tagPixelData]
+			delete(ds.Elements, tagPixelData)
+			return ds, pixels, nil
+		}
+	}
+}
+
+type parser struct {
+	r          *bufio.Reader
+	explicit   bool
+	skipPixels bool
+}
+
+// element reads one data element into ds, skipping sequence contents
+func (p *parser) element(ds *Dataset) (Tag, error) {
+	tag, vr, length, err := p.header()
+	if err != nil {
+		return tag, err
+	}
+
+	if length == 0xFFFFFFFF {
+		if tag == tagPixelData {
+			return tag, fmt.Errorf("%w: encapsulated pixel data", ErrUnsupportedSyntax)
+		}
+		return tag, p.skipSequence()
+	}
+	if tag == tagPixelData && p.skipPixels {
+		return tag, nil
+	}
+
+	// the length comes from the file, so the value grows with the bytes
+	// actually there rather than being allocated up front
+	value, err := io.ReadAll(io.LimitReader(p.r, int64(length)))
+	if err != nil {
+		return tag, fmt.Errorf("reading %s: %w", tag, err)
+	}
+	if uint32(len(value)) < length {
+		return tag, fmt.Errorf("reading %s: %w", tag, io.ErrUnexpectedEOF)
+	}
+
+	if vr != "SQ" {
+		ds.Elements[tag] = value
+		ds.VRs[tag] = vr
+	}
+	return tag, nil
+}
+
+// header reads a tag, its VR (empty for implicit VR) and value length
+func (p *parser) header() (Tag, string, uint32, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(p.r, buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return Tag{}, "", 0, err
+	}
+
+	tag := Tag{binary.LittleEndian.Uint16(buf), binary.LittleEndian.Uint16(buf[2:])}
+
+	// items and delimiters never carry a VR
+	if !p.explicit || tag.Group == 0xFFFE {
+		return tag, "", binary.LittleEndian.Uint32(buf[4:]), nil
+	}
+
+	vr := string(buf[4:6])
+	switch vr {
+	case "OB", "OD", "OF", "OL", "OW", "SQ", "UC", "UN", "UR", "UT":
+		ext := make([]byte, 4)
+		if _, err := io.ReadFull(p.r, ext); err != nil {
+			return tag, vr, 0, err
+		}
+		return tag, vr, binary.LittleEndian.Uint32(ext), nil
+	default:
+		return tag, vr, uint32(binary.LittleEndian.Uint16(buf[6:])), nil
+	}
+}
+
+// skipSequence discards an undefined-length sequence up to its delimiter
+func (p *parser) skipSequence() error {
+	for {
+		tag, _, length, err := p.header()
+		if err != nil {
+			return err
+		}
+
+		switch tag {
+		case tagSequenceDelim:
+			return nil
+		case tagItem:
+			if length != 0xFFFFFFFF {
+				if _, err := p.r.Discard(int(length)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := p.skipItem(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected %s in sequence", tag)
+		}
+	}
+}
+
+// skipItem discards the elements of an undefined-length item
+func (p *parser) skipItem() error {
+	scratch := &Dataset{Elements: map[Tag][]byte{}, VRs: map[Tag]string{}}
+	for {
+		next, err := p.r.Peek(4)
+		if err != nil {
+			return err
+		}
+		if (Tag{binary.LittleEndian.Uint16(next), binary.LittleEndian.Uint16(next[2:])}) == tagItemDelim {
+			_, _, _, err := p.header()
+			return err
+		}
+		if _, err := p.element(scratch); err != nil {
+			return err
+		}
+	}
+}
+
+// render converts stored pixel values to an 8-bit image
+func render(ds *Dataset, pixels []byte, opts Options) (image.Image, error) {
+	width, height := ds.Uint16(tagColumns), ds.Uint16(tagRows)
+	samples := max(1, ds.Uint16(tagSamplesPerPixel))
+	bits := ds.Uint16(tagBitsAllocated)
+	if width == 0 || height == 0 {
+		return nil, errors.New("missing image dimensions")
+	}
+
+	if samples == 3 {
+		if bits != 8 || len(pixels) < width*height*3 {
+			return nil, errors.New("unsupported color pixel data")
+		}
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for i := 0; i < width*height; i++ {
+			copy(img.Pix[i*4:], pixels[i*3:i*3+3])
+			img.Pix[i*4+3] = 255
+		}
+		return img, nil
+	}
+
+	if bits != 8 && bits != 16 {
+		return nil, fmt.Errorf("unsupported bits allocated: %d", bits)
+	}
+	if len(pixels) < width*height*bits/8 {
+		return nil, errors.New("truncated pixel data")
+	}
+
+	signed := ds.Uint16(tagPixelRepr) == 1
+	slope := ds.Float(tagRescaleSlope, 1)
+	intercept := ds.Float(tagRescaleIntercept, 0)
+
+	values := make([]float64, width*height)
+	low, high := math.Inf(1), math.Inf(-1)
+	for i := range values {
+		var raw float64
+		switch {
+		case bits == 8:
+			raw = float64(pixels[i])
+		case signed:
+			raw = float64(int16(binary.LittleEndian.Uint16(pixels[i*2:])))
+		default:
+			raw = float64(binary.LittleEndian.Uint16(pixels[i*2:]))
+		}
+
+		values[i] = raw*slope + intercept
+		low, high = math.Min(low, values[i]), math.Max(high, values[i])
+	}
+
+	windowCenter, windowWidth := opts.WindowCenter, opts.WindowWidth
+	if windowWidth <= 0 {
+		windowCenter, windowWidth = ds.Float(tagWindowCenter, 0), ds.Float(tagWindowWidth, 0)
+	}
+	if windowWidth <= 0 {
+		windowCenter, windowWidth = (low+high)/2, math.Max(1, high-low)
+	}
+
+	invert := ds.String(tagPhotometric) == "MONOCHROME1"
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i, v := range values {
+		g := (v - (windowCenter - windowWidth/2)) / windowWidth * 255
+		g = math.Max(0, math.Min(255, g))
+		if invert {
+			g = 255 - g
+		}
+		img.Pix[i] = uint8(math.Round(g))
+	}
+
+	return img, nil
+}
+
+// Modality returns the modality of the dataset, such as CT or MR
+func (d *Dataset) Modality() string {
+	return d.String(tagModality)
+}
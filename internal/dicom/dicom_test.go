@@ -0,0 +1,124 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// a DICOM file of the preamble and explicit VR little endian elements
+func dicomFile(elements ...[]byte) []byte {
+	data := append(make([]byte, 128), "DICM"...)
+	for _, e := range elements {
+		data = append(data, e...)
+	}
+	return data
+}
+
+// an element with a 16-bit length
+func element(group, elem uint16, vr string, value []byte) []byte {
+	e := binary.LittleEndian.AppendUint16(nil, group)
+	e = binary.LittleEndian.AppendUint16(e, elem)
+	e = append(e, vr...)
+	e = binary.LittleEndian.AppendUint16(e, uint16(len(value)))
+	return append(e, value...)
+}
+
+// an element with a 32-bit length, which needn't match value
+func longElement(group, elem uint16, vr string, length uint32, value []byte) []byte {
+	e := binary.LittleEndian.AppendUint16(nil, group)
+	e = binary.LittleEndian.AppendUint16(e, elem)
+	e = append(e, vr...)
+	e = append(e, 0, 0)
+	e = binary.LittleEndian.AppendUint32(e, length)
+	return append(e, value...)
+}
+
+func us(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+
+func TestDecode(t *testing.T) {
+	data := dicomFile(
+		element(0x0002, 0x0010, "UI", []byte(ExplicitVRLittleEndian+"\x00")),
+		element(0x0008, 0x0060, "CS", []byte("CT")),
+		element(0x0028, 0x0010, "US", us(2)),
+		element(0x0028, 0x0011, "US", us(2)),
+		element(0x0028, 0x0100, "US", us(8)),
+		longElement(0x7FE0, 0x0010, "OB", 4, []byte{0, 85, 170, 255}),
+	)
+	img, ds, err := Decode(bytes.NewReader(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Modality() != "CT" {
+		t.Errorf("modality %q", ds.Modality())
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Errorf("bounds %v", b)
+	}
+}
+
+// patient, institution and study details are gone from the dataset Decode
+// returns, and kept only when asked for
+func TestDecodeAnonymizes(t *testing.T) {
+	data := dicomFile(
+		element(0x0002, 0x0010, "UI", []byte(ExplicitVRLittleEndian+"\x00")),
+		element(0x0008, 0x0060, "CS", []byte("MR")),
+		element(0x0008, 0x0080, "LO", []byte("St Elsewhere")),
+		element(0x0008, 0x0090, "PN", []byte("House^Gregory")),
+		element(0x0010, 0x0010, "PN", []byte("Doe^Jane")),
+		element(0x0010, 0x0020, "LO", []byte("PID-12345 ")),
+		element(0x0010, 0x0030, "DA", []byte("19700101")),
+		element(0x0020, 0x0010, "SH", []byte("STUDY7")),
+		element(0x0028, 0x0010, "US", us(1)),
+		element(0x0028, 0x0011, "US", us(1)),
+		element(0x0028, 0x0100, "US", us(8)),
+		longElement(0x7FE0, 0x0010, "OB", 2, []byte{128, 0}),
+	)
+	identifying := []Tag{{0x0008, 0x0080}, {0x0008, 0x0090}, {0x0010, 0x0010}, {0x0010, 0x0020}, {0x0010, 0x0030}, {0x0020, 0x0010}}
+
+	_, ds, err := Decode(bytes.NewReader(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range identifying {
+		if v, ok := ds.Elements[tag]; ok {
+			t.Errorf("%s kept as %q", tag, v)
+		}
+		if _, ok := ds.VRs[tag]; ok {
+			t.Errorf("%s kept its VR", tag)
+		}
+	}
+	if ds.Modality() != "MR" {
+		t.Errorf("modality %q, want it kept", ds.Modality())
+	}
+
+	_, ds, err = Decode(bytes.NewReader(data), Options{KeepIdentifiers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := ds.String(Tag{0x0010, 0x0010}); name != "Doe^Jane" {
+		t.Errorf("patient name %q with KeepIdentifiers", name)
+	}
+}
+
+// a length of 4 GB in a file of a few hundred bytes fails on the missing
+// bytes instead of allocating them
+func TestDecodeHugeLength(t *testing.T) {
+	data := dicomFile(
+		element(0x0002, 0x0010, "UI", []byte(ExplicitVRLittleEndian+"\x00")),
+		longElement(0x0008, 0x0100, "UT", 0xFFFFFFF0, []byte("short")),
+	)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := Decode(bytes.NewReader(data), Options{})
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("error %v, want unexpected EOF", err)
+	}
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("allocated %d bytes for a %d-byte file", grown, len(data))
+	}
+}
@@ -0,0 +1,328 @@
+// Package discovery finds the images under an input directory, narrowed by
+// name patterns, extension, size and modification time
+package discovery
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// extensions of the formats the processor decodes
+var supportedExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".bmp":  true,
+	".tiff": true,
+	".tif":  true,
+	".webp": true,
+	".dcm":  true,
+	".fits": true,
+	".fit":  true,
+	".fts":  true,
+}
+
+// Filter narrows the files a walk returns; zero fields don't filter.
+// Patterns are filepath.Match globs matched against the base name, or
+// against the slash-separated path below the walked directory when they
+// contain a slash
+type Filter struct {
+	// files must match one of these, when set
+	Include []string
+	// files and directories matching any of these are skipped
+	Exclude []string
+	// extensions kept, with or without the leading dot
+	Extensions []string
+
+	MinSize int64
+	MaxSize int64
+
+	// files larger than this are skipped as too large to process, unlike
+	// MaxSize which narrows the input
+	MaxFileSize int64
+
+	NewerThan time.Time
+	OlderThan time.Time
+
+	// skip files and directories whose names start with a dot
+	SkipHidden bool
+}
+
+// how a walk treats symbolic links
+const (
+	// links to files are walked, links to directories are not
+	SymlinksFiles = "files"
+	// links to directories are descended into too, once per real directory
+	SymlinksFollow = "follow"
+	// links are ignored
+	SymlinksSkip = "skip"
+)
+
+// Options control how a walk traverses the tree
+type Options struct {
+	// goroutines reading directories; more than one returns files in no
+	// particular order
+	Workers int
+	// one of the Symlinks constants, SymlinksFiles when empty
+	Symlinks string
+	// levels of directories walked, 1 for only the files directly in the
+	// walked directory; 0 is unlimited
+	MaxDepth int
+}
+
+// Skipped counts the entries a walk passed over that the filter wanted but
+// that can't be processed
+type Skipped struct {
+	// files larger than the filter's MaxFileSize
+	TooLarge int `json:"too_large"`
+	// files of formats the processor doesn't decode, and special files
+	Unsupported int `json:"unsupported"`
+	// files that can't be opened, broken links and unreadable directories
+	Unreadable int `json:"unreadable"`
+}
+
+// Total is the number of entries skipped for any reason
+func (s Skipped) Total() int {
+	return s.TooLarge + s.Unsupported + s.Unreadable
+}
+
+// Find walks dir and returns the supported images that pass filter.
+// Unreadable entries are skipped
+func Find(dir string, filter Filter, opts Options) ([]string, error) {
+	var files []string
+	_, err := Walk(dir, filter, opts, func(path string) error {
+		files = append(files, path)
+		return nil
+	})
+	return files, err
+}
+
+// Walk calls fn with each supported image under dir that passes filter, as
+// it is found, so callers can start on the first files before the walk ends.
+// With more than one worker, directories are read concurrently, which hides
+// the latency of network filesystems; fn is never called concurrently. An
+// error from fn stops the walk and is returned, along with the counts of the
+// entries skipped so far
+func Walk(dir string, filter Filter, opts Options, fn func(path string) error) (Skipped, error) {
+	w := &walker{
+		root:    dir,
+		filter:  filter,
+		opts:    opts,
+		fn:      fn,
+		exts:    map[string]bool{},
+		visited: map[string]bool{},
+	}
+	for _, ext := range filter.Extensions {
+		w.exts["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = true
+	}
+	if opts.Symlinks == SymlinksFollow {
+		w.visit(dir)
+	}
+
+	var err error
+	if opts.Workers > 1 {
+		err = w.parallel(opts.Workers)
+	} else {
+		err = w.sequential(dir, 1)
+	}
+	return w.skipped, err
+}
+
+// one walk of a directory tree
+type walker struct {
+	root   string
+	filter Filter
+	opts   Options
+	exts   map[string]bool
+
+	// serializes fn across parallel workers
+	fnMu sync.Mutex
+	fn   func(path string) error
+
+	// real paths of the directories entered when following links, so a
+	// link cycle is walked once
+	visitedMu sync.Mutex
+	visited   map[string]bool
+
+	skippedMu sync.Mutex
+	skipped   Skipped
+}
+
+// walk dir and its subdirectories depth-first, in name order like
+// filepath.Walk
+func (w *walker) sequential(dir string, depth int) error {
+	return w.readDir(dir, depth, func(subdir string) error {
+		return w.sequential(subdir, depth+1)
+	})
+}
+
+// pass the wanted files of dir, at depth levels below the root, to fn and
+// the directories to walk to enter. An unreadable directory or entry is
+// skipped; only errors from fn and enter are returned
+func (w *walker) readDir(dir string, depth int, enter func(subdir string) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.skip(&w.skipped.Unreadable)
+		return nil
+	}
+
+	for _, entry := range entries {
+		if w.filter.SkipHidden && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		isDir := entry.IsDir()
+		var info fs.FileInfo
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if w.opts.Symlinks == SymlinksSkip {
+				continue
+			}
+			// size and time filters apply to the target; broken links are
+			// skipped
+			target, err := os.Stat(path)
+			if err != nil {
+				w.skip(&w.skipped.Unreadable)
+				continue
+			}
+			if target.IsDir() && w.opts.Symlinks != SymlinksFollow {
+				continue
+			}
+			isDir, info = target.IsDir(), target
+		}
+
+		if isDir {
+			if w.opts.MaxDepth > 0 && depth >= w.opts.MaxDepth || w.excluded(path) {
+				continue
+			}
+			if w.opts.Symlinks == SymlinksFollow && !w.visit(path) {
+				continue
+			}
+			if err := enter(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if info == nil {
+			if info, err = entry.Info(); err != nil {
+				w.skip(&w.skipped.Unreadable)
+				continue
+			}
+		}
+		if !w.wanted(path, info) {
+			continue
+		}
+		w.fnMu.Lock()
+		err := w.fn(path)
+		w.fnMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark the real directory behind path as entered, reporting false if it
+// already was
+func (w *walker) visit(path string) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	w.visitedMu.Lock()
+	defer w.visitedMu.Unlock()
+	if w.visited[real] {
+		return false
+	}
+	w.visited[real] = true
+	return true
+}
+
+// path below the root, slash-separated as patterns expect
+func (w *walker) rel(path string) string {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// whether the directory at path is excluded
+func (w *walker) excluded(path string) bool {
+	return matchAny(w.filter.Exclude, w.rel(path))
+}
+
+// count an entry skipped for the reason counter points at
+func (w *walker) skip(counter *int) {
+	w.skippedMu.Lock()
+	*counter++
+	w.skippedMu.Unlock()
+}
+
+// whether the file at path passes the filter and can be processed: a
+// readable regular file of a supported format within MaxFileSize. Files the
+// filter wants but that can't be processed are counted as skipped
+func (w *walker) wanted(path string, info fs.FileInfo) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if len(w.exts) > 0 && !w.exts[ext] || !w.filter.match(w.rel(path), info) {
+		return false
+	}
+	if !supportedExts[ext] || !info.Mode().IsRegular() {
+		w.skip(&w.skipped.Unsupported)
+		return false
+	}
+	if w.filter.MaxFileSize > 0 && info.Size() > w.filter.MaxFileSize {
+		w.skip(&w.skipped.TooLarge)
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		w.skip(&w.skipped.Unreadable)
+		return false
+	}
+	file.Close()
+	return true
+}
+
+// whether a file at rel below the walked directory passes the filter
+func (f Filter) match(rel string, info fs.FileInfo) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, rel) {
+		return false
+	}
+	if matchAny(f.Exclude, rel) {
+		return false
+	}
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if !f.NewerThan.IsZero() && !info.ModTime().After(f.NewerThan) {
+		return false
+	}
+	if !f.OlderThan.IsZero() && !info.ModTime().Before(f.OlderThan) {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
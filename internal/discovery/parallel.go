@@ -0,0 +1,80 @@
+package discovery
+
+import "sync"
+
+// a directory waiting to be read by a parallel walk, and its depth below
+// the root
+type queuedDir struct {
+	path  string
+	depth int
+}
+
+// directories waiting to be read by a parallel walk
+type dirQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	dirs []queuedDir
+	// directories being read, whose subdirectories aren't queued yet
+	active int
+	err    error
+}
+
+// walk the tree with workers goroutines, each taking the next queued
+// directory, passing its files to fn and queueing its subdirectories
+func (w *walker) parallel(workers int) error {
+	q := &dirQueue{dirs: []queuedDir{{path: w.root, depth: 1}}}
+	q.cond = sync.NewCond(&q.mu)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := q.next()
+				if !ok {
+					return
+				}
+
+				var subdirs []queuedDir
+				err := w.readDir(dir.path, dir.depth, func(subdir string) error {
+					subdirs = append(subdirs, queuedDir{path: subdir, depth: dir.depth + 1})
+					return nil
+				})
+				q.done(subdirs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return q.err
+}
+
+// the next directory to read; false once the walk is over or failed
+func (q *dirQueue) next() (queuedDir, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.dirs) == 0 && q.active > 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if len(q.dirs) == 0 || q.err != nil {
+		return queuedDir{}, false
+	}
+
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	q.active++
+	return dir, true
+}
+
+// finish reading a directory, queueing its subdirectories
+func (q *dirQueue) done(subdirs []queuedDir, err error) {
+	q.mu.Lock()
+	q.dirs = append(q.dirs, subdirs...)
+	q.active--
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
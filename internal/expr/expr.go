@@ -0,0 +1,432 @@
+// Package expr compiles the per-pixel color math of the expression filter,
+// such as "r = clamp(r*1.1 + 10); b = b*0.9"
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// channels in the order of RGBA pixel data
+var channels = map[string]int{"r": 0, "g": 1, "b": 2, "a": 3}
+
+// Program is a compiled expression: an assignment to some of the r, g, b
+// and a channels. Every right-hand side sees the input pixel, with channels
+// from 0 to 255, and results are rounded and clamped to that range;
+// channels not assigned are left as they are
+type Program struct {
+	source  string
+	assigns [4]node
+}
+
+// a compiled expression, evaluated against one pixel
+type node func(px *[4]float64) float64
+
+// Compile parses statements of the form channel = expression, separated by
+// semicolons or newlines. Expressions take numbers, the channels, the
+// operators + - * / % ^, comparisons giving 1 or 0, parentheses, and the
+// functions listed in functions
+func Compile(source string) (*Program, error) {
+	p := &parser{source: source}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+
+	program := &Program{source: source}
+	for !p.done() {
+		if p.accept(";") {
+			continue
+		}
+		t := p.next()
+		channel, ok := channels[t.text]
+		if t.kind != identToken || !ok {
+			return nil, p.errorf(t, "cannot assign %s", t.text)
+		}
+		if program.assigns[channel] != nil {
+			return nil, p.errorf(t, "%s is assigned twice", t.text)
+		}
+		if eq := p.next(); eq.text != "=" {
+			return nil, p.errorf(eq, "expected = after %s", t.text)
+		}
+		n, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		program.assigns[channel] = n
+		if !p.done() && !p.accept(";") {
+			return nil, p.errorf(p.peek(), "expected ; or a new line before %s", p.peek().text)
+		}
+	}
+	for _, n := range program.assigns {
+		if n != nil {
+			return program, nil
+		}
+	}
+	return nil, fmt.Errorf("expression assigns no channel")
+}
+
+// Apply runs the program on every pixel of RGBA data
+func (p *Program) Apply(src []uint8) []uint8 {
+	dst := make([]uint8, len(src))
+	var px [4]float64
+	for i := 0; i+3 < len(src); i += 4 {
+		for c := 0; c < 4; c++ {
+			px[c] = float64(src[i+c])
+		}
+		for c, n := range p.assigns {
+			if n == nil {
+				dst[i+c] = src[i+c]
+				continue
+			}
+			dst[i+c] = toByte(n(&px))
+		}
+	}
+	return dst
+}
+
+// String returns the source of the program
+func (p *Program) String() string {
+	return p.source
+}
+
+// MarshalJSON encodes the program as its source, so it identifies the
+// filter in cache keys
+func (p *Program) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.source)
+}
+
+func toByte(v float64) uint8 {
+	if math.IsNaN(v) || v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(math.Round(v))
+}
+
+// functions an expression can call, with the number of arguments they take;
+// -1 is any number from one up
+var functions = map[string]struct {
+	args int
+	fn   func(args []float64) float64
+}{
+	"clamp": {-1, func(a []float64) float64 {
+		// clamp(v) keeps v within 0 to 255, clamp(v, lo, hi) within lo to hi
+		lo, hi := 0.0, 255.0
+		if len(a) == 3 {
+			lo, hi = a[1], a[2]
+		}
+		return math.Max(lo, math.Min(hi, a[0]))
+	}},
+	"min": {-1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	"max": {-1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"if": {3, func(a []float64) float64 {
+		if a[0] != 0 {
+			return a[1]
+		}
+		return a[2]
+	}},
+	// Rec. 601 luma of r, g and b
+	"luma": {3, func(a []float64) float64 { return 0.299*a[0] + 0.587*a[1] + 0.114*a[2] }},
+}
+
+type tokenKind int
+
+const (
+	numberToken tokenKind = iota
+	identToken
+	opToken
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value float64
+	pos   int
+}
+
+type parser struct {
+	source string
+	tokens []token
+	i      int
+}
+
+// split the source into tokens; newlines separate statements like ;
+func (p *parser) lex() error {
+	s := p.source
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case c == '\n':
+			p.tokens = append(p.tokens, token{kind: opToken, text: ";", pos: i})
+			i++
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			v, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q at %d", s[i:j], i+1)
+			}
+			p.tokens = append(p.tokens, token{kind: numberToken, text: s[i:j], value: v, pos: i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, token{kind: identToken, text: s[i:j], pos: i})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(s) && (s[i+1] == '=' && strings.ContainsRune("<>=!", c)) {
+				op = s[i : i+2]
+			} else if !strings.ContainsRune("+-*/%^()=<>,;", c) {
+				return fmt.Errorf("unexpected %q at %d", c, i+1)
+			}
+			p.tokens = append(p.tokens, token{kind: opToken, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+func (p *parser) done() bool {
+	return p.i >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: opToken, text: "end of expression", pos: len(p.source)}
+	}
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.i++
+	return t
+}
+
+// consume the operator op if it comes next
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); !p.done() && t.kind == opToken && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, args...), t.pos+1)
+}
+
+// expression := sum [comparison sum]
+func (p *parser) expression() (node, error) {
+	left, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		compare := map[string]func(a, b float64) bool{
+			"<":  func(a, b float64) bool { return a < b },
+			">":  func(a, b float64) bool { return a > b },
+			"<=": func(a, b float64) bool { return a <= b },
+			">=": func(a, b float64) bool { return a >= b },
+			"==": func(a, b float64) bool { return a == b },
+			"!=": func(a, b float64) bool { return a != b },
+		}[op]
+		return func(px *[4]float64) float64 {
+			if compare(left(px), right(px)) {
+				return 1
+			}
+			return 0
+		}, nil
+	}
+	return left, nil
+}
+
+// sum := product {(+|-) product}
+func (p *parser) sum() (node, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("+"):
+			right, err := p.product()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(px *[4]float64) float64 { return l(px) + right(px) }
+		case p.accept("-"):
+			right, err := p.product()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(px *[4]float64) float64 { return l(px) - right(px) }
+		default:
+			return left, nil
+		}
+	}
+}
+
+// product := unary {(*|/|%) unary}
+func (p *parser) product() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op func(a, b float64) float64
+		switch {
+		case p.accept("*"):
+			op = func(a, b float64) float64 { return a * b }
+		case p.accept("/"):
+			op = func(a, b float64) float64 { return a / b }
+		case p.accept("%"):
+			op = math.Mod
+		default:
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(px *[4]float64) float64 { return op(l(px), right(px)) }
+	}
+}
+
+// unary := -unary | power
+func (p *parser) unary() (node, error) {
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(px *[4]float64) float64 { return -operand(px) }, nil
+	}
+	return p.power()
+}
+
+// power := primary [^ unary], right associative
+func (p *parser) power() (node, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("^") {
+		return base, nil
+	}
+	exponent, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(px *[4]float64) float64 { return math.Pow(base(px), exponent(px)) }, nil
+}
+
+// primary := number | channel | function(args) | (expression)
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch {
+	case t.kind == numberToken:
+		v := t.value
+		return func(*[4]float64) float64 { return v }, nil
+	case t.kind == identToken:
+		if c, ok := channels[t.text]; ok {
+			return func(px *[4]float64) float64 { return px[c] }, nil
+		}
+		f, ok := functions[t.text]
+		if !ok {
+			return nil, p.errorf(t, "unknown name %q", t.text)
+		}
+		if !p.accept("(") {
+			return nil, p.errorf(p.peek(), "expected ( after %s", t.text)
+		}
+		var args []node
+		for !p.accept(")") {
+			if len(args) > 0 && !p.accept(",") {
+				return nil, p.errorf(p.peek(), "expected , or ) in call to %s", t.text)
+			}
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		if f.args >= 0 && len(args) != f.args || len(args) == 0 {
+			return nil, p.errorf(t, "%s takes %s", t.text, arity(f.args))
+		}
+		if t.text == "clamp" && len(args) != 1 && len(args) != 3 {
+			return nil, p.errorf(t, "clamp takes 1 or 3 arguments")
+		}
+		fn := f.fn
+		return func(px *[4]float64) float64 {
+			values := make([]float64, len(args))
+			for i, arg := range args {
+				values[i] = arg(px)
+			}
+			return fn(values)
+		}, nil
+	case t.text == "(":
+		inner, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf(p.peek(), "expected )")
+		}
+		return inner, nil
+	}
+	if t.pos == len(p.source) {
+		return nil, p.errorf(t, "unexpected end of expression")
+	}
+	return nil, p.errorf(t, "unexpected %q", t.text)
+}
+
+func arity(args int) string {
+	switch args {
+	case -1:
+		return "at least 1 argument"
+	case 1:
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", args)
+}
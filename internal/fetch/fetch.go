@@ -0,0 +1,225 @@
+// Package fetch downloads remote images into a local directory so they can
+// be processed like files from the input directory
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+)
+
+// first wait between attempts, doubled after each failed one
+const retryBackoff = 500 * time.Millisecond
+
+// IsURL reports whether s is an http or https URL
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// Downloader fetches URLs with bounded concurrency into a directory, which
+// doubles as a cache: a URL already downloaded there isn't fetched again
+type Downloader struct {
+	client  *http.Client
+	dir     string
+	workers int
+	// attempts after the first for errors that may pass: network errors,
+	// 429 and 5xx responses
+	retries int
+	maxSize int64
+}
+
+// NewDownloader returns a downloader writing to dir with workers concurrent
+// downloads, each attempt limited to timeout and downloads to maxSize bytes
+func NewDownloader(dir string, workers, retries int, timeout time.Duration, maxSize int64) *Downloader {
+	return &Downloader{
+		client:  &http.Client{Timeout: timeout},
+		dir:     dir,
+		workers: workers,
+		retries: retries,
+		maxSize: maxSize,
+	}
+}
+
+// Fetch downloads urls and calls fn with the index and local path of each,
+// or the error that stopped it, as downloads finish; fn is never called
+// concurrently. It returns once every URL is done, or ctx is, leaving
+// the rest unreported
+func (d *Downloader) Fetch(ctx context.Context, urls []string, fn func(i int, path string, err error)) {
+	queue := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				path, err := d.Download(ctx, urls[i])
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				fn(i, path, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range urls {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// Download fetches rawURL, retrying errors that may pass, and returns the
+// path of the local copy. The copy is named after the last element of the
+// URL path, in a directory keyed by a hash of the URL so names don't clash
+func (d *Downloader) Download(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid URL %q", rawURL)
+	}
+
+	sum := sha256.Sum256([]byte(rawURL))
+	dir := filepath.Join(d.dir, hex.EncodeToString(sum[:8]))
+	if path, ok := cached(dir); ok {
+		return path, nil
+	}
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		path, err := d.get(ctx, rawURL, dir, name(u))
+		if err == nil || attempt >= d.retries || !retryable(err) {
+			return path, err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// a response other than 200 OK; 429 and 5xx are retried
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+}
+
+// errors of an oversized or unrecognized download, which a retry won't fix
+var (
+	errTooLarge    = fmt.Errorf("%w: download exceeds maximum size", processor.ErrFileTooLarge)
+	errUnsupported = processor.ErrUnsupportedFormat
+)
+
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	return !errors.Is(err, errTooLarge) && !errors.Is(err, errUnsupported) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// one attempt at downloading rawURL as dir/name; the file only appears
+// under its final name once complete, so an interrupted download isn't
+// mistaken for a cached one
+func (d *Downloader) get(ctx context.Context, rawURL, dir, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{code: resp.StatusCode}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, d.maxSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if int64(len(data)) > d.maxSize {
+		return "", errTooLarge
+	}
+	ext := processor.DetectExtension(data)
+	if ext == "" {
+		return "", errUnsupported
+	}
+	// the decoder is picked by extension, so it has to match the contents
+	if !strings.EqualFold(filepath.Ext(name), ext) {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// the file downloaded into dir by an earlier run, if any
+func cached(dir string) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			return filepath.Join(dir, entry.Name()), true
+		}
+	}
+	return "", false
+}
+
+// file name of a download: the last element of the URL path
+func name(u *url.URL) string {
+	base := path.Base(u.Path)
+	if base == "/" || base == "." || strings.HasPrefix(base, ".") {
+		return "download"
+	}
+	return base
+}
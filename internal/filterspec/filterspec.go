@@ -0,0 +1,250 @@
+// Package filterspec describes the filters a pipeline step can name and the
+// settings each one takes, so configuration defaults and validation, the
+// generated config file, the command line help and the HTTP API all read
+// the same list. Filters added by plugins or library callers register here
+// too
+package filterspec
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Type is the kind of value a setting takes, which decides how it is
+// parsed and checked
+type Type string
+
+const (
+	Int      Type = "int"
+	Float    Type = "float"
+	String   Type = "string"
+	Duration Type = "duration"
+	// pixels ("24") or a percentage ("10%")
+	Length Type = "length"
+	// hex color such as #ff8800
+	Color Type = "color"
+	// width:height or a number
+	Aspect Type = "aspect"
+	// program and arguments
+	Command Type = "command"
+	// assignments of the expression filter
+	Expression Type = "expression"
+)
+
+// Param is a setting of a filter. It has a key in the filter's section of
+// the config file, such as radius in filters.blur, and stands for a flat
+// configuration key, such as blur_radius, which flags and pipeline step
+// params also use. The settings of custom filters have no flat key and are
+// kept as strings in plugin_params
+type Param struct {
+	Name    string      `json:"name"`
+	Key     string      `json:"key"`
+	Type    Type        `json:"type"`
+	Default interface{} `json:"default"`
+	Doc     string      `json:"doc"`
+
+	// bounds of a number; nil is unbounded. With MinExclusive the value
+	// must be greater than Min, as for a factor that must be positive
+	Min          *float64 `json:"min,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	MinExclusive bool     `json:"min_exclusive,omitempty"`
+	// the values a string takes, any when empty
+	Values []string `json:"values,omitempty"`
+	// the setting must be set when the filter is used
+	Required bool `json:"required,omitempty"`
+}
+
+// Filter describes a filter and its settings. Custom filters, those of
+// plugins and library callers, take whatever settings their filters
+// section has; those they declare get defaults and are checked
+type Filter struct {
+	Name   string  `json:"name"`
+	Doc    string  `json:"doc"`
+	Params []Param `json:"params,omitempty"`
+	Custom bool    `json:"custom,omitempty"`
+}
+
+// Param returns the setting of f with the given section key
+func (f Filter) Param(name string) (Param, bool) {
+	for _, p := range f.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// Bound returns a pointer to v, for Param.Min and Param.Max
+func Bound(v float64) *float64 {
+	return &v
+}
+
+// CheckRange returns what v must be instead when it is outside the bounds
+// of p, "" when it is within them
+func (p Param) CheckRange(v float64) string {
+	low := p.Min == nil || v > *p.Min || v == *p.Min && !p.MinExclusive
+	high := p.Max == nil || v <= *p.Max
+	if low && high {
+		return ""
+	}
+
+	switch {
+	case p.Min != nil && p.Max != nil:
+		return fmt.Sprintf("must be between %g and %g", *p.Min, *p.Max)
+	case p.Max != nil:
+		return fmt.Sprintf("must be at most %g", *p.Max)
+	case p.MinExclusive:
+		return fmt.Sprintf("must be greater than %g", *p.Min)
+	case *p.Min == 0:
+		return "cannot be negative"
+	default:
+		return fmt.Sprintf("must be at least %g", *p.Min)
+	}
+}
+
+var (
+	mu       sync.RWMutex
+	filters  []Filter
+	byName   = map[string]int{}
+	paramKey = map[string]string{}
+)
+
+func init() {
+	for _, f := range builtin() {
+		if err := Register(f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register adds a filter. Its name and the flat keys of its settings must
+// not be taken by another filter
+func Register(f Filter) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if f.Name == "" {
+		return fmt.Errorf("filter has no name")
+	}
+	if _, ok := byName[f.Name]; ok {
+		return fmt.Errorf("filter %q is already registered", f.Name)
+	}
+	for _, p := range f.Params {
+		if owner, ok := paramKey[p.Key]; ok && p.Key != "" {
+			return fmt.Errorf("filter %q: setting %s belongs to filter %q", f.Name, p.Key, owner)
+		}
+	}
+
+	byName[f.Name] = len(filters)
+	filters = append(filters, f)
+	for _, p := range f.Params {
+		if p.Key != "" {
+			paramKey[p.Key] = f.Name
+		}
+	}
+	return nil
+}
+
+// Lookup returns the registered filter with the given name
+func Lookup(name string) (Filter, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	i, ok := byName[name]
+	if !ok {
+		return Filter{}, false
+	}
+	return filters[i], true
+}
+
+// All returns the registered filters, built-in ones first, in the order
+// they were registered
+func All() []Filter {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]Filter(nil), filters...)
+}
+
+// Names returns the names of the registered filters, in the order of All
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, len(filters))
+	for i, f := range filters {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// Params returns the settings with flat configuration keys of every
+// registered filter, in the order of All
+func Params() []Param {
+	mu.RLock()
+	defer mu.RUnlock()
+	var params []Param
+	for _, f := range filters {
+		for _, p := range f.Params {
+			if p.Key != "" {
+				params = append(params, p)
+			}
+		}
+	}
+	return params
+}
+
+// the built-in filters
+func builtin() []Filter {
+	return []Filter{
+		{Name: "grayscale", Doc: "luminance of each pixel"},
+		{Name: "blur", Doc: "gaussian blur", Params: []Param{
+			{Name: "radius", Key: "blur_radius", Type: Float, Default: 2.0, Doc: "gaussian radius in pixels", Min: Bound(0)},
+		}},
+		{Name: "brightness", Doc: "scale every channel", Params: []Param{
+			{Name: "factor", Key: "brightness", Type: Float, Default: 1.2, Doc: "multiplier, above 1 brightens", Min: Bound(0), MinExclusive: true},
+		}},
+		{Name: "contrast", Doc: "stretch channels around the midpoint", Params: []Param{
+			{Name: "factor", Key: "contrast", Type: Float, Default: 1.1, Doc: "multiplier, above 1 adds contrast"},
+		}},
+		{Name: "gamma", Doc: "gamma correction", Params: []Param{
+			{Name: "value", Key: "gamma", Type: Float, Default: 2.2, Doc: "above 1 brightens midtones", Min: Bound(0), MinExclusive: true},
+		}},
+		{Name: "invert", Doc: "negative of each channel"},
+		{Name: "round-corners", Doc: "make the corners transparent", Params: []Param{
+			{Name: "radius", Key: "corner_radius", Type: Length, Default: "10%", Doc: `pixels ("24") or percent of the shorter side ("10%")`},
+		}},
+		{Name: "circle-mask", Doc: "keep the largest centered circle"},
+		{Name: "drop-shadow", Doc: "composite the image over a blurred shadow", Params: []Param{
+			{Name: "offset_x", Key: "shadow_offset_x", Type: Int, Default: 8, Doc: "pixels right of the image"},
+			{Name: "offset_y", Key: "shadow_offset_y", Type: Int, Default: 8, Doc: "pixels below the image"},
+			{Name: "blur", Key: "shadow_blur", Type: Float, Default: 12.0, Doc: "radius in pixels", Min: Bound(0)},
+			{Name: "color", Key: "shadow_color", Type: Color, Default: "#000000", Doc: "hex color"},
+			{Name: "opacity", Key: "shadow_opacity", Type: Float, Default: 0.5, Doc: "0 to 1", Min: Bound(0), Max: Bound(1)},
+		}},
+		{Name: "outer-glow", Doc: "composite the image over a blurred glow", Params: []Param{
+			{Name: "radius", Key: "glow_radius", Type: Float, Default: 16.0, Doc: "pixels", Min: Bound(0)},
+			{Name: "color", Key: "glow_color", Type: Color, Default: "#ffffff", Doc: "hex color"},
+			{Name: "opacity", Key: "glow_opacity", Type: Float, Default: 0.8, Doc: "0 to 1", Min: Bound(0), Max: Bound(1)},
+		}},
+		{Name: "resize", Doc: "scale to a width, a height or both", Params: []Param{
+			{Name: "width", Key: "resize_width", Type: Int, Default: 0, Doc: "0 keeps the aspect ratio", Min: Bound(0)},
+			{Name: "height", Key: "resize_height", Type: Int, Default: 0, Doc: "0 keeps the aspect ratio", Min: Bound(0)},
+		}},
+		{Name: "crop", Doc: "cut out a rectangle", Params: []Param{
+			{Name: "x", Key: "crop_x", Type: Int, Default: 0, Doc: "left edge", Min: Bound(0)},
+			{Name: "y", Key: "crop_y", Type: Int, Default: 0, Doc: "top edge", Min: Bound(0)},
+			{Name: "width", Key: "crop_width", Type: Int, Default: 0, Doc: "0 extends to the image edge", Min: Bound(0)},
+			{Name: "height", Key: "crop_height", Type: Int, Default: 0, Doc: "0 extends to the image edge", Min: Bound(0)},
+		}},
+		{Name: "smart-crop", Doc: "crop to an aspect ratio around the most interesting region", Params: []Param{
+			{Name: "aspect", Key: "smart_crop_aspect", Type: Aspect, Default: "1:1", Doc: "width:height or a number"},
+			{Name: "strategy", Key: "smart_crop_strategy", Type: String, Default: "entropy", Doc: "entropy, saliency or center", Values: []string{"entropy", "saliency", "center"}},
+		}},
+		{Name: "exec", Doc: "run an external command on the image", Params: []Param{
+			{Name: "command", Key: "exec_command", Type: Command, Default: []string{}, Doc: "program and arguments, reading PNG on stdin and writing an image to stdout", Required: true},
+			{Name: "timeout", Key: "exec_timeout", Type: Duration, Default: "30s", Doc: "limit on each run, 0 for none", Min: Bound(0)},
+			{Name: "concurrency", Key: "exec_concurrency", Type: Int, Default: runtime.NumCPU(), Doc: "runs at once", Min: Bound(0), MinExclusive: true},
+		}},
+		{Name: "expression", Doc: "compute each pixel with an expression", Params: []Param{
+			{Name: "code", Key: "expression", Type: Expression, Default: "", Doc: "assignments to r, g, b or a, such as r = clamp(r*1.1 + 10); b = b*0.9", Required: true},
+		}},
+	}
+}
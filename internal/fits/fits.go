@@ -0,0 +1,308 @@
+// Package fits decodes the primary image of FITS files, stretching the
+// physical values into 8 or 16-bit grayscale
+package fits
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	blockSize = 2880
+	cardSize  = 80
+	// most pixels of an image, 32768 squared; the data of a larger one
+	// wouldn't fit in memory as values
+	maxPixels = 1 << 30
+)
+
+// stretch functions mapping normalised values to display brightness
+const (
+	StretchLinear = "linear"
+	StretchLog    = "log"
+	StretchAsinh  = "asinh"
+)
+
+var (
+	ErrNotFITS     = errors.New("not a FITS file")
+	ErrUnsupported = errors.New("unsupported FITS image")
+)
+
+// Header holds the keywords of the primary header
+type Header map[string]string
+
+// String returns a keyword's value with quotes and padding removed
+func (h Header) String(key string) string {
+	v := strings.TrimSpace(h[key])
+	if strings.HasPrefix(v, "'") {
+		v = strings.TrimSpace(strings.Trim(v, "'"))
+	}
+	return v
+}
+
+// Int returns an integer keyword, or fallback if missing
+func (h Header) Int(key string, fallback int) int {
+	n, err := strconv.Atoi(h.String(key))
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// Float returns a real keyword, or fallback if missing
+func (h Header) Float(key string, fallback float64) float64 {
+	f, err := strconv.ParseFloat(strings.Replace(h.String(key), "D", "E", 1), 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+// Options controls how physical values are mapped to output pixels
+type Options struct {
+	// Stretch is linear, log or asinh; empty means linear
+	Stretch string
+	// BitDepth is 8 or 16; anything else means 8
+	BitDepth int
+}
+
+// Decode reads the primary image and returns it as an *image.Gray or
+// *image.Gray16, flipped so that the first FITS row is at the bottom
+func Decode(r io.Reader, opts Options) (image.Image, Header, error) {
+	br := bufio.NewReader(r)
+	header, err := readHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	width, height, bitpix, err := dimensions(header)
+	if err != nil {
+		return nil, header, err
+	}
+
+	values, err := readValues(br, header, width*height, bitpix)
+	if err != nil {
+		return nil, header, err
+	}
+
+	return render(values, width, height, opts), header, nil
+}
+
+// DecodeConfig returns the dimensions without reading the data unit
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	header, err := readHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	width, height, _, err := dimensions(header)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.GrayModel, Width: width, Height: height}, nil
+}
+
+// readHeader reads header blocks up to and including the one with END
+func readHeader(r io.Reader) (Header, error) {
+	header := Header{}
+	block := make([]byte, blockSize)
+
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if first {
+				return nil, ErrNotFITS
+			}
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+
+		for i := 0; i < blockSize; i += cardSize {
+			card := string(block[i : i+cardSize])
+			key := strings.TrimSpace(card[:8])
+
+			if first && i == 0 && (key != "SIMPLE" || cardValue(card) != "T") {
+				return nil, ErrNotFITS
+			}
+			if key == "END" {
+				return header, nil
+			}
+			if len(card) > 10 && card[8:10] == "= " {
+				header[key] = cardValue(card)
+			}
+		}
+	}
+}
+
+// cardValue extracts the value of a card, dropping any trailing comment
+func cardValue(card string) string {
+	value := card[10:]
+	if strings.HasPrefix(strings.TrimSpace(value), "'") {
+		// the comment separator may appear inside a quoted string
+		start := strings.IndexByte(value, '\'')
+		if end := strings.IndexByte(value[start+1:], '\''); end >= 0 {
+			return value[start : start+end+2]
+		}
+		return value
+	}
+	if i := strings.IndexByte(value, '/'); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// dimensions validates the primary array and returns its size and BITPIX
+func dimensions(header Header) (int, int, int, error) {
+	naxis := header.Int("NAXIS", 0)
+	if naxis < 2 {
+		return 0, 0, 0, fmt.Errorf("%w: primary HDU has %d axes", ErrUnsupported, naxis)
+	}
+
+	// extra axes, such as a colour or time plane, must be degenerate; only
+	// the first plane is read otherwise
+	width, height := header.Int("NAXIS1", 0), header.Int("NAXIS2", 0)
+	if width <= 0 || height <= 0 {
+		return 0, 0, 0, fmt.Errorf("%w: invalid dimensions %dx%d", ErrUnsupported, width, height)
+	}
+	// checked by division so the product can't overflow
+	if width > maxPixels/height {
+		return 0, 0, 0, fmt.Errorf("%w: dimensions %dx%d are too large", ErrUnsupported, width, height)
+	}
+
+	bitpix := header.Int("BITPIX", 0)
+	switch bitpix {
+	case 8, 16, 32, 64, -32, -64:
+	default:
+		return 0, 0, 0, fmt.Errorf("%w: BITPIX %d", ErrUnsupported, bitpix)
+	}
+
+	return width, height, bitpix, nil
+}
+
+// readValues reads n big-endian values and applies BSCALE and BZERO; blank
+// integers and NaNs come back as NaN
+func readValues(r io.Reader, header Header, n, bitpix int) ([]float64, error) {
+	size := abs(bitpix) / 8
+	// the size comes from the header, so the data grows with the bytes
+	// actually there rather than being allocated up front
+	raw, err := io.ReadAll(io.LimitReader(r, int64(n)*int64(size)))
+	if err != nil {
+		return nil, fmt.Errorf("reading data: %w", err)
+	}
+	if len(raw) < n*size {
+		return nil, fmt.Errorf("reading data: %w", io.ErrUnexpectedEOF)
+	}
+
+	scale := header.Float("BSCALE", 1)
+	zero := header.Float("BZERO", 0)
+	_, hasBlank := header["BLANK"]
+	blank := int64(header.Int("BLANK", 0))
+
+	values := make([]float64, n)
+	for i := range values {
+		b := raw[i*size:]
+
+		var v float64
+		var stored int64
+		isInt := true
+		switch bitpix {
+		case 8:
+			stored = int64(b[0])
+		case 16:
+			stored = int64(int16(binary.BigEndian.Uint16(b)))
+		case 32:
+			stored = int64(int32(binary.BigEndian.Uint32(b)))
+		case 64:
+			stored = int64(binary.BigEndian.Uint64(b))
+		case -32:
+			v, isInt = float64(math.Float32frombits(binary.BigEndian.Uint32(b))), false
+		case -64:
+			v, isInt = math.Float64frombits(binary.BigEndian.Uint64(b)), false
+		}
+
+		if isInt {
+			if hasBlank && stored == blank {
+				values[i] = math.NaN()
+				continue
+			}
+			v = float64(stored)
+		}
+		values[i] = v*scale + zero
+	}
+
+	return values, nil
+}
+
+// render normalises the finite values to their range, applies the stretch
+// and writes rows bottom-up, the FITS display convention
+func render(values []float64, width, height int, opts Options) image.Image {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+	}
+	span := high - low
+	if !(span > 0) {
+		span = 1
+	}
+
+	stretch := stretchFunc(opts.Stretch)
+	maxValue := 255.0
+	if opts.BitDepth == 16 {
+		maxValue = 65535
+	}
+
+	level := func(v float64) float64 {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0
+		}
+		t := math.Max(0, math.Min(1, (v-low)/span))
+		return math.Round(stretch(t) * maxValue)
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	if opts.BitDepth == 16 {
+		img := image.NewGray16(bounds)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetGray16(x, height-1-y, color.Gray16{Y: uint16(level(values[y*width+x]))})
+			}
+		}
+		return img
+	}
+
+	img := image.NewGray(bounds)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Pix[img.PixOffset(x, height-1-y)] = uint8(level(values[y*width+x]))
+		}
+	}
+	return img
+}
+
+// stretchFunc maps [0, 1] to [0, 1], lifting faint values for log and asinh
+func stretchFunc(name string) func(float64) float64 {
+	switch name {
+	case StretchLog:
+		const a = 1000.0
+		return func(t float64) float64 { return math.Log(a*t+1) / math.Log(a+1) }
+	case StretchAsinh:
+		const soft = 0.1
+		return func(t float64) float64 { return math.Asinh(t/soft) / math.Asinh(1/soft) }
+	default:
+		return func(t float64) float64 { return t }
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package fits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// a FITS file of the header cards, padded to a block, followed by data
+func fitsFile(cards []string, data []byte) []byte {
+	var b bytes.Buffer
+	for _, card := range append(cards, "END") {
+		fmt.Fprintf(&b, "%-80s", card)
+	}
+	b.WriteString(strings.Repeat(" ", blockSize-b.Len()%blockSize))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func header(bitpix, width, height int) []string {
+	return []string{
+		"SIMPLE  =                    T",
+		fmt.Sprintf("BITPIX  = %20d", bitpix),
+		"NAXIS   =                    2",
+		fmt.Sprintf("NAXIS1  = %20d", width),
+		fmt.Sprintf("NAXIS2  = %20d", height),
+	}
+}
+
+func TestDecode(t *testing.T) {
+	data := make([]byte, 0, 8)
+	for _, v := range []int16{0, 100, 200, 300} {
+		data = binary.BigEndian.AppendUint16(data, uint16(v))
+	}
+	img, _, err := Decode(bytes.NewReader(fitsFile(header(16, 2, 2), data)), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Errorf("bounds %v", b)
+	}
+}
+
+// dimensions from the header are checked before anything is allocated
+func TestDecodeHugeDimensions(t *testing.T) {
+	cases := map[string][]string{
+		// NAXIS1*NAXIS2*8 wraps around 64 bits
+		"overflowing": header(-64, 1<<31, 1<<31),
+		"too large":   header(8, 1<<20, 1<<20),
+	}
+	for name, cards := range cases {
+		_, _, err := Decode(bytes.NewReader(fitsFile(cards, nil)), Options{})
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: error %v, want ErrUnsupported", name, err)
+		}
+		if _, err := DecodeConfig(bytes.NewReader(fitsFile(cards, nil))); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: DecodeConfig error %v, want ErrUnsupported", name, err)
+		}
+	}
+
+	// within the limit but far more data than the file has
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := Decode(bytes.NewReader(fitsFile(header(-64, 16384, 16384), make([]byte, 64))), Options{})
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("error %v, want unexpected EOF", err)
+	}
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("allocated %d bytes for a file without data", grown)
+	}
+}
@@ -0,0 +1,12 @@
+// Package gpu runs the blur and resize filters on a GPU through OpenCL. The
+// backend is compiled in with the opencl build tag, which needs the OpenCL
+// headers and loader; without it every call returns ErrUnavailable and
+// callers keep to their CPU filters. Pixels are tightly packed 8-bit RGBA
+// rows, premultiplied as image.RGBA stores them
+package gpu
+
+import "errors"
+
+// ErrUnavailable is returned when the binary was built without the opencl
+// tag or no GPU device could be opened
+var ErrUnavailable = errors.New("no GPU backend: build with -tags opencl and install an OpenCL driver")
@@ -0,0 +1,20 @@
+//go:build !opencl
+
+package gpu
+
+// Available reports whether a GPU device is open for filters
+func Available() bool {
+	return false
+}
+
+// Blur box blurs pix, width by height pixels, over a square of radius
+// pixels clipped to the image, as the CPU blur does
+func Blur(pix []uint8, width, height, radius int) ([]uint8, error) {
+	return nil, ErrUnavailable
+}
+
+// Resize resamples pix, width by height pixels, to dstWidth by dstHeight
+// with a Catmull-Rom kernel, widened when shrinking
+func Resize(pix []uint8, width, height, dstWidth, dstHeight int) ([]uint8, error) {
+	return nil, ErrUnavailable
+}
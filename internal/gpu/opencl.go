@@ -0,0 +1,302 @@
+//go:build opencl
+
+package gpu
+
+/*
+#cgo linux LDFLAGS: -lOpenCL
+#cgo windows LDFLAGS: -lOpenCL
+#cgo darwin LDFLAGS: -framework OpenCL
+#define CL_TARGET_OPENCL_VERSION 120
+#include <stdlib.h>
+#ifdef __APPLE__
+#include <OpenCL/opencl.h>
+#else
+#include <CL/cl.h>
+#endif
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// the kernels, one work item per output pixel. Blur sums in integers and
+// truncates the mean like the CPU blur; resize filters rows into a float
+// buffer and then columns, rounding at the end
+const kernelSource = `
+__kernel void box_blur(__global const uchar4 *src, __global uchar4 *dst, int width, int height, int radius) {
+	int x = get_global_id(0), y = get_global_id(1);
+	if (x >= width || y >= height) return;
+	int x0 = max(x - radius, 0), x1 = min(x + radius, width - 1);
+	int y0 = max(y - radius, 0), y1 = min(y + radius, height - 1);
+	uint4 sum = (uint4)(0);
+	for (int ny = y0; ny <= y1; ny++)
+		for (int nx = x0; nx <= x1; nx++)
+			sum += convert_uint4(src[ny * width + nx]);
+	uint count = (uint)((x1 - x0 + 1) * (y1 - y0 + 1));
+	dst[y * width + x] = convert_uchar4(sum / count);
+}
+
+float catmull_rom(float t) {
+	t = fabs(t);
+	if (t < 1) return (1.5f * t - 2.5f) * t * t + 1;
+	if (t < 2) return ((-0.5f * t + 2.5f) * t - 4) * t + 2;
+	return 0;
+}
+
+// the weighted sum of n source pixels, stride apart, under the kernel
+// centred on output pixel i of m
+float4 resample(__global const float4 *src, int first, int stride, int n, int m, int i) {
+	float scale = (float)n / m, widen = fmax(scale, 1.0f);
+	float center = (i + 0.5f) * scale - 0.5f;
+	int lo = max((int)ceil(center - 2 * widen), 0), hi = min((int)floor(center + 2 * widen), n - 1);
+	float4 sum = (float4)(0);
+	float total = 0;
+	for (int k = lo; k <= hi; k++) {
+		float w = catmull_rom((k - center) / widen);
+		sum += w * src[first + k * stride];
+		total += w;
+	}
+	return total != 0 ? sum / total : (float4)(0);
+}
+
+__kernel void to_float(__global const uchar4 *src, __global float4 *dst, int n) {
+	int i = get_global_id(0);
+	if (i < n) dst[i] = convert_float4(src[i]);
+}
+
+__kernel void resize_rows(__global const float4 *src, __global float4 *dst, int width, int height, int dstWidth) {
+	int x = get_global_id(0), y = get_global_id(1);
+	if (x >= dstWidth || y >= height) return;
+	dst[y * dstWidth + x] = resample(src, y * width, 1, width, dstWidth, x);
+}
+
+__kernel void resize_columns(__global const float4 *src, __global uchar4 *dst, int width, int height, int dstHeight) {
+	int x = get_global_id(0), y = get_global_id(1);
+	if (x >= width || y >= dstHeight) return;
+	float4 v = resample(src, x, width, height, dstHeight, y);
+	// premultiplied colors can't exceed alpha
+	v.w = clamp(v.w, 0.0f, 255.0f);
+	v.xyz = clamp(v.xyz, 0.0f, v.w);
+	dst[y * width + x] = convert_uchar4_sat_rte(v);
+}
+`
+
+// an opened GPU with its queue and built kernels
+type device struct {
+	context C.cl_context
+	queue   C.cl_command_queue
+
+	blur          C.cl_kernel
+	toFloat       C.cl_kernel
+	resizeRows    C.cl_kernel
+	resizeColumns C.cl_kernel
+}
+
+var (
+	openOnce sync.Once
+	opened   *device
+	openErr  error
+
+	// a kernel holds one set of arguments, so filters set them and run
+	// one at a time
+	mu sync.Mutex
+)
+
+// the first GPU of any platform, opened on first use
+func open() (*device, error) {
+	openOnce.Do(func() {
+		opened, openErr = openDevice()
+	})
+	return opened, openErr
+}
+
+// Available reports whether a GPU device is open for filters
+func Available() bool {
+	_, err := open()
+	return err == nil
+}
+
+func openDevice() (*device, error) {
+	var platforms [8]C.cl_platform_id
+	var count C.cl_uint
+	if C.clGetPlatformIDs(C.cl_uint(len(platforms)), &platforms[0], &count) != C.CL_SUCCESS || count == 0 {
+		return nil, ErrUnavailable
+	}
+	var id C.cl_device_id
+	found := false
+	for _, platform := range platforms[:min(int(count), len(platforms))] {
+		if C.clGetDeviceIDs(platform, C.CL_DEVICE_TYPE_GPU, 1, &id, nil) == C.CL_SUCCESS {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrUnavailable
+	}
+
+	var status C.cl_int
+	d := &device{}
+	d.context = C.clCreateContext(nil, 1, &id, nil, nil, &status)
+	if err := check(status, "create context"); err != nil {
+		return nil, err
+	}
+	d.queue = C.clCreateCommandQueue(d.context, id, 0, &status)
+	if err := check(status, "create command queue"); err != nil {
+		return nil, err
+	}
+
+	source := C.CString(kernelSource)
+	defer C.free(unsafe.Pointer(source))
+	program := C.clCreateProgramWithSource(d.context, 1, &source, nil, &status)
+	if err := check(status, "create program"); err != nil {
+		return nil, err
+	}
+	if C.clBuildProgram(program, 1, &id, nil, nil, nil) != C.CL_SUCCESS {
+		return nil, fmt.Errorf("build kernels: %s", buildLog(program, id))
+	}
+
+	for name, kernel := range map[string]*C.cl_kernel{
+		"box_blur":       &d.blur,
+		"to_float":       &d.toFloat,
+		"resize_rows":    &d.resizeRows,
+		"resize_columns": &d.resizeColumns,
+	} {
+		cname := C.CString(name)
+		*kernel = C.clCreateKernel(program, cname, &status)
+		C.free(unsafe.Pointer(cname))
+		if err := check(status, "create kernel "+name); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// the compiler output of a program that failed to build
+func buildLog(program C.cl_program, id C.cl_device_id) string {
+	var size C.size_t
+	C.clGetProgramBuildInfo(program, id, C.CL_PROGRAM_BUILD_LOG, 0, nil, &size)
+	if size == 0 {
+		return "no build log"
+	}
+	log := make([]byte, size)
+	C.clGetProgramBuildInfo(program, id, C.CL_PROGRAM_BUILD_LOG, size, unsafe.Pointer(&log[0]), nil)
+	return string(log[:size-1])
+}
+
+func check(status C.cl_int, what string) error {
+	if status != C.CL_SUCCESS {
+		return fmt.Errorf("%s: OpenCL error %d", what, int(status))
+	}
+	return nil
+}
+
+// a device buffer of size bytes, filled from host when it's given
+func (d *device) buffer(flags C.cl_mem_flags, size int, host []uint8) (C.cl_mem, error) {
+	var ptr unsafe.Pointer
+	if host != nil {
+		ptr = unsafe.Pointer(&host[0])
+		flags |= C.CL_MEM_COPY_HOST_PTR
+	}
+	var status C.cl_int
+	mem := C.clCreateBuffer(d.context, flags, C.size_t(size), ptr, &status)
+	return mem, check(status, "create buffer")
+}
+
+// set a kernel's arguments, buffers and ints, and run it over a width by
+// height grid
+func (d *device) run(kernel C.cl_kernel, width, height int, args ...interface{}) error {
+	for i, arg := range args {
+		var status C.cl_int
+		switch arg := arg.(type) {
+		case C.cl_mem:
+			status = C.clSetKernelArg(kernel, C.cl_uint(i), C.size_t(unsafe.Sizeof(arg)), unsafe.Pointer(&arg))
+		case int:
+			v := C.cl_int(arg)
+			status = C.clSetKernelArg(kernel, C.cl_uint(i), C.size_t(unsafe.Sizeof(v)), unsafe.Pointer(&v))
+		}
+		if err := check(status, "set kernel argument"); err != nil {
+			return err
+		}
+	}
+	global := [2]C.size_t{C.size_t(width), C.size_t(height)}
+	return check(C.clEnqueueNDRangeKernel(d.queue, kernel, 2, nil, &global[0], nil, 0, nil, nil), "run kernel")
+}
+
+// copy a buffer into dst once the queued kernels finish
+func (d *device) read(mem C.cl_mem, dst []uint8) error {
+	return check(C.clEnqueueReadBuffer(d.queue, mem, C.CL_TRUE, 0, C.size_t(len(dst)), unsafe.Pointer(&dst[0]), 0, nil, nil), "read buffer")
+}
+
+// Blur box blurs pix, width by height pixels, over a square of radius
+// pixels clipped to the image, as the CPU blur does
+func Blur(pix []uint8, width, height, radius int) ([]uint8, error) {
+	d, err := open()
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	src, err := d.buffer(C.CL_MEM_READ_ONLY, len(pix), pix)
+	if err != nil {
+		return nil, err
+	}
+	defer C.clReleaseMemObject(src)
+	dst, err := d.buffer(C.CL_MEM_WRITE_ONLY, len(pix), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer C.clReleaseMemObject(dst)
+
+	if err := d.run(d.blur, width, height, src, dst, width, height, radius); err != nil {
+		return nil, err
+	}
+	out := make([]uint8, len(pix))
+	return out, d.read(dst, out)
+}
+
+// Resize resamples pix, width by height pixels, to dstWidth by dstHeight
+// with a Catmull-Rom kernel, widened when shrinking
+func Resize(pix []uint8, width, height, dstWidth, dstHeight int) ([]uint8, error) {
+	d, err := open()
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	// float4 pixels of the source, and of the image resized across
+	buffers := []struct {
+		flags C.cl_mem_flags
+		size  int
+		host  []uint8
+	}{
+		{C.CL_MEM_READ_ONLY, len(pix), pix},
+		{C.CL_MEM_READ_WRITE, width * height * 16, nil},
+		{C.CL_MEM_READ_WRITE, dstWidth * height * 16, nil},
+		{C.CL_MEM_WRITE_ONLY, dstWidth * dstHeight * 4, nil},
+	}
+	mems := make([]C.cl_mem, len(buffers))
+	for i, b := range buffers {
+		if mems[i], err = d.buffer(b.flags, b.size, b.host); err != nil {
+			return nil, err
+		}
+		defer C.clReleaseMemObject(mems[i])
+	}
+	src, float, rows, dst := mems[0], mems[1], mems[2], mems[3]
+
+	if err := d.run(d.toFloat, width*height, 1, src, float, width*height); err != nil {
+		return nil, err
+	}
+	if err := d.run(d.resizeRows, dstWidth, height, float, rows, width, height, dstWidth); err != nil {
+		return nil, err
+	}
+	if err := d.run(d.resizeColumns, dstWidth, dstHeight, rows, dst, dstWidth, height, dstHeight); err != nil {
+		return nil, err
+	}
+	out := make([]uint8, dstWidth*dstHeight*4)
+	return out, d.read(dst, out)
+}
@@ -0,0 +1,202 @@
+// Package health serves the liveness and readiness probes of the daemons,
+// so an orchestrator such as Kubernetes can restart a stuck process and only
+// send work to instances able to take it
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// limit on each backend check of a probe
+const checkTimeout = 5 * time.Second
+
+// Check reports whether a backend the daemon depends on is usable
+type Check func(ctx context.Context) error
+
+// Status is the body of /healthz and /readyz: "ok" or "unavailable", the
+// outcome of each check and the worker pool state
+type Status struct {
+	Status string              `json:"status"`
+	Checks map[string]string   `json:"checks"`
+	Pool   processor.PoolStats `json:"pool"`
+}
+
+// Checker tracks a daemon's worker pool and backends. /healthz fails when
+// the pool stopped or stalled, and restarting the process is the fix;
+// /readyz also fails while the job queue is full, a backend is unreachable,
+// the pool is paused or the daemon is shutting down, and waiting is the fix
+type Checker struct {
+	service      *processor.Service
+	queueSize    int
+	stallTimeout time.Duration
+
+	mu       sync.Mutex
+	checks   []namedCheck
+	stopping bool
+	// when the pool last finished a job or was idle, as seen by the probes
+	progress  time.Time
+	completed int64
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// New returns a checker of service's worker pool
+func New(cfg *config.Config, service *processor.Service) *Checker {
+	return &Checker{
+		service:      service,
+		queueSize:    cfg.BufferSize,
+		stallTimeout: cfg.HealthStallTimeout,
+		progress:     time.Now(),
+	}
+}
+
+// Add makes readiness depend on a backend check
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Shutdown marks the daemon as stopping, failing readiness so no more work
+// is sent while it drains
+func (c *Checker) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopping = true
+}
+
+// Register adds the /healthz and /readyz routes to mux
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		c.respond(w, c.Live())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		c.respond(w, c.Ready(r.Context()))
+	})
+}
+
+// Live reports whether the worker pool is running and making progress
+func (c *Checker) Live() Status {
+	status := Status{Checks: map[string]string{}, Pool: c.service.Stats()}
+	status.Checks["pool"] = result(c.pool(status.Pool))
+	return status.settle()
+}
+
+// Ready reports whether the daemon can take work: it is live, not shutting
+// down, has room in its job queue and reaches its backends
+func (c *Checker) Ready(ctx context.Context) Status {
+	status := c.Live()
+
+	c.mu.Lock()
+	stopping := c.stopping
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.Unlock()
+
+	switch {
+	case stopping || status.Pool.Draining:
+		status.Checks["shutdown"] = "shutting down"
+	case status.Pool.Paused:
+		status.Checks["pause"] = "paused"
+	case status.Pool.Queued >= c.queueSize:
+		status.Checks["queue"] = fmt.Sprintf("job queue full with %d jobs", status.Pool.Queued)
+	}
+
+	// backends are checked concurrently, so one hanging doesn't hold up
+	// the others
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	results := make([]string, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = result(check(ctx))
+		}(i, nc.check)
+	}
+	wg.Wait()
+	for i, nc := range checks {
+		status.Checks[nc.name] = results[i]
+	}
+	return status.settle()
+}
+
+// an error if the pool stopped, or has had jobs in flight without finishing
+// any for the stall timeout; a paused pool isn't stalled
+func (c *Checker) pool(stats processor.PoolStats) error {
+	if c.service.Stopped() {
+		return errors.New("worker pool stopped")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inFlight := int64(stats.Queued+stats.Decoded+stats.Filtered) + stats.Decoding + stats.Filtering + stats.Encoding
+	if inFlight == 0 || stats.Paused || stats.Completed != c.completed {
+		c.completed = stats.Completed
+		c.progress = time.Now()
+		return nil
+	}
+	if c.stallTimeout > 0 && time.Since(c.progress) > c.stallTimeout {
+		return fmt.Errorf("no job finished in %s with %d in flight", time.Since(c.progress).Round(time.Second), inFlight)
+	}
+	return nil
+}
+
+func result(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// set the overall status from the checks
+func (s Status) settle() Status {
+	s.Status = "ok"
+	for _, check := range s.Checks {
+		if check != "ok" {
+			s.Status = "unavailable"
+		}
+	}
+	return s
+}
+
+func (c *Checker) respond(w http.ResponseWriter, status Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Start serves the probes on addr until ctx is done. Failing to listen is
+// fatal: an orchestrator probing addr would take the process for dead
+func Start(ctx context.Context, addr string, c *Checker, log logger.Logger) {
+	mux := http.NewServeMux()
+	c.Register(mux)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		log.WithField("listen", addr).Info("Serving health probes")
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("Health listener failed")
+		}
+	}()
+}
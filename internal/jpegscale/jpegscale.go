@@ -0,0 +1,592 @@
+// Package jpegscale decodes baseline and extended sequential JPEG files at
+// 1/2, 1/4 or 1/8 of their size, running a smaller inverse DCT on the low
+// frequencies of each block instead of decoding every pixel and
+// downsampling them
+package jpegscale
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// markers
+const (
+	markerSOF0  = 0xc0
+	markerSOF1  = 0xc1
+	markerSOF15 = 0xcf
+	markerDHT   = 0xc4
+	markerRST0  = 0xd0
+	markerRST7  = 0xd7
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerDQT   = 0xdb
+	markerDRI   = 0xdd
+	markerAPP14 = 0xee
+)
+
+var (
+	ErrNotJPEG = errors.New("not a JPEG file")
+	// progressive, lossless, arithmetic-coded, 12-bit and CMYK files, which
+	// the standard decoder handles at full size
+	ErrUnsupported = errors.New("unsupported JPEG")
+)
+
+// position in the block of each coefficient in the zigzag order of the file
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Scaled returns the size of an image of the given size decoded at 1/scale,
+// each side rounded up
+func Scaled(size image.Point, scale int) image.Point {
+	return image.Pt((size.X+scale-1)/scale, (size.Y+scale-1)/scale)
+}
+
+// Decode reads a JPEG at 1/scale of its size, scale 1, 2, 4 or 8, with
+// sides rounded up as by Scaled. Grayscale files give an *image.Gray and
+// color files an *image.RGBA
+func Decode(r io.Reader, scale int) (image.Image, error) {
+	if scale != 1 && scale != 2 && scale != 4 && scale != 8 {
+		return nil, fmt.Errorf("scale %d is not 1, 2, 4 or 8", scale)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{data: data, n: 8 / scale}
+	if err := d.decode(); err != nil {
+		return nil, err
+	}
+	return d.image(Scaled(image.Pt(d.width, d.height), scale)), nil
+}
+
+type component struct {
+	id, h, v int
+	// quantization and Huffman tables
+	tq, td, ta int
+	// the DC value of the previous block
+	pred int32
+	// decoded samples at the output scale, covering every MCU
+	plane  []uint8
+	stride int
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	// the size of a decoded block
+	n int
+
+	width, height int
+	hmax, vmax    int
+	mcusX, mcusY  int
+	comps         []component
+	quant         [4][64]int32
+	dc, ac        [4]*huffman
+	restart       int
+	// an Adobe marker's color transform, -1 without one
+	transform int
+	frame     bool
+
+	// entropy-coded bits, most significant first, and whether a marker
+	// ended the data
+	bits   uint32
+	nbits  int
+	marker bool
+
+	idct [][]float64
+}
+
+func (d *decoder) decode() error {
+	if len(d.data) < 2 || d.data[0] != 0xff || d.data[1] != markerSOI {
+		return ErrNotJPEG
+	}
+	d.pos = 2
+	d.transform = -1
+
+	for {
+		marker, segment, err := d.segment()
+		if err != nil {
+			return err
+		}
+		switch {
+		case marker == markerEOI:
+			if !d.frame {
+				return fmt.Errorf("missing frame header")
+			}
+			return nil
+		case marker == markerSOF0 || marker == markerSOF1:
+			err = d.readFrame(segment)
+		case marker == markerDHT:
+			err = d.readHuffman(segment)
+		case marker > markerSOF1 && marker <= markerSOF15 && marker != 0xc8 && marker != 0xcc:
+			// progressive, lossless, hierarchical and arithmetic frames
+			return ErrUnsupported
+		case marker == markerDQT:
+			err = d.readQuant(segment)
+		case marker == markerDRI:
+			if len(segment) < 2 {
+				return fmt.Errorf("short DRI segment")
+			}
+			d.restart = int(segment[0])<<8 | int(segment[1])
+		case marker == markerAPP14:
+			if len(segment) >= 12 && string(segment[:5]) == "Adobe" {
+				d.transform = int(segment[11])
+			}
+		case marker == markerSOS:
+			err = d.readScan(segment)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// the next marker and its segment, skipping to it past any data left of a
+// scan; EOI has no segment
+func (d *decoder) segment() (byte, []byte, error) {
+	for {
+		if d.pos+1 >= len(d.data) {
+			if d.frame {
+				// treat a truncated file like one ending in EOI
+				return markerEOI, nil, nil
+			}
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		if d.data[d.pos] != 0xff {
+			d.pos++
+			continue
+		}
+		marker := d.data[d.pos+1]
+		if marker == 0 || marker == 0xff || (marker >= markerRST0 && marker <= markerRST7) {
+			d.pos++
+			continue
+		}
+		d.pos += 2
+		if marker == markerEOI || marker == markerSOI {
+			return marker, nil, nil
+		}
+		if d.pos+2 > len(d.data) {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		length := int(d.data[d.pos])<<8 | int(d.data[d.pos+1])
+		if length < 2 || d.pos+length > len(d.data) {
+			return 0, nil, fmt.Errorf("bad length of marker %#x", marker)
+		}
+		segment := d.data[d.pos+2 : d.pos+length]
+		d.pos += length
+		return marker, segment, nil
+	}
+}
+
+func (d *decoder) readFrame(s []byte) error {
+	if d.frame {
+		return ErrUnsupported
+	}
+	if len(s) < 6 {
+		return fmt.Errorf("short frame header")
+	}
+	if s[0] != 8 {
+		return ErrUnsupported
+	}
+	d.height, d.width = int(s[1])<<8|int(s[2]), int(s[3])<<8|int(s[4])
+	count := int(s[5])
+	if count != 1 && count != 3 {
+		return ErrUnsupported
+	}
+	if d.width == 0 || d.height == 0 || len(s) < 6+count*3 {
+		return fmt.Errorf("bad frame header")
+	}
+
+	d.hmax, d.vmax = 1, 1
+	for i := 0; i < count; i++ {
+		c := component{id: int(s[6+i*3]), h: int(s[7+i*3] >> 4), v: int(s[7+i*3] & 15), tq: int(s[8+i*3] & 3)}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return fmt.Errorf("bad sampling factors %dx%d", c.h, c.v)
+		}
+		// a lone component is one block per MCU whatever its factors
+		if count == 1 {
+			c.h, c.v = 1, 1
+		}
+		d.hmax, d.vmax = max(d.hmax, c.h), max(d.vmax, c.v)
+		d.comps = append(d.comps, c)
+	}
+
+	d.mcusX = (d.width + 8*d.hmax - 1) / (8 * d.hmax)
+	d.mcusY = (d.height + 8*d.vmax - 1) / (8 * d.vmax)
+	for i := range d.comps {
+		c := &d.comps[i]
+		c.stride = d.mcusX * c.h * d.n
+		c.plane = make([]uint8, c.stride*d.mcusY*c.v*d.n)
+	}
+
+	// the rows of an n-point inverse DCT giving the means of the 8/n pixel
+	// runs the 8-point one would: each frequency's cosine, averaged over a
+	// run, is the n-point cosine damped by sin(su*pi/16) / (s sin(u*pi/16))
+	s8 := float64(8 / d.n)
+	d.idct = make([][]float64, d.n)
+	for x := range d.idct {
+		d.idct[x] = make([]float64, d.n)
+		for u := range d.idct[x] {
+			c := math.Sqrt2 / 2
+			if u > 0 {
+				w := float64(u) * math.Pi / 16
+				c = math.Sin(s8*w) / (s8 * math.Sin(w))
+			}
+			d.idct[x][u] = c / 2 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*d.n))
+		}
+	}
+	d.frame = true
+	return nil
+}
+
+func (d *decoder) readQuant(s []byte) error {
+	for len(s) > 0 {
+		precision, id := s[0]>>4, s[0]&3
+		size := 64 * (1 + int(precision))
+		if precision > 1 || len(s) < 1+size {
+			return fmt.Errorf("bad DQT segment")
+		}
+		for k := 0; k < 64; k++ {
+			if precision == 0 {
+				d.quant[id][k] = int32(s[1+k])
+			} else {
+				d.quant[id][k] = int32(s[1+2*k])<<8 | int32(s[2+2*k])
+			}
+		}
+		s = s[1+size:]
+	}
+	return nil
+}
+
+func (d *decoder) readHuffman(s []byte) error {
+	for len(s) > 0 {
+		if len(s) < 17 {
+			return fmt.Errorf("short DHT segment")
+		}
+		class, id := s[0]>>4, s[0]&3
+		var counts [16]int
+		total := 0
+		for i := range counts {
+			counts[i] = int(s[1+i])
+			total += counts[i]
+		}
+		if class > 1 || len(s) < 17+total {
+			return fmt.Errorf("bad DHT segment")
+		}
+		h := newHuffman(counts, s[17:17+total])
+		if class == 0 {
+			d.dc[id] = h
+		} else {
+			d.ac[id] = h
+		}
+		s = s[17+total:]
+	}
+	return nil
+}
+
+// decode the blocks of a scan into the planes of its components
+func (d *decoder) readScan(s []byte) error {
+	if !d.frame {
+		return fmt.Errorf("scan before frame header")
+	}
+	if len(s) < 1 || len(s) < 1+int(s[0])*2+3 {
+		return fmt.Errorf("short scan header")
+	}
+	var comps []*component
+	for i := 0; i < int(s[0]); i++ {
+		id, tables := int(s[1+i*2]), s[2+i*2]
+		var c *component
+		for j := range d.comps {
+			if d.comps[j].id == id {
+				c = &d.comps[j]
+			}
+		}
+		if c == nil {
+			return fmt.Errorf("scan of unknown component %d", id)
+		}
+		c.td, c.ta = int(tables>>4)&3, int(tables&3)
+		if d.dc[c.td] == nil || d.ac[c.ta] == nil {
+			return fmt.Errorf("missing Huffman table of component %d", id)
+		}
+		c.pred = 0
+		comps = append(comps, c)
+	}
+	d.bits, d.nbits, d.marker = 0, 0, false
+
+	// a lone component is coded block by block over its own size, an
+	// interleaved scan MCU by MCU
+	across, down := d.mcusX, d.mcusY
+	if len(comps) == 1 {
+		c := comps[0]
+		across = ((d.width*c.h+d.hmax-1)/d.hmax + 7) / 8
+		down = ((d.height*c.v+d.vmax-1)/d.vmax + 7) / 8
+	}
+
+	var coef [64]int32
+	mcu := 0
+	for my := 0; my < down; my++ {
+		for mx := 0; mx < across; mx++ {
+			if d.restart > 0 && mcu > 0 && mcu%d.restart == 0 {
+				if err := d.restartScan(comps); err != nil {
+					return err
+				}
+			}
+			mcu++
+
+			if len(comps) == 1 {
+				if err := d.block(comps[0], mx, my, &coef); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, c := range comps {
+				for v := 0; v < c.v; v++ {
+					for h := 0; h < c.h; h++ {
+						if err := d.block(c, mx*c.h+h, my*c.v+v, &coef); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// skip the RST marker ending an interval and reset the DC predictions
+func (d *decoder) restartScan(comps []*component) error {
+	for d.pos+1 < len(d.data) && !(d.data[d.pos] == 0xff && d.data[d.pos+1] != 0) {
+		d.pos++
+	}
+	if d.pos+1 >= len(d.data) || d.data[d.pos+1] < markerRST0 || d.data[d.pos+1] > markerRST7 {
+		return fmt.Errorf("missing restart marker")
+	}
+	d.pos += 2
+	d.bits, d.nbits, d.marker = 0, 0, false
+	for _, c := range comps {
+		c.pred = 0
+	}
+	return nil
+}
+
+// decode the block at bx, by of a component and write its scaled samples
+func (d *decoder) block(c *component, bx, by int, coef *[64]int32) error {
+	*coef = [64]int32{}
+	q := &d.quant[c.tq]
+
+	t, err := d.dc[c.td].decode(d)
+	if err != nil {
+		return err
+	}
+	c.pred += d.receive(int(t))
+	coef[0] = c.pred * q[0]
+
+	// every coefficient is read, but only the low frequencies are kept
+	ac := d.ac[c.ta]
+	for k := 1; k < 64; {
+		rs, err := ac.decode(d)
+		if err != nil {
+			return err
+		}
+		r, s := int(rs>>4), int(rs&15)
+		if s == 0 {
+			if r != 15 {
+				break
+			}
+			k += 16
+			continue
+		}
+		k += r
+		if k > 63 {
+			return fmt.Errorf("bad AC coefficient index")
+		}
+		v := d.receive(s)
+		if z := zigzag[k]; z%8 < d.n && z/8 < d.n {
+			coef[z] = v * q[k]
+		}
+		k++
+	}
+
+	// blocks past the planes are padding of a lone component's scan
+	n := d.n
+	x0, y0 := bx*n, by*n
+	if x0+n > c.stride || (y0+n)*c.stride > len(c.plane) {
+		return nil
+	}
+
+	// rows then columns of the n-point inverse DCT
+	var tmp [64]float64
+	for v := 0; v < n; v++ {
+		for x := 0; x < n; x++ {
+			sum := 0.0
+			for u := 0; u < n; u++ {
+				sum += float64(coef[v*8+u]) * d.idct[x][u]
+			}
+			tmp[v*8+x] = sum
+		}
+	}
+	for y := 0; y < n; y++ {
+		row := c.plane[(y0+y)*c.stride+x0:]
+		for x := 0; x < n; x++ {
+			sum := 0.0
+			for v := 0; v < n; v++ {
+				sum += tmp[v*8+x] * d.idct[y][v]
+			}
+			row[x] = clamp(math.Round(sum + 128))
+		}
+	}
+	return nil
+}
+
+func clamp(v float64) uint8 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(v)
+}
+
+// top up the bit buffer to at least 25 bits, removing stuffed zero bytes
+// and feeding zeros once a marker ends the data
+func (d *decoder) fill() {
+	for d.nbits <= 24 {
+		var b byte
+		switch {
+		case d.marker || d.pos >= len(d.data):
+			d.marker = true
+		case d.data[d.pos] != 0xff:
+			b = d.data[d.pos]
+			d.pos++
+		case d.pos+1 < len(d.data) && d.data[d.pos+1] == 0:
+			b = 0xff
+			d.pos += 2
+		default:
+			d.marker = true
+		}
+		d.bits |= uint32(b) << (24 - d.nbits)
+		d.nbits += 8
+	}
+}
+
+// read an s-bit coefficient and extend its sign
+func (d *decoder) receive(s int) int32 {
+	if s == 0 {
+		return 0
+	}
+	d.fill()
+	v := int32(d.bits >> (32 - s))
+	d.bits <<= s
+	d.nbits -= s
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v
+}
+
+// the number of bits looked up at once when decoding Huffman codes
+const lookupBits = 9
+
+// huffman decodes codes up to lookupBits long with a table and longer ones
+// by their canonical ranges
+type huffman struct {
+	// value and code length by the next lookupBits bits, length 0 for
+	// longer codes
+	lookup [1 << lookupBits]struct{ value, length uint8 }
+	// the largest code of each length, -1 for none, and the index in values
+	// of the first one
+	maxCode [17]int32
+	offset  [17]int32
+	values  []uint8
+}
+
+func newHuffman(counts [16]int, values []uint8) *huffman {
+	h := &huffman{values: values}
+	code, index := int32(0), int32(0)
+	for length := 1; length <= 16; length++ {
+		n := int32(counts[length-1])
+		h.offset[length] = index - code
+		h.maxCode[length] = -1
+		if n > 0 {
+			h.maxCode[length] = code + n - 1
+		}
+		if length <= lookupBits {
+			for i := int32(0); i < n; i++ {
+				shift := lookupBits - length
+				first := (code + i) << shift
+				for j := int32(0); j < 1<<shift; j++ {
+					h.lookup[first+j] = struct{ value, length uint8 }{values[index+i], uint8(length)}
+				}
+			}
+		}
+		code = (code + n) << 1
+		index += n
+	}
+	return h
+}
+
+func (h *huffman) decode(d *decoder) (uint8, error) {
+	d.fill()
+	if e := h.lookup[d.bits>>(32-lookupBits)]; e.length > 0 {
+		d.bits <<= e.length
+		d.nbits -= int(e.length)
+		return e.value, nil
+	}
+	for length := lookupBits + 1; length <= 16; length++ {
+		code := int32(d.bits >> (32 - length))
+		if code <= h.maxCode[length] {
+			d.bits <<= length
+			d.nbits -= length
+			return h.values[h.offset[length]+code], nil
+		}
+	}
+	return 0, fmt.Errorf("bad Huffman code")
+}
+
+// convert the planes to an image of the given size, upsampling chroma
+// by repeating samples as the standard decoder's YCbCr images do
+func (d *decoder) image(size image.Point) image.Image {
+	if len(d.comps) == 1 {
+		c := d.comps[0]
+		img := image.NewGray(image.Rect(0, 0, size.X, size.Y))
+		for y := 0; y < size.Y; y++ {
+			copy(img.Pix[y*img.Stride:(y+1)*img.Stride], c.plane[y*c.stride:])
+		}
+		return img
+	}
+
+	// Adobe files without a transform, and JFIF files whose components are
+	// named R, G and B, hold RGB samples
+	rgb := d.transform == 0 ||
+		(d.transform < 0 && d.comps[0].id == 'R' && d.comps[1].id == 'G' && d.comps[2].id == 'B')
+	img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	var samples [3]uint8
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			for i, c := range d.comps {
+				samples[i] = c.plane[(y*c.v/d.vmax)*c.stride+x*c.h/d.hmax]
+			}
+			r, g, b := samples[0], samples[1], samples[2]
+			if !rgb {
+				r, g, b = color.YCbCrToRGB(r, g, b)
+			}
+			i := y*img.Stride + x*4
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = r, g, b, 0xff
+		}
+	}
+	return img
+}
@@ -0,0 +1,121 @@
+// Package lockfile takes an advisory lock on a directory, so two runs
+// writing to the same outputs, state and cache files can't interleave. The
+// operating system releases the lock when its holder exits, so a crashed run
+// never leaves a stale one behind
+package lockfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name is the lock file created in a locked directory
+const Name = ".processor.lock"
+
+// ErrLocked is returned by Acquire when another process holds the lock
+var ErrLocked = errors.New("directory is locked by another process")
+
+// errUnsupported is returned by the platform lock where there is none
+var errUnsupported = errors.New("file locks are not supported on this platform")
+
+// Holder describes the process holding a lock, as written to the lock file
+type Holder struct {
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// Lock is a held lock on a directory
+type Lock struct {
+	file *os.File
+	path string
+}
+
+// Acquire locks dir for this process, without waiting. When another process
+// holds the lock the error wraps ErrLocked and names its holder. Where the
+// platform has no file locks, the directory isn't locked and Acquire
+// succeeds
+func Acquire(dir string) (*Lock, error) {
+	path := filepath.Join(dir, Name)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+
+		if err := lock(file); err != nil {
+			file.Close()
+			if errors.Is(err, errUnsupported) {
+				return &Lock{path: path}, nil
+			}
+			if errors.Is(err, ErrLocked) {
+				if holder, ok := readHolder(path); ok {
+					return nil, fmt.Errorf("%w: pid %d (%s) since %s", ErrLocked, holder.PID, holder.Command, holder.Started.Format(time.RFC3339))
+				}
+				return nil, ErrLocked
+			}
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+
+		// the holder may have removed the file between our open and lock,
+		// leaving us a lock on a file nobody else will open
+		if current, err := os.Stat(path); err == nil {
+			if info, err := file.Stat(); err == nil && os.SameFile(info, current) {
+				l := &Lock{file: file, path: path}
+				l.writeHolder()
+				return l, nil
+			}
+		}
+		unlock(file)
+		file.Close()
+	}
+}
+
+// Release unlocks the directory and removes the lock file
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	// removed while still locked, so no one locks the old file after us
+	removed := os.Remove(l.path) == nil
+	err := unlock(l.file)
+	l.file.Close()
+	l.file = nil
+	if !removed {
+		// Windows doesn't remove open files, ours included, and fails
+		// while another process has it open
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// record this process in the lock file, for the error of the next Acquire
+func (l *Lock) writeHolder() {
+	holder := Holder{PID: os.Getpid(), Started: time.Now()}
+	if len(os.Args) > 0 {
+		holder.Command = filepath.Base(os.Args[0])
+		if len(os.Args) > 1 {
+			holder.Command += " " + os.Args[1]
+		}
+	}
+	data, err := json.Marshal(holder)
+	if err != nil {
+		return
+	}
+	l.file.Truncate(0)
+	l.file.WriteAt(append(data, '\n'), 0)
+}
+
+// the holder recorded in the lock file at path
+func readHolder(path string) (Holder, bool) {
+	var holder Holder
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &holder) != nil || holder.PID == 0 {
+		return holder, false
+	}
+	return holder, true
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package lockfile
+
+import "os"
+
+func lock(file *os.File) error {
+	return errUnsupported
+}
+
+func unlock(file *os.File) error {
+	return nil
+}
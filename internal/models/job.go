@@ -1,8 +1,10 @@
 package models
 
 import (
-	"image"
+	"image/color"
 	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/expr"
 )
 
 type FilterType string
@@ -12,15 +14,73 @@ const (
 	FilterBlur       FilterType = "blur"
 	FilterBrightness FilterType = "brightness"
 	FilterConstrast  FilterType = "contrast"
+	FilterGamma      FilterType = "gamma"
+	FilterInvert     FilterType = "invert"
+
+	// whole-image operations
+	FilterRoundCorners FilterType = "round-corners"
+	FilterCircleMask   FilterType = "circle-mask"
+	FilterDropShadow   FilterType = "drop-shadow"
+	FilterOuterGlow    FilterType = "outer-glow"
+	FilterResize       FilterType = "resize"
+	FilterCrop         FilterType = "crop"
+	FilterSmartCrop    FilterType = "smart-crop"
+
+	// the image piped through an external command
+	FilterExec FilterType = "exec"
+
+	// per-pixel color math from the configuration
+	FilterExpression FilterType = "expression"
+)
+
+// Priority orders the jobs waiting for a decode worker: queued jobs of a
+// higher priority are started first, whatever their submission order
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
 )
 
 // single image processing job
 type ImageJob struct {
 	ID         string
+	Index      int
 	InputPath  string
 	OutputPath string
 	Filter     FilterType
 	Params     FilterParams
+
+	// pipeline DAG and the files written from it; OutputPath is the first
+	// output's path and Filter names the whole pipeline
+	Steps   []PipelineStep
+	Outputs []PipelineOutput
+
+	// set when the job is queued, to measure how long it waited for a worker
+	SubmittedAt time.Time
+	// queue the job waits in; empty is normal
+	Priority Priority
+
+	// W3C traceparent of the span the job was submitted under, so its spans
+	// join the caller's trace; empty starts a new trace
+	TraceParent string
+}
+
+// one filter of a pipeline with its own parameters, applied to the result
+// of the Input step
+type PipelineStep struct {
+	ID     string
+	Input  string
+	Filter FilterType
+	Params FilterParams
+}
+
+// a file written from the result of a pipeline step
+type PipelineOutput struct {
+	Name string
+	From string
+	Path string
 }
 
 // parameters for different filters
@@ -28,45 +88,396 @@ type FilterParams struct {
 	BlurRadius float64
 	Brightness float64
 	Contrast   float64
+	Gamma      float64
 	Quality    int
+
+	// run point filters with the scalar loops instead of the vectorized ones
+	Scalar bool
+
+	// cpu, gpu or auto, which uses the GPU for blur and resize on images of
+	// at least GPUMinPixels
+	Backend      string
+	GPUMinPixels int64
+
+	// the level a point filter maps each color channel level to, built once
+	// from the other params; nil computes levels per pixel
+	Table *[256]uint8
+
+	// corner radius in pixels, or percent of the shorter side when CornerRadiusPercent is set
+	CornerRadius        float64
+	CornerRadiusPercent bool
+
+	// drop shadow rendered behind the alpha silhouette
+	ShadowOffsetX int
+	ShadowOffsetY int
+	ShadowBlur    float64
+	ShadowColor   color.NRGBA
+	ShadowOpacity float64
+
+	// glow rendered around the alpha silhouette
+	GlowRadius  float64
+	GlowColor   color.NRGBA
+	GlowOpacity float64
+
+	// target size for resize, a zero side keeps the aspect ratio
+	ResizeWidth  int
+	ResizeHeight int
+
+	// crop rectangle, clipped to the image
+	CropX      int
+	CropY      int
+	CropWidth  int
+	CropHeight int
+
+	// aspect ratio smart crop cuts to, and how it scores regions
+	SmartCropAspect   float64
+	SmartCropStrategy string
+
+	// command the exec filter pipes the image through, and its time limit
+	ExecCommand []string
+	ExecTimeout time.Duration
+
+	// compiled color math of the expression filter
+	Expression *expr.Program
+
+	// settings of a filter loaded from a plugin
+	Plugin map[string]string
 }
 
 // result of processing image
 type ProcessingResult struct {
+	// position of the input in the batch
+	Index          int
 	InputPath      string
 	OutputPath     string
 	ProcessingTime time.Duration
-	Error          error
-	Metadata       ImageMetadata
+	// time between submission and a decode worker starting the job,
+	// including any wait for the memory budget
+	QueueWait time.Duration
+	Error     error
+	Metadata  ImageMetadata
+	// every file written for a branching pipeline, first one matching
+	// OutputPath and Metadata
+	Outputs []OutputFile
+	// finished by a previous run recorded in the state file, so not
+	// processed again
+	Resumed bool
+	// unchanged since a previous run recorded it in the incremental index,
+	// so not processed again
+	UpToDate bool
+	// outputs copied from the processing cache
+	Cached bool
+	// filtered and encoded a band of rows at a time while decoding
+	Streamed bool
+	// outputs are copies or links of the input, which the pipeline leaves
+	// unchanged
+	Unchanged bool
+	// near-duplicate of this earlier input, so skipped or linked to its
+	// outputs instead of processed
+	DuplicateOf string
+	// the duplicate has the same bytes as DuplicateOf, and its outputs are
+	// copies or links of those of DuplicateOf
+	Identical bool
+	Resources ResourceUsage
+}
+
+// resources a job used, to size workers and budgets and find the images
+// that cost the most
+type ResourceUsage struct {
+	// most bytes of pixel buffers the job held at once, estimated from the
+	// decoded image, strips and pipeline nodes
+	PeakMemory int64
+	// time spent working on the job by the decode, filter, row and encode
+	// workers together
+	CPUTime time.Duration
+	// garbage collections, and their stop-the-world pauses, while the job
+	// was in flight; jobs running at the same time share them
+	GCCycles int64
+	GCPause  time.Duration
+}
+
+// a file written by one pipeline output
+type OutputFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+
+	// JPEG quality chosen for target_size or target_ssim
+	Quality int `json:"quality,omitempty"`
+
+	// content-addressed outputs: the SHA-256 of the file, and the path it
+	// would have been written to otherwise
+	SHA256      string `json:"sha256,omitempty"`
+	LogicalPath string `json:"logical_path,omitempty"`
 }
 
 // info of processed image
 type ImageMetadata struct {
-	Width         int
-	Height        int
+	Width  int
+	Height int
+	// dimensions of the decoded input
+	SourceWidth   int
+	SourceHeight  int
 	Format        string
 	OriginalSize  int64
 	ProcessedSize int64
 	RowsProcessed int
+	Geo           *GeoMetadata
+	Timings       StageTimings
 }
 
-// job for processing a single row
-type RowJob struct{
-	ImageID string
-	RowIndex int
-	Pixels []uint8
-	Width int
-	Bounds image.Rectangle
-	Filter FilterType
-	Params FilterParams
+// time a job spent in each stage, to find the slow one instead of reading
+// a single duration. Streamed jobs decode, filter and encode a band of rows
+// at a time, so only have their strips; outputs restored from the cache or
+// copied unchanged have none
+type StageTimings struct {
+	// reading and decoding the input
+	Decode time.Duration
+	// each pipeline step, in the order they ran; point filters that run
+	// as one pass are one step
+	Steps []StepTiming
+	// encoding the outputs, including any quality search, and writing
+	// their bytes and any GeoTIFF tags or ICC profile to disk
+	Encode time.Duration
+	Write  time.Duration
+	// every strip of rows filtered, with strip_timings set
+	Strips []StripTiming
+}
+
+// time of one pipeline step
+type StepTiming struct {
+	ID       string
+	Filter   FilterType
+	Duration time.Duration
+}
+
+// time of one strip of rows through a row filter
+type StripTiming struct {
+	// ID of the step it belongs to
+	Step     string
+	StartRow int
+	EndRow   int
+	Duration time.Duration
+}
+
+// GeoTIFF georeferencing carried from input to output
+type GeoMetadata struct {
+	PixelScale     []float64 `json:"pixel_scale,omitempty"`
+	Tiepoints      []float64 `json:"tiepoints,omitempty"`
+	Transformation []float64 `json:"transformation,omitempty"`
+	GeoKeys        []uint16  `json:"geo_keys,omitempty"`
+	GeoDoubles     []float64 `json:"geo_doubles,omitempty"`
+	GeoASCII       string    `json:"geo_ascii,omitempty"`
+	EPSG           int       `json:"epsg,omitempty"`
 }
 
-// result of processing single row
-type RowResult struct{
-	ImageID string
-	RowIndex int
-	Pixels []uint8
-	Error error
+// job for processing a horizontal strip of rows. Pixels holds rows
+// [StartRow-Top, EndRow+Bottom) so neighborhood filters see the rows around
+// the strip; only rows [StartRow, EndRow) are kept from the result
+type StripJob struct {
+	ImageID  string
+	StartRow int
+	EndRow   int
+	Top      int
+	Bottom   int
+	Pixels   []uint8
+	Width    int
+	Filter   FilterType
+	Params   FilterParams
+}
+
+// result of processing a single strip, holding only rows [StartRow, EndRow)
+type StripResult struct {
+	ImageID  string
+	StartRow int
+	EndRow   int
+	Pixels   []uint8
+	Error    error
 	Duration time.Duration
 }
 
+// comparison of one file present in both baseline and compare directories
+type DiffResult struct {
+	Name          string  `json:"name"`
+	Status        string  `json:"status"`
+	ChangedPixels int     `json:"changed_pixels"`
+	ChangedRatio  float64 `json:"changed_ratio"`
+	MaxDelta      int     `json:"max_delta"`
+	MaskPath      string  `json:"mask_path,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// diff statuses
+const (
+	DiffUnchanged = "unchanged"
+	DiffChanged   = "changed"
+	DiffMissing   = "missing"
+	DiffAdded     = "added"
+	DiffError     = "error"
+)
+
+// report of a directory comparison
+type DiffReport struct {
+	BaselineDir string         `json:"baseline_dir"`
+	CompareDir  string         `json:"compare_dir"`
+	Threshold   int            `json:"threshold"`
+	Results     []DiffResult   `json:"results"`
+	Summary     map[string]int `json:"summary"`
+}
+
+// report of near-duplicate images found by perceptual hash
+type DuplicateReport struct {
+	Algorithm string             `json:"algorithm"`
+	Threshold int                `json:"threshold"`
+	Images    int                `json:"images"`
+	Clusters  []DuplicateCluster `json:"clusters"`
+	Errors    []ImageHash        `json:"errors,omitempty"`
+}
+
+// an image and the later ones within the threshold of it
+type DuplicateCluster struct {
+	Original   ImageHash   `json:"original"`
+	Duplicates []ImageHash `json:"duplicates"`
+}
+
+// perceptual hash of one image, and its Hamming distance from the original
+// of its cluster
+type ImageHash struct {
+	Path     string `json:"path"`
+	Hash     string `json:"hash,omitempty"`
+	Distance int    `json:"distance"`
+	Error    string `json:"error,omitempty"`
+}
+
+// statistics of one file in stats mode, for automated quality checks
+type ImageStats struct {
+	Path      string        `json:"path"`
+	Width     int           `json:"width,omitempty"`
+	Height    int           `json:"height,omitempty"`
+	Red       *ChannelStats `json:"red,omitempty"`
+	Green     *ChannelStats `json:"green,omitempty"`
+	Blue      *ChannelStats `json:"blue,omitempty"`
+	Luminance *ChannelStats `json:"luminance,omitempty"`
+	// variance of the Laplacian of the luminance; higher is sharper
+	Sharpness float64 `json:"sharpness,omitempty"`
+	// percent of pixels with every channel at 0, or any at 255
+	ClippedShadows    float64 `json:"clipped_shadows,omitempty"`
+	ClippedHighlights float64 `json:"clipped_highlights,omitempty"`
+	Error             string  `json:"error,omitempty"`
+}
+
+// distribution of one channel over the opaque pixels of an image
+type ChannelStats struct {
+	Mean      float64 `json:"mean"`
+	Std       float64 `json:"std"`
+	Histogram []int   `json:"histogram,omitempty"`
+}
+
+// description of one file in inspect mode
+type ImageInfo struct {
+	Path       string       `json:"path"`
+	Format     string       `json:"format,omitempty"`
+	Width      int          `json:"width,omitempty"`
+	Height     int          `json:"height,omitempty"`
+	ColorModel string       `json:"color_model,omitempty"`
+	BitDepth   int          `json:"bit_depth,omitempty"`
+	Size       int64        `json:"size"`
+	Exif       *ExifSummary `json:"exif,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// commonly used EXIF fields
+type ExifSummary struct {
+	Make         string  `json:"make,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Lens         string  `json:"lens,omitempty"`
+	Software     string  `json:"software,omitempty"`
+	DateTime     string  `json:"date_time,omitempty"`
+	Orientation  int     `json:"orientation,omitempty"`
+	ExposureTime string  `json:"exposure_time,omitempty"`
+	FNumber      float64 `json:"f_number,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"`
+	GPS          bool    `json:"gps,omitempty"`
+}
+
+// outcome of decoding one file in validate mode
+type ValidationResult struct {
+	Path            string `json:"path"`
+	Status          string `json:"status"`
+	Format          string `json:"format,omitempty"`
+	ExtensionFormat string `json:"extension_format,omitempty"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	Size            int64  `json:"size"`
+	Error           string `json:"error,omitempty"`
+}
+
+// validation statuses
+const (
+	ValidationValid      = "valid"
+	ValidationMismatched = "mismatched"
+	ValidationCorrupt    = "corrupt"
+)
+
+// report of validating a directory
+type ValidationReport struct {
+	InputDir string             `json:"input_dir"`
+	Results  []ValidationResult `json:"results"`
+	Summary  map[string]int     `json:"summary"`
+}
+
+// outcome of recompressing one file in optimize mode
+type OptimizeResult struct {
+	Path          string `json:"path"`
+	OutputPath    string `json:"output_path,omitempty"`
+	Format        string `json:"format,omitempty"`
+	OriginalSize  int64  `json:"original_size"`
+	OptimizedSize int64  `json:"optimized_size,omitempty"`
+	Saved         int64  `json:"saved"`
+	Skipped       bool   `json:"skipped,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// report of optimizing a directory; sizes total the files optimized
+type OptimizeReport struct {
+	Images        int              `json:"images"`
+	OriginalSize  int64            `json:"original_size"`
+	OptimizedSize int64            `json:"optimized_size"`
+	Saved         int64            `json:"saved"`
+	Skipped       int              `json:"skipped"`
+	Errors        int              `json:"errors"`
+	Results       []OptimizeResult `json:"results"`
+}
+
+// changed tile emitted for incremental re-rendering
+type TileChange struct {
+	Column int    `json:"column"`
+	Row    int    `json:"row"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Path   string `json:"path"`
+}
+
+// changed tiles of one image pair
+type TileManifest struct {
+	Name       string       `json:"name"`
+	Status     string       `json:"status"`
+	Width      int          `json:"width,omitempty"`
+	Height     int          `json:"height,omitempty"`
+	TotalTiles int          `json:"total_tiles,omitempty"`
+	Full       bool         `json:"full,omitempty"`
+	Tiles      []TileChange `json:"tiles,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// manifest of all changed tiles in a run
+type TileReport struct {
+	TileSize int            `json:"tile_size"`
+	Filter   FilterType     `json:"filter"`
+	Images   []TileManifest `json:"images"`
+}
@@ -0,0 +1,20 @@
+// Package nice lowers the operating system's scheduling priority of the
+// running process, so a long batch run leaves the CPU and disk to
+// foreground work
+package nice
+
+import "errors"
+
+// ErrUnsupported is returned by Lower where the platform has no process
+// priority to lower
+var ErrUnsupported = errors.New("process priority not supported on this platform")
+
+// Lower sets the niceness of the process, from 1 to 19 as with nice(1),
+// without raising a priority that is already lower, and lowers its disk
+// priority where the platform allows
+func Lower(niceness int) error {
+	if niceness <= 0 {
+		return nil
+	}
+	return lower(min(niceness, 19))
+}
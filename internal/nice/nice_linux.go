@@ -0,0 +1,56 @@
+package nice
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ioprio_set arguments: a thread's best-effort class at its lowest level
+const (
+	ioprioWhoProcess = 1
+	ioprioClassBE    = 2
+	ioprioClassShift = 13
+	ioprioLowest     = 7
+)
+
+// Linux keeps the niceness and I/O priority of each thread, and threads
+// inherit them from the one that creates them, so every thread the Go
+// runtime has started is lowered and later ones follow
+func lower(niceness int) error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return lowerThread(0, niceness)
+	}
+	var first error
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// threads can exit while being walked
+		if err := lowerThread(tid, niceness); err != nil && err != syscall.ESRCH && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func lowerThread(tid, niceness int) error {
+	// the raw syscall returns 20 minus the niceness
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+	if err != nil {
+		return err
+	}
+	if 20-prio < niceness {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, niceness); err != nil {
+			return err
+		}
+	}
+
+	ioprio := ioprioClassBE<<ioprioClassShift | ioprioLowest
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
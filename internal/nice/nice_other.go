@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package nice
+
+func lower(niceness int) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build unix && !linux
+
+package nice
+
+import "syscall"
+
+func lower(niceness int) error {
+	current, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		return err
+	}
+	if current >= niceness {
+		return nil
+	}
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, niceness)
+}
@@ -0,0 +1,35 @@
+package nice
+
+import "syscall"
+
+// priority classes of SetPriorityClass
+const (
+	belowNormalPriorityClass = 0x4000
+	idlePriorityClass        = 0x40
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	getPriorityClass = kernel32.NewProc("GetPriorityClass")
+	setPriorityClass = kernel32.NewProc("SetPriorityClass")
+)
+
+// Windows has priority classes rather than niceness: below normal, or idle
+// from a niceness of 15
+func lower(niceness int) error {
+	class := belowNormalPriorityClass
+	if niceness >= 15 {
+		class = idlePriorityClass
+	}
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if current, _, _ := getPriorityClass.Call(uintptr(process)); current == idlePriorityClass {
+		return nil
+	}
+	if ok, _, err := setPriorityClass.Call(uintptr(process), uintptr(class)); ok == 0 {
+		return err
+	}
+	return nil
+}
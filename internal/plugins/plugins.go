@@ -0,0 +1,177 @@
+// Package plugins loads custom filters and job hooks from Go plugins, so
+// they can be shipped without changing this repository
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"sync"
+)
+
+// Symbol is the name a plugin exports its filter under
+const Symbol = "Filter"
+
+// HookSymbol is the name a plugin exports its hook under
+const HookSymbol = "Hook"
+
+// CustomFilter is the filter a plugin exports as its Filter variable. It
+// works on strips of RGBA rows like the built-in row filters, so only the
+// standard library is needed to build one:
+//
+//	package main
+//
+//	type sepia struct{}
+//
+//	func (sepia) Name() string { return "sepia" }
+//
+//	func (sepia) Apply(src []uint8, width int, params map[string]string) []uint8 { ... }
+//
+//	var Filter sepia
+//
+// built with go build -buildmode=plugin, by the same Go version as the
+// processor. params are the filter's settings from its filters section or
+// pipeline step
+type CustomFilter interface {
+	Name() string
+	Apply(src []uint8, width int, params map[string]string) []uint8
+}
+
+// Overlapper is implemented by neighborhood filters, which need rows of
+// context above and below each strip
+type Overlapper interface {
+	Overlap(params map[string]string) int
+}
+
+// Describer is implemented by filters that document themselves for the
+// filters command, the /filters endpoint and generated config files.
+// Settings maps each setting the filter takes to its default, which it gets
+// unless its filters section or pipeline step sets another
+type Describer interface {
+	Doc() string
+	Settings() map[string]string
+}
+
+// CustomHook is the hook a plugin exports as its Hook variable, run around
+// every job like the processor's own hooks and with the same methods, so
+// again only the standard library is needed. A plugin can export a hook, a
+// filter or both
+type CustomHook interface {
+	BeforeDecode(ctx context.Context, input string) error
+	AfterDecode(ctx context.Context, input string, img image.Image) error
+	BeforeEncode(ctx context.Context, input, output string, img image.Image) error
+	AfterSave(ctx context.Context, input, output string) error
+}
+
+var (
+	mu      sync.RWMutex
+	loaded  = map[string]CustomFilter{}
+	hooks   []CustomHook
+	fromDir string
+)
+
+// Load opens every .so file in dir and registers its filter and hook.
+// Plugins can't be unloaded, so only the first directory loaded counts and
+// later calls with it do nothing
+func Load(dir string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if fromDir != "" {
+		if filepath.Clean(dir) != fromDir {
+			return fmt.Errorf("plugins are already loaded from %s", fromDir)
+		}
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	filters := map[string]CustomFilter{}
+	var found []CustomHook
+	for _, path := range paths {
+		filter, hook, err := open(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if hook != nil {
+			found = append(found, hook)
+		}
+		if filter == nil {
+			continue
+		}
+		if _, ok := filters[filter.Name()]; ok {
+			return fmt.Errorf("%s: filter %q is defined by another plugin", filepath.Base(path), filter.Name())
+		}
+		filters[filter.Name()] = filter
+	}
+	loaded, hooks, fromDir = filters, found, filepath.Clean(dir)
+	return nil
+}
+
+// the filter and hook a plugin file exports, either of which may be nil
+// but not both
+func open(path string) (CustomFilter, CustomHook, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// variables are looked up as pointers to them
+	var filter CustomFilter
+	if sym, err := p.Lookup(Symbol); err == nil {
+		var ok bool
+		if filter, ok = sym.(CustomFilter); !ok {
+			return nil, nil, errors.New("the exported Filter doesn't implement Name() string and Apply([]uint8, int, map[string]string) []uint8")
+		}
+		if filter.Name() == "" {
+			return nil, nil, errors.New("filter has no name")
+		}
+	}
+	var hook CustomHook
+	if sym, err := p.Lookup(HookSymbol); err == nil {
+		var ok bool
+		if hook, ok = sym.(CustomHook); !ok {
+			return nil, nil, errors.New("the exported Hook doesn't implement BeforeDecode, AfterDecode, BeforeEncode and AfterSave")
+		}
+	}
+	if filter == nil && hook == nil {
+		return nil, nil, errors.New("exports neither a Filter nor a Hook")
+	}
+	return filter, hook, nil
+}
+
+// Hooks returns the loaded hooks in the order of their files' names
+func Hooks() []CustomHook {
+	mu.RLock()
+	defer mu.RUnlock()
+	return hooks
+}
+
+// Lookup returns the loaded filter with the given name
+func Lookup(name string) (CustomFilter, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	filter, ok := loaded[name]
+	return filter, ok
+}
+
+// Names returns the names of the loaded filters, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(loaded))
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+)
+
+// Background is composited behind transparent pixels before an image is
+// encoded to a format without an alpha channel
+type Background struct {
+	mode    string
+	from    color.NRGBA
+	to      color.NRGBA
+	angle   float64
+	pattern image.Image
+}
+
+// create background from config, returns nil when no background is configured
+func NewBackground(cfg *config.Config) (*Background, error) {
+	if cfg.Background == "" {
+		return nil, nil
+	}
+
+	bg := &Background{
+		mode:  cfg.Background,
+		angle: cfg.BackgroundAngle * math.Pi / 180,
+	}
+
+	var err error
+	if bg.from, err = config.ParseColor(cfg.BackgroundColor); err != nil {
+		return nil, err
+	}
+	if bg.to, err = config.ParseColor(cfg.BackgroundColorEnd); err != nil {
+		return nil, err
+	}
+
+	if bg.mode == "pattern" {
+		file, err := os.Open(cfg.BackgroundPattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open background pattern: %w", err)
+		}
+		defer file.Close()
+
+		if bg.pattern, _, err = image.Decode(file); err != nil {
+			return nil, fmt.Errorf("failed to decode background pattern: %w", err)
+		}
+		// tiling steps by the pattern's size, so an empty one never ends
+		if bg.pattern.Bounds().Empty() {
+			return nil, fmt.Errorf("background pattern %s is empty", cfg.BackgroundPattern)
+		}
+	}
+
+	return bg, nil
+}
+
+// Composite returns a copy of img drawn over the background
+func (b *Background) Composite(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+
+	switch b.mode {
+	case "color":
+		draw.Draw(dst, bounds, image.NewUniform(b.from), image.Point{}, draw.Src)
+	case "pattern":
+		b.tile(dst)
+	default:
+		b.gradient(dst)
+	}
+
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
+
+// repeat the pattern image across the whole canvas
+func (b *Background) tile(dst *image.RGBA) {
+	bounds := dst.Bounds()
+	pb := b.pattern.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += pb.Dy() {
+		for x := bounds.Min.X; x < bounds.Max.X; x += pb.Dx() {
+			draw.Draw(dst, image.Rect(x, y, x+pb.Dx(), y+pb.Dy()), b.pattern, pb.Min, draw.Src)
+		}
+	}
+}
+
+// fill with a linear gradient along the configured angle, or a radial
+// gradient from the centre out to the corners
+func (b *Background) gradient(dst *image.RGBA) {
+	bounds := dst.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	cx, cy := w/2, h/2
+	dx, dy := math.Cos(b.angle), math.Sin(b.angle)
+
+	// half the extent of the image projected onto the gradient direction
+	extent := (math.Abs(dx)*w + math.Abs(dy)*h) / 2
+	maxDist := math.Hypot(cx, cy)
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			px, py := float64(x)+0.5-cx, float64(y)+0.5-cy
+
+			var t float64
+			if b.mode == "radial" {
+				t = math.Hypot(px, py) / maxDist
+			} else {
+				t = ((px*dx+py*dy)/extent + 1) / 2
+			}
+			t = math.Max(0, math.Min(1, t))
+
+			dst.Set(bounds.Min.X+x, bounds.Min.Y+y, color.NRGBA{
+				R: lerp(b.from.R, b.to.R, t),
+				G: lerp(b.from.G, b.to.G, t),
+				B: lerp(b.from.B, b.to.B, t),
+				A: lerp(b.from.A, b.to.A, t),
+			})
+		}
+	}
+}
+
+func lerp(a, b uint8, t float64) uint8 {
+	return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t))
+}
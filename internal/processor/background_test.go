@@ -0,0 +1,35 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+)
+
+// an empty pattern is refused when loaded, since tiling it would never end
+func TestBackgroundEmptyPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.gif")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(file, image.NewPaletted(image.Rect(0, 0, 0, 0), color.Palette{color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Background, cfg.BackgroundPattern = "pattern", path
+	if _, err := NewBackground(cfg); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("error %v, want the pattern refused", err)
+	}
+}
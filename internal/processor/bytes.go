@@ -0,0 +1,81 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// ProcessBytes runs pipeline on the encoded image data and returns its
+// first output encoded the same way, for callers such as serverless
+// functions whose images arrive and leave as byte slices. A nil pipeline
+// runs the processor's own. The image passes through a temporary directory
+// that is removed before returning, so outputs aren't kept by content and
+// the input is never edited in place
+func (p *Processor) ProcessBytes(ctx context.Context, data []byte, pipeline []config.PipelineStep) ([]byte, models.ImageMetadata, error) {
+	ext := DetectExtension(data)
+	if ext == "" {
+		return nil, models.ImageMetadata{}, ErrUnsupportedFormat
+	}
+
+	view, err := p.bytesView(pipeline)
+	if err != nil {
+		return nil, models.ImageMetadata{}, err
+	}
+
+	dir, err := os.MkdirTemp("", "imgproc-")
+	if err != nil {
+		return nil, models.ImageMetadata{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input"+ext)
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		return nil, models.ImageMetadata{}, err
+	}
+	outputDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		return nil, models.ImageMetadata{}, err
+	}
+
+	result := view.ProcessFile(ctx, input, outputDir)
+	if result.Error != nil {
+		return nil, result.Metadata, result.Error
+	}
+	output, err := os.ReadFile(result.Outputs[0].Path)
+	if err != nil {
+		return nil, result.Metadata, fmt.Errorf("failed to read output: %w", err)
+	}
+	return output, result.Metadata, nil
+}
+
+// a copy of the processor writing only to the directory it is given,
+// running pipeline instead of its own when that isn't nil
+func (p *Processor) bytesView(pipeline []config.PipelineStep) (*Processor, error) {
+	cfg := *p.config
+	cfg.ContentAddressed = false
+	cfg.InPlace = false
+
+	view := *p
+	view.config = &cfg
+	if pipeline == nil {
+		return &view, nil
+	}
+
+	cfg.Pipeline = pipeline
+	cfg.PipelineOutputs = nil
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid pipeline: %w", err)
+	}
+	steps, err := pipelineSteps(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	view.steps, view.outputs = steps, cfg.Outputs()
+	view.params = filterParams(&cfg)
+	return &view, nil
+}
@@ -0,0 +1,174 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// identify everything that decides the pixels and encoding of a job's
+// outputs, but not where they are written
+func (p *Processor) pipelineFingerprint() string {
+	cfg := p.config
+	data, _ := json.Marshal(struct {
+		Steps       []models.PipelineStep
+		Outputs     interface{}
+		Format      string
+		Quality     []interface{}
+		Compression []string
+		Background  []interface{}
+		ICC         bool
+		Dicom       []float64
+		Fits        []interface{}
+		ScaledJPEG  bool
+		Unchanged   string
+	}{
+		p.steps, p.outputs, cfg.OutputFormat,
+		[]interface{}{cfg.Quality, cfg.TargetSize, cfg.TargetSSIM},
+		[]string{cfg.PNGCompression, cfg.TIFFCompression},
+		[]interface{}{cfg.Background, cfg.BackgroundColor, cfg.BackgroundColorEnd, cfg.BackgroundAngle, cfg.BackgroundPattern},
+		cfg.KeepICCProfile,
+		[]float64{cfg.DicomWindowCenter, cfg.DicomWindowWidth},
+		[]interface{}{cfg.FitsStretch, cfg.FitsBitDepth},
+		cfg.JPEGScaledDecode,
+		cfg.UnchangedOutputs,
+	})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cache key of a job: the SHA-256 of the input's contents, the pipeline and
+// the extensions of its outputs
+func (p *Processor) cacheKey(job models.ImageJob) (string, error) {
+	file, err := os.Open(job.InputPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	fmt.Fprint(h, p.pipelineFingerprint())
+	// manifest jobs carry their own pipeline and parameters
+	steps, _ := json.Marshal(struct {
+		Steps  []models.PipelineStep
+		Params models.FilterParams
+	}{job.Steps, job.Params})
+	h.Write(steps)
+	for _, output := range job.Outputs {
+		fmt.Fprint(h, filepath.Ext(output.Path))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// directory holding the outputs cached under key
+func (p *Processor) cacheEntry(key string) string {
+	return filepath.Join(p.config.CacheDir, key[:2], key)
+}
+
+// copy a job's cached outputs into place. Returns false on a cache miss
+func (p *Processor) restoreCached(sj *stageJob, key string) (bool, error) {
+	dir := p.cacheEntry(key)
+	data, err := os.ReadFile(filepath.Join(dir, "entry.json"))
+	if err != nil {
+		return false, nil
+	}
+	var files []models.OutputFile
+	if err := json.Unmarshal(data, &files); err != nil || len(files) != len(sj.job.Outputs) {
+		return false, nil
+	}
+
+	for i, output := range sj.job.Outputs {
+		if err := copyFile(filepath.Join(dir, cachedName(i, output.Path)), output.Path); err != nil {
+			return false, err
+		}
+
+		file := files[i]
+		file.Name, file.Path = output.Name, output.Path
+		if p.config.ContentAddressed {
+			contentPath, hash, err := p.contentAddress(output.Path)
+			if err != nil {
+				return false, err
+			}
+			file.Path, file.SHA256, file.LogicalPath = contentPath, hash, output.Path
+		}
+		sj.result.Outputs = append(sj.result.Outputs, file)
+	}
+
+	first := sj.result.Outputs[0]
+	sj.result.OutputPath = first.Path
+	sj.result.Metadata.Width, sj.result.Metadata.Height = first.Width, first.Height
+	sj.result.Metadata.ProcessedSize = first.Size
+	sj.result.Cached = true
+	return true, nil
+}
+
+// copy a job's written outputs into the cache. The entry is assembled in a
+// temporary directory and renamed into place, so readers never see a
+// partial one
+func (p *Processor) storeCached(sj *stageJob) error {
+	dir := p.cacheEntry(sj.cacheKey)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for i, file := range sj.result.Outputs {
+		if err := copyFile(file.Path, filepath.Join(tmp, cachedName(i, sj.job.Outputs[i].Path))); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(sj.result.Outputs)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "entry.json"), data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil && !os.IsExist(err) {
+		// another job with the same input stored it first
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// name of the i-th output inside a cache entry
+func cachedName(i int, outputPath string) string {
+	return fmt.Sprintf("%d%s", i, strings.ToLower(filepath.Ext(outputPath)))
+}
+
+// copy src to dst, replacing dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,205 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// first line of a state file, identifying the run it belongs to
+type checkpointHeader struct {
+	Fingerprint string    `json:"fingerprint"`
+	Started     time.Time `json:"started"`
+}
+
+// one finished job. The input's size and modification time are kept so a
+// changed input is processed again
+type checkpointEntry struct {
+	Input   string              `json:"input"`
+	Size    int64               `json:"size"`
+	ModTime time.Time           `json:"mod_time"`
+	Error   string              `json:"error,omitempty"`
+	Outputs []models.OutputFile `json:"outputs,omitempty"`
+}
+
+// state of a batch run, appended to a JSON lines file as jobs finish so an
+// interrupted run can skip the work it already did
+type checkpoint struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]checkpointEntry
+}
+
+// open the state file at path, loading the entries of a previous run with
+// the same fingerprint; a state file from a different configuration is
+// replaced
+func openCheckpoint(path, fingerprint string) (*checkpoint, bool, error) {
+	cp := &checkpoint{entries: map[string]checkpointEntry{}}
+	resumed := false
+
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+		var header checkpointHeader
+		if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &header) == nil && header.Fingerprint == fingerprint {
+			resumed = true
+			for scanner.Scan() {
+				var entry checkpointEntry
+				// a line cut short by a crash is skipped
+				if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+					cp.entries[entry.Input] = entry
+				}
+			}
+		}
+		file.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	cp.file = file
+
+	if !resumed {
+		if err := cp.append(checkpointHeader{Fingerprint: fingerprint, Started: time.Now()}); err != nil {
+			file.Close()
+			return nil, false, err
+		}
+	}
+	return cp, resumed, nil
+}
+
+// the recorded result of an input that was processed successfully and
+// hasn't changed since, with all of its outputs still present
+func (cp *checkpoint) completed(path string) (checkpointEntry, bool) {
+	entry, ok := cp.entries[path]
+	if !ok || entry.Error != "" {
+		return entry, false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+		return entry, false
+	}
+	for _, output := range entry.Outputs {
+		if _, err := os.Stat(output.Path); err != nil {
+			return entry, false
+		}
+	}
+	return entry, true
+}
+
+// record a finished job. Jobs that were skipped or interrupted by shutdown
+// are left out, so they run again on resume
+func (cp *checkpoint) record(result models.ProcessingResult) error {
+	if errors.Is(result.Error, ErrSkipped) || errors.Is(result.Error, context.Canceled) {
+		return nil
+	}
+
+	info, err := os.Stat(result.InputPath)
+	if err != nil {
+		return err
+	}
+	entry := checkpointEntry{
+		Input:   result.InputPath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Outputs: result.Outputs,
+	}
+	if result.Error != nil {
+		entry.Error = result.Error.Error()
+	}
+	return cp.append(entry)
+}
+
+// write one JSON line
+func (cp *checkpoint) append(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, err = cp.file.Write(append(data, '\n'))
+	return err
+}
+
+// close the state file
+func (cp *checkpoint) Close() error {
+	return cp.file.Close()
+}
+
+// identify the configuration that produces a run's outputs, so a state file
+// is only resumed by the same command
+func (p *Processor) runFingerprint() string {
+	sum := sha256.Sum256([]byte(p.pipelineFingerprint() + p.config.OutputDir))
+	return hex.EncodeToString(sum[:])
+}
+
+// result of an input completed by a previous run
+func resumedResult(index int, entry checkpointEntry) models.ProcessingResult {
+	result := models.ProcessingResult{
+		Index:     index,
+		InputPath: entry.Input,
+		Outputs:   entry.Outputs,
+		Resumed:   true,
+	}
+	if len(entry.Outputs) > 0 {
+		result.OutputPath = entry.Outputs[0].Path
+		result.Metadata.Width = entry.Outputs[0].Width
+		result.Metadata.Height = entry.Outputs[0].Height
+		result.Metadata.ProcessedSize = entry.Outputs[0].Size
+	}
+	result.Metadata.OriginalSize = entry.Size
+	return result
+}
+
+// load the state file and split the inputs into those to process and the
+// results of those already done
+func (p *Processor) resume(imagePaths []string) (*checkpoint, []int, []models.ProcessingResult, error) {
+	cp, resumed, err := openCheckpoint(p.config.StateFile, p.runFingerprint())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+
+	var pending []int
+	var done []models.ProcessingResult
+	for i, path := range imagePaths {
+		if entry, ok := cp.completed(path); ok {
+			done = append(done, resumedResult(i, entry))
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	if resumed {
+		p.logger.WithFields(map[string]interface{}{
+			"state_file": p.config.StateFile,
+			"completed":  len(done),
+			"remaining":  len(pending),
+		}).Info("Resuming previous run")
+	}
+	return cp, pending, done, nil
+}
@@ -0,0 +1,163 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Rename is an output given another name because another input's output
+// already had its path
+type Rename struct {
+	Input   string `json:"input"`
+	Path    string `json:"path"`
+	Renamed string `json:"renamed"`
+}
+
+// the output paths of a run and the inputs writing them, so two inputs
+// with the same name in different directories don't overwrite each other's
+// outputs. The first input to claim a path keeps it; with the sequential
+// walk, inputs are found in name order and the names are the same on every
+// run
+type outputNames struct {
+	mu      sync.Mutex
+	owners  map[string]string
+	renames []Rename
+}
+
+func newOutputNames() *outputNames {
+	return &outputNames{owners: map[string]string{}}
+}
+
+// the key of path in owners; on case-insensitive filesystems, names
+// differing only in case are the same file
+func nameKey(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// reserve outputs for input as they are, such as those a resumed run keeps
+func (n *outputNames) reserve(input string, outputs []models.OutputFile) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, output := range outputs {
+		// a content-addressed output was claimed by its usual name
+		path := output.Path
+		if output.LogicalPath != "" {
+			path = output.LogicalPath
+		}
+		if _, taken := n.owners[nameKey(path)]; !taken {
+			n.owners[nameKey(path)] = input
+		}
+	}
+}
+
+// the job of the input at path in a batch run, with its output paths
+// claimed
+func (p *Processor) batchJob(i int, path string) models.ImageJob {
+	job := p.newJob(i, path, p.config.OutputDir)
+	p.claimJob(&job)
+	return job
+}
+
+// claim the output paths of job
+func (p *Processor) claimJob(job *models.ImageJob) {
+	job.Outputs = p.claimOutputs(job.InputPath, job.Outputs)
+	job.OutputPath = job.Outputs[0].Path
+}
+
+// reserve the outputs of the jobs cp records as done, which a resumed run
+// keeps, so new inputs can't take their names
+func (p *Processor) reserveCheckpoint(cp *checkpoint) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, entry := range cp.entries {
+		if entry.Error == "" {
+			p.names.reserve(entry.Input, entry.Outputs)
+		}
+	}
+}
+
+// claim the paths of input's outputs, renaming those another input already
+// has and recording the renames
+func (p *Processor) claimOutputs(input string, outputs []models.PipelineOutput) []models.PipelineOutput {
+	n := p.names
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, output := range outputs {
+		owner, taken := n.owners[nameKey(output.Path)]
+		if !taken || owner == input {
+			n.owners[nameKey(output.Path)] = input
+			continue
+		}
+
+		renamed := p.freeName(input, output.Path)
+		n.owners[nameKey(renamed)] = input
+		n.renames = append(n.renames, Rename{Input: input, Path: output.Path, Renamed: renamed})
+		p.logger.WithFields(map[string]interface{}{
+			"input":   input,
+			"output":  output.Path,
+			"renamed": renamed,
+			"owner":   owner,
+		}).Warn("Output path is taken by another input, renaming")
+		outputs[i].Path = renamed
+	}
+	return outputs
+}
+
+// the first name for input's output at path that no input has, by
+// output_collisions. Called with the names locked
+func (p *Processor) freeName(input, path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	if p.config.OutputCollisions != "number" {
+		candidate := fmt.Sprintf("%s_%s%s", base, p.inputHash(input), ext)
+		if _, taken := p.names.owners[nameKey(candidate)]; !taken {
+			return candidate
+		}
+		// another input with the same hash prefix; number from here
+		base = strings.TrimSuffix(candidate, ext)
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if _, taken := p.names.owners[nameKey(candidate)]; !taken {
+			return candidate
+		}
+	}
+}
+
+// the first 8 hex digits of the SHA-256 of input's path relative to
+// input_dir, the same wherever the tree is
+func (p *Processor) inputHash(input string) string {
+	path := input
+	if rel, err := filepath.Rel(p.config.InputDir, input); err == nil && !strings.HasPrefix(rel, "..") {
+		path = rel
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(path)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Renames returns the outputs renamed so far because another input's
+// output had their paths, by input
+func (p *Processor) Renames() []Rename {
+	p.names.mu.Lock()
+	defer p.names.mu.Unlock()
+
+	renames := append([]Rename(nil), p.names.renames...)
+	sort.SliceStable(renames, func(i, j int) bool {
+		return renames[i].Input < renames[j].Input
+	})
+	return renames
+}
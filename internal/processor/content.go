@@ -0,0 +1,67 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// move a written output to <output_dir>/<hash[:2]>/<hash[2:]>.<ext>, named
+// by the SHA-256 of its contents. Identical outputs share one file, so an
+// existing copy is kept and the new one removed
+func (p *Processor) contentAddress(path string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	file.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	ext := strings.ToLower(filepath.Ext(path))
+	contentPath := filepath.Join(p.config.OutputDir, hash[:2], hash[2:]+ext)
+
+	if err := os.MkdirAll(filepath.Dir(contentPath), 0755); err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(contentPath); err == nil {
+		return contentPath, hash, os.Remove(path)
+	}
+	return contentPath, hash, os.Rename(path, contentPath)
+}
+
+// ContentManifest maps the name each successful output would have had,
+// relative to the output directory, to its content-addressed path
+func (p *Processor) ContentManifest(results []models.ProcessingResult) map[string]string {
+	manifest := map[string]string{}
+	for _, result := range results {
+		if result.Error != nil {
+			continue
+		}
+		for _, output := range result.Outputs {
+			if output.LogicalPath == "" {
+				continue
+			}
+			manifest[p.relativeOutput(output.LogicalPath)] = p.relativeOutput(output.Path)
+		}
+	}
+	return manifest
+}
+
+// path relative to the output directory, with forward slashes as used in URLs
+func (p *Processor) relativeOutput(path string) string {
+	rel, err := filepath.Rel(p.config.OutputDir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,63 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// error record written next to a quarantined input
+type deadLetterRecord struct {
+	Input    string    `json:"input"`
+	Error    string    `json:"error"`
+	Size     int64     `json:"size"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// copy or symlink the input of a failed job into dead_letter_dir, keeping
+// its path relative to the input directory, and write <name>.error.json
+// beside it. Jobs that were skipped or cancelled by shutdown didn't fail
+func (p *Processor) deadLetter(result models.ProcessingResult) error {
+	if p.config.DeadLetterDir == "" || result.Error == nil ||
+		errors.Is(result.Error, ErrSkipped) || errors.Is(result.Error, context.Canceled) {
+		return nil
+	}
+
+	rel, err := filepath.Rel(p.config.InputDir, result.InputPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(result.InputPath)
+	}
+	target := filepath.Join(p.config.DeadLetterDir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// replace the copy from an earlier failure of the same input
+	os.Remove(target)
+	if p.config.DeadLetterMode == "symlink" {
+		source, err := filepath.Abs(result.InputPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(source, target); err != nil {
+			return err
+		}
+	} else if err := copyFile(result.InputPath, target); err != nil {
+		return err
+	}
+
+	record := deadLetterRecord{
+		Input:    result.InputPath,
+		Error:    result.Error.Error(),
+		FailedAt: time.Now(),
+	}
+	if info, err := os.Stat(result.InputPath); err == nil {
+		record.Size = info.Size()
+	}
+	return WriteJSON(target+".error.json", record)
+}
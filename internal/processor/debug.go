@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// per-channel value counts of one pipeline stage
+type channelHistogram struct {
+	Stage string   `json:"stage"`
+	Red   [256]int `json:"red"`
+	Green [256]int `json:"green"`
+	Blue  [256]int `json:"blue"`
+	Alpha [256]int `json:"alpha"`
+}
+
+// report whether an image is in the debug sample. Sampling hashes the path,
+// so the same images are picked on every run
+func (p *Processor) debugSampled(path string) bool {
+	if !p.config.DebugDumps {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return float64(h.Sum32()%10000) < p.config.DebugSampleRate*10000
+}
+
+// write a pipeline stage of a sampled image to <debug_dir>/<name>/: the
+// image itself, its channel histograms, and a bit-plane montage per channel
+func (p *Processor) debugDump(sj *stageJob, step int, stage string, img *image.RGBA) {
+	if !sj.debug {
+		return
+	}
+
+	name := strings.TrimSuffix(filepath.Base(sj.job.InputPath), filepath.Ext(sj.job.InputPath))
+	debugDir := p.config.DebugDir
+	if debugDir == "" {
+		debugDir = filepath.Join(p.config.OutputDir, "debug")
+	}
+	dir := filepath.Join(debugDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		sj.log.WithError(err).Warn("Failed to create debug directory")
+		return
+	}
+	prefix := filepath.Join(dir, fmt.Sprintf("%02d_%s", step, stage))
+
+	if err := p.saveImage(img, prefix+".png", "png", p.config.Quality); err != nil {
+		sj.log.WithError(err).Warn("Failed to write debug image")
+	}
+
+	hist := histogram(img)
+	hist.Stage = stage
+	if err := WriteJSON(prefix+"_histogram.json", hist); err != nil {
+		sj.log.WithError(err).Warn("Failed to write debug histogram")
+	}
+
+	for c, channel := range []string{"red", "green", "blue", "alpha"} {
+		if err := p.saveImage(bitPlanes(img, c), prefix+"_planes_"+channel+".png", "png", p.config.Quality); err != nil {
+			sj.log.WithError(err).Warn("Failed to write debug bit planes")
+		}
+	}
+
+	sj.log.WithField("path", prefix).Debug("Wrote debug dump")
+}
+
+func histogram(img *image.RGBA) channelHistogram {
+	var hist channelHistogram
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := img.PixOffset(bounds.Min.X, y)
+		for x := 0; x < bounds.Dx(); x, i = x+1, i+4 {
+			hist.Red[img.Pix[i]]++
+			hist.Green[img.Pix[i+1]]++
+			hist.Blue[img.Pix[i+2]]++
+			hist.Alpha[img.Pix[i+3]]++
+		}
+	}
+
+	return hist
+}
+
+// lay the 8 bit planes of channel c out as a 4x2 grid, most significant bit
+// top left; set bits are white
+func bitPlanes(img *image.RGBA, c int) *image.Gray {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	montage := image.NewGray(image.Rect(0, 0, w*4, h*2))
+
+	for bit := 7; bit >= 0; bit-- {
+		cell := 7 - bit
+		ox, oy := (cell%4)*w, (cell/4)*h
+
+		for y := 0; y < h; y++ {
+			i := img.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			for x := 0; x < w; x, i = x+1, i+4 {
+				if img.Pix[i+c]&(1<<bit) != 0 {
+					montage.SetGray(ox+x, oy+y, color.Gray{Y: 255})
+				}
+			}
+		}
+	}
+
+	return montage
+}
@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// decodes given up on by hardened_decode that are still running. Go can't
+// stop a goroutine, so each keeps its memory until its decoder returns
+var abandonedDecodes atomic.Int64
+
+// states of a hardened decode
+const (
+	decodeRunning int32 = iota
+	decodeDone
+	decodeAbandoned
+)
+
+// run a decoder on the file at path, turning its panic into an error so a
+// malformed input fails its job instead of the process. With hardened_decode
+// it runs in a goroutine of its own, which is given up on after
+// decode_timeout
+func guardDecode[T any](p *Processor, path string, decode func() (T, error)) (T, error) {
+	run := func() (v T, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				p.logger.WithFields(map[string]interface{}{
+					"file":  path,
+					"stack": string(debug.Stack()),
+				}).Warn("Decoder panicked")
+				err = fmt.Errorf("decoder panic: %v", r)
+			}
+		}()
+		return decode()
+	}
+	if !p.config.HardenedDecode {
+		return run()
+	}
+
+	type decoded struct {
+		v   T
+		err error
+	}
+	done := make(chan decoded, 1)
+	var state atomic.Int32
+	go func() {
+		v, err := run()
+		done <- decoded{v, err}
+		if !state.CompareAndSwap(decodeRunning, decodeDone) {
+			abandonedDecodes.Add(-1)
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if p.config.DecodeTimeout > 0 {
+		timer := time.NewTimer(p.config.DecodeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case d := <-done:
+		return d.v, d.err
+	case <-timeout:
+		abandonedDecodes.Add(1)
+		if !state.CompareAndSwap(decodeRunning, decodeAbandoned) {
+			// it finished as the timeout fired
+			abandonedDecodes.Add(-1)
+			d := <-done
+			return d.v, d.err
+		}
+		p.logger.WithFields(map[string]interface{}{
+			"file":      path,
+			"timeout":   p.config.DecodeTimeout.String(),
+			"abandoned": abandonedDecodes.Load(),
+		}).Warn("Gave up on a decode, its goroutine runs on")
+		var zero T
+		return zero, fmt.Errorf("decode %w after %s", ErrTimeout, p.config.DecodeTimeout)
+	}
+}
+
+// an image and the name of its format
+type decodedImage struct {
+	img    image.Image
+	format string
+}
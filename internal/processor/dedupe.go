@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// FilterIdentical passes on the paths received on paths whose bytes differ
+// from those of every earlier one, for dedupe. Inputs are compared by the
+// SHA-256 of their contents in the order received, so the first of a group
+// is processed; those that can't be read are passed on for processing to
+// report. The inputs held back are sent once paths is closed
+func (p *Processor) FilterIdentical(ctx context.Context, paths <-chan string) (<-chan string, <-chan []Duplicate) {
+	unique := make(chan string)
+	found := make(chan []Duplicate, 1)
+
+	go func() {
+		defer close(unique)
+		var duplicates []Duplicate
+		defer func() { found <- duplicates }()
+
+		originals := map[[sha256.Size]byte]string{}
+		for path := range paths {
+			if sum, err := contentHash(path); err == nil {
+				if original, ok := originals[sum]; ok {
+					p.logger.WithFields(map[string]interface{}{
+						"file":     path,
+						"original": original,
+					}).Debug("Found identical input")
+					duplicates = append(duplicates, Duplicate{Path: path, Original: original, Identical: true})
+					continue
+				}
+				originals[sum] = path
+			}
+
+			select {
+			case unique <- path:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return unique, found
+}
+
+// the SHA-256 of the file at path
+func contentHash(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	file, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
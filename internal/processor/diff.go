@@ -0,0 +1,198 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Diff pairs files with the same relative path under the input and compare
+// directories, writes a mask of changed pixels for every changed pair and
+// returns a report covering all files on either side
+func (p *Processor) Diff(ctx context.Context, baseline, compare []string) (models.DiffReport, error) {
+	report := models.DiffReport{
+		BaselineDir: p.config.InputDir,
+		CompareDir:  p.config.CompareDir,
+		Threshold:   p.config.DiffThreshold,
+		Summary:     map[string]int{},
+	}
+
+	pairs, err := pairFiles(p.config.InputDir, baseline, p.config.CompareDir, compare)
+	if err != nil {
+		return report, err
+	}
+
+	p.logger.WithField("pairs", len(pairs)).Info("Starting directory comparison")
+
+	results := make([]models.DiffResult, len(pairs))
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+
+	for i, pair := range pairs {
+		wg.Add(1)
+		go func(i int, pair filePair) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = models.DiffResult{Name: pair.name, Status: models.DiffError, Error: ctx.Err().Error()}
+				return
+			}
+
+			results[i] = p.diffPair(pair)
+		}(i, pair)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	report.Results = results
+	for _, r := range results {
+		report.Summary[r.Status]++
+	}
+
+	return report, nil
+}
+
+// files matched by relative path; either side is empty when unmatched
+type filePair struct {
+	name     string
+	baseline string
+	compare  string
+}
+
+func pairFiles(baseDir string, baseline []string, compareDir string, compare []string) ([]filePair, error) {
+	byName := map[string]*filePair{}
+
+	for _, path := range baseline {
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil, err
+		}
+		byName[rel] = &filePair{name: rel, baseline: path}
+	}
+
+	for _, path := range compare {
+		rel, err := filepath.Rel(compareDir, path)
+		if err != nil {
+			return nil, err
+		}
+		if pair, ok := byName[rel]; ok {
+			pair.compare = path
+		} else {
+			byName[rel] = &filePair{name: rel, compare: path}
+		}
+	}
+
+	pairs := make([]filePair, 0, len(byName))
+	for _, pair := range byName {
+		pairs = append(pairs, *pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name })
+
+	return pairs, nil
+}
+
+// compare one pair and write its mask when anything changed
+func (p *Processor) diffPair(pair filePair) models.DiffResult {
+	result := models.DiffResult{Name: pair.name}
+
+	switch {
+	case pair.compare == "":
+		result.Status = models.DiffMissing
+		return result
+	case pair.baseline == "":
+		result.Status = models.DiffAdded
+		return result
+	}
+
+	fail := func(err error) models.DiffResult {
+		result.Status = models.DiffError
+		result.Error = err.Error()
+		return result
+	}
+
+	before, _, err := p.loadImage(pair.baseline)
+	if err != nil {
+		return fail(fmt.Errorf("failed to load baseline: %w", err))
+	}
+	after, _, err := p.loadImage(pair.compare)
+	if err != nil {
+		return fail(fmt.Errorf("failed to load comparison: %w", err))
+	}
+
+	if before.Bounds().Size() != after.Bounds().Size() {
+		result.Status = models.DiffChanged
+		result.Error = fmt.Sprintf("dimensions differ: %dx%d vs %dx%d",
+			before.Bounds().Dx(), before.Bounds().Dy(), after.Bounds().Dx(), after.Bounds().Dy())
+		return result
+	}
+
+	mask, changed, maxDelta := DiffMask(ImageToRGBA(before), ImageToRGBA(after), p.config.DiffThreshold)
+	result.ChangedPixels = changed
+	result.ChangedRatio = float64(changed) / float64(mask.Bounds().Dx()*mask.Bounds().Dy())
+	result.MaxDelta = maxDelta
+
+	if changed == 0 {
+		result.Status = models.DiffUnchanged
+		return result
+	}
+	result.Status = models.DiffChanged
+
+	name := strings.TrimSuffix(pair.name, filepath.Ext(pair.name))
+	result.MaskPath = filepath.Join(p.config.OutputDir, name+"_diff.png")
+	if err := os.MkdirAll(filepath.Dir(result.MaskPath), 0755); err != nil {
+		return fail(err)
+	}
+	if err := p.saveImage(mask, result.MaskPath, "png", p.config.Quality); err != nil {
+		return fail(fmt.Errorf("failed to save mask: %w", err))
+	}
+
+	return result
+}
+
+// DiffMask marks pixels where any channel differs by more than threshold in
+// white, returning the mask, the number of changed pixels and the largest
+// channel difference seen
+func DiffMask(before, after *image.RGBA, threshold int) (*image.Gray, int, int) {
+	bounds := before.Bounds()
+	ab := after.Bounds()
+	mask := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	changed, maxDelta := 0, 0
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			i := before.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+			j := after.PixOffset(ab.Min.X+x, ab.Min.Y+y)
+
+			delta := 0
+			for c := 0; c < 4; c++ {
+				d := int(before.Pix[i+c]) - int(after.Pix[j+c])
+				if d < 0 {
+					d = -d
+				}
+				delta = max(delta, d)
+			}
+
+			maxDelta = max(maxDelta, delta)
+			if delta > threshold {
+				mask.SetGray(x, y, color.Gray{Y: 255})
+				changed++
+			}
+		}
+	}
+
+	return mask, changed, maxDelta
+}
@@ -0,0 +1,346 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Duplicates hashes every image and groups near-duplicates: each image joins
+// the cluster of the first earlier image within duplicate_threshold bits of
+// it, and clusters of a single image aren't reported
+func (p *Processor) Duplicates(ctx context.Context, imagePaths []string) (models.DuplicateReport, error) {
+	report := models.DuplicateReport{
+		Algorithm: p.config.HashAlgorithm,
+		Threshold: p.config.DuplicateThreshold,
+		Images:    len(imagePaths),
+	}
+
+	hashes := make([]models.ImageHash, len(imagePaths))
+	values := make([]uint64, len(imagePaths))
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+
+	for i, path := range imagePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				hashes[i] = models.ImageHash{Path: path, Error: ctx.Err().Error()}
+				return
+			}
+
+			hash, err := p.hashImage(path)
+			if err != nil {
+				hashes[i] = models.ImageHash{Path: path, Error: err.Error()}
+				return
+			}
+			hashes[i], values[i] = models.ImageHash{Path: path, Hash: formatHash(hash)}, hash
+		}(i, path)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	var index duplicateIndex
+	clusters := map[int]*models.DuplicateCluster{}
+	for i, hash := range hashes {
+		if hash.Error != "" {
+			report.Errors = append(report.Errors, hash)
+			continue
+		}
+		original, distance, ok := index.match(values[i], p.config.DuplicateThreshold)
+		if !ok {
+			index.add(i, values[i])
+			continue
+		}
+		cluster := clusters[original]
+		if cluster == nil {
+			cluster = &models.DuplicateCluster{Original: hashes[original]}
+			clusters[original] = cluster
+		}
+		hash.Distance = distance
+		cluster.Duplicates = append(cluster.Duplicates, hash)
+	}
+
+	originals := make([]int, 0, len(clusters))
+	for original := range clusters {
+		originals = append(originals, original)
+	}
+	sort.Ints(originals)
+	report.Clusters = []models.DuplicateCluster{}
+	for _, original := range originals {
+		report.Clusters = append(report.Clusters, *clusters[original])
+	}
+	return report, nil
+}
+
+// Duplicate is an input found to be a near-duplicate of an earlier one, or
+// identical to it
+type Duplicate struct {
+	Path      string
+	Original  string
+	Distance  int
+	Identical bool
+}
+
+// FilterDuplicates passes on the paths received on paths that aren't within
+// duplicate_threshold of an earlier one, for duplicate_action. Images are
+// hashed in the order received, so the first of a group is processed; those
+// that can't be hashed are passed on for processing to report. The inputs
+// held back are sent once paths is closed
+func (p *Processor) FilterDuplicates(ctx context.Context, paths <-chan string) (<-chan string, <-chan []Duplicate) {
+	unique := make(chan string)
+	found := make(chan []Duplicate, 1)
+
+	go func() {
+		defer close(unique)
+		var duplicates []Duplicate
+		defer func() { found <- duplicates }()
+
+		var index duplicateIndex
+		var originals []string
+		for path := range paths {
+			hash, err := p.hashImage(path)
+			if err == nil {
+				if original, distance, ok := index.match(hash, p.config.DuplicateThreshold); ok {
+					p.logger.WithFields(map[string]interface{}{
+						"file":     path,
+						"original": originals[original],
+						"distance": distance,
+					}).Debug("Found near-duplicate")
+					duplicates = append(duplicates, Duplicate{Path: path, Original: originals[original], Distance: distance})
+					continue
+				}
+				index.add(len(originals), hash)
+				originals = append(originals, path)
+			}
+
+			select {
+			case unique <- path:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return unique, found
+}
+
+// ResolveDuplicates returns a result for each duplicate held back by
+// FilterDuplicates or FilterIdentical, once results has those of their
+// originals. With duplicate_action link, or dedupe link, every output of a
+// duplicate is a hard link to the matching output of its original; with
+// dedupe copy it is a copy, and with duplicate_action skip nothing is
+// written
+func (p *Processor) ResolveDuplicates(duplicates []Duplicate, results []models.ProcessingResult) []models.ProcessingResult {
+	processed := map[string]models.ProcessingResult{}
+	for _, result := range results {
+		processed[result.InputPath] = result
+	}
+
+	resolved := make([]models.ProcessingResult, len(duplicates))
+	for i, duplicate := range duplicates {
+		result := models.ProcessingResult{
+			Index:       len(results) + i,
+			InputPath:   duplicate.Path,
+			DuplicateOf: duplicate.Original,
+			Identical:   duplicate.Identical,
+		}
+		original := processed[duplicate.Original]
+		action := p.config.DuplicateAction
+		if duplicate.Identical {
+			action = p.config.Dedupe
+			result.Metadata = original.Metadata
+		}
+		switch {
+		case original.DuplicateOf != "" && len(original.Outputs) == 0:
+			// the original was itself skipped as a near-duplicate
+		case action == "link", action == "copy":
+			result.Outputs, result.Error = p.shareOutputs(duplicate, original, action)
+		}
+		if len(result.Outputs) > 0 {
+			result.OutputPath = result.Outputs[0].Path
+		}
+		resolved[i] = result
+	}
+	return resolved
+}
+
+// give a duplicate the outputs of its original, each a hard link to, or
+// with action copy a copy of, the original's output of the same name
+func (p *Processor) shareOutputs(duplicate Duplicate, original models.ProcessingResult, action string) ([]models.OutputFile, error) {
+	put := os.Link
+	if action == "copy" {
+		put = copyFile
+	}
+
+	if original.InputPath == "" {
+		return nil, fmt.Errorf("original %s wasn't processed", duplicate.Original)
+	}
+	if original.Error != nil {
+		return nil, fmt.Errorf("original %s failed: %w", duplicate.Original, original.Error)
+	}
+
+	// the original's outputs may have been renamed on a collision
+	sources := make(map[string]models.OutputFile, len(original.Outputs))
+	for _, output := range original.Outputs {
+		sources[output.Name] = output
+	}
+	targets := p.claimOutputs(duplicate.Path, p.jobOutputs(duplicate.Path, p.config.OutputDir))
+	outputs := make([]models.OutputFile, 0, len(targets))
+	for _, target := range targets {
+		source, ok := sources[target.Name]
+		if !ok {
+			return nil, fmt.Errorf("original %s has no %s output", duplicate.Original, target.Name)
+		}
+		if err := os.Remove(target.Path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to replace %s: %w", target.Path, err)
+		}
+		if err := put(source.Path, target.Path); err != nil {
+			return nil, fmt.Errorf("failed to %s output: %w", action, err)
+		}
+		file := source
+		file.Path = target.Path
+		outputs = append(outputs, file)
+	}
+	return outputs, nil
+}
+
+// the perceptual hash of the image at path
+func (p *Processor) hashImage(path string) (uint64, error) {
+	img, _, err := p.loadImage(path)
+	if err != nil {
+		return 0, err
+	}
+	if p.config.HashAlgorithm == "dhash" {
+		return differenceHash(img), nil
+	}
+	return perceptionHash(img), nil
+}
+
+// hashes of the originals seen so far, in order
+type duplicateIndex struct {
+	ids    []int
+	hashes []uint64
+}
+
+func (d *duplicateIndex) add(id int, hash uint64) {
+	d.ids = append(d.ids, id)
+	d.hashes = append(d.hashes, hash)
+}
+
+// the first original within threshold bits of hash, and its distance
+func (d *duplicateIndex) match(hash uint64, threshold int) (int, int, bool) {
+	for i, h := range d.hashes {
+		if distance := bits.OnesCount64(hash ^ h); distance <= threshold {
+			return d.ids[i], distance, true
+		}
+	}
+	return 0, 0, false
+}
+
+// dHash: whether each pixel of a 9x8 grayscale thumbnail is brighter than
+// its right neighbour, robust to scaling and small color changes
+func differenceHash(img image.Image) uint64 {
+	thumb := grayThumbnail(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if thumb[y*9+x] > thumb[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// pHash: whether each of the lowest 8x8 frequencies of the DCT of a 32x32
+// grayscale thumbnail is above their median, robust to scaling,
+// compression and gamma changes
+func perceptionHash(img image.Image) uint64 {
+	const size, low = 32, 8
+	thumb := grayThumbnail(img, size, size)
+
+	// separable DCT-II, rows then the columns of the low frequencies
+	rows := make([]float64, size*low)
+	for y := 0; y < size; y++ {
+		for u := 0; u < low; u++ {
+			var sum float64
+			for x := 0; x < size; x++ {
+				sum += thumb[y*size+x] * math.Cos(float64((2*x+1)*u)*math.Pi/(2*size))
+			}
+			rows[y*low+u] = sum
+		}
+	}
+	coefficients := make([]float64, low*low)
+	for v := 0; v < low; v++ {
+		for u := 0; u < low; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				sum += rows[y*low+u] * math.Cos(float64((2*y+1)*v)*math.Pi/(2*size))
+			}
+			coefficients[v*low+u] = sum
+		}
+	}
+
+	// the DC term is the mean brightness, left out of the median
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, c := range coefficients {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// the image scaled to width x height by averaging the luma of the pixels
+// in each cell
+func grayThumbnail(img image.Image, width, height int) []float64 {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = ImageToRGBA(img)
+	}
+	bounds := rgba.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]int, width*height)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		cy := y * height / bounds.Dy()
+		for x := 0; x < bounds.Dx(); x++ {
+			i := x * 4
+			cell := cy*width + x*width/bounds.Dx()
+			sums[cell] += 0.299*float64(row[i]) + 0.587*float64(row[i+1]) + 0.114*float64(row[i+2])
+			counts[cell]++
+		}
+	}
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+		}
+	}
+	return sums
+}
+
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/dicom"
+	"github.com/arsalan9702/concurrent-image-processor/internal/fits"
+)
+
+// Errors wrapped by the errors of failed results, so callers can tell
+// classes of failure apart with errors.Is instead of matching messages
+var (
+	// the input isn't in a format any decoder reads
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	// the input is larger than max_file_size
+	ErrFileTooLarge = errors.New("file too large")
+	// the input's format is supported but its data is corrupt or truncated
+	ErrDecodeFailed = errors.New("failed to decode image")
+	// a pipeline step names a filter that isn't registered
+	ErrFilterUnknown = errors.New("unknown filter")
+	// the job, an exec filter or a pipeline script ran out of time
+	ErrTimeout = errors.New("timed out")
+)
+
+// failure classes of FailureClass by the error they wrap
+var failureClasses = []struct {
+	err   error
+	class string
+}{
+	{ErrUnsupportedFormat, "unsupported_format"},
+	{ErrFileTooLarge, "too_large"},
+	{ErrDecodeFailed, "decode"},
+	{ErrFilterUnknown, "unknown_filter"},
+	{ErrTimeout, "timeout"},
+}
+
+// FailureClass names the class of a failed result's error for reports,
+// such as "too_large" for ErrFileTooLarge, or "" for other errors
+func FailureClass(err error) string {
+	for _, c := range failureClasses {
+		if errors.Is(err, c.err) {
+			return c.class
+		}
+	}
+	return ""
+}
+
+// wrap the error of decoding an input in ErrUnsupportedFormat when no
+// decoder reads it, or ErrDecodeFailed when its data is bad, as when the
+// decoder panics. Errors opening the file and decode timeouts are neither
+func decodeError(err error) error {
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &pathErr), errors.Is(err, ErrTimeout):
+		return fmt.Errorf("failed to load image: %w", err)
+	case errors.Is(err, image.ErrFormat), errors.Is(err, dicom.ErrNotDICOM), errors.Is(err, dicom.ErrUnsupportedSyntax),
+		errors.Is(err, fits.ErrNotFITS), errors.Is(err, fits.ErrUnsupported):
+		return fmt.Errorf("%w: %w", ErrUnsupportedFormat, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrDecodeFailed, err)
+	}
+}
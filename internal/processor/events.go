@@ -0,0 +1,244 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// job lifecycle events. Chunk events report the progress of a job, one per
+// strip of rows filtered
+const (
+	EventQueued    = "queued"
+	EventStarted   = "started"
+	EventChunk     = "chunk"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+)
+
+// Event is a job lifecycle event, as delivered to subscribers and written
+// as one line of the events file
+type Event struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	JobID       string    `json:"job_id"`
+	Index       int       `json:"index"`
+	Input       string    `json:"input"`
+	QueueWaitMs float64   `json:"queue_wait_ms,omitempty"`
+	StartRow    int       `json:"start_row,omitempty"`
+	EndRow      int       `json:"end_row,omitempty"`
+	DurationMs  float64   `json:"duration_ms,omitempty"`
+	Outputs     []string  `json:"outputs,omitempty"`
+	Cached      bool      `json:"cached,omitempty"`
+	Unchanged   bool      `json:"unchanged,omitempty"`
+	Error       string    `json:"error,omitempty"`
+
+	// resources of a finished job, see models.ResourceUsage
+	PeakMemory int64   `json:"peak_memory,omitempty"`
+	CPUMs      float64 `json:"cpu_ms,omitempty"`
+	GCCycles   int64   `json:"gc_cycles,omitempty"`
+	GCPauseMs  float64 `json:"gc_pause_ms,omitempty"`
+
+	// stages of a completed job, see models.StageTimings
+	DecodeMs float64     `json:"decode_ms,omitempty"`
+	Steps    []StepEvent `json:"steps,omitempty"`
+	EncodeMs float64     `json:"encode_ms,omitempty"`
+	WriteMs  float64     `json:"write_ms,omitempty"`
+
+	// the job's result, for completed and failed events; not written to
+	// the events file
+	Result *models.ProcessingResult `json:"-"`
+}
+
+// StepEvent is the time of a pipeline step in a completed event
+type StepEvent struct {
+	ID         string  `json:"id"`
+	Filter     string  `json:"filter"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// eventBus delivers the lifecycle events of a processor's jobs to its
+// subscribers: the events file, webhooks, metrics and those added with
+// WithSubscribers or Subscribe. Subscribers are called in the order they
+// subscribed, on the goroutine the event happens on, so concurrently; they
+// must return quickly
+type eventBus struct {
+	mu   sync.RWMutex
+	next int
+	subs []subscription
+}
+
+type subscription struct {
+	id int
+	fn func(Event)
+}
+
+// subscribe fn to every event that follows, until the returned function is
+// called
+func (b *eventBus) subscribe(fn func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subs = append(b.subs, subscription{id: id, fn: fn})
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, sub := range b.subs {
+			if sub.id == id {
+				// copied so a publish iterating the old slice is unaffected
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// deliver an event of job to every subscriber
+func (b *eventBus) publish(kind string, job models.ImageJob, e Event) {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	e.Time, e.Event = time.Now(), kind
+	e.JobID, e.Index, e.Input = job.ID, job.Index, job.InputPath
+	for _, sub := range subs {
+		sub.fn(e)
+	}
+}
+
+// WithSubscribers calls each of subscribers with every job lifecycle event,
+// after the events file, webhooks and metrics, in the order given. They are
+// called from the workers, so concurrently, and must return quickly
+func WithSubscribers(subscribers ...func(Event)) Option {
+	return func(o *options) {
+		o.subscribers = append(o.subscribers, subscribers...)
+	}
+}
+
+// Subscribe calls fn with every job lifecycle event that follows, like
+// WithSubscribers, until the returned function is called. Subscriptions
+// don't carry over to the processor of a reloaded service
+func (p *Processor) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return p.bus.subscribe(fn)
+}
+
+// subscribe the events file, webhooks, metrics and the subscribers of the
+// options, in that order, to the bus
+func (p *Processor) subscribe(events *eventLog, subscribers []func(Event)) {
+	if events != nil {
+		p.bus.subscribe(events.write)
+	}
+	p.bus.subscribe(func(e Event) {
+		if e.Event == EventFailed && !errors.Is(e.Result.Error, ErrSkipped) && !errors.Is(e.Result.Error, context.Canceled) {
+			p.webhooks.JobFailed(e.JobID, e.Input, e.Result.Error, e.Result.ProcessingTime)
+		}
+	})
+	if p.metrics != nil {
+		p.bus.subscribe(func(e Event) {
+			if e.Result != nil {
+				p.metrics.ObserveJob(*e.Result)
+			}
+		})
+	}
+	for _, fn := range subscribers {
+		p.bus.subscribe(fn)
+	}
+}
+
+// a strip of rows finished filtering
+func (b *eventBus) chunk(job models.ImageJob, strip models.StripResult) {
+	b.publish(EventChunk, job, Event{
+		StartRow:   strip.StartRow,
+		EndRow:     strip.EndRow,
+		DurationMs: milliseconds(strip.Duration),
+	})
+}
+
+// a job's result was emitted
+func (b *eventBus) finished(job models.ImageJob, result models.ProcessingResult) {
+	usage := result.Resources
+	if result.Error != nil {
+		b.publish(EventFailed, job, Event{
+			DurationMs: milliseconds(result.ProcessingTime),
+			Error:      result.Error.Error(),
+			PeakMemory: usage.PeakMemory,
+			CPUMs:      milliseconds(usage.CPUTime),
+			GCCycles:   usage.GCCycles,
+			GCPauseMs:  milliseconds(usage.GCPause),
+			Result:     &result,
+		})
+		return
+	}
+
+	outputs := make([]string, len(result.Outputs))
+	for i, output := range result.Outputs {
+		outputs[i] = output.Path
+	}
+	timings := result.Metadata.Timings
+	var steps []StepEvent
+	for _, step := range timings.Steps {
+		steps = append(steps, StepEvent{ID: step.ID, Filter: string(step.Filter), DurationMs: milliseconds(step.Duration)})
+	}
+	b.publish(EventCompleted, job, Event{
+		DurationMs: milliseconds(result.ProcessingTime),
+		Outputs:    outputs,
+		Cached:     result.Cached,
+		Unchanged:  result.Unchanged,
+		PeakMemory: usage.PeakMemory,
+		CPUMs:      milliseconds(usage.CPUTime),
+		GCCycles:   usage.GCCycles,
+		GCPauseMs:  milliseconds(usage.GCPause),
+		DecodeMs:   milliseconds(timings.Decode),
+		Steps:      steps,
+		EncodeMs:   milliseconds(timings.Encode),
+		WriteMs:    milliseconds(timings.Write),
+		Result:     &result,
+	})
+}
+
+// appends events to a file as JSON lines, each written whole so the file
+// can be tailed while a run is in progress
+type eventLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// open the events file, nil if path is empty
+func openEventLog(path string) (*eventLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{file: file}, nil
+}
+
+// write an event, subscribed to the bus
+func (l *eventLog) write(e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Write(append(data, '\n'))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// how much of a failed command's stderr goes into its error
+const execStderrLimit = 1024
+
+// pipe the image through the exec filter's command: PNG on its stdin, and
+// whatever it writes to stdout decoded as the result. Commands wait for one
+// of exec_concurrency slots, and each run is limited to exec_timeout
+func (p *Processor) applyExec(ctx context.Context, params models.FilterParams, img *image.RGBA) (*image.RGBA, error) {
+	select {
+	case p.execSlots <- struct{}{}:
+		defer func() { <-p.execSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if params.ExecTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, params.ExecTimeout)
+		defer cancel()
+	}
+
+	var input bytes.Buffer
+	// the command does its own compression, if any
+	encoder := &png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&input, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image for %s: %w", params.ExecCommand[0], err)
+	}
+
+	var stdout bytes.Buffer
+	stderr := &limitedBuffer{limit: execStderrLimit}
+	cmd := exec.CommandContext(ctx, params.ExecCommand[0], params.ExecCommand[1:]...)
+	cmd.Stdin = &input
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%s %w after %s", params.ExecCommand[0], ErrTimeout, params.ExecTimeout)
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%s failed: %w: %s", params.ExecCommand[0], err, message)
+		}
+		return nil, fmt.Errorf("%s failed: %w", params.ExecCommand[0], err)
+	}
+
+	result, _, err := image.Decode(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode output of %s: %w", params.ExecCommand[0], err)
+	}
+	return ImageToRGBA(result), nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty command can't grow it without bound
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(data[:min(room, len(data))])
+	}
+	return len(data), nil
+}
@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tiffmeta"
+)
+
+// EXIF tags, in IFD0 and the EXIF sub-IFD
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+)
+
+// read the EXIF metadata of a JPEG, PNG or TIFF file, nil when it has none
+func readExif(path string) (*models.ExifSummary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tiff []byte
+	switch sniffFormat(data) {
+	case "jpeg":
+		tiff = jpegExif(data)
+	case "png":
+		tiff = pngExif(data)
+	case "tiff":
+		tiff = data
+	}
+	if tiff == nil {
+		return nil, nil
+	}
+
+	r := bytes.NewReader(tiff)
+	dir, err := tiffmeta.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &models.ExifSummary{
+		Make:     ascii(dir, tagMake),
+		Model:    ascii(dir, tagModel),
+		Software: ascii(dir, tagSoftware),
+		DateTime: ascii(dir, tagDateTime),
+	}
+	if e, ok := dir.Find(tagOrientation); ok {
+		if v := dir.Longs(e); len(v) > 0 {
+			exif.Orientation = int(v[0])
+		}
+	}
+	_, exif.GPS = dir.Find(tagGPSIFD)
+
+	if e, ok := dir.Find(tagExifIFD); ok {
+		if v := dir.Longs(e); len(v) > 0 {
+			if sub, err := tiffmeta.ReadIFD(r, dir.Order, int64(v[0])); err == nil {
+				readExifIFD(sub, exif)
+			}
+		}
+	}
+
+	// a plain TIFF has an IFD0 but no EXIF fields
+	if *exif == (models.ExifSummary{}) {
+		return nil, nil
+	}
+	return exif, nil
+}
+
+// fill in the capture settings of the EXIF sub-IFD
+func readExifIFD(dir *tiffmeta.Directory, exif *models.ExifSummary) {
+	if original := ascii(dir, tagDateTimeOriginal); original != "" {
+		exif.DateTime = original
+	}
+	exif.Lens = ascii(dir, tagLensModel)
+
+	if e, ok := dir.Find(tagExposureTime); ok {
+		if v := dir.Rationals(e); len(v) > 0 && v[0][1] != 0 {
+			if v[0][0] < v[0][1] && v[0][0] > 0 {
+				exif.ExposureTime = fmt.Sprintf("1/%d", (v[0][1]+v[0][0]/2)/v[0][0])
+			} else {
+				exif.ExposureTime = fmt.Sprintf("%gs", float64(v[0][0])/float64(v[0][1]))
+			}
+		}
+	}
+	if e, ok := dir.Find(tagFNumber); ok {
+		if v := dir.Rationals(e); len(v) > 0 && v[0][1] != 0 {
+			exif.FNumber = float64(v[0][0]) / float64(v[0][1])
+		}
+	}
+	if e, ok := dir.Find(tagFocalLength); ok {
+		if v := dir.Rationals(e); len(v) > 0 && v[0][1] != 0 {
+			exif.FocalLength = float64(v[0][0]) / float64(v[0][1])
+		}
+	}
+	if e, ok := dir.Find(tagISO); ok {
+		if v := dir.Longs(e); len(v) > 0 {
+			exif.ISO = int(v[0])
+		}
+	}
+}
+
+// ASCII value of tag, "" if absent
+func ascii(dir *tiffmeta.Directory, tag uint16) string {
+	if e, ok := dir.Find(tag); ok {
+		return dir.ASCII(e)
+	}
+	return ""
+}
+
+// TIFF structure of a JPEG's APP1 Exif segment, nil if there is none
+func jpegExif(data []byte) []byte {
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		// start of scan, no metadata segments follow
+		if marker == 0xda {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		if payload := data[i+4 : end]; marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return payload[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+// TIFF structure of a PNG's eXIf chunk, nil if there is none
+func pngExif(data []byte) []byte {
+	r := bytes.NewReader(data[8:])
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		switch string(header[4:]) {
+		case "eXIf":
+			chunk := make([]byte, length)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil
+			}
+			return chunk
+		case "IDAT", "IEND":
+			return nil
+		}
+		// skip the data and CRC
+		if _, err := r.Seek(length+4, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+)
+
+// ErrInjected is the error of decodes failed by fault injection
+var ErrInjected = errors.New("injected fault")
+
+// fails, delays and panics jobs at the configured rates. Whether a fault
+// fires is a hash of the seed, the fault and the input path, so with a fixed
+// seed the same jobs fail regardless of scheduling. A nil injector injects
+// nothing
+type faultInjector struct {
+	spec config.FaultSpec
+	seed int64
+}
+
+// create an injector from a fault_inject spec, nil when it is empty.
+// Without a seed in the spec, deterministic runs use 0 and others the time
+func newFaultInjector(s string, deterministic bool) (*faultInjector, error) {
+	if s == "" {
+		return nil, nil
+	}
+	spec, err := config.ParseFaultSpec(s)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := spec.Seed
+	if seed == 0 && !deterministic {
+		seed = time.Now().UnixNano()
+	}
+	return &faultInjector{spec: spec, seed: seed}, nil
+}
+
+// report whether a fault with the given rate fires for a job
+func (f *faultInjector) roll(rate float64, fault, path string) bool {
+	if rate == 0 {
+		return false
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%s", f.seed, fault, path)
+	return float64(h.Sum64()%1000000) < rate*1000000
+}
+
+// fail a decode at the configured rate
+func (f *faultInjector) decode(path string) error {
+	if f != nil && f.roll(f.spec.DecodeRate, "decode", path) {
+		return fmt.Errorf("decode: %w", ErrInjected)
+	}
+	return nil
+}
+
+// delay and panic a filter at the configured rates; the delay ends early
+// when ctx is done, so slow jobs still trip job_timeout
+func (f *faultInjector) filter(ctx context.Context, path string) {
+	if f == nil {
+		return
+	}
+	if f.roll(f.spec.SlowRate, "slow", path) {
+		select {
+		case <-time.After(f.spec.SlowDelay):
+		case <-ctx.Done():
+		}
+	}
+	if f.roll(f.spec.PanicRate, "panic", path) {
+		panic("injected worker panic")
+	}
+}
+
+// run a stage, turning a panic into the job's error so one bad job doesn't
+// take down its worker
+func (p *Processor) runStage(sj *stageJob, stage func(*stageJob)) {
+	defer func() {
+		if r := recover(); r != nil {
+			sj.log.WithField("stack", string(debug.Stack())).Error("stage panicked")
+			sj.result.Error = fmt.Errorf("worker panic: %v", r)
+		}
+	}()
+	stage(sj)
+}
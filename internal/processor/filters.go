@@ -5,17 +5,75 @@ import (
 	"image/color"
 	"math"
 
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
 	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/plugins"
 )
 
 // Filter represents s function that can be applied to pixel data
 type Filter func(src []uint8, width int, params models.FilterParams) []uint8
 
+// FilterRegistry holds the row filters by name; internal/filterspec
+// describes them and their settings
 var FilterRegistry = map[models.FilterType]Filter{
 	models.FilterBlur:       ApplyBlur,
 	models.FilterBrightness: ApplyBrightness,
 	models.FilterConstrast:  ApplyContrast,
+	models.FilterGamma:      ApplyGamma,
+	models.FilterInvert:     ApplyInvert,
 	models.FilterGrayScale:  ApplyGrayScale,
+	models.FilterExpression: ApplyExpression,
+}
+
+// RegisterFilter adds a custom row filter, described by spec, so pipeline
+// steps can name it and configuration, the filters command and the
+// /filters endpoint know its settings. apply gets the settings of the
+// filter's section or step as strings, with the declared defaults filled
+// in, like a plugin filter. Register filters before creating processors,
+// which read the registry without locking
+func RegisterFilter(spec filterspec.Filter, apply func(src []uint8, width int, params map[string]string) []uint8) error {
+	spec.Custom = true
+	spec.Params = append([]filterspec.Param(nil), spec.Params...)
+	for i := range spec.Params {
+		// custom settings live in plugin_params, not in flat keys
+		spec.Params[i].Key = ""
+	}
+	if err := filterspec.Register(spec); err != nil {
+		return err
+	}
+	FilterRegistry[models.FilterType(spec.Name)] = func(src []uint8, width int, params models.FilterParams) []uint8 {
+		return apply(src, width, params.Plugin)
+	}
+	return nil
+}
+
+// add the filters loaded from plugins to FilterRegistry. Plugins are only
+// loaded once, so after the first processor is created this finds them all
+// registered and writes nothing while jobs read the registry
+func registerPlugins() {
+	for _, name := range plugins.Names() {
+		filterType := models.FilterType(name)
+		if _, ok := FilterRegistry[filterType]; ok {
+			continue
+		}
+		filter, _ := plugins.Lookup(name)
+		FilterRegistry[filterType] = func(src []uint8, width int, params models.FilterParams) []uint8 {
+			return filter.Apply(src, width, params.Plugin)
+		}
+		if o, ok := filter.(plugins.Overlapper); ok {
+			FilterOverlap[filterType] = func(params models.FilterParams) int {
+				return o.Overlap(params.Plugin)
+			}
+		}
+	}
+}
+
+// FilterOverlap reports how many rows of context above and below a strip a
+// neighborhood filter needs; filters not listed are point operations
+var FilterOverlap = map[models.FilterType]func(params models.FilterParams) int{
+	models.FilterBlur: func(params models.FilterParams) int {
+		return int(params.BlurRadius)
+	},
 }
 
 func ApplyGrayScale(src []uint8, width int, params models.FilterParams) []uint8 {
@@ -24,6 +82,10 @@ func ApplyGrayScale(src []uint8, width int, params models.FilterParams) []uint8
 	}
 
 	dst := make([]uint8, len(src))
+	if vectorFilters && !params.Scalar {
+		grayscaleVector(dst, src)
+		return dst
+	}
 
 	for i := 0; i < len(src); i += 4 {
 		r := float64(src[i])
@@ -48,7 +110,15 @@ func ApplyBrightness(src []uint8, width int, params models.FilterParams) []uint8
 	}
 
 	dst := make([]uint8, len(src))
+	if params.Table != nil {
+		applyTable(dst, src, params.Table)
+		return dst
+	}
 	factor := params.Brightness
+	if op, ok := newLinearOp(factor, 0); ok && vectorFilters && !params.Scalar {
+		op.apply(dst, src)
+		return dst
+	}
 
 	for i := 0; i < len(src); i += 4 {
 		r := clamp(float64(src[i]) * factor)
@@ -71,12 +141,20 @@ func ApplyContrast(src []uint8, width int, params models.FilterParams) []uint8 {
 	}
 
 	dst := make([]uint8, len(src))
+	if params.Table != nil {
+		applyTable(dst, src, params.Table)
+		return dst
+	}
 	factor := params.Contrast
+	if op, ok := newLinearOp(factor, 128-128*factor); ok && vectorFilters && !params.Scalar {
+		op.apply(dst, src)
+		return dst
+	}
 
 	for i := 0; i < len(src); i += 4 {
-		r := clamp((float64(src[i]-128) * factor) + 128)
-		g := clamp((float64(src[i+1]-128) * factor) + 128)
-		b := clamp((float64(src[i+2]-128) * factor) + 128)
+		r := clamp(((float64(src[i]) - 128) * factor) + 128)
+		g := clamp(((float64(src[i+1]) - 128) * factor) + 128)
+		b := clamp(((float64(src[i+2]) - 128) * factor) + 128)
 		a := src[i+3]
 
 		dst[i] = uint8(r)
@@ -88,6 +166,44 @@ func ApplyContrast(src []uint8, width int, params models.FilterParams) []uint8 {
 	return dst
 }
 
+// raise each color channel to 1/gamma, so gamma above 1 brightens midtones
+func ApplyGamma(src []uint8, width int, params models.FilterParams) []uint8 {
+	if len(src)%4 != 0 {
+		return src
+	}
+
+	table := params.Table
+	if table == nil {
+		table = pointTable(models.FilterGamma, params)
+	}
+	dst := make([]uint8, len(src))
+	applyTable(dst, src, table)
+	return dst
+}
+
+// invert each color channel, keeping alpha
+func ApplyInvert(src []uint8, width int, params models.FilterParams) []uint8 {
+	if len(src)%4 != 0 {
+		return src
+	}
+
+	table := params.Table
+	if table == nil {
+		table = pointTable(models.FilterInvert, params)
+	}
+	dst := make([]uint8, len(src))
+	applyTable(dst, src, table)
+	return dst
+}
+
+// run the compiled expression on every pixel
+func ApplyExpression(src []uint8, width int, params models.FilterParams) []uint8 {
+	if len(src)%4 != 0 || params.Expression == nil {
+		return src
+	}
+	return params.Expression.Apply(src)
+}
+
 func ApplyBlur(src []uint8, width int, params models.FilterParams) []uint8 {
 	if len(src)%4 != 0 {
 		return src
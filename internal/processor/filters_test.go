@@ -0,0 +1,172 @@
+package processor
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// pixels covering every level in each channel, then random colors, with an
+// odd count so the vector loops finish on a single pixel
+func testPixels() []uint8 {
+	rng := rand.New(rand.NewSource(1))
+	var src []uint8
+	for v := 0; v < 256; v++ {
+		src = append(src, uint8(v), uint8(v), uint8(v), uint8(255-v))
+		src = append(src, uint8(v), 0, 255, uint8(v))
+		src = append(src, 255, uint8(v), 0, 128)
+		src = append(src, 0, 255, uint8(v), 255)
+	}
+	for i := 0; i < 10001; i++ {
+		src = append(src, uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)))
+	}
+	return src
+}
+
+// check the vectorized filter against its scalar loop: color channels within
+// one level and alpha untouched
+func checkVector(t *testing.T, filter Filter, params models.FilterParams) {
+	t.Helper()
+	if !vectorFilters {
+		t.Skip("no vectorized filters on this CPU")
+	}
+
+	src := testPixels()
+	vector := filter(src, 1, params)
+	params.Scalar = true
+	scalar := filter(src, 1, params)
+
+	for i := range src {
+		diff := int(vector[i]) - int(scalar[i])
+		if i%4 == 3 && (vector[i] != src[i] || scalar[i] != src[i]) {
+			t.Fatalf("alpha of pixel %d changed: %d, vector %d, scalar %d", i/4, src[i], vector[i], scalar[i])
+		}
+		if diff < -1 || diff > 1 {
+			t.Fatalf("pixel %d channel %d of %v: vector %d, scalar %d", i/4, i%4, src[i&^3:i&^3+4], vector[i], scalar[i])
+		}
+	}
+}
+
+func TestGrayScaleVector(t *testing.T) {
+	checkVector(t, ApplyGrayScale, models.FilterParams{})
+
+	// gray pixels keep their level exactly
+	src := []uint8{0, 0, 0, 255, 77, 77, 77, 255, 255, 255, 255, 255}
+	dst := ApplyGrayScale(src, 3, models.FilterParams{})
+	for i := range src {
+		if dst[i] != src[i] {
+			t.Fatalf("gray pixel %d: got %d, want %d", i/4, dst[i], src[i])
+		}
+	}
+}
+
+func TestBrightnessVector(t *testing.T) {
+	for _, factor := range []float64{0.01, 0.5, 0.8, 1, 1.1, 1.2, 1.5, 2, 3.7, 63.9, 64, 1000} {
+		checkVector(t, ApplyBrightness, models.FilterParams{Brightness: factor})
+	}
+}
+
+func TestContrastVector(t *testing.T) {
+	for _, factor := range []float64{-70, -2, -1, -0.5, 0, 0.5, 0.9, 1, 1.1, 1.5, 2, 10, 63.9, 100} {
+		checkVector(t, ApplyContrast, models.FilterParams{Contrast: factor})
+	}
+}
+
+// factors that map levels onto whole levels give the scalar results exactly
+func TestVectorExactFactors(t *testing.T) {
+	if !vectorFilters {
+		t.Skip("no vectorized filters on this CPU")
+	}
+	src := testPixels()
+	for _, params := range []models.FilterParams{{Brightness: 1}, {Brightness: 2}, {Brightness: 0.5}, {Contrast: 1}, {Contrast: -1}, {Contrast: 2}} {
+		filter := Filter(ApplyBrightness)
+		if params.Contrast != 0 {
+			filter = ApplyContrast
+		}
+		vector := filter(src, 1, params)
+		params.Scalar = true
+		scalar := filter(src, 1, params)
+		for i := range src {
+			if vector[i] != scalar[i] {
+				t.Fatalf("%+v: pixel %d channel %d: vector %d, scalar %d", params, i/4, i%4, vector[i], scalar[i])
+			}
+		}
+	}
+}
+
+// the lookup tables give exactly the pixels of the per-pixel loops
+func TestPointTable(t *testing.T) {
+	src := testPixels()
+	for _, c := range []struct {
+		filter Filter
+		typ    models.FilterType
+		params models.FilterParams
+	}{
+		{ApplyBrightness, models.FilterBrightness, models.FilterParams{Brightness: 1.2}},
+		{ApplyBrightness, models.FilterBrightness, models.FilterParams{Brightness: 0.37}},
+		{ApplyContrast, models.FilterConstrast, models.FilterParams{Contrast: 1.1}},
+		{ApplyContrast, models.FilterConstrast, models.FilterParams{Contrast: -2.5}},
+	} {
+		c.params.Scalar = true
+		want := c.filter(src, 1, c.params)
+		c.params.Table = pointTable(c.typ, c.params)
+		got := c.filter(src, 1, c.params)
+		for i := range src {
+			if got[i] != want[i] {
+				t.Fatalf("%s %+v: pixel %d channel %d: table %d, loop %d", c.typ, c.params, i/4, i%4, got[i], want[i])
+			}
+		}
+	}
+
+	dst := ApplyInvert([]uint8{0, 100, 255, 7}, 1, models.FilterParams{})
+	if string(dst) != string([]uint8{255, 155, 0, 7}) {
+		t.Fatalf("invert: got %v", dst)
+	}
+	dst = ApplyGamma([]uint8{0, 64, 255, 7}, 1, models.FilterParams{Gamma: 2})
+	if string(dst) != string([]uint8{0, 128, 255, 7}) {
+		t.Fatalf("gamma: got %v", dst)
+	}
+}
+
+// a 1920x1080 frame of random pixels
+func benchPixels() []uint8 {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]uint8, 1920*1080*4)
+	rng.Read(src)
+	return src
+}
+
+// run the scalar, vectorized and, for point filters, lookup table paths
+func benchFilter(b *testing.B, filter Filter, typ models.FilterType, params models.FilterParams) {
+	src := benchPixels()
+	run := func(name string, params models.FilterParams) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				filter(src, 1920, params)
+			}
+		})
+	}
+
+	scalar := params
+	scalar.Scalar = true
+	run("scalar", scalar)
+	run("vector", params)
+	if table := pointTable(typ, params); table != nil {
+		params.Table = table
+		run("table", params)
+	}
+}
+
+func BenchmarkGrayScale(b *testing.B) {
+	benchFilter(b, ApplyGrayScale, models.FilterGrayScale, models.FilterParams{})
+}
+
+func BenchmarkBrightness(b *testing.B) {
+	benchFilter(b, ApplyBrightness, models.FilterBrightness, models.FilterParams{Brightness: 1.2})
+}
+
+func BenchmarkContrast(b *testing.B) {
+	benchFilter(b, ApplyContrast, models.FilterConstrast, models.FilterParams{Contrast: 1.1})
+}
@@ -0,0 +1,187 @@
+package processor
+
+import (
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tiffmeta"
+)
+
+// GeoTIFF tags
+const (
+	tagModelPixelScale     = 33550
+	tagModelTiepoint       = 33922
+	tagModelTransformation = 34264
+	tagGeoKeyDirectory     = 34735
+	tagGeoDoubleParams     = 34736
+	tagGeoASCIIParams      = 34737
+
+	keyGeographicType = 2048
+	keyProjectedType  = 3072
+)
+
+// read GeoTIFF georeferencing from a TIFF file, nil when it has none
+func readGeoMetadata(path string) (*models.GeoMetadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dir, err := tiffmeta.Read(file)
+	if err != nil {
+		return nil, err
+	}
+
+	geo := &models.GeoMetadata{}
+	found := false
+	if e, ok := dir.Find(tagModelPixelScale); ok {
+		geo.PixelScale, found = dir.Doubles(e), true
+	}
+	if e, ok := dir.Find(tagModelTiepoint); ok {
+		geo.Tiepoints, found = dir.Doubles(e), true
+	}
+	if e, ok := dir.Find(tagModelTransformation); ok {
+		geo.Transformation, found = dir.Doubles(e), true
+	}
+	if e, ok := dir.Find(tagGeoKeyDirectory); ok {
+		geo.GeoKeys, found = dir.Shorts(e), true
+	}
+	if e, ok := dir.Find(tagGeoDoubleParams); ok {
+		geo.GeoDoubles = dir.Doubles(e)
+	}
+	if e, ok := dir.Find(tagGeoASCIIParams); ok {
+		geo.GeoASCII = dir.ASCII(e)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	geo.EPSG = epsgCode(geo.GeoKeys)
+	return geo, nil
+}
+
+// find the projected or geographic CRS code in a GeoKey directory, whose
+// entries are (key, location, count, value) after a 4-value header
+func epsgCode(keys []uint16) int {
+	code := 0
+	for i := 4; i+3 < len(keys); i += 4 {
+		if keys[i+1] != 0 {
+			continue
+		}
+		switch keys[i] {
+		case keyProjectedType:
+			return int(keys[i+3])
+		case keyGeographicType:
+			code = int(keys[i+3])
+		}
+	}
+	return code
+}
+
+// write georeferencing into an already encoded TIFF file
+func writeGeoMetadata(path string, geo *models.GeoMetadata) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	dir, err := tiffmeta.Read(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	order := dir.Order
+	var entries []tiffmeta.Entry
+	if len(geo.PixelScale) > 0 {
+		entries = append(entries, tiffmeta.DoublesEntry(order, tagModelPixelScale, geo.PixelScale))
+	}
+	if len(geo.Tiepoints) > 0 {
+		entries = append(entries, tiffmeta.DoublesEntry(order, tagModelTiepoint, geo.Tiepoints))
+	}
+	if len(geo.Transformation) > 0 {
+		entries = append(entries, tiffmeta.DoublesEntry(order, tagModelTransformation, geo.Transformation))
+	}
+	if len(geo.GeoKeys) > 0 {
+		entries = append(entries, tiffmeta.ShortsEntry(order, tagGeoKeyDirectory, geo.GeoKeys))
+	}
+	if len(geo.GeoDoubles) > 0 {
+		entries = append(entries, tiffmeta.DoublesEntry(order, tagGeoDoubleParams, geo.GeoDoubles))
+	}
+	if geo.GeoASCII != "" {
+		entries = append(entries, tiffmeta.ASCIIEntry(tagGeoASCIIParams, geo.GeoASCII))
+	}
+
+	out, err := tiffmeta.AddTags(data, entries)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, out, 0644)
+}
+
+// shift georeferencing so that pixel (x, y) becomes the new origin
+func cropGeo(geo *models.GeoMetadata, x, y int) {
+	fx, fy := float64(x), float64(y)
+
+	// with a single tiepoint and a pixel scale the origin is recomputed
+	// directly, otherwise the tiepoints are moved with the raster
+	if len(geo.Tiepoints) == 6 && len(geo.PixelScale) >= 2 {
+		t := geo.Tiepoints
+		t[3] += (fx - t[0]) * geo.PixelScale[0]
+		t[4] -= (fy - t[1]) * geo.PixelScale[1]
+		t[0], t[1] = 0, 0
+	} else {
+		for i := 0; i+5 < len(geo.Tiepoints); i += 6 {
+			geo.Tiepoints[i] -= fx
+			geo.Tiepoints[i+1] -= fy
+		}
+	}
+
+	// the 4x4 model transformation maps (i, j, k, 1) to model space
+	if m := geo.Transformation; len(m) == 16 {
+		m[3] += m[0]*fx + m[1]*fy
+		m[7] += m[4]*fx + m[5]*fy
+	}
+}
+
+// rescale georeferencing for a raster resized by the given factors, where a
+// factor is the old size divided by the new size
+func scaleGeo(geo *models.GeoMetadata, sx, sy float64) {
+	if len(geo.PixelScale) >= 2 {
+		geo.PixelScale[0] *= sx
+		geo.PixelScale[1] *= sy
+	}
+
+	for i := 0; i+5 < len(geo.Tiepoints); i += 6 {
+		geo.Tiepoints[i] /= sx
+		geo.Tiepoints[i+1] /= sy
+	}
+
+	if m := geo.Transformation; len(m) == 16 {
+		m[0] *= sx
+		m[1] *= sy
+		m[4] *= sx
+		m[5] *= sy
+	}
+}
+
+// copy georeferencing so that pipeline branches can transform it separately
+func cloneGeo(geo *models.GeoMetadata) *models.GeoMetadata {
+	if geo == nil {
+		return nil
+	}
+
+	clone := *geo
+	clone.PixelScale = append([]float64(nil), geo.PixelScale...)
+	clone.Tiepoints = append([]float64(nil), geo.Tiepoints...)
+	clone.Transformation = append([]float64(nil), geo.Transformation...)
+	clone.GeoKeys = append([]uint16(nil), geo.GeoKeys...)
+	clone.GeoDoubles = append([]float64(nil), geo.GeoDoubles...)
+	return &clone
+}
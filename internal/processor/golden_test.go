@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"image"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/imagetest"
+)
+
+// apply a row filter to all of img
+func applyFilter(filter Filter, img *image.RGBA, params models.FilterParams) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	out.Pix = filter(img.Pix, img.Bounds().Dx(), params)
+	return out
+}
+
+// the filters against goldens made from their scalar loops, so a change to
+// a filter's output shows up as a failure here
+func TestFilterGoldens(t *testing.T) {
+	src := imagetest.Noise(48, 32, 1)
+	scalar := models.FilterParams{Scalar: true}
+	blur, gamma := scalar, scalar
+	blur.BlurRadius = 2
+	gamma.Gamma = 2.2
+
+	for _, c := range []struct {
+		name   string
+		filter Filter
+		params models.FilterParams
+	}{
+		{"grayscale", ApplyGrayScale, scalar},
+		{"blur", ApplyBlur, blur},
+		{"gamma", ApplyGamma, gamma},
+		{"invert", ApplyInvert, scalar},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got := applyFilter(c.filter, src, c.params)
+			imagetest.AssertGolden(t, imagetest.Golden(c.name), got, imagetest.Tolerance{})
+		})
+	}
+
+	// vectorized loops may round differently by a level
+	vector := applyFilter(ApplyGrayScale, src, models.FilterParams{})
+	diff, err := imagetest.Compare(vector, applyFilter(ApplyGrayScale, src, scalar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Within(imagetest.Tolerance{MaxDelta: 1, MinSSIM: 0.99}) {
+		t.Errorf("vectorized grayscale: %s", diff)
+	}
+}
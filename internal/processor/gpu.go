@@ -0,0 +1,84 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/gpu"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// filters the GPU backend runs
+var gpuFilters = map[models.FilterType]bool{
+	models.FilterBlur:   true,
+	models.FilterResize: true,
+}
+
+// warn once that jobs asking for the GPU run on the CPU
+var gpuMissing sync.Once
+
+// whether a job's filter runs on the GPU under its backend setting
+func useGPU(job models.ImageJob, bounds image.Rectangle) bool {
+	if !gpuFilters[job.Filter] {
+		return false
+	}
+	switch job.Params.Backend {
+	case "gpu":
+		return true
+	case "auto":
+		return int64(bounds.Dx())*int64(bounds.Dy()) >= job.Params.GPUMinPixels
+	}
+	return false
+}
+
+// run blur or resize on the GPU when the job's backend selects it; false
+// when it doesn't, or the GPU is missing or fails, and the CPU filter runs
+func (p *Processor) applyGPU(ctx context.Context, job models.ImageJob, img *image.RGBA) (*image.RGBA, bool) {
+	bounds := img.Bounds()
+	if !useGPU(job, bounds) {
+		return nil, false
+	}
+	if !gpu.Available() {
+		gpuMissing.Do(func() {
+			p.logger.WithError(gpu.ErrUnavailable).Warn("GPU backend unavailable, filtering on the CPU")
+		})
+		return nil, false
+	}
+	defer usageFrom(ctx).since(time.Now())
+
+	// the kernels read packed rows from the origin
+	width, height := bounds.Dx(), bounds.Dy()
+	src := img
+	if img.Stride != width*4 || bounds.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			copy(src.Pix[y*src.Stride:(y+1)*src.Stride], img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
+		}
+	}
+
+	var dst *image.RGBA
+	var err error
+	switch job.Filter {
+	case models.FilterBlur:
+		radius := int(job.Params.BlurRadius)
+		if radius <= 0 {
+			return nil, false
+		}
+		dst = image.NewRGBA(bounds)
+		dst.Pix, err = gpu.Blur(src.Pix, width, height, radius)
+	case models.FilterResize:
+		size := ResizeTarget(bounds, job.Params)
+		if size == bounds.Size() {
+			return img, true
+		}
+		dst = image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+		dst.Pix, err = gpu.Resize(src.Pix, width, height, size.X, size.Y)
+	}
+	if err != nil {
+		p.logger.WithError(err).WithField("filter", job.Filter).Warn("GPU filter failed, filtering on the CPU")
+		return nil, false
+	}
+	return dst, true
+}
@@ -0,0 +1,152 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// a node of the pipeline diagram
+type graphNode struct {
+	id    string
+	label []string
+}
+
+// an edge between two diagram nodes
+type graphEdge struct {
+	from, to string
+}
+
+// PipelineGraph renders the configured pipeline, from decode through each
+// filter and its parameters to every output, as a Graphviz dot or Mermaid
+// diagram. Steps that feed several branches appear once with several edges
+func (p *Processor) PipelineGraph(format string) (string, error) {
+	// diagram ids are generated, since step ids may not be valid identifiers
+	ids := map[string]string{config.SourceNode: "decode"}
+	nodes := []graphNode{{id: "decode", label: []string{"decode", p.config.InputDir}}}
+	var edges []graphEdge
+
+	for i, step := range p.steps {
+		id := fmt.Sprintf("step%d", i+1)
+		ids[step.ID] = id
+
+		title := string(step.Filter)
+		if step.ID != id {
+			title = step.ID + ": " + title
+		}
+		nodes = append(nodes, graphNode{id: id, label: append([]string{title}, stepParams(step)...)})
+		edges = append(edges, graphEdge{from: ids[step.Input], to: id})
+	}
+
+	for i, output := range p.outputs {
+		id := fmt.Sprintf("output%d", i+1)
+		label := []string{"encode " + p.outputDescription(output)}
+		if output.Name != "" {
+			label = append(label, output.Name)
+		}
+		nodes = append(nodes, graphNode{id: id, label: append(label, p.config.OutputDir)})
+		edges = append(edges, graphEdge{from: ids[output.From], to: id})
+	}
+
+	switch format {
+	case "dot":
+		return dotGraph(nodes, edges), nil
+	case "mermaid":
+		return mermaidGraph(nodes, edges), nil
+	default:
+		return "", fmt.Errorf("unknown graph format: %s", format)
+	}
+}
+
+func dotGraph(nodes []graphNode, edges []graphEdge) string {
+	var b strings.Builder
+	b.WriteString("digraph pipeline {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "  %s [label=%q];\n", n.id, strings.Join(n.label, "\n"))
+	}
+	for _, e := range edges {
+		fmt.Fprintf(&b, "  %s -> %s;\n", e.from, e.to)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func mermaidGraph(nodes []graphNode, edges []graphEdge) string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, n := range nodes {
+		// quotes can't be escaped inside a mermaid label
+		label := strings.ReplaceAll(strings.Join(n.label, "<br/>"), `"`, "'")
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", n.id, label)
+	}
+	for _, e := range edges {
+		fmt.Fprintf(&b, "  %s --> %s\n", e.from, e.to)
+	}
+	return b.String()
+}
+
+// format an output is encoded in
+func (p *Processor) outputDescription(output config.PipelineOutput) string {
+	switch {
+	case output.Format != "":
+		return output.Format
+	case p.alphaUpstream(output.From):
+		return "png"
+	default:
+		return "(input format)"
+	}
+}
+
+// the parameters a filter reads, formatted as key=value
+func stepParams(step models.PipelineStep) []string {
+	params := step.Params
+
+	switch step.Filter {
+	case models.FilterBlur:
+		return []string{fmt.Sprintf("blur_radius=%g", params.BlurRadius)}
+	case models.FilterBrightness:
+		return []string{fmt.Sprintf("brightness=%g", params.Brightness)}
+	case models.FilterConstrast:
+		return []string{fmt.Sprintf("contrast=%g", params.Contrast)}
+	case models.FilterGamma:
+		return []string{fmt.Sprintf("gamma=%g", params.Gamma)}
+	case models.FilterRoundCorners:
+		return []string{"corner_radius=" + formatLength(params.CornerRadius, params.CornerRadiusPercent)}
+	case models.FilterDropShadow:
+		return []string{
+			fmt.Sprintf("shadow_offset=%d,%d", params.ShadowOffsetX, params.ShadowOffsetY),
+			fmt.Sprintf("shadow_blur=%g", params.ShadowBlur),
+			"shadow_color=" + formatColor(params.ShadowColor.R, params.ShadowColor.G, params.ShadowColor.B),
+			fmt.Sprintf("shadow_opacity=%g", params.ShadowOpacity),
+		}
+	case models.FilterOuterGlow:
+		return []string{
+			fmt.Sprintf("glow_radius=%g", params.GlowRadius),
+			"glow_color=" + formatColor(params.GlowColor.R, params.GlowColor.G, params.GlowColor.B),
+			fmt.Sprintf("glow_opacity=%g", params.GlowOpacity),
+		}
+	case models.FilterResize:
+		return []string{fmt.Sprintf("resize=%dx%d", params.ResizeWidth, params.ResizeHeight)}
+	case models.FilterCrop:
+		return []string{fmt.Sprintf("crop=%d,%d %dx%d", params.CropX, params.CropY, params.CropWidth, params.CropHeight)}
+	case models.FilterSmartCrop:
+		return []string{fmt.Sprintf("aspect=%g", params.SmartCropAspect), "strategy=" + params.SmartCropStrategy}
+	default:
+		return nil
+	}
+}
+
+func formatLength(value float64, percent bool) string {
+	if percent {
+		return fmt.Sprintf("%g%%", value)
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+func formatColor(r, g, b uint8) string {
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/plugins"
+)
+
+// Hook runs custom code around the stages of every job, such as logging,
+// scanning inputs for viruses, adding metadata to outputs or uploading
+// them. An error from any method fails the job. Methods are called from the
+// workers, so concurrently, and only take standard library types, so a Go
+// plugin can export a hook as well. Embed HookFuncs to implement only some
+type Hook interface {
+	// BeforeDecode is called before the input is read, once its size is
+	// checked
+	BeforeDecode(ctx context.Context, input string) error
+	// AfterDecode is called with the decoded input, before any filter.
+	// Inputs restored from the cache, copied unchanged or streamed aren't
+	// decoded whole, so skip it
+	AfterDecode(ctx context.Context, input string, img image.Image) error
+	// BeforeEncode is called with the image of each output before it is
+	// encoded to the output path. Streamed outputs skip it
+	BeforeEncode(ctx context.Context, input, output string, img image.Image) error
+	// AfterSave is called once each output file is written, and may change
+	// it; outputs restored from the cache aren't written again
+	AfterSave(ctx context.Context, input, output string) error
+}
+
+// HookFuncs is a Hook calling the functions it has, so a hook can set only
+// those it needs
+type HookFuncs struct {
+	OnBeforeDecode func(ctx context.Context, input string) error
+	OnAfterDecode  func(ctx context.Context, input string, img image.Image) error
+	OnBeforeEncode func(ctx context.Context, input, output string, img image.Image) error
+	OnAfterSave    func(ctx context.Context, input, output string) error
+}
+
+func (h HookFuncs) BeforeDecode(ctx context.Context, input string) error {
+	if h.OnBeforeDecode == nil {
+		return nil
+	}
+	return h.OnBeforeDecode(ctx, input)
+}
+
+func (h HookFuncs) AfterDecode(ctx context.Context, input string, img image.Image) error {
+	if h.OnAfterDecode == nil {
+		return nil
+	}
+	return h.OnAfterDecode(ctx, input, img)
+}
+
+func (h HookFuncs) BeforeEncode(ctx context.Context, input, output string, img image.Image) error {
+	if h.OnBeforeEncode == nil {
+		return nil
+	}
+	return h.OnBeforeEncode(ctx, input, output, img)
+}
+
+func (h HookFuncs) AfterSave(ctx context.Context, input, output string) error {
+	if h.OnAfterSave == nil {
+		return nil
+	}
+	return h.OnAfterSave(ctx, input, output)
+}
+
+// WithHooks runs hooks around every job, after those of plugins, in the
+// order given
+func WithHooks(hooks ...Hook) Option {
+	return func(o *options) {
+		o.hooks = append(o.hooks, hooks...)
+	}
+}
+
+// call run with the hooks of plugins, then the processor's own, stopping at
+// the first error, which is returned naming the stage
+func (p *Processor) runHooks(stage string, run func(Hook) error) error {
+	for _, hook := range plugins.Hooks() {
+		if err := run(hook); err != nil {
+			return fmt.Errorf("%s hook: %w", stage, err)
+		}
+	}
+	for _, hook := range p.hooks {
+		if err := run(hook); err != nil {
+			return fmt.Errorf("%s hook: %w", stage, err)
+		}
+	}
+	return nil
+}
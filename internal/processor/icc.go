@@ -0,0 +1,188 @@
+package processor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/tiffmeta"
+)
+
+// TIFF tag of an embedded ICC profile
+const tagICCProfile = 34675
+
+// largest ICC chunk a JPEG APP2 segment holds, after its 14-byte header
+const jpegICCChunk = 65519
+
+// read the ICC profile embedded in a JPEG, PNG or TIFF file, nil when it has
+// none or it can't be read
+func readICC(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	switch sniffFormat(data) {
+	case "jpeg":
+		return jpegICC(data)
+	case "png":
+		return pngICC(data)
+	case "tiff":
+		dir, err := tiffmeta.Read(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		if e, ok := dir.Find(tagICCProfile); ok {
+			return e.Data
+		}
+	}
+	return nil
+}
+
+// whether profile describes RGB data, the only kind the encoders write
+// besides 16-bit grayscale
+func rgbProfile(profile []byte) bool {
+	return len(profile) >= 128 && string(profile[16:20]) == "RGB "
+}
+
+// the profile split over a JPEG's APP2 ICC_PROFILE segments, which number
+// their chunks from 1
+func jpegICC(data []byte) []byte {
+	segments, err := parseJPEG(data)
+	if err != nil {
+		return nil
+	}
+
+	chunks := map[int][]byte{}
+	total := 0
+	for _, s := range segments {
+		if s.marker != markerAPP2 || !bytes.HasPrefix(s.payload, []byte("ICC_PROFILE\x00")) || len(s.payload) < 14 {
+			continue
+		}
+		chunks[int(s.payload[12])] = s.payload[14:]
+		total = int(s.payload[13])
+	}
+	if len(chunks) == 0 || len(chunks) != total {
+		return nil
+	}
+
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var profile []byte
+	for i, seq := range seqs {
+		if seq != i+1 {
+			return nil
+		}
+		profile = append(profile, chunks[seq]...)
+	}
+	return profile
+}
+
+// the profile of a PNG's iCCP chunk: a name, a compression method and the
+// zlib-compressed profile
+func pngICC(data []byte) []byte {
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if end > len(data) {
+			return nil
+		}
+		switch string(data[i+4 : i+8]) {
+		case "iCCP":
+			chunk := data[i+8 : end-4]
+			name := bytes.IndexByte(chunk, 0)
+			if name < 0 || name+2 > len(chunk) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		case "IDAT", "IEND":
+			return nil
+		}
+		i = end
+	}
+	return nil
+}
+
+// embed an ICC profile in the JPEG, PNG or TIFF file at path, as saveImage
+// wrote it
+func embedICC(path string, profile []byte) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch encodedFormat(path) {
+	case "jpeg":
+		out = embedJPEGICC(data, profile)
+	case "tiff":
+		entry := tiffmeta.Entry{Tag: tagICCProfile, Type: tiffmeta.TypeUndefined, Count: uint32(len(profile)), Data: profile}
+		if out, err = tiffmeta.AddTags(data, []tiffmeta.Entry{entry}); err != nil {
+			return err
+		}
+	default:
+		if out, err = embedPNGICC(data, profile); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// insert APP2 segments right after SOI
+func embedJPEGICC(data, profile []byte) []byte {
+	count := (len(profile) + jpegICCChunk - 1) / jpegICCChunk
+	out := make([]byte, 0, len(data)+len(profile)+count*18)
+	out = append(out, data[:2]...)
+	for seq := 1; seq <= count; seq++ {
+		chunk := profile[(seq-1)*jpegICCChunk : min(seq*jpegICCChunk, len(profile))]
+		length := 2 + 14 + len(chunk)
+		out = append(out, 0xff, markerAPP2, byte(length>>8), byte(length))
+		out = append(out, "ICC_PROFILE\x00"...)
+		out = append(out, byte(seq), byte(count))
+		out = append(out, chunk...)
+	}
+	return append(out, data[2:]...)
+}
+
+// insert an iCCP chunk into a PNG
+func embedPNGICC(data, profile []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	if _, err := w.Write(profile); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	body := append([]byte("iCCPICC profile\x00\x00"), compressed.Bytes()...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)-4))
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(body))
+	return insertPNGChunks(data, chunk), nil
+}
+
+// insert chunks after the IHDR chunk of a PNG written by the encoder, where
+// chunks that must precede PLTE and IDAT go
+func insertPNGChunks(data, chunks []byte) []byte {
+	header := 8 + 12 + int(binary.BigEndian.Uint32(data[8:]))
+	out := make([]byte, 0, len(data)+len(chunks))
+	out = append(out, data[:header]...)
+	out = append(out, chunks...)
+	return append(out, data[header:]...)
+}
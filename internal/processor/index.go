@@ -0,0 +1,347 @@
+package processor
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// one input as it was when last processed. Size and modification time spare
+// hashing inputs that weren't touched; the hash catches those touched but
+// not changed
+type indexEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+	// runFingerprint of the pipeline, encoding and output directory that
+	// produced Outputs
+	Params  string              `json:"params"`
+	Outputs []models.OutputFile `json:"outputs,omitempty"`
+}
+
+// file layout of incremental_index
+type indexFile struct {
+	Updated time.Time             `json:"updated"`
+	Inputs  map[string]indexEntry `json:"inputs"`
+}
+
+// Index records the inputs of earlier runs with incremental_index, so a run
+// only processes inputs that are new or changed since, or whose pipeline
+// or outputs are
+type Index struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]indexEntry
+	// outputs an input had before this run that it no longer has, for
+	// mirror_delete
+	stale []string
+}
+
+// OpenIndex loads incremental_index, which may not exist yet, and reserves
+// the names of the outputs it records so new inputs don't take them
+func (p *Processor) OpenIndex() (*Index, error) {
+	idx := &Index{path: p.config.IncrementalIndex, entries: map[string]indexEntry{}}
+	data, err := os.ReadFile(idx.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %w", idx.path, err)
+	}
+	if file.Inputs != nil {
+		idx.entries = file.Inputs
+	}
+	for input, entry := range idx.entries {
+		p.names.reserve(input, entry.Outputs)
+	}
+	return idx, nil
+}
+
+// FilterIndexed passes on the paths received on paths that are new or
+// changed since idx recorded them, and sends a result marked UpToDate for
+// each of the others once paths is closed. An input is up to date when it
+// was processed with the same pipeline and output directory, its outputs
+// still exist, and it has the same size and modification time, or failing
+// those the same SHA-256
+func (p *Processor) FilterIndexed(ctx context.Context, idx *Index, paths <-chan string) (<-chan string, <-chan []models.ProcessingResult) {
+	changed := make(chan string)
+	found := make(chan []models.ProcessingResult, 1)
+	params := p.runFingerprint()
+
+	go func() {
+		defer close(changed)
+		var upToDate []models.ProcessingResult
+		defer func() { found <- upToDate }()
+
+		for path := range paths {
+			if entry, ok := idx.upToDate(path, params); ok {
+				upToDate = append(upToDate, indexedResult(path, entry))
+				continue
+			}
+
+			select {
+			case changed <- path:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changed, found
+}
+
+// the entry of an input that is up to date, see FilterIndexed. An input
+// touched without being changed gets its new modification time, so it
+// isn't hashed again
+func (idx *Index) upToDate(path, params string) (indexEntry, bool) {
+	idx.mu.Lock()
+	entry, ok := idx.entries[path]
+	idx.mu.Unlock()
+	if !ok || entry.Params != params {
+		return entry, false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != entry.Size {
+		return entry, false
+	}
+	for _, output := range entry.Outputs {
+		if _, err := os.Stat(output.Path); err != nil {
+			return entry, false
+		}
+	}
+	if info.ModTime().Equal(entry.ModTime) {
+		return entry, true
+	}
+
+	sum, err := contentHash(path)
+	if err != nil || hex.EncodeToString(sum[:]) != entry.Hash {
+		return entry, false
+	}
+	entry.ModTime = info.ModTime()
+	idx.mu.Lock()
+	idx.entries[path] = entry
+	idx.mu.Unlock()
+	return entry, true
+}
+
+// result of an input up to date in the index
+func indexedResult(path string, entry indexEntry) models.ProcessingResult {
+	result := models.ProcessingResult{
+		InputPath: path,
+		Outputs:   entry.Outputs,
+		UpToDate:  true,
+	}
+	if len(entry.Outputs) > 0 {
+		result.OutputPath = entry.Outputs[0].Path
+		result.Metadata.Width = entry.Outputs[0].Width
+		result.Metadata.Height = entry.Outputs[0].Height
+		result.Metadata.ProcessedSize = entry.Outputs[0].Size
+	}
+	result.Metadata.OriginalSize = entry.Size
+	return result
+}
+
+// UpdateIndex records in idx the successful results of a run. Failed
+// inputs are dropped, so the next run tries them again, and those skipped
+// or interrupted keep their earlier entry
+func (p *Processor) UpdateIndex(idx *Index, results []models.ProcessingResult) {
+	params := p.runFingerprint()
+	for _, result := range results {
+		if result.UpToDate || errors.Is(result.Error, ErrSkipped) || errors.Is(result.Error, context.Canceled) {
+			continue
+		}
+		if result.Error != nil {
+			idx.forget(result.InputPath)
+			continue
+		}
+
+		// an input removed while it was processed leaves its outputs
+		// behind
+		info, err := os.Stat(result.InputPath)
+		if err != nil {
+			idx.retire(result.Outputs, nil)
+			idx.forget(result.InputPath)
+			continue
+		}
+		sum, err := contentHash(result.InputPath)
+		if err != nil {
+			idx.retire(result.Outputs, nil)
+			idx.forget(result.InputPath)
+			continue
+		}
+		idx.mu.Lock()
+		idx.retireLocked(idx.entries[result.InputPath].Outputs, result.Outputs)
+		idx.entries[result.InputPath] = indexEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Hash:    hex.EncodeToString(sum[:]),
+			Params:  params,
+			Outputs: result.Outputs,
+		}
+		idx.mu.Unlock()
+	}
+}
+
+func (idx *Index) forget(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.entries, path)
+}
+
+// mark the outputs that aren't among kept as stale
+func (idx *Index) retire(outputs, kept []models.OutputFile) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.retireLocked(outputs, kept)
+}
+
+func (idx *Index) retireLocked(outputs, kept []models.OutputFile) {
+	keep := map[string]bool{}
+	for _, output := range kept {
+		keep[output.Path] = true
+	}
+	for _, output := range outputs {
+		if !keep[output.Path] {
+			idx.stale = append(idx.stale, output.Path)
+		}
+	}
+}
+
+// MirrorDelete removes the outputs of every input under input_dir in idx
+// that no longer exists, and those an input had before this run but no
+// longer has, so the output directory only holds outputs of the current
+// inputs. Entries of inputs elsewhere, such as those of another input_dir,
+// are left alone, and only files inside output_dir are removed. Files
+// another input's entry still names, such as a shared content-addressed
+// output, are kept, and directories of output_dir left empty are removed.
+// It returns the files removed. Callers run it only after a complete walk
+// of input_dir, so an input missing from it is one that was deleted
+func (p *Processor) MirrorDelete(idx *Index) ([]string, error) {
+	inputDir, err := filepath.Abs(p.config.InputDir)
+	if err != nil {
+		return nil, err
+	}
+	outputDir, err := filepath.Abs(p.config.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	// an unmounted or moved input directory would look like every input
+	// was deleted
+	if info, err := os.Stat(inputDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("input directory %s is missing", p.config.InputDir)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	candidates := idx.stale
+	idx.stale = nil
+	for input, entry := range idx.entries {
+		if !within(inputDir, input) {
+			continue
+		}
+		if _, err := os.Stat(input); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		for _, output := range entry.Outputs {
+			candidates = append(candidates, output.Path)
+		}
+		delete(idx.entries, input)
+	}
+
+	kept := map[string]bool{}
+	for _, entry := range idx.entries {
+		for _, output := range entry.Outputs {
+			kept[output.Path] = true
+		}
+	}
+
+	var removed []string
+	var errs []error
+	for _, path := range candidates {
+		if kept[path] {
+			continue
+		}
+		// listed twice when shared by removed inputs
+		kept[path] = true
+		if !within(outputDir, path) {
+			p.logger.WithField("output", path).Warn("Not removing an output outside the output directory")
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		removed = append(removed, path)
+		p.logger.WithField("output", path).Debug("Removed output of a deleted input")
+		pruneEmptyDirs(outputDir, filepath.Dir(path))
+	}
+	return removed, errors.Join(errs...)
+}
+
+// whether path, made absolute, is inside the absolute directory root
+func within(root, path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// remove dir and its parents while they are empty, up to root
+func pruneEmptyDirs(root, dir string) {
+	for within(root, dir) && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Save writes the index through a temporary file renamed over it, so an
+// interrupted save leaves the previous index
+func (idx *Index) Save() error {
+	idx.mu.Lock()
+	data, err := json.MarshalIndent(indexFile{Updated: time.Now().UTC(), Inputs: idx.entries}, "", "  ")
+	idx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(idx.path), ".index-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), idx.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// mirror_delete removes only the outputs of deleted inputs under
+// input_dir, and never a file outside output_dir
+func TestMirrorDelete(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	touch := func(path string) string {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	outputs := func(paths ...string) []models.OutputFile {
+		var files []models.OutputFile
+		for _, path := range paths {
+			files = append(files, models.OutputFile{Path: path})
+		}
+		return files
+	}
+
+	kept := touch(filepath.Join(in, "kept.png"))
+	keptOut := touch(filepath.Join(out, "kept.png"))
+	deletedOut := touch(filepath.Join(out, "sub", "deleted.png"))
+	elsewhereOut := touch(filepath.Join(out, "elsewhere.png"))
+	outside := touch(filepath.Join(dir, "outside.png"))
+
+	idx := &Index{entries: map[string]indexEntry{
+		kept:                                 {Outputs: outputs(keptOut)},
+		filepath.Join(in, "deleted.png"):     {Outputs: outputs(deletedOut)},
+		filepath.Join(in, "escape.png"):      {Outputs: outputs(outside)},
+		filepath.Join(dir, "other", "x.png"): {Outputs: outputs(elsewhereOut)},
+	}}
+	p := &Processor{
+		config: &config.Config{InputDir: in, OutputDir: out},
+		logger: logger.NewLoggerWithOutput(false, "text", io.Discard),
+	}
+
+	removed, err := p.MirrorDelete(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != deletedOut {
+		t.Errorf("removed %v, want only %s", removed, deletedOut)
+	}
+	for _, path := range []string{keptOut, elsewhereOut, outside} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "sub")); !os.IsNotExist(err) {
+		t.Errorf("empty output directory sub was kept")
+	}
+
+	// a missing input directory looks like every input was deleted
+	os.RemoveAll(in)
+	if _, err := p.MirrorDelete(idx); err == nil {
+		t.Error("no error for a missing input directory")
+	}
+	if _, err := os.Stat(keptOut); err != nil {
+		t.Errorf("%s was removed with the input directory missing", keptOut)
+	}
+}
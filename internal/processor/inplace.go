@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// InPlaceTempPattern matches the temporary files in_place jobs write next
+// to their inputs, so walks of the input directory can leave them out
+const InPlaceTempPattern = ".*.in-place.*"
+
+// the temporary file an in_place job writes next to its input, with the
+// extension of the format it's encoded in
+func inPlaceTemp(inputPath, ext string) string {
+	dir, base := filepath.Split(inputPath)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	return filepath.Join(dir, "."+name+".in-place"+ext)
+}
+
+// whether job writes its result over its input. Manifest entries naming
+// their own output aren't
+func inPlaceJob(job models.ImageJob) bool {
+	if len(job.Outputs) != 1 {
+		return false
+	}
+	output := job.Outputs[0].Path
+	return output == inPlaceTemp(job.InputPath, filepath.Ext(output))
+}
+
+// an error for an in_place job whose pipeline would change the input's
+// format, before any work is done on it
+func checkInPlace(job models.ImageJob) error {
+	if !inPlaceJob(job) {
+		return nil
+	}
+	from, to := formatExt(job.InputPath), formatExt(job.Outputs[0].Path)
+	if from != to {
+		return fmt.Errorf("in-place editing can't change %s to %s", from, to)
+	}
+	return nil
+}
+
+// the extension of path's format, with its spellings folded
+func formatExt(path string) string {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".jpeg":
+		return ".jpg"
+	case ".tiff":
+		return ".tif"
+	default:
+		return ext
+	}
+}
+
+// move an in_place job's result over its input, reporting the input as its
+// output. A failed job's temporary file is removed and the input left as it
+// was
+func (p *Processor) replaceInput(sj *stageJob) {
+	if !inPlaceJob(sj.job) {
+		return
+	}
+	input, temp := sj.job.InputPath, sj.job.Outputs[0].Path
+	if sj.result.Error != nil {
+		os.Remove(temp)
+		return
+	}
+	if err := p.replaceWith(input, temp); err != nil {
+		os.Remove(temp)
+		sj.result.Error = fmt.Errorf("failed to replace input: %w", err)
+		return
+	}
+
+	for i := range sj.result.Outputs {
+		if sj.result.Outputs[i].Path == temp {
+			sj.result.Outputs[i].Path = input
+		}
+	}
+	sj.result.OutputPath = input
+}
+
+// rename temp over input, keeping the input's permissions, after backing
+// the input up when in_place_backup is set. The rename is atomic, so
+// readers see the old file or the new one, never a partial write
+func (p *Processor) replaceWith(input, temp string) error {
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	tempInfo, err := os.Stat(temp)
+	if err != nil {
+		return err
+	}
+	// unchanged_outputs link linked the input itself
+	if os.SameFile(info, tempInfo) {
+		return os.Remove(temp)
+	}
+
+	if err := os.Chmod(temp, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := syncFile(temp); err != nil {
+		return err
+	}
+	if suffix := p.config.InPlaceBackup; suffix != "" {
+		if err := backupFile(input, input+suffix); err != nil {
+			return fmt.Errorf("failed to back up input: %w", err)
+		}
+	}
+	return os.Rename(temp, input)
+}
+
+// keep the original at backup. A backup left by an earlier run is kept, so
+// it stays the file as it was before any in-place edit. It's a hard link
+// where the filesystem allows, since the input is about to be replaced
+func backupFile(path, backup string) error {
+	if _, err := os.Lstat(backup); err == nil {
+		return nil
+	}
+	if err := os.Link(path, backup); err == nil {
+		return nil
+	}
+	return copyFile(path, backup)
+}
+
+// flush path to disk, so a crash after the rename can't leave an empty file
+// in place of the input
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// an in-place service writing backups with suffix
+func inPlaceService(t *testing.T, dir, suffix string) *Service {
+	t.Helper()
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.InputDir, cfg.OutputDir = dir, ""
+	cfg.InPlace, cfg.InPlaceBackup = true, suffix
+	cfg.Filter = "grayscale"
+	p, err := New(WithConfig(cfg), WithLogger(logger.NewLoggerWithOutput(false, "text", io.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return p.StartService(ctx)
+}
+
+// the result replaces the input, the original is kept once under the
+// backup suffix, and no temporary file is left behind
+func TestInPlaceBackup(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "photo.png")
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		img.Set(i%4, i/4, color.RGBA{200, 40, 10, 255})
+	}
+	writePNG(t, input, img)
+	original, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := inPlaceService(t, dir, ".bak")
+	for run := 0; run < 2; run++ {
+		result, err := service.ProcessEntry(context.Background(), config.ManifestEntry{Input: input})
+		if err == nil {
+			err = result.Error
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.OutputPath != input {
+			t.Errorf("output %s, want the input", result.OutputPath)
+		}
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	edited, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := edited.At(0, 0).RGBA(); r != g || g != b {
+		t.Errorf("input wasn't replaced by the grayscale result")
+	}
+	// the second run found a backup and kept it, rather than backing up
+	// the first run's result
+	backup, err := os.ReadFile(input + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backup, original) {
+		t.Error("the backup isn't the original input")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".in-place") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+// a pipeline that would change the input's format fails before touching
+// it, and leaves neither backup nor temporary file
+func TestInPlaceRefusesFormatChange(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "photo.png")
+	writePNG(t, input, image.NewGray(image.Rect(0, 0, 4, 4)))
+	original, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := inPlaceService(t, dir, ".bak")
+	result, err := service.ProcessEntry(context.Background(), config.ManifestEntry{
+		Input:  input,
+		Params: map[string]interface{}{"output_format": "jpeg"},
+	})
+	if err == nil {
+		err = result.Error
+	}
+	if err == nil || !strings.Contains(err.Error(), "can't change") {
+		t.Fatalf("error %v, want the format change refused", err)
+	}
+	if data, _ := os.ReadFile(input); !bytes.Equal(data, original) {
+		t.Error("the input was changed")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the input directory, want only the input", len(entries))
+	}
+}
@@ -0,0 +1,106 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Inspect decodes each image with the same loader used for processing and
+// describes its dimensions, format, color model, bit depth, EXIF and size
+func (p *Processor) Inspect(ctx context.Context, imagePaths []string) ([]models.ImageInfo, error) {
+	infos := make([]models.ImageInfo, len(imagePaths))
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+
+	for i, path := range imagePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				infos[i] = models.ImageInfo{Path: path, Error: ctx.Err().Error()}
+				return
+			}
+
+			infos[i] = p.inspectImage(path)
+		}(i, path)
+	}
+	wg.Wait()
+
+	return infos, ctx.Err()
+}
+
+// describe one file
+func (p *Processor) inspectImage(path string) models.ImageInfo {
+	info := models.ImageInfo{Path: path}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Size = stat.Size()
+
+	img, format, err := p.loadImage(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Format = format
+	info.Width, info.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	info.ColorModel, info.BitDepth = describeColor(img)
+
+	// missing or unreadable EXIF is not an error for inspection
+	info.Exif, _ = readExif(path)
+
+	return info
+}
+
+// color model name and bits per channel of a decoded image
+func describeColor(img image.Image) (string, int) {
+	switch m := img.(type) {
+	case *image.Gray:
+		return "gray", 8
+	case *image.Gray16:
+		return "gray", 16
+	case *image.Alpha:
+		return "alpha", 8
+	case *image.Alpha16:
+		return "alpha", 16
+	case *image.RGBA:
+		return "rgba", 8
+	case *image.RGBA64:
+		return "rgba", 16
+	case *image.NRGBA:
+		return "nrgba", 8
+	case *image.NRGBA64:
+		return "nrgba", 16
+	case *image.CMYK:
+		return "cmyk", 8
+	case *image.YCbCr:
+		return "ycbcr " + subsampleRatios[m.SubsampleRatio], 8
+	case *image.NYCbCrA:
+		return "ycbcra " + subsampleRatios[m.SubsampleRatio], 8
+	case *image.Paletted:
+		return fmt.Sprintf("paletted (%d colors)", len(m.Palette)), 8
+	default:
+		return fmt.Sprintf("%T", img), 0
+	}
+}
+
+var subsampleRatios = map[image.YCbCrSubsampleRatio]string{
+	image.YCbCrSubsampleRatio444: "4:4:4",
+	image.YCbCrSubsampleRatio422: "4:2:2",
+	image.YCbCrSubsampleRatio420: "4:2:0",
+	image.YCbCrSubsampleRatio440: "4:4:0",
+	image.YCbCrSubsampleRatio411: "4:1:1",
+	image.YCbCrSubsampleRatio410: "4:1:0",
+}
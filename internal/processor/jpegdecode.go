@@ -0,0 +1,100 @@
+package processor
+
+import (
+	"errors"
+	"image"
+	"io"
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/jpegscale"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// DCT scales JPEG inputs can be decoded at, largest first
+var jpegScales = []int{8, 4, 2}
+
+// the largest DCT scale a JPEG of the given size can be decoded at for a
+// job whose source is read only by a resize, keeping the decoded image at
+// least as large as the resize target, and the index of that step; scale 1
+// when the job can't use one
+func jpegScale(job models.ImageJob, size image.Point) (int, int) {
+	step := -1
+	for i, s := range job.Steps {
+		if s.Input != config.SourceNode {
+			continue
+		}
+		if step >= 0 || s.Filter != models.FilterResize {
+			return 1, -1
+		}
+		step = i
+	}
+	if step < 0 {
+		return 1, -1
+	}
+	for _, output := range job.Outputs {
+		if output.From == config.SourceNode {
+			return 1, -1
+		}
+	}
+
+	target := ResizeTarget(image.Rectangle{Max: size}, job.Steps[step].Params)
+	for _, scale := range jpegScales {
+		scaled := jpegscale.Scaled(size, scale)
+		if scaled.X >= target.X && scaled.Y >= target.Y {
+			return scale, step
+		}
+	}
+	return 1, -1
+}
+
+// decode a JPEG input at a reduced scale when its pipeline starts by
+// shrinking it, pinning the resize to the size it has from the full image.
+// Returns the image and the full size, or nil when the input is decoded
+// as usual
+func (p *Processor) loadScaledJPEG(sj *stageJob) (image.Image, image.Point) {
+	if !p.config.JPEGScaledDecode {
+		return nil, image.Point{}
+	}
+	file, err := os.Open(sj.job.InputPath)
+	if err != nil {
+		return nil, image.Point{}
+	}
+	defer file.Close()
+
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil || format != "jpeg" {
+		return nil, image.Point{}
+	}
+	size := image.Pt(cfg.Width, cfg.Height)
+	scale, step := jpegScale(sj.job, size)
+	if scale == 1 {
+		return nil, image.Point{}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, image.Point{}
+	}
+
+	img, err := guardDecode(p, sj.job.InputPath, func() (image.Image, error) {
+		return jpegscale.Decode(file, scale)
+	})
+	if err != nil {
+		// progressive and other files the standard decoder reads whole
+		if !errors.Is(err, jpegscale.ErrUnsupported) {
+			sj.log.WithError(err).Debug("Scaled JPEG decode failed, decoding whole")
+		}
+		return nil, image.Point{}
+	}
+
+	steps := append([]models.PipelineStep(nil), sj.job.Steps...)
+	target := ResizeTarget(image.Rectangle{Max: size}, steps[step].Params)
+	steps[step].Params.ResizeWidth, steps[step].Params.ResizeHeight = target.X, target.Y
+	sj.job.Steps = steps
+
+	sj.log.WithFields(map[string]interface{}{
+		"scale":  scale,
+		"width":  img.Bounds().Dx(),
+		"height": img.Bounds().Dy(),
+	}).Debug("Decoded JPEG at reduced scale")
+	return img, size
+}
@@ -0,0 +1,589 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// JPEG markers the optimizer handles
+const (
+	markerSOF0  = 0xc0
+	markerSOF1  = 0xc1
+	markerDHT   = 0xc4
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerDNL   = 0xdc
+	markerDRI   = 0xdd
+	markerAPP0  = 0xe0
+	markerAPP1  = 0xe1
+	markerAPP2  = 0xe2
+	markerAPP14 = 0xee
+	markerCOM   = 0xfe
+)
+
+var errUnsupportedJPEG = errors.New("unsupported JPEG")
+
+// a marker segment of a JPEG file; scans carry their entropy-coded data
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+	data    []byte
+}
+
+// split a JPEG into its marker segments, up to EOI
+func parseJPEG(data []byte) ([]jpegSegment, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, fmt.Errorf("missing SOI marker")
+	}
+
+	var segments []jpegSegment
+	for i := 2; ; {
+		// markers may be preceded by fill bytes
+		for i+1 < len(data) && data[i] == 0xff && data[i+1] == 0xff {
+			i++
+		}
+		if i+2 > len(data) || data[i] != 0xff {
+			return nil, fmt.Errorf("expected a marker at %d", i)
+		}
+		marker := data[i+1]
+		if marker == markerEOI {
+			return segments, nil
+		}
+		if i+4 > len(data) {
+			return nil, fmt.Errorf("truncated segment at %d", i)
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("truncated segment at %d", i)
+		}
+		segment := jpegSegment{marker: marker, payload: data[i+4 : end]}
+		i = end
+
+		if marker == markerSOS {
+			// entropy-coded data runs to the first marker other than a
+			// stuffed zero or a restart
+			start := i
+			for i+1 < len(data) && !(data[i] == 0xff && data[i+1] != 0 && (data[i+1] < 0xd0 || data[i+1] > 0xd7)) {
+				i++
+			}
+			if i+1 >= len(data) {
+				return nil, fmt.Errorf("truncated scan at %d", start)
+			}
+			segment.data = data[start:i]
+		}
+		segments = append(segments, segment)
+	}
+}
+
+// a Huffman table as decoded from a DHT segment
+type huffmanTable struct {
+	counts  [16]int
+	symbols []byte
+
+	// first code and index into symbols of each code length
+	minCode [16]int
+	index   [16]int
+}
+
+func newHuffmanTable(counts [16]int, symbols []byte) *huffmanTable {
+	t := &huffmanTable{counts: counts, symbols: symbols}
+	code, k := 0, 0
+	for l := 0; l < 16; l++ {
+		t.minCode[l], t.index[l] = code, k
+		code = (code + counts[l]) << 1
+		k += counts[l]
+	}
+	return t
+}
+
+// the tables a DHT segment defines, by class (0 DC, 1 AC) * 4 + id
+func parseDHT(payload []byte, tables *[8]*huffmanTable) error {
+	for len(payload) > 0 {
+		if len(payload) < 17 {
+			return fmt.Errorf("truncated DHT segment")
+		}
+		class, id := payload[0]>>4, payload[0]&15
+		if class > 1 || id > 3 {
+			return fmt.Errorf("invalid Huffman table %d/%d", class, id)
+		}
+		var counts [16]int
+		total := 0
+		for l := range counts {
+			counts[l] = int(payload[1+l])
+			total += counts[l]
+		}
+		if len(payload) < 17+total || total > 256 {
+			return fmt.Errorf("truncated DHT segment")
+		}
+		tables[class*4+id] = newHuffmanTable(counts, payload[17:17+total])
+		payload = payload[17+total:]
+	}
+	return nil
+}
+
+// a Huffman-coded symbol of a scan with its extra bits, or a restart marker
+// when slot is restartSlot
+type jpegSymbol struct {
+	slot   uint8
+	symbol uint8
+	nbits  uint8
+	bits   uint16
+}
+
+const restartSlot = 0xff
+
+// reads the bits of one restart interval of entropy-coded data
+type scanReader struct {
+	data []byte
+	pos  int
+	acc  uint32
+	n    uint
+}
+
+func (r *scanReader) bit() (int, error) {
+	if r.n == 0 {
+		if r.pos >= len(r.data) {
+			return 0, fmt.Errorf("scan data ends early")
+		}
+		b := r.data[r.pos]
+		r.pos++
+		// a zero byte stuffed after 0xff isn't data
+		if b == 0xff && r.pos < len(r.data) && r.data[r.pos] == 0 {
+			r.pos++
+		}
+		r.acc, r.n = uint32(b), 8
+	}
+	r.n--
+	return int(r.acc>>r.n) & 1, nil
+}
+
+func (r *scanReader) bits(n uint8) (uint16, error) {
+	var v uint16
+	for i := uint8(0); i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | uint16(b)
+	}
+	return v, nil
+}
+
+func (r *scanReader) decode(t *huffmanTable) (uint8, error) {
+	code := 0
+	for l := 0; l < 16; l++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if offset := code - t.minCode[l]; offset < t.counts[l] {
+			return t.symbols[t.index[l]+offset], nil
+		}
+	}
+	return 0, fmt.Errorf("invalid Huffman code")
+}
+
+// the frame of a baseline or extended sequential Huffman JPEG
+type jpegFrame struct {
+	width, height int
+	hmax, vmax    int
+	components    map[byte][2]int
+}
+
+func parseSOF(payload []byte) (*jpegFrame, error) {
+	if len(payload) < 6 {
+		return nil, fmt.Errorf("truncated SOF segment")
+	}
+	f := &jpegFrame{
+		height:     int(binary.BigEndian.Uint16(payload[1:])),
+		width:      int(binary.BigEndian.Uint16(payload[3:])),
+		components: map[byte][2]int{},
+	}
+	n := int(payload[5])
+	if len(payload) < 6+3*n || f.width == 0 || f.height == 0 {
+		return nil, errUnsupportedJPEG
+	}
+	for i := 0; i < n; i++ {
+		c := payload[6+3*i:]
+		h, v := int(c[1]>>4), int(c[1]&15)
+		if h < 1 || v < 1 {
+			return nil, fmt.Errorf("invalid sampling factors")
+		}
+		f.components[c[0]] = [2]int{h, v}
+		f.hmax, f.vmax = max(f.hmax, h), max(f.vmax, v)
+	}
+	return f, nil
+}
+
+// decode the Huffman symbols of a scan, without reconstructing coefficients
+func decodeScan(frame *jpegFrame, header []byte, data []byte, tables *[8]*huffmanTable, restartInterval int) ([]jpegSymbol, error) {
+	if len(header) < 1 || len(header) < 1+2*int(header[0])+3 {
+		return nil, fmt.Errorf("truncated SOS segment")
+	}
+	type scanComponent struct {
+		blocks   int
+		dc, ac   uint8
+		sampling [2]int
+	}
+	n := int(header[0])
+	components := make([]scanComponent, n)
+	for i := range components {
+		sampling, ok := frame.components[header[1+2*i]]
+		if !ok {
+			return nil, fmt.Errorf("scan of unknown component %d", header[1+2*i])
+		}
+		selectors := header[2+2*i]
+		dc, ac := selectors>>4, 4+selectors&15
+		if selectors>>4 > 3 || selectors&15 > 3 || tables[dc] == nil || tables[ac] == nil {
+			return nil, fmt.Errorf("scan uses an undefined Huffman table")
+		}
+		components[i] = scanComponent{blocks: sampling[0] * sampling[1], dc: dc, ac: ac, sampling: sampling}
+	}
+
+	// a single-component scan codes one block per MCU over the component's
+	// own dimensions
+	var mcus int
+	if n == 1 {
+		c := &components[0]
+		width := (frame.width*c.sampling[0] + frame.hmax - 1) / frame.hmax
+		height := (frame.height*c.sampling[1] + frame.vmax - 1) / frame.vmax
+		mcus = ((width + 7) / 8) * ((height + 7) / 8)
+		c.blocks = 1
+	} else {
+		mcus = ((frame.width + 8*frame.hmax - 1) / (8 * frame.hmax)) * ((frame.height + 8*frame.vmax - 1) / (8 * frame.vmax))
+	}
+
+	// restart intervals are split at their markers
+	var intervals [][]byte
+	for start, i := 0, 0; ; i++ {
+		if i+1 >= len(data) {
+			intervals = append(intervals, data[start:])
+			break
+		}
+		if data[i] == 0xff && data[i+1] >= 0xd0 && data[i+1] <= 0xd7 {
+			intervals = append(intervals, data[start:i])
+			start = i + 2
+			i++
+		}
+	}
+
+	var symbols []jpegSymbol
+	r := &scanReader{data: intervals[0]}
+	for mcu := 0; mcu < mcus; mcu++ {
+		if restartInterval > 0 && mcu > 0 && mcu%restartInterval == 0 {
+			next := mcu / restartInterval
+			if next >= len(intervals) {
+				return nil, fmt.Errorf("missing restart marker")
+			}
+			r = &scanReader{data: intervals[next]}
+			symbols = append(symbols, jpegSymbol{slot: restartSlot})
+		}
+
+		for _, c := range components {
+			for b := 0; b < c.blocks; b++ {
+				size, err := r.decode(tables[c.dc])
+				if err != nil {
+					return nil, err
+				}
+				if size > 11 {
+					return nil, fmt.Errorf("invalid DC size %d", size)
+				}
+				bits, err := r.bits(size)
+				if err != nil {
+					return nil, err
+				}
+				symbols = append(symbols, jpegSymbol{slot: c.dc, symbol: size, nbits: size, bits: bits})
+
+				for k := 1; k < 64; {
+					rs, err := r.decode(tables[c.ac])
+					if err != nil {
+						return nil, err
+					}
+					run, size := int(rs>>4), rs&15
+					if size > 10 {
+						return nil, fmt.Errorf("invalid AC size %d", size)
+					}
+					bits, err := r.bits(size)
+					if err != nil {
+						return nil, err
+					}
+					symbols = append(symbols, jpegSymbol{slot: c.ac, symbol: rs, nbits: size, bits: bits})
+					if size == 0 && run != 15 {
+						break
+					}
+					k += run + 1
+					if k > 64 {
+						return nil, fmt.Errorf("coefficients overrun the block")
+					}
+				}
+			}
+		}
+	}
+	return symbols, nil
+}
+
+// an optimal Huffman table for the symbol frequencies, with codes of at most
+// 16 bits and none of all ones, following Annex K.2 of the JPEG standard
+func optimalHuffmanTable(freq [256]int) ([16]int, []byte) {
+	var f [257]int
+	copy(f[:], freq[:])
+	// a reserved symbol keeps any real code from being all ones
+	f[256] = 1
+
+	var size [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// the two least frequent, the larger symbol first on ties
+		c1, c2 := -1, -1
+		for i := range f {
+			if f[i] > 0 && (c1 < 0 || f[i] <= f[c1]) {
+				c1 = i
+			}
+		}
+		for i := range f {
+			if f[i] > 0 && i != c1 && (c2 < 0 || f[i] <= f[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		for size[c1]++; others[c1] >= 0; size[c1]++ {
+			c1 = others[c1]
+		}
+		others[c1] = c2
+		for size[c2]++; others[c2] >= 0; size[c2]++ {
+			c2 = others[c2]
+		}
+	}
+
+	var bits [33]int
+	for _, s := range size {
+		if s > 0 {
+			bits[s]++
+		}
+	}
+	// move codes longer than 16 bits up the tree
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// drop the reserved symbol, which has the longest code
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var counts [16]int
+	copy(counts[:], bits[1:17])
+	var symbols []byte
+	for l := 1; l <= 32; l++ {
+		for s := 0; s < 256; s++ {
+			if size[s] == l {
+				symbols = append(symbols, byte(s))
+			}
+		}
+	}
+	return counts, symbols
+}
+
+// writes entropy-coded data, stuffing a zero after every 0xff
+type scanWriter struct {
+	buf bytes.Buffer
+	acc uint32
+	n   uint
+}
+
+func (w *scanWriter) write(bits uint32, n uint) {
+	for n > 0 {
+		n--
+		w.acc = w.acc<<1 | bits>>n&1
+		w.n++
+		if w.n == 8 {
+			b := byte(w.acc)
+			w.buf.WriteByte(b)
+			if b == 0xff {
+				w.buf.WriteByte(0)
+			}
+			w.acc, w.n = 0, 0
+		}
+	}
+}
+
+// pad the last byte with ones
+func (w *scanWriter) flush() {
+	if w.n > 0 {
+		w.write(0xff, 8-w.n)
+	}
+}
+
+// optimizeJPEG rewrites a JPEG without the segments strip rejects and, for
+// sequential Huffman-coded files, with Huffman tables built for its own
+// symbol frequencies. Progressive and arithmetic-coded files are only
+// stripped
+func optimizeJPEG(data []byte, strip func(jpegSegment) bool) ([]byte, error) {
+	segments, err := parseJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []jpegSegment
+	for _, s := range segments {
+		if !strip(s) {
+			kept = append(kept, s)
+		}
+	}
+
+	optimized, err := recodeJPEG(kept)
+	if errors.Is(err, errUnsupportedJPEG) {
+		return writeJPEG(kept), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return optimized, nil
+}
+
+// the segments with optimal Huffman tables, errUnsupportedJPEG when they
+// aren't a sequential Huffman-coded frame
+func recodeJPEG(segments []jpegSegment) ([]byte, error) {
+	var tables [8]*huffmanTable
+	var frame *jpegFrame
+	restartInterval := 0
+	scans := map[int][]jpegSymbol{}
+	var freq [8][256]int
+
+	for i, s := range segments {
+		switch {
+		case s.marker == markerSOF0 || s.marker == markerSOF1:
+			f, err := parseSOF(s.payload)
+			if err != nil {
+				return nil, err
+			}
+			frame = f
+		case s.marker >= 0xc2 && s.marker <= 0xcf && s.marker != markerDHT && s.marker != 0xc8 && s.marker != 0xcc:
+			// progressive, lossless and arithmetic-coded frames
+			return nil, errUnsupportedJPEG
+		case s.marker == markerDNL:
+			return nil, errUnsupportedJPEG
+		case s.marker == markerDHT:
+			if err := parseDHT(s.payload, &tables); err != nil {
+				return nil, err
+			}
+		case s.marker == markerDRI:
+			if len(s.payload) < 2 {
+				return nil, fmt.Errorf("truncated DRI segment")
+			}
+			restartInterval = int(binary.BigEndian.Uint16(s.payload))
+		case s.marker == markerSOS:
+			if frame == nil {
+				return nil, fmt.Errorf("scan before frame header")
+			}
+			symbols, err := decodeScan(frame, s.payload, s.data, &tables, restartInterval)
+			if err != nil {
+				return nil, err
+			}
+			for _, sym := range symbols {
+				if sym.slot != restartSlot {
+					freq[sym.slot][sym.symbol]++
+				}
+			}
+			scans[i] = symbols
+		}
+	}
+	if frame == nil {
+		return nil, errUnsupportedJPEG
+	}
+
+	// one table for every slot in use, replacing all the file's tables
+	var dht bytes.Buffer
+	var codes [8][256]uint16
+	var lengths [8][256]uint8
+	for slot := range freq {
+		used := false
+		for _, n := range freq[slot] {
+			used = used || n > 0
+		}
+		if !used {
+			continue
+		}
+		counts, symbols := optimalHuffmanTable(freq[slot])
+		dht.WriteByte(byte(slot/4<<4 | slot%4))
+		for _, n := range counts {
+			dht.WriteByte(byte(n))
+		}
+		dht.Write(symbols)
+
+		code, k := 0, 0
+		for l := 0; l < 16; l++ {
+			for j := 0; j < counts[l]; j++ {
+				codes[slot][symbols[k]], lengths[slot][symbols[k]] = uint16(code), uint8(l+1)
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+
+	recoded := make([]jpegSegment, 0, len(segments)+1)
+	tablesWritten := false
+	for i, s := range segments {
+		if s.marker == markerDHT {
+			continue
+		}
+		if s.marker == markerSOS {
+			if !tablesWritten {
+				recoded = append(recoded, jpegSegment{marker: markerDHT, payload: dht.Bytes()})
+				tablesWritten = true
+			}
+			w := &scanWriter{}
+			restarts := 0
+			for _, sym := range scans[i] {
+				if sym.slot == restartSlot {
+					w.flush()
+					w.buf.Write([]byte{0xff, byte(0xd0 + restarts%8)})
+					restarts++
+					continue
+				}
+				w.write(uint32(codes[sym.slot][sym.symbol]), uint(lengths[sym.slot][sym.symbol]))
+				w.write(uint32(sym.bits), uint(sym.nbits))
+			}
+			w.flush()
+			s.data = w.buf.Bytes()
+		}
+		recoded = append(recoded, s)
+	}
+	return writeJPEG(recoded), nil
+}
+
+// serialize segments as a JPEG file
+func writeJPEG(segments []jpegSegment) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, markerSOI})
+	for _, s := range segments {
+		buf.Write([]byte{0xff, s.marker, byte((len(s.payload) + 2) >> 8), byte(len(s.payload) + 2)})
+		buf.Write(s.payload)
+		buf.Write(s.data)
+	}
+	buf.Write([]byte{0xff, markerEOI})
+	return buf.Bytes()
+}
@@ -0,0 +1,46 @@
+package processor
+
+import (
+	"math"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// pointTable builds the level each color channel level maps to under a point
+// filter, computed as the filter's per-pixel loop computes it, so looking it
+// up gives the same pixels without per-pixel floating point. Nil for filters
+// that aren't per-channel point operations
+func pointTable(filter models.FilterType, params models.FilterParams) *[256]uint8 {
+	var level func(v float64) float64
+	switch filter {
+	case models.FilterBrightness:
+		level = func(v float64) float64 { return clamp(v * params.Brightness) }
+	case models.FilterConstrast:
+		level = func(v float64) float64 { return clamp(((v - 128) * params.Contrast) + 128) }
+	case models.FilterGamma:
+		level = func(v float64) float64 { return clamp(math.Round(255 * math.Pow(v/255, 1/params.Gamma))) }
+	case models.FilterInvert:
+		level = func(v float64) float64 { return 255 - v }
+	default:
+		return nil
+	}
+
+	table := new([256]uint8)
+	for v := range table {
+		table[v] = uint8(level(float64(v)))
+	}
+	return table
+}
+
+// applyTable writes the table's level for each color channel of src to dst,
+// keeping alpha
+func applyTable(dst, src []uint8, table *[256]uint8) {
+	for i := 0; i+4 <= len(src); i += 4 {
+		s := src[i : i+4 : i+4]
+		d := dst[i : i+4 : i+4]
+		d[0] = table[s[0]]
+		d[1] = table[s[1]]
+		d[2] = table[s[2]]
+		d[3] = s[3]
+	}
+}
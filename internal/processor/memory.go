@@ -0,0 +1,85 @@
+package processor
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryGate bounds the estimated pixel memory held by in-flight jobs. A nil
+// gate admits everything
+type MemoryGate struct {
+	mu       sync.Mutex
+	budget   int64
+	inUse    int64
+	released chan struct{}
+}
+
+// create memory gate, returns nil when budget is not positive
+func NewMemoryGate(budget int64) *MemoryGate {
+	if budget <= 0 {
+		return nil
+	}
+
+	return &MemoryGate{
+		budget:   budget,
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire blocks until n bytes fit in the budget or ctx is done. A job larger
+// than the whole budget is admitted once nothing else is in flight, so it runs
+// alone instead of waiting forever
+func (g *MemoryGate) Acquire(ctx context.Context, n int64) error {
+	if g == nil {
+		return nil
+	}
+
+	for {
+		g.mu.Lock()
+		if g.inUse == 0 || g.inUse+n <= g.budget {
+			g.inUse += n
+			g.mu.Unlock()
+			return nil
+		}
+		wait := g.released
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// Release returns n bytes to the budget and wakes waiting jobs
+func (g *MemoryGate) Release(n int64) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	g.inUse -= n
+	close(g.released)
+	g.released = make(chan struct{})
+	g.mu.Unlock()
+}
+
+// InUse returns the estimated bytes currently held by admitted jobs
+func (g *MemoryGate) InUse() int64 {
+	if g == nil {
+		return 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inUse
+}
+
+// Budget returns the configured budget, 0 when unlimited
+func (g *MemoryGate) Budget() int64 {
+	if g == nil {
+		return 0
+	}
+	return g.budget
+}
@@ -0,0 +1,177 @@
+package processor
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Operation represents a function that is applied to a whole image at once,
+// for transformations that need more context than a single row or that change
+// the canvas size
+type Operation func(img *image.RGBA, params models.FilterParams) *image.RGBA
+
+var OperationRegistry = map[models.FilterType]Operation{
+	models.FilterRoundCorners: ApplyRoundCorners,
+	models.FilterCircleMask:   ApplyCircleMask,
+	models.FilterDropShadow:   ApplyDropShadow,
+	models.FilterOuterGlow:    ApplyOuterGlow,
+	models.FilterResize:       ApplyResize,
+	models.FilterCrop:         ApplyCrop,
+	models.FilterSmartCrop:    ApplySmartCrop,
+}
+
+// AlphaFilters lists filters whose output relies on transparency, so results
+// must be written in a format with an alpha channel
+var AlphaFilters = map[models.FilterType]bool{
+	models.FilterRoundCorners: true,
+	models.FilterCircleMask:   true,
+	models.FilterDropShadow:   true,
+	models.FilterOuterGlow:    true,
+}
+
+// ApplyRoundCorners makes the corners of the image transparent using the
+// configured radius, with anti-aliased edges
+func ApplyRoundCorners(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	shorter := math.Min(float64(width), float64(height))
+
+	radius := params.CornerRadius
+	if params.CornerRadiusPercent {
+		radius = shorter * radius / 100
+	}
+	radius = math.Min(radius, shorter/2)
+	if radius <= 0 {
+		return img
+	}
+
+	// arc centres and the direction each corner extends towards
+	corners := []struct{ cx, cy, sx, sy float64 }{
+		{radius, radius, -1, -1},
+		{float64(width) - radius, radius, 1, -1},
+		{radius, float64(height) - radius, -1, 1},
+		{float64(width) - radius, float64(height) - radius, 1, 1},
+	}
+
+	r := int(math.Ceil(radius))
+	for _, c := range corners {
+		x0, y0 := 0, 0
+		if c.sx > 0 {
+			x0 = width - r
+		}
+		if c.sy > 0 {
+			y0 = height - r
+		}
+
+		for y := y0; y < y0+r; y++ {
+			for x := x0; x < x0+r; x++ {
+				dx, dy := float64(x)+0.5-c.cx, float64(y)+0.5-c.cy
+				if dx*c.sx <= 0 || dy*c.sy <= 0 {
+					continue
+				}
+
+				coverage := radius - math.Hypot(dx, dy) + 0.5
+				scaleAlpha(img, bounds.Min.X+x, bounds.Min.Y+y, coverage)
+			}
+		}
+	}
+
+	return img
+}
+
+// ApplyCircleMask crops the image to a centred square and masks it with a
+// circle, leaving everything outside the circle transparent
+func ApplyCircleMask(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+
+	offset := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, offset, draw.Src)
+
+	radius := float64(side) / 2
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			coverage := radius - math.Hypot(float64(x)+0.5-radius, float64(y)+0.5-radius) + 0.5
+			scaleAlpha(dst, x, y, coverage)
+		}
+	}
+
+	return dst
+}
+
+// scaleAlpha multiplies a pixel by coverage in the 0-1 range; image.RGBA is
+// alpha-premultiplied so all four channels are scaled together
+func scaleAlpha(img *image.RGBA, x, y int, coverage float64) {
+	if coverage >= 1 {
+		return
+	}
+	if coverage < 0 {
+		coverage = 0
+	}
+
+	i := img.PixOffset(x, y)
+	for c := 0; c < 4; c++ {
+		img.Pix[i+c] = uint8(float64(img.Pix[i+c]) * coverage)
+	}
+}
+
+// ApplyResize scales the image to the configured size; when only one side is
+// set the other follows the aspect ratio
+func ApplyResize(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	size := ResizeTarget(img.Bounds(), params)
+	if size == img.Bounds().Size() {
+		return img
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// ResizeTarget returns the output size of a resize
+func ResizeTarget(bounds image.Rectangle, params models.FilterParams) image.Point {
+	width, height := params.ResizeWidth, params.ResizeHeight
+
+	switch {
+	case width <= 0 && height <= 0:
+		return bounds.Size()
+	case width <= 0:
+		width = int(math.Round(float64(bounds.Dx()) * float64(height) / float64(bounds.Dy())))
+	case height <= 0:
+		height = int(math.Round(float64(bounds.Dy()) * float64(width) / float64(bounds.Dx())))
+	}
+
+	return image.Pt(max(1, width), max(1, height))
+}
+
+// ApplyCrop cuts the configured rectangle out of the image
+func ApplyCrop(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	rect := CropRect(img.Bounds(), params)
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min.Add(rect.Min), draw.Src)
+	return dst
+}
+
+// CropRect returns the crop rectangle relative to the image origin, clipped
+// to the image; a zero width or height extends to the edge
+func CropRect(bounds image.Rectangle, params models.FilterParams) image.Rectangle {
+	width, height := params.CropWidth, params.CropHeight
+	if width <= 0 {
+		width = bounds.Dx() - params.CropX
+	}
+	if height <= 0 {
+		height = bounds.Dy() - params.CropY
+	}
+
+	rect := image.Rect(params.CropX, params.CropY, params.CropX+width, params.CropY+height)
+	return rect.Intersect(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+}
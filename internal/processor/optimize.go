@@ -0,0 +1,237 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tiffmeta"
+)
+
+// PNG chunks that change how pixels are displayed, kept when stripping
+var pngColorChunks = map[string]bool{"iCCP": true, "sRGB": true, "gAMA": true, "cHRM": true, "sBIT": true}
+
+// Optimize recompresses every PNG and JPEG input losslessly into the output
+// directory under its own name, in its directory below input_dir and
+// renamed by output_collisions when another input has the path: metadata
+// is stripped, PNGs are re-deflated at best compression and JPEGs get
+// Huffman tables fitted to their data.
+// Each rewrite is decoded and compared with the input before it's kept, and
+// inputs that can't be made smaller are copied as they are; other formats
+// are skipped
+func (p *Processor) Optimize(ctx context.Context, imagePaths []string) (models.OptimizeReport, error) {
+	report := models.OptimizeReport{Images: len(imagePaths)}
+	if p.config.OutputDir == "" {
+		return report, errors.New("optimize needs an output directory")
+	}
+
+	results := make([]models.OptimizeResult, len(imagePaths))
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+
+	// claimed in input order, so the same input keeps a name on every run
+	outputPaths := make([]string, len(imagePaths))
+	for i, path := range imagePaths {
+		outputPaths[i] = p.optimizedPath(path)
+	}
+
+	for i, path := range imagePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = models.OptimizeResult{Path: path, Error: ctx.Err().Error()}
+				return
+			}
+
+			results[i] = p.optimizeImage(path, outputPaths[i])
+		}(i, path)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	report.Results = results
+	for _, r := range results {
+		if r.Error != "" {
+			report.Errors++
+			continue
+		}
+		if r.Skipped {
+			report.Skipped++
+			continue
+		}
+		report.OriginalSize += r.OriginalSize
+		report.OptimizedSize += r.OptimizedSize
+	}
+	report.Saved = report.OriginalSize - report.OptimizedSize
+	return report, nil
+}
+
+// optimize one file into outputPath
+func (p *Processor) optimizeImage(path, outputPath string) models.OptimizeResult {
+	result := models.OptimizeResult{Path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Format = sniffFormat(data)
+	result.OriginalSize = int64(len(data))
+
+	var optimized []byte
+	switch result.Format {
+	case "jpeg":
+		optimized, err = optimizeJPEG(data, stripJPEGSegment)
+	case "png":
+		optimized, err = optimizePNG(data)
+	default:
+		// other formats are left out of the output
+		result.Skipped = true
+		return result
+	}
+	if err == nil {
+		err = samePixels(data, optimized)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(optimized) >= len(data) {
+		optimized = data
+	}
+
+	result.OutputPath = outputPath
+	if err := os.MkdirAll(filepath.Dir(result.OutputPath), 0755); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := os.WriteFile(result.OutputPath, optimized, 0644); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OptimizedSize = int64(len(optimized))
+	result.Saved = result.OriginalSize - result.OptimizedSize
+	return result
+}
+
+// the claimed path in the output directory of the optimized input at path,
+// keeping its directory below input_dir
+func (p *Processor) optimizedPath(path string) string {
+	name := filepath.Base(path)
+	if rel, err := filepath.Rel(p.config.InputDir, path); err == nil && filepath.IsLocal(rel) {
+		name = rel
+	}
+	outputs := []models.PipelineOutput{{Path: filepath.Join(p.config.OutputDir, name)}}
+	return p.claimOutputs(path, outputs)[0].Path
+}
+
+// whether a JPEG segment is metadata to drop: comments and application
+// segments other than the JFIF header, the ICC profile and Adobe's color
+// transform. EXIF is kept when its orientation rotates the image, which
+// would otherwise be shown sideways
+func stripJPEGSegment(s jpegSegment) bool {
+	switch {
+	case s.marker == markerCOM:
+		return true
+	case s.marker == markerAPP0:
+		return !bytes.HasPrefix(s.payload, []byte("JFIF\x00"))
+	case s.marker == markerAPP1:
+		return !bytes.HasPrefix(s.payload, []byte("Exif\x00\x00")) || !rotated(s.payload[6:])
+	case s.marker == markerAPP2:
+		return !bytes.HasPrefix(s.payload, []byte("ICC_PROFILE\x00"))
+	case s.marker == markerAPP14:
+		return false
+	case s.marker > markerAPP0 && s.marker <= 0xef:
+		return true
+	}
+	return false
+}
+
+// whether the orientation in EXIF data is anything but upright
+func rotated(exif []byte) bool {
+	dir, err := tiffmeta.Read(bytes.NewReader(exif))
+	if err != nil {
+		return false
+	}
+	if e, ok := dir.Find(tagOrientation); ok {
+		if v := dir.Longs(e); len(v) > 0 {
+			return v[0] > 1
+		}
+	}
+	return false
+}
+
+// optimizePNG re-encodes a PNG at the best compression, carrying over the
+// chunks that affect its colors and a rotating eXIf chunk; text, time and
+// other ancillary chunks are dropped
+func optimizePNG(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := &png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	var kept []byte
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if end > len(data) {
+			return nil, fmt.Errorf("truncated chunk at %d", i)
+		}
+		name := string(data[i+4 : i+8])
+		if pngColorChunks[name] || name == "eXIf" && rotated(data[i+8:end-4]) {
+			kept = append(kept, data[i:end]...)
+		}
+		if name == "IEND" {
+			break
+		}
+		i = end
+	}
+	return insertPNGChunks(buf.Bytes(), kept), nil
+}
+
+// check that two encodings decode to the same pixels
+func samePixels(original, optimized []byte) error {
+	a, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+	b, _, err := image.Decode(bytes.NewReader(optimized))
+	if err != nil {
+		return fmt.Errorf("optimized file does not decode: %w", err)
+	}
+	if a.Bounds() != b.Bounds() {
+		return fmt.Errorf("optimized file has different dimensions")
+	}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return fmt.Errorf("optimized file differs at %d,%d", x, y)
+			}
+		}
+	}
+	return nil
+}
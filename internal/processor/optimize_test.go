@@ -0,0 +1,70 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// optimized files keep their directory below input_dir, and an input
+// outside it taking another's name is renamed instead of overwriting it
+func TestOptimizeOutputPaths(t *testing.T) {
+	root := t.TempDir()
+	in, out := filepath.Join(root, "in"), filepath.Join(root, "out")
+	inputs := []string{
+		filepath.Join(in, "a.png"),
+		filepath.Join(in, "sub", "a.png"),
+		filepath.Join(root, "other", "a.png"),
+	}
+	for i, path := range inputs {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewGray(image.Rect(0, 0, 4, 4))
+		img.SetGray(0, 0, color.Gray{Y: uint8(50 * i)})
+		writePNG(t, path, img)
+	}
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.InputDir, cfg.OutputDir, cfg.OutputCollisions = in, out, "number"
+	p, err := New(WithConfig(cfg), WithLogger(logger.NewLoggerWithOutput(false, "text", io.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := p.Optimize(context.Background(), inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		filepath.Join(out, "a.png"),
+		filepath.Join(out, "sub", "a.png"),
+		filepath.Join(out, "a_2.png"),
+	}
+	for i, r := range report.Results {
+		if r.Error != "" {
+			t.Fatalf("%s: %s", r.Path, r.Error)
+		}
+		if r.OutputPath != want[i] {
+			t.Errorf("%s: written to %s, want %s", r.Path, r.OutputPath, want[i])
+		}
+		if _, err := os.Stat(r.OutputPath); err != nil {
+			t.Error(err)
+		}
+	}
+
+	cfg.OutputDir = ""
+	if _, err := p.Optimize(context.Background(), inputs); err == nil {
+		t.Error("optimized without an output directory")
+	}
+}
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// Option configures a processor built by New
+type Option func(*options)
+
+// settings gathered from the options given to New
+type options struct {
+	config   *config.Config
+	logger   logger.Logger
+	workers  int
+	pipeline []config.PipelineStep
+	storage  Storage
+	metrics  Metrics
+	hooks    []Hook
+	// subscribers of the event bus
+	subscribers []func(Event)
+}
+
+// Storage keeps the outputs of finished jobs somewhere besides the local
+// paths they are written to, such as an object store
+type Storage interface {
+	// Store is called from the workers with each output of a job that
+	// succeeded, once it is written; an error fails the job
+	Store(ctx context.Context, output models.OutputFile) error
+}
+
+// Metrics is told of the result of every job, including failed and skipped
+// ones, for exporting counts and latencies to a monitoring system.
+// ObserveJob is subscribed to the processor's events, so it is called from
+// the workers, concurrently
+type Metrics interface {
+	ObserveJob(result models.ProcessingResult)
+}
+
+// WithConfig starts from cfg instead of the defaults. The other options
+// apply to a copy, so cfg isn't changed
+func WithConfig(cfg *config.Config) Option {
+	return func(o *options) {
+		o.config = cfg
+	}
+}
+
+// WithLogger logs to log instead of stdout at info level
+func WithLogger(log logger.Logger) Option {
+	return func(o *options) {
+		o.logger = log
+	}
+}
+
+// WithWorkers sets the number of filter workers, as the workers setting
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithFilterPipeline runs steps on each image instead of the configured
+// pipeline or filter, as the pipeline setting, writing the result of the
+// last step
+func WithFilterPipeline(steps ...config.PipelineStep) Option {
+	return func(o *options) {
+		o.pipeline = steps
+	}
+}
+
+// WithStorage hands the outputs of each successful job to storage
+func WithStorage(storage Storage) Option {
+	return func(o *options) {
+		o.storage = storage
+	}
+}
+
+// WithMetrics reports the result of each job to metrics
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// the configuration and logger of the options: the defaults unless given,
+// with the worker count and pipeline applied to a validated copy
+func (o *options) resolve() (*config.Config, logger.Logger, error) {
+	log := o.logger
+	if log == nil {
+		log = logger.NewLogger(false)
+	}
+
+	cfg := o.config
+	if cfg == nil {
+		defaults, err := config.Default()
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg = defaults
+	}
+	if o.workers == 0 && o.pipeline == nil {
+		return cfg, log, nil
+	}
+
+	overridden := *cfg
+	if o.workers != 0 {
+		overridden.Workers = o.workers
+	}
+	if o.pipeline != nil {
+		overridden.Pipeline = o.pipeline
+		overridden.PipelineOutputs = nil
+	}
+	if err := overridden.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid options: %w", err)
+	}
+	return &overridden, log, nil
+}
+
+// hand the outputs of a successful job to the storage, failing the job if
+// one can't be stored
+func (p *Processor) storeOutputs(ctx context.Context, sj *stageJob) {
+	if p.storage == nil || sj.result.Error != nil {
+		return
+	}
+	for _, output := range sj.result.Outputs {
+		if err := p.storage.Store(ctx, output); err != nil {
+			sj.result.Error = fmt.Errorf("failed to store %s: %w", output.Path, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"strings"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// the result of a pipeline step, with georeferencing carried along its path
+type pipelineNode struct {
+	img    *image.RGBA
+	bounds image.Rectangle
+	geo    *models.GeoMetadata
+}
+
+// resolve the configured steps and their parameters
+func pipelineSteps(cfg *config.Config) ([]models.PipelineStep, error) {
+	var steps []models.PipelineStep
+	for i, step := range cfg.Steps() {
+		stepCfg, err := cfg.StepConfig(step)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline step %d (%s): %w", i+1, step.ID, err)
+		}
+		steps = append(steps, models.PipelineStep{
+			ID:     step.ID,
+			Input:  step.Input,
+			Filter: models.FilterType(step.Filter),
+			Params: filterParams(stepCfg),
+		})
+	}
+	return steps, nil
+}
+
+// name of the pipeline used in output file names: the filter names joined
+// by underscores
+func (p *Processor) pipelineName() string {
+	names := make([]string, len(p.steps))
+	for i, step := range p.steps {
+		names[i] = string(step.Filter)
+	}
+	return strings.Join(names, "_")
+}
+
+// output files of an input image written to outputDir, in configured order
+func (p *Processor) jobOutputs(inputPath, outputDir string) []models.PipelineOutput {
+	outputs := make([]models.PipelineOutput, len(p.outputs))
+	for i, output := range p.outputs {
+		outputs[i] = models.PipelineOutput{
+			Name: output.Name,
+			From: output.From,
+			Path: p.generateOutputPath(inputPath, outputDir, output),
+		}
+	}
+	return outputs
+}
+
+// report whether any step on the path from decode to the given step leaves
+// transparent pixels
+func (p *Processor) alphaUpstream(id string) bool {
+	for id != config.SourceNode {
+		step, ok := p.step(id)
+		if !ok {
+			return false
+		}
+		if AlphaFilters[step.Filter] {
+			return true
+		}
+		id = step.Input
+	}
+	return false
+}
+
+func (p *Processor) step(id string) (models.PipelineStep, bool) {
+	for _, step := range p.steps {
+		if step.ID == id {
+			return step, true
+		}
+	}
+	return models.PipelineStep{}, false
+}
+
+// report whether every step is grayscale, which leaves gray pixels unchanged
+func grayscaleOnly(job models.ImageJob) bool {
+	for _, step := range job.Steps {
+		if step.Filter != models.FilterGrayScale {
+			return false
+		}
+	}
+	return true
+}
+
+// fusePointSteps merges each run of point filter steps, where every step
+// reads only the result of the one before, into a single step applying
+// their composed table, so a chain such as brightness, contrast and gamma
+// traverses the image once. The merged step has the ID and filter of the
+// run's last step, which applies the table as any point filter does, and
+// the input of its first; a step whose result is an output or read by other
+// steps ends a run
+func fusePointSteps(steps []models.PipelineStep, outputs []models.PipelineOutput) []models.PipelineStep {
+	readers := map[string]int{}
+	for _, step := range steps {
+		readers[step.Input]++
+	}
+	for _, output := range outputs {
+		readers[output.From]++
+	}
+
+	var fused []models.PipelineStep
+	for _, step := range steps {
+		if n := len(fused); n > 0 {
+			prev := fused[n-1]
+			if step.Input == prev.ID && readers[prev.ID] == 1 && prev.Params.Table != nil && step.Params.Table != nil {
+				table := new([256]uint8)
+				for v := range table {
+					table[v] = step.Params.Table[prev.Params.Table[v]]
+				}
+				step.Input = prev.Input
+				step.Params.Table = table
+				fused[n-1] = step
+				continue
+			}
+		}
+		fused = append(fused, step)
+	}
+	return fused
+}
+
+// runPipeline executes the job's steps in order, each on the result of its
+// input step, so work shared by several branches runs once per image.
+// Intermediate results are dropped once every step reading them has run.
+// It returns the nodes the job's outputs read from; after, if set, is
+// called with each step's result, and otherwise runs of point filters are
+// fused into one pass
+func (p *Processor) runPipeline(ctx context.Context, job models.ImageJob, src *image.RGBA, geo *models.GeoMetadata, after func(i int, step models.PipelineStep, node pipelineNode), log logger.Logger) (map[string]pipelineNode, error) {
+	steps := job.Steps
+	if after == nil {
+		steps = fusePointSteps(job.Steps, job.Outputs)
+	}
+
+	readers := map[string]int{}
+	for _, step := range steps {
+		readers[step.Input]++
+	}
+	keep := map[string]bool{}
+	for _, output := range job.Outputs {
+		keep[output.From] = true
+	}
+
+	nodes := map[string]pipelineNode{
+		config.SourceNode: {img: src, bounds: src.Bounds(), geo: geo},
+	}
+
+	// account a node's pixels as released unless another node shares them,
+	// as filters that change nothing return their input
+	usage := usageFrom(ctx)
+	release := func(id string) {
+		img := nodes[id].img
+		delete(nodes, id)
+		for _, node := range nodes {
+			if node.img == img {
+				return
+			}
+		}
+		usage.free(imageBytes(img))
+	}
+
+	for i, step := range steps {
+		input := nodes[step.Input]
+
+		stepJob := job
+		stepJob.Filter, stepJob.Params = step.Filter, step.Params
+
+		_, span := p.tracer.Start(ctx, "filter")
+		span.SetAttribute("step", step.ID)
+		span.SetAttribute("filter", string(step.Filter))
+		start := time.Now()
+		processed, err := p.applyFilter(ctx, stepJob, input.img)
+		endSpan(span, err)
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", step.ID, err)
+		}
+		usage.step(step, start)
+
+		if processed != input.img {
+			usage.alloc(imageBytes(processed))
+		}
+		node := pipelineNode{img: processed, bounds: processed.Bounds()}
+		if input.geo != nil {
+			node.geo = p.transformGeo(cloneGeo(input.geo), stepJob, input.bounds, node.bounds, log)
+		}
+		nodes[step.ID] = node
+
+		if after != nil {
+			after(i, step, node)
+		}
+
+		if readers[step.Input]--; readers[step.Input] == 0 && !keep[step.Input] {
+			release(step.Input)
+		}
+	}
+
+	for id := range nodes {
+		if !keep[id] {
+			release(id)
+		}
+	}
+	return nodes, nil
+}
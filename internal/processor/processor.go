@@ -2,14 +2,19 @@ package processor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"image"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	lua "github.com/yuin/gopher-lua"
 	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
 	"golang.org/x/image/webp"
@@ -19,7 +24,13 @@ import (
 	"image/png"
 
 	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/dicom"
+	"github.com/arsalan9702/concurrent-image-processor/internal/expr"
+	"github.com/arsalan9702/concurrent-image-processor/internal/fits"
+	"github.com/arsalan9702/concurrent-image-processor/internal/jpegscale"
 	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tracing"
+	"github.com/arsalan9702/concurrent-image-processor/internal/webhook"
 	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
 )
 
@@ -28,17 +39,116 @@ type Processor struct {
 	config     *config.Config
 	workerPool *WorkerPool
 	logger     logger.Logger
+	background *Background
+	steps      []models.PipelineStep
+	outputs    []config.PipelineOutput
+	faults     *faultInjector
+	tracer     tracing.Tracer
+	bus        *eventBus
+	webhooks   *webhook.Notifier
+	// slots of exec filter commands running at once
+	execSlots chan struct{}
+	// compiled pipeline_script, nil without one
+	script *lua.FunctionProto
+	// top-level filter parameters, built once so an expression compiles
+	// once per run
+	params models.FilterParams
+	// output paths claimed by the run's inputs
+	names *outputNames
+	// given by WithStorage, WithMetrics and WithHooks, nil without them
+	storage     Storage
+	metrics     Metrics
+	hooks       []Hook
+	subscribers []func(Event)
 }
 
-// create new processor instance
-func New(cfg *config.Config, log logger.Logger) (*Processor, error) {
+// New creates a processor configured by opts. Without WithConfig it starts
+// from the defaults, so a library can build one without a config file
+func New(opts ...Option) (*Processor, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cfg, log, err := o.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	registerPlugins()
+
+	background, err := NewBackground(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := pipelineSteps(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	faults, err := newFaultInjector(cfg.FaultInject, cfg.Deterministic)
+	if err != nil {
+		return nil, err
+	}
+	if faults != nil {
+		log.WithField("fault_inject", cfg.FaultInject).Warn("Fault injection enabled")
+	}
+	if cfg.Deterministic && runsPrograms(steps) {
+		log.Warn("Deterministic mode can't pin the output of exec filters")
+	}
+
+	var script *lua.FunctionProto
+	if cfg.PipelineScript != "" {
+		if script, err = loadScript(cfg.PipelineScript); err != nil {
+			return nil, fmt.Errorf("failed to load pipeline script: %w", err)
+		}
+	}
+
+	tracer, err := newTracer(cfg.TraceFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+
+	events, err := openEventLog(cfg.EventsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events file: %w", err)
+	}
+
+	webhooks, err := webhook.New(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
 	processor := &Processor{
-		config: cfg,
-		logger: log,
+		config:     cfg,
+		logger:     log,
+		background: background,
+		steps:      steps,
+		outputs:    cfg.Outputs(),
+		faults:     faults,
+		tracer:     tracer,
+		bus:        &eventBus{},
+		webhooks:   webhooks,
+		execSlots:  make(chan struct{}, cfg.ExecConcurrency),
+		script:     script,
+		params:     filterParams(cfg),
+		names:      newOutputNames(),
+		storage:    o.storage,
+		metrics:    o.metrics,
+		hooks:      o.hooks,
+		// kept for Reload, so a reloaded service notifies them too
+		subscribers: o.subscribers,
 	}
+	processor.subscribe(events, o.subscribers)
 	
 	// Pass the processor instance to the worker pool
-	workerPool := NewWorkerPool(cfg.Workers, cfg.BufferSize, log, processor)
+	workerPool := NewWorkerPool(PoolSizes{
+		Decode: cfg.DecodeWorkers,
+		Filter: cfg.Workers,
+		Encode: cfg.EncodeWorkers,
+	}, cfg.BufferSize, cfg.MemoryBudget, log, processor)
+	workerPool.images = NewThrottle(cfg.MaxImagesPerSec)
+	workerPool.io = NewThrottle(cfg.MaxIOMBPerSec * (1 << 20))
 	processor.workerPool = workerPool
 
 	return processor, nil
@@ -46,172 +156,976 @@ func New(cfg *config.Config, log logger.Logger) (*Processor, error) {
 
 // process multiple images concurrently
 func (p *Processor) ProcessImages(ctx context.Context, imagePaths []string) ([]models.ProcessingResult, error) {
+	return p.processJobs(ctx, imagePaths, func(i int) models.ImageJob {
+		return p.batchJob(i, imagePaths[i])
+	})
+}
+
+// ProcessManifest processes the jobs of a manifest concurrently, each with
+// the output, pipeline and parameters of its entry. Entries are validated
+// when the manifest is loaded
+func (p *Processor) ProcessManifest(ctx context.Context, entries []config.ManifestEntry) ([]models.ProcessingResult, error) {
+	jobs := make([]models.ImageJob, len(entries))
+	imagePaths := make([]string, len(entries))
+	for i, entry := range entries {
+		job, err := p.manifestJob(i, entry)
+		if err != nil {
+			return nil, fmt.Errorf("manifest entry %d: %w", i+1, err)
+		}
+		// an entry's own output is left to its author
+		if entry.Output == "" {
+			p.claimJob(&job)
+		}
+		for _, output := range job.Outputs {
+			if err := os.MkdirAll(filepath.Dir(output.Path), 0755); err != nil {
+				return nil, fmt.Errorf("failed to create output directory: %w", err)
+			}
+		}
+		jobs[i], imagePaths[i] = job, entry.Input
+	}
+
+	return p.processJobs(ctx, imagePaths, func(i int) models.ImageJob {
+		return jobs[i]
+	})
+}
+
+// process the inputs at imagePaths concurrently, with newJob creating the
+// job of the input at an index
+func (p *Processor) processJobs(ctx context.Context, imagePaths []string, newJob func(i int) models.ImageJob) ([]models.ProcessingResult, error) {
 	p.logger.WithField("count", len(imagePaths)).Info("Starting batch image processing")
 
 	p.workerPool.Start(ctx)
 	defer p.workerPool.Stop()
 
-	for i, path := range imagePaths {
-		job := models.ImageJob{
-			ID:         fmt.Sprintf("job_%d", i),
-			InputPath:  path,
-			OutputPath: p.generateOutputPath(path),
-			Filter:     models.FilterType(p.config.Filter),
-			Params: models.FilterParams{
-				BlurRadius: p.config.BlurRadius,
-				Brightness: p.config.Brightness,
-				Contrast:   p.config.Contrast,
-				Quality:    p.config.Quality,
-			},
+	var results []models.ProcessingResult
+	pending := make([]int, len(imagePaths))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	// skip inputs a previous run with the same state file already finished
+	var cp *checkpoint
+	if p.config.StateFile != "" {
+		var err error
+		cp, pending, results, err = p.resume(imagePaths)
+		if err != nil {
+			return nil, err
 		}
+		defer cp.Close()
+		p.reserveCheckpoint(cp)
+	}
 
+	jobs := make([]models.ImageJob, len(pending))
+	for j, i := range pending {
+		jobs[j] = newJob(i)
+	}
+
+	for _, job := range byPriority(orderJobs(jobs, p.config.Schedule, p.estimateMemory)) {
+		job.SubmittedAt = time.Now()
+		p.bus.publish(EventQueued, job, Event{})
 		p.workerPool.SubmitJob(job)
 	}
 
-	var results []models.ProcessingResult
 	resultsReceived := 0
-	expectedResults := len(imagePaths)
+	expectedResults := len(jobs)
 
 	for resultsReceived < expectedResults {
 		select {
 		case <-ctx.Done():
-			return results, ctx.Err()
+			return p.orderResults(results), ctx.Err()
 		case result := <-p.workerPool.Results():
+			p.recordResult(cp, result)
 			results = append(results, result)
 			resultsReceived++
 		}
 	}
 
-	return results, nil
+	return p.orderResults(results), nil
+}
+
+// ProcessStream processes the paths received on paths while they are still
+// being found, so a walk of a huge tree doesn't hold every path in memory or
+// delay the first job. Inputs are indexed in the order received, and the
+// stream is no longer read once the pool drains. Schedules other than fifo
+// need every input up front, so they read the whole stream first
+func (p *Processor) ProcessStream(ctx context.Context, paths <-chan string) ([]models.ProcessingResult, error) {
+	if p.config.Schedule != ScheduleFIFO && p.config.Schedule != "" {
+		var imagePaths []string
+		for path := range paths {
+			imagePaths = append(imagePaths, path)
+		}
+		return p.ProcessImages(ctx, imagePaths)
+	}
+
+	p.logger.Info("Starting streaming image processing")
+
+	p.workerPool.Start(ctx)
+	defer p.workerPool.Stop()
+
+	var cp *checkpoint
+	if p.config.StateFile != "" {
+		var resumed bool
+		var err error
+		cp, resumed, err = openCheckpoint(p.config.StateFile, p.runFingerprint())
+		if err != nil {
+			return nil, fmt.Errorf("failed to open state file: %w", err)
+		}
+		defer cp.Close()
+		p.reserveCheckpoint(cp)
+		if resumed {
+			p.logger.WithField("state_file", p.config.StateFile).Info("Resuming previous run")
+		}
+	}
+
+	// inputs finished by a previous run, and the number of jobs submitted
+	// once the stream ends
+	done := make(chan models.ProcessingResult)
+	submitted := make(chan int, 1)
+
+	go func() {
+		count := 0
+		defer func() { submitted <- count }()
+
+		for i := 0; ; i++ {
+			var path string
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case path, ok = <-paths:
+			}
+			if !ok || p.workerPool.isDraining() {
+				return
+			}
+
+			if cp != nil {
+				if entry, ok := cp.completed(path); ok {
+					select {
+					case done <- resumedResult(i, entry):
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+			}
+
+			job := p.batchJob(i, path)
+			job.SubmittedAt = time.Now()
+			p.bus.publish(EventQueued, job, Event{})
+			// the pool stops once this returns, so the send must give up
+			// with the context rather than outlive it
+			select {
+			case p.workerPool.queue(job) <- job:
+				count++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var results []models.ProcessingResult
+	received, expected := 0, -1
+	for expected < 0 || received < expected {
+		select {
+		case <-ctx.Done():
+			if expected < 0 {
+				<-submitted
+			}
+			return p.orderResults(results), ctx.Err()
+		case expected = <-submitted:
+		case result := <-done:
+			results = append(results, result)
+		case result := <-p.workerPool.Results():
+			p.recordResult(cp, result)
+			results = append(results, result)
+			received++
+		}
+	}
+
+	return p.orderResults(results), nil
 }
 
-// process single image with row-level concurrency
+// record a finished job in the state file and quarantine a failed input
+func (p *Processor) recordResult(cp *checkpoint, result models.ProcessingResult) {
+	if cp != nil {
+		if err := cp.record(result); err != nil {
+			p.logger.WithError(err).WithField("file", result.InputPath).Warn("Failed to record job in state file")
+		}
+	}
+	if err := p.deadLetter(result); err != nil {
+		p.logger.WithError(err).WithField("file", result.InputPath).Warn("Failed to quarantine input")
+	}
+}
+
+// job running the pipeline on the input at index i, writing to outputDir
+func (p *Processor) newJob(i int, path, outputDir string) models.ImageJob {
+	outputs := p.jobOutputs(path, outputDir)
+	if p.config.InPlace {
+		// encoded beside the input, then renamed over it by replaceInput
+		outputs[0].Path = inPlaceTemp(path, filepath.Ext(outputs[0].Path))
+	}
+	return models.ImageJob{
+		ID:         fmt.Sprintf("job_%d", i),
+		Index:      i,
+		InputPath:  path,
+		OutputPath: outputs[0].Path,
+		Filter:     models.FilterType(p.pipelineName()),
+		Params:     p.filterParams(),
+		Steps:      p.steps,
+		Outputs:    outputs,
+		Priority:   models.Priority(p.config.Priority),
+	}
+}
+
+// job of a manifest entry: the pipeline, parameters and output paths the
+// processor would use with the entry's overrides applied
+func (p *Processor) manifestJob(i int, entry config.ManifestEntry) (models.ImageJob, error) {
+	cfg, err := p.config.JobConfig(entry)
+	if err != nil {
+		return models.ImageJob{}, err
+	}
+	steps, err := pipelineSteps(cfg)
+	if err != nil {
+		return models.ImageJob{}, err
+	}
+
+	// output naming reads the pipeline from the processor
+	view := *p
+	view.config, view.steps, view.outputs = cfg, steps, cfg.Outputs()
+	view.params = filterParams(cfg)
+
+	outputDir := entry.OutputDir
+	if outputDir == "" {
+		outputDir = p.config.OutputDir
+	}
+	job := view.newJob(i, entry.Input, outputDir)
+	if entry.Output != "" {
+		job.Outputs[0].Path = entry.Output
+		job.OutputPath = entry.Output
+	}
+	return job, nil
+}
+
+// whether the pipeline runs external programs, whose output deterministic
+// mode can't pin
+func runsPrograms(steps []models.PipelineStep) bool {
+	for _, step := range steps {
+		if step.Filter == models.FilterExec {
+			return true
+		}
+	}
+	return false
+}
+
+// sort results back into input order when ordered_results or deterministic
+// is set; images are still processed concurrently and in schedule order
+func (p *Processor) orderResults(results []models.ProcessingResult) []models.ProcessingResult {
+	if p.config.OrderedResults || p.config.Deterministic {
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].Index < results[j].Index
+		})
+	}
+	return results
+}
+
+// Webhooks returns the notifier of the configured webhooks, nil when there
+// are none
+func (p *Processor) Webhooks() *webhook.Notifier {
+	return p.webhooks
+}
+
+// publish a job's result to the subscribers of the bus, which record it in
+// the events file and the metrics and notify the webhooks of a failure
+func (p *Processor) finished(job models.ImageJob, result models.ProcessingResult) {
+	p.bus.finished(job, result)
+}
+
+// Stats reports the worker pool's queues and in-flight jobs
+func (p *Processor) Stats() PoolStats {
+	return p.workerPool.Stats()
+}
+
+// Drain stops ProcessImages from starting more images: those already
+// decoding, filtering or encoding finish, and the rest are returned with
+// ErrSkipped. Cancel the context to abandon in-flight images too
+func (p *Processor) Drain() {
+	p.workerPool.Drain()
+}
+
+// Pause stops the worker pool from starting queued images until Resume,
+// letting those in flight finish; nothing queued is lost. Reports whether
+// the pool was running
+func (p *Processor) Pause() bool {
+	return p.workerPool.Pause()
+}
+
+// Resume starts queued images again after Pause. Reports whether the pool
+// was paused
+func (p *Processor) Resume() bool {
+	return p.workerPool.Resume()
+}
+
+// Resize changes the number of decode, filter and encode workers of a
+// running pool, leaving stages given zero as they are. Retired workers
+// finish the image they're on. Returns the new worker counts
+func (p *Processor) Resize(sizes PoolSizes) (PoolSizes, error) {
+	return p.workerPool.Resize(sizes)
+}
+
+// filter parameters of the top-level configuration
+func (p *Processor) filterParams() models.FilterParams {
+	return p.params
+}
+
+// build filter parameters from a configuration; values are validated on load
+func filterParams(cfg *config.Config) models.FilterParams {
+	params := models.FilterParams{
+		BlurRadius:    cfg.BlurRadius,
+		Brightness:    cfg.Brightness,
+		Contrast:      cfg.Contrast,
+		Gamma:         cfg.Gamma,
+		Quality:       cfg.Quality,
+		Scalar:        !cfg.SIMDFilters,
+		Backend:       cfg.ComputeBackend,
+		GPUMinPixels:  cfg.GPUMinPixels,
+		ShadowOffsetX: cfg.ShadowOffsetX,
+		ShadowOffsetY: cfg.ShadowOffsetY,
+		ShadowBlur:    cfg.ShadowBlur,
+		ShadowOpacity: cfg.ShadowOpacity,
+		GlowRadius:    cfg.GlowRadius,
+		GlowOpacity:   cfg.GlowOpacity,
+		ResizeWidth:   cfg.ResizeWidth,
+		ResizeHeight:  cfg.ResizeHeight,
+		CropX:         cfg.CropX,
+		CropY:         cfg.CropY,
+		CropWidth:     cfg.CropWidth,
+		CropHeight:    cfg.CropHeight,
+		ExecCommand:   cfg.ExecCommand,
+		ExecTimeout:   cfg.ExecTimeout,
+		Plugin:        cfg.CustomParams(cfg.Filter),
+	}
+	params.CornerRadius, params.CornerRadiusPercent, _ = config.ParseLength(cfg.CornerRadius)
+	params.ShadowColor, _ = config.ParseColor(cfg.ShadowColor)
+	params.GlowColor, _ = config.ParseColor(cfg.GlowColor)
+	params.SmartCropAspect, _ = config.ParseAspect(cfg.SmartCropAspect)
+	params.SmartCropStrategy = cfg.SmartCropStrategy
+	if cfg.Filter == string(models.FilterExpression) {
+		params.Expression, _ = expr.Compile(cfg.Expression)
+	}
+	params.Table = pointTable(models.FilterType(cfg.Filter), params)
+
+	return params
+}
+
+// job state handed from the decode stage to the filter and encode stages
+type stageJob struct {
+	job       models.ImageJob
+	result    models.ProcessingResult
+	img       *image.RGBA
+	gray16    *image.Gray16
+	// ICC profile of the input, embedded in outputs with keep_icc_profile
+	icc       []byte
+	usage     *jobUsage
+	nodes     map[string]pipelineNode
+	debug     bool
+	srcBounds image.Rectangle
+	format    string
+	startTime time.Time
+	cost      int64
+	log       logger.Logger
+	// set on a cache miss, to store the outputs once written
+	cacheKey string
+
+	// bounded by job_timeout; cancel once the result is emitted
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// whether the job needs no later stage: it failed, or its outputs were
+// written while decoding
+func (sj *stageJob) finished() bool {
+	r := sj.result
+	return r.Error != nil || r.Cached || r.Streamed || r.Unchanged
+}
+
+// process single image with row-level concurrency, running the decode,
+// filter and encode stages back to back
 func (p *Processor) ProcessSingleImage(ctx context.Context, job models.ImageJob) models.ProcessingResult {
-	startTime := time.Now()
-	log := p.logger.WithFields(map[string]interface{}{
-		"job_id":     job.ID,
-		"input_path": job.InputPath,
-		"filter":     job.Filter,
-	})
+	sj := p.decodeStage(ctx, job, p.logger)
+	defer sj.cancel()
+
+	if !sj.finished() {
+		p.runStage(sj, p.filterStage)
+	}
+	if !sj.finished() {
+		p.runStage(sj, p.encodeStage)
+	}
+
+	sj.result.Resources = sj.usage.result()
+	sj.result.Metadata.Timings = sj.usage.stageTimings()
+	return sj.result
+}
 
-	result := models.ProcessingResult{
-		InputPath:  job.InputPath,
-		OutputPath: job.OutputPath,
+// ProcessFile runs the pipeline on the image at inputPath, writing its
+// outputs to outputDir
+func (p *Processor) ProcessFile(ctx context.Context, inputPath, outputDir string) models.ProcessingResult {
+	return p.ProcessSingleImage(ctx, p.newJob(0, inputPath, outputDir))
+}
+
+// derive the context a single job runs under, limited by job_timeout
+func (p *Processor) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.config.JobTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, p.config.JobTimeout)
+}
+
+// record the job's context error and report whether the job must stop
+func (p *Processor) stageCancelled(sj *stageJob) bool {
+	err := sj.ctx.Err()
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("job %w after %s: %w", ErrTimeout, p.config.JobTimeout, err)
+	}
+	sj.result.Error = err
+	return true
+}
+
+// read and decode the input, along with any GeoTIFF tags. The job's timeout
+// starts here, so time spent queued doesn't count against it. The job's log
+// adds its fields to log
+func (p *Processor) decodeStage(ctx context.Context, job models.ImageJob, log logger.Logger) *stageJob {
+	sj := &stageJob{
+		job:       job,
+		startTime: time.Now(),
+		log: log.WithFields(map[string]interface{}{
+			"job_id":     job.ID,
+			"input_path": job.InputPath,
+			"filter":     job.Filter,
+		}),
+		result: models.ProcessingResult{
+			Index:      job.Index,
+			InputPath:  job.InputPath,
+			OutputPath: job.OutputPath,
+		},
+	}
+	sj.ctx, sj.cancel = p.jobContext(ctx)
+	sj.usage = newJobUsage(p.config.StripTimings)
+	sj.ctx = withUsage(sj.ctx, sj.usage)
+	defer sj.usage.since(time.Now())
+	p.startJobSpan(sj)
+
+	_, span := p.tracer.Start(sj.ctx, "decode")
+	defer func() { endSpan(span, sj.result.Error) }()
 
 	// check file size
 	fileInfo, err := os.Stat(job.InputPath)
 	if err != nil {
-		result.Error = fmt.Errorf("fialed to stat file: %w", err)
-		return result
+		sj.result.Error = fmt.Errorf("fialed to stat file: %w", err)
+		return sj
 	}
 
 	if fileInfo.Size() > p.config.MaxFileSize {
-		result.Error = fmt.Errorf("file size %d exceeds maximum %d", fileInfo.Size(), p.config.MaxFileSize)
-		return result
+		sj.result.Error = fmt.Errorf("%w: size %d exceeds maximum %d", ErrFileTooLarge, fileInfo.Size(), p.config.MaxFileSize)
+		return sj
 	}
 
-	result.Metadata.OriginalSize = fileInfo.Size()
+	sj.result.Metadata.OriginalSize = fileInfo.Size()
 
-	img, format, err := p.loadImage(job.InputPath)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to load image: %w", err)
-		return result
+	if err := p.runHooks("before decode", func(h Hook) error {
+		return h.BeforeDecode(sj.ctx, job.InputPath)
+	}); err != nil {
+		sj.result.Error = err
+		return sj
+	}
+
+	if p.script != nil {
+		scripted, err := p.scriptedJob(sj.ctx, job, fileInfo)
+		if err != nil {
+			sj.result.Error = fmt.Errorf("pipeline script: %w", err)
+			return sj
+		}
+		job = scripted
+		sj.job, sj.result.OutputPath = job, job.OutputPath
+		sj.log = sj.log.WithField("filter", job.Filter)
+	}
+
+	if err := checkInPlace(job); err != nil {
+		sj.result.Error = err
+		return sj
+	}
+
+	// a cache hit copies the outputs of an earlier run and skips the rest
+	if p.config.CacheDir != "" {
+		key, err := p.cacheKey(job)
+		if err != nil {
+			sj.result.Error = fmt.Errorf("failed to hash input: %w", err)
+			return sj
+		}
+		hit, err := p.restoreCached(sj, key)
+		if err != nil {
+			sj.result.Error = fmt.Errorf("failed to restore cached outputs: %w", err)
+			return sj
+		}
+		if hit {
+			sj.result.ProcessingTime = time.Since(sj.startTime)
+			sj.log.Debug("restored outputs from cache")
+			return sj
+		}
+		sj.cacheKey = key
+	}
+
+	if err := p.faults.decode(job.InputPath); err != nil {
+		sj.result.Error = fmt.Errorf("failed to load image: %w", err)
+		return sj
+	}
+
+	// pipelines that leave the pixels as they are copy the input
+	if p.copyUnchanged(sj) {
+		return sj
 	}
 
-	log.WithFields(map[string]interface{}{
+	// inputs too large to hold are filtered and encoded as they decode
+	if src, format, ok := p.openStream(job); ok {
+		p.streamJob(sj, src, format)
+		return sj
+	}
+
+	// pipelines that start by shrinking a JPEG decode it at a smaller scale
+	decodeStart := time.Now()
+	img, size := p.loadScaledJPEG(sj)
+	format := "jpeg"
+	if img == nil {
+		img, format, err = p.loadImage(job.InputPath)
+		if err != nil {
+			sj.result.Error = decodeError(err)
+			return sj
+		}
+		size = img.Bounds().Size()
+	}
+	sj.usage.decoded(decodeStart)
+	if p.stageCancelled(sj) {
+		return sj
+	}
+	if err := p.runHooks("after decode", func(h Hook) error {
+		return h.AfterDecode(sj.ctx, job.InputPath, img)
+	}); err != nil {
+		sj.result.Error = err
+		return sj
+	}
+
+	sj.log.WithFields(map[string]interface{}{
 		"width":  img.Bounds().Dx(),
 		"height": img.Bounds().Dy(),
 		"format": format,
 	}).Debug("Image loaded successfully")
 
-	rgba := ImageToRGBA(img)
-	bounds := rgba.Bounds()
+	if format == "tiff" {
+		geo, err := readGeoMetadata(job.InputPath)
+		if err != nil {
+			sj.log.WithError(err).Warn("Failed to read GeoTIFF tags")
+		}
+		sj.result.Metadata.Geo = geo
+	}
+	if p.config.KeepICCProfile {
+		sj.icc = readICC(job.InputPath)
+	}
+
+	// the grayscale filter leaves gray pixels unchanged, so 16-bit grayscale
+	// input skips the 8-bit filter path and keeps its full depth
+	sj.usage.alloc(imageBytes(img))
+	if gray16, ok := img.(*image.Gray16); ok && grayscaleOnly(job) {
+		sj.gray16 = gray16
+	} else {
+		sj.img = ImageToRGBA(img)
+		sj.usage.alloc(imageBytes(sj.img))
+		sj.usage.free(imageBytes(img))
+	}
+	sj.srcBounds = img.Bounds()
+	sj.result.Metadata.SourceWidth, sj.result.Metadata.SourceHeight = size.X, size.Y
+	sj.format = format
+	sj.debug = sj.img != nil && p.debugSampled(job.InputPath)
+	return sj
+}
+
+// run the job's pipeline over the decoded pixels
+func (p *Processor) filterStage(sj *stageJob) {
+	p.faults.filter(sj.ctx, sj.job.InputPath)
+	if p.stageCancelled(sj) {
+		return
+	}
+
+	if sj.gray16 != nil {
+		// every step is grayscale, so each output is the decoded image
+		sj.nodes = map[string]pipelineNode{}
+		for _, output := range sj.job.Outputs {
+			sj.nodes[output.From] = pipelineNode{bounds: sj.srcBounds, geo: sj.result.Metadata.Geo}
+		}
+	} else {
+		p.debugDump(sj, 0, "decoded", sj.img)
+
+		// dumps need every step's result, so they keep point filters apart
+		var after func(i int, step models.PipelineStep, node pipelineNode)
+		if sj.debug {
+			after = func(i int, step models.PipelineStep, node pipelineNode) {
+				p.debugDump(sj, i+1, step.ID+"_"+string(step.Filter), node.img)
+			}
+		}
+		nodes, err := p.runPipeline(sj.ctx, sj.job, sj.img, sj.result.Metadata.Geo, after, sj.log)
+		if err != nil {
+			if !p.stageCancelled(sj) {
+				sj.result.Error = err
+			}
+			return
+		}
+		sj.nodes = nodes
+		sj.img = nil
+	}
+
+	// metadata describes the first output
+	first := sj.nodes[sj.job.Outputs[0].From]
+	width, height := first.bounds.Dx(), first.bounds.Dy()
+	sj.result.Metadata.Width = width
+	sj.result.Metadata.Height = height
+	sj.result.Metadata.Format = sj.format
+	sj.result.Metadata.RowsProcessed = height
+	sj.result.Metadata.Geo = first.geo
+}
+
+// encode and write every output, restore any GeoTIFF tags and, if enabled,
+// re-decode each file to validate it
+func (p *Processor) encodeStage(sj *stageJob) {
+	if p.stageCancelled(sj) {
+		return
+	}
+	job := sj.job
+
+	ctx, span := p.tracer.Start(sj.ctx, "encode")
+	defer func() { endSpan(span, sj.result.Error) }()
+	defer sj.usage.since(time.Now())
+
+	for _, output := range job.Outputs {
+		if err := p.writeOutput(ctx, sj, output); err != nil {
+			sj.result.Error = err
+			return
+		}
+	}
+	// drop the pixels as soon as they're written
+	sj.nodes, sj.gray16 = nil, nil
+
+	p.finishJob(sj)
+}
+
+// record the first output as the job's, cache the outputs and log the
+// job's completion once every output is written
+func (p *Processor) finishJob(sj *stageJob) {
+	sj.result.OutputPath = sj.result.Outputs[0].Path
+
+	if sj.cacheKey != "" {
+		if err := p.storeCached(sj); err != nil {
+			sj.log.WithError(err).Warn("failed to cache outputs")
+		}
+	}
+	sj.result.Metadata.ProcessedSize = sj.result.Outputs[0].Size
+	sj.result.ProcessingTime = time.Since(sj.startTime)
+	sj.log.WithField("duration", sj.result.ProcessingTime).Info("image processing completed")
+}
+
+// run the after save hooks on a written output and add it to the job's
+// result with its size, moving it into the content-addressed store when
+// that's enabled
+func (p *Processor) addOutput(sj *stageJob, file models.OutputFile) error {
+	if err := p.runHooks("after save", func(h Hook) error {
+		return h.AfterSave(sj.ctx, sj.job.InputPath, file.Path)
+	}); err != nil {
+		return err
+	}
+	if outputInfo, err := os.Stat(file.Path); err == nil {
+		file.Size = outputInfo.Size()
+	}
+	if p.config.ContentAddressed {
+		contentPath, hash, err := p.contentAddress(file.Path)
+		if err != nil {
+			return fmt.Errorf("failed to store output by content: %w", err)
+		}
+		file.Path, file.SHA256, file.LogicalPath = contentPath, hash, file.Path
+	}
+	sj.result.Outputs = append(sj.result.Outputs, file)
+	return nil
+}
+
+// encode and write one output, adding it to the job's result
+func (p *Processor) writeOutput(ctx context.Context, sj *stageJob, output models.PipelineOutput) (err error) {
+	_, span := p.tracer.Start(ctx, "write")
+	span.SetAttribute("output", output.Name)
+	span.SetAttribute("path", output.Path)
+	defer func() { endSpan(span, err) }()
+
+	node := sj.nodes[output.From]
+	var img image.Image = node.img
+	if sj.gray16 != nil {
+		img = sj.gray16
+	}
+
+	encodeStart := time.Now()
+	quality, searched := sj.job.Params.Quality, false
+	if p.qualityTarget() && encodedFormat(output.Path) == "jpeg" {
+		var met bool
+		if quality, met, err = p.searchQuality(img, quality); err != nil {
+			return fmt.Errorf("failed to search quality: %w", err)
+		}
+		if !met {
+			sj.log.WithField("quality", quality).Warn("Quality target not reached")
+		}
+		searched = true
+	}
+	search := time.Since(encodeStart)
+
+	if err := p.runHooks("before encode", func(h Hook) error {
+		return h.BeforeEncode(ctx, sj.job.InputPath, output.Path, img)
+	}); err != nil {
+		return err
+	}
+	encodeStart = time.Now()
+	written, err := p.saveImageTimed(img, output.Path, sj.format, quality)
+	if err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	encode := search + time.Since(encodeStart) - written
+	writeStart := time.Now()
+
+	if node.geo != nil && isTIFF(output.Path) {
+		if err := writeGeoMetadata(output.Path, node.geo); err != nil {
+			return fmt.Errorf("failed to write GeoTIFF tags: %w", err)
+		}
+	}
+
+	// the encoders write RGB, so other profiles would misdescribe the data
+	if sj.icc != nil && rgbProfile(sj.icc) && sj.gray16 == nil {
+		if err := embedICC(output.Path, sj.icc); err != nil {
+			return fmt.Errorf("failed to embed ICC profile: %w", err)
+		}
+	}
+	sj.usage.encoded(encode, written+time.Since(writeStart))
+
+	if p.config.ValidateOutputs {
+		if err := p.verifyOutput(output.Path, img); err != nil {
+			return fmt.Errorf("output %s failed validation: %w", output.Path, err)
+		}
+	}
+
+	file := models.OutputFile{
+		Name:   output.Name,
+		Path:   output.Path,
+		Width:  node.bounds.Dx(),
+		Height: node.bounds.Dy(),
+	}
+	if searched {
+		file.Quality = quality
+	}
+	return p.addOutput(sj, file)
+}
+
+// apply the job's filter, either as a whole-image operation or row by row.
+// Strip processing stops early once ctx is done; operations run to completion
+func (p *Processor) applyFilter(ctx context.Context, job models.ImageJob, rgba *image.RGBA) (*image.RGBA, error) {
+	if processed, ok := p.applyGPU(ctx, job, rgba); ok {
+		return processed, nil
+	}
+	if op, exists := OperationRegistry[job.Filter]; exists {
+		defer usageFrom(ctx).since(time.Now())
+		return op(rgba, job.Params), nil
+	}
+	if job.Filter == models.FilterExec {
+		defer usageFrom(ctx).since(time.Now())
+		return p.applyExec(ctx, job.Params, rgba)
+	}
+
+	processed, err := p.processStrips(ctx, job, rgba)
+	if err != nil {
+		return nil, fmt.Errorf("row processing failed: %w", err)
+	}
+
+	return processed, nil
+}
+
+// process the image in horizontal strips of strip_height rows, applying the
+// job's row filter. Strips are fed to a fixed set of row workers, and each
+// strip carries the extra rows a neighborhood filter needs around it
+func (p *Processor) processStrips(ctx context.Context, job models.ImageJob, src *image.RGBA) (*image.RGBA, error) {
+	bounds := src.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 
-	result.Metadata.Width = width
-	result.Metadata.Height = height
-	result.Metadata.Format = format
-	result.Metadata.RowsProcessed = height
+	filter, exists := FilterRegistry[job.Filter]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrFilterUnknown, job.Filter)
+	}
 
-	// process image row by row using goroutines
-	processedRows := make([][]uint8, height)
-	var wg sync.WaitGroup
-	rowResults := make(chan models.RowResult, height)
+	overlap := 0
+	if fn, ok := FilterOverlap[job.Filter]; ok {
+		overlap = fn(job.Params)
+	}
 
-	for row := 0; row < height; row++ {
+	stripHeight := p.config.StripHeight
+	strips := (height + stripHeight - 1) / stripHeight
+	stripJobs := make(chan models.StripJob, strips)
+	stripResults := make(chan models.StripResult, strips)
+
+	// every strip is copied out of the source, filtered into a buffer of
+	// its own and copied into dst, and all of them are held until the end
+	usage := usageFrom(ctx)
+	var held int64
+	defer func() { usage.free(held) }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(p.config.RowWorkers, strips); i++ {
 		wg.Add(1)
-		go func(rowIndex int) {
+		go func() {
 			defer wg.Done()
-
-			pixels := ExtractRowPixels(rgba, rowIndex)
-			if pixels == nil {
-				rowResults <- models.RowResult{
-					ImageID:  job.ID,
-					RowIndex: rowIndex,
-					Error:    fmt.Errorf("failed to extract pixels for row %d", rowIndex),
+			for stripJob := range stripJobs {
+				// both channels hold every strip, so a cancelled job drains
+				// the queue without blocking and no worker is left behind
+				if err := ctx.Err(); err != nil {
+					stripResults <- models.StripResult{ImageID: stripJob.ImageID, StartRow: stripJob.StartRow, EndRow: stripJob.EndRow, Error: err}
+					continue
 				}
-				return
-			}
-
-			var processPixels []uint8
-			if filter, exists := FilterRegistry[job.Filter]; exists {
-				processPixels = filter(pixels, width, job.Params)
-			} else {
-				rowResults <- models.RowResult{
-					ImageID:  job.ID,
-					RowIndex: rowIndex,
-					Error:    fmt.Errorf("unknown filter: %s", job.Filter),
+				stripResults <- processStrip(stripJob, filter)
+				// let the goroutines of other jobs and of foreground work
+				// sharing the few CPUs run between strips
+				if p.config.LowPriority {
+					runtime.Gosched()
 				}
-				return
 			}
+		}()
+	}
 
-			rowResults <- models.RowResult{
-				ImageID:  job.ID,
-				RowIndex: rowIndex,
-				Pixels:   processPixels,
-				Error:    nil,
-			}
-		}(row)
+	for start := 0; start < height && ctx.Err() == nil; start += stripHeight {
+		end := min(start+stripHeight, height)
+		top, bottom := min(overlap, start), min(overlap, height-end)
+
+		pixels := extractRows(src, start-top, end+bottom)
+		held += int64(len(pixels))
+		usage.alloc(int64(len(pixels)))
+		stripJobs <- models.StripJob{
+			ImageID:  job.ID,
+			StartRow: start,
+			EndRow:   end,
+			Top:      top,
+			Bottom:   bottom,
+			Pixels:   pixels,
+			Width:    width,
+			Filter:   job.Filter,
+			Params:   job.Params,
+		}
 	}
+	close(stripJobs)
 
 	go func() {
 		wg.Wait()
-		close(rowResults)
+		close(stripResults)
 	}()
 
-	// collect row results
-	for rowResult := range rowResults {
-		if rowResult.Error != nil {
-			result.Error = fmt.Errorf("row processing failed: %w", rowResult.Error)
-			return result
+	// strips read overlapping source rows, so results go to a separate image;
+	// the channel is drained even after a failure so the workers can exit
+	dst := image.NewRGBA(bounds)
+	held += int64(len(dst.Pix))
+	usage.alloc(int64(len(dst.Pix)))
+	var firstErr error
+	for stripResult := range stripResults {
+		if stripResult.Error != nil {
+			if firstErr == nil {
+				firstErr = stripResult.Error
+			}
+			continue
 		}
-		processedRows[rowResult.RowIndex] = rowResult.Pixels
+		held += int64(len(stripResult.Pixels))
+		usage.alloc(int64(len(stripResult.Pixels)))
+		usage.work(stripResult.Duration)
+		usage.strip("", stripResult)
+		setRows(dst, stripResult.StartRow, stripResult.Pixels)
+		p.bus.chunk(job, stripResult)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
 	}
 
-	for row := 0; row < height; row++ {
-		if processedRows[row] != nil {
-			SetRowPixels(rgba, row, processedRows[row])
-		}
+	return dst, nil
+}
+
+// apply a row filter to a strip and keep only the strip's own rows
+func processStrip(stripJob models.StripJob, filter Filter) models.StripResult {
+	startTime := time.Now()
+	result := models.StripResult{
+		ImageID:  stripJob.ImageID,
+		StartRow: stripJob.StartRow,
+		EndRow:   stripJob.EndRow,
 	}
 
-	if err := p.saveImage(rgba, job.OutputPath, format, job.Params.Quality); err != nil {
-		result.Error = fmt.Errorf("failed to save image: %w", err)
+	rows := stripJob.EndRow - stripJob.StartRow
+	if len(stripJob.Pixels) != (rows+stripJob.Top+stripJob.Bottom)*stripJob.Width*4 {
+		result.Error = fmt.Errorf("invalid pixel data for rows %d-%d", stripJob.StartRow, stripJob.EndRow)
 		return result
 	}
 
-	if outputInfo, err := os.Stat(job.OutputPath); err != nil {
-		result.Metadata.ProcessedSize = outputInfo.Size()
+	processed := filter(stripJob.Pixels, stripJob.Width, stripJob.Params)
+	// plugin filters may not keep to the strip's size
+	if len(processed) != len(stripJob.Pixels) {
+		result.Error = fmt.Errorf("filter %s returned %d bytes for %d", stripJob.Filter, len(processed), len(stripJob.Pixels))
+		return result
 	}
+	rowBytes := stripJob.Width * 4
+	result.Pixels = processed[stripJob.Top*rowBytes : (stripJob.Top+rows)*rowBytes]
+	result.Duration = time.Since(startTime)
+	return result
+}
 
-	result.ProcessingTime = time.Since(startTime)
-	log.WithField("duration", result.ProcessingTime).Info("image processing completed")
+// copy rows [y0, y1) into a contiguous buffer
+func extractRows(img *image.RGBA, y0, y1 int) []uint8 {
+	bounds := img.Bounds()
+	rowBytes := bounds.Dx() * 4
+	pixels := make([]uint8, (y1-y0)*rowBytes)
 
-	return result
+	for y := y0; y < y1; y++ {
+		i := img.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		copy(pixels[(y-y0)*rowBytes:], img.Pix[i:i+rowBytes])
+	}
+
+	return pixels
+}
+
+// copy a contiguous buffer of rows into the image starting at row y0
+func setRows(img *image.RGBA, y0 int, pixels []uint8) {
+	bounds := img.Bounds()
+	rowBytes := bounds.Dx() * 4
+
+	for r := 0; r*rowBytes < len(pixels); r++ {
+		i := img.PixOffset(bounds.Min.X, bounds.Min.Y+y0+r)
+		copy(img.Pix[i:i+rowBytes], pixels[r*rowBytes:(r+1)*rowBytes])
+	}
 }
 
 // loading image
 func (p *Processor) loadImage(path string) (image.Image, string, error) {
+	return p.loadImageAs(path, filepath.Ext(path))
+}
+
+// load an image with the decoder for ext, whatever the path's own extension
+func (p *Processor) loadImageAs(path, ext string) (image.Image, string, error) {
+	d, err := guardDecode(p, path, func() (decodedImage, error) {
+		img, format, err := p.decodeAs(path, ext)
+		return decodedImage{img, format}, err
+	})
+	return d.img, d.format, err
+}
+
+// decode the file at path with the decoder for ext
+func (p *Processor) decodeAs(path, ext string) (image.Image, string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, "", err
@@ -219,9 +1133,7 @@ func (p *Processor) loadImage(path string) (image.Image, string, error) {
 
 	defer file.Close()
 
-	ext := strings.ToLower(filepath.Ext(path))
-
-	switch ext {
+	switch strings.ToLower(ext) {
 	case ".webp":
 		img, err := webp.Decode(file)
 		return img, "webp", err
@@ -231,6 +1143,25 @@ func (p *Processor) loadImage(path string) (image.Image, string, error) {
 	case ".tiff", ".tif":
 		img, err := tiff.Decode(file)
 		return img, "tiff", err
+	case ".dcm":
+		// the dataset is anonymized by the decoder, only the modality is logged
+		img, ds, err := dicom.Decode(file, dicom.Options{
+			WindowCenter: p.config.DicomWindowCenter,
+			WindowWidth:  p.config.DicomWindowWidth,
+		})
+		if err == nil {
+			p.logger.WithFields(map[string]interface{}{
+				"file":     path,
+				"modality": ds.Modality(),
+			}).Debug("Decoded DICOM image")
+		}
+		return img, "dicom", err
+	case ".fits", ".fit", ".fts":
+		img, _, err := fits.Decode(file, fits.Options{
+			Stretch:  p.config.FitsStretch,
+			BitDepth: p.config.FitsBitDepth,
+		})
+		return img, "fits", err
 	default:
 		// Use Go's built-in image decoder
 		img, format, err := image.Decode(file)
@@ -238,14 +1169,97 @@ func (p *Processor) loadImage(path string) (image.Image, string, error) {
 	}
 }
 
+// input formats that can't be encoded, their output is written as PNG
+var readOnlyExts = map[string]bool{
+	".dcm":  true,
+	".fits": true,
+	".fit":  true,
+	".fts":  true,
+}
+
+// read image dimensions without decoding pixel data
+func (p *Processor) decodeConfig(path string) (image.Config, error) {
+	return guardDecode(p, path, func() (image.Config, error) {
+		return p.decodeHeader(path)
+	})
+}
+
+// read the header of the file at path with the decoder for its extension
+func (p *Processor) decodeHeader(path string) (image.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".webp":
+		return webp.DecodeConfig(file)
+	case ".bmp":
+		return bmp.DecodeConfig(file)
+	case ".tiff", ".tif":
+		return tiff.DecodeConfig(file)
+	case ".dcm":
+		return dicom.DecodeConfig(file)
+	case ".fits", ".fit", ".fts":
+		return fits.DecodeConfig(file)
+	default:
+		cfg, _, err := image.DecodeConfig(file)
+		return cfg, err
+	}
+}
+
+// estimate decoded pixel memory for an image, 0 if its header can't be read
+func (p *Processor) estimateMemory(path string) int64 {
+	cfg, err := p.decodeConfig(path)
+	if err != nil {
+		return 0
+	}
+
+	// a streamed job holds bands of rows rather than the image
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if p.config.StreamMinPixels > 0 && pixels >= p.config.StreamMinPixels {
+		job := p.newJob(0, path, p.config.OutputDir)
+		if p.streamablePipeline(job) {
+			return p.streamMemory(job, cfg.Width)
+		}
+	}
+	if p.config.JPEGScaledDecode && encodedFormat(path) == "jpeg" {
+		size := image.Pt(cfg.Width, cfg.Height)
+		if scale, _ := jpegScale(p.newJob(0, path, p.config.OutputDir), size); scale > 1 {
+			size = jpegscale.Scaled(size, scale)
+			pixels = int64(size.X) * int64(size.Y)
+		}
+	}
+
+	return pixels * 4
+}
+
 func (p *Processor) saveImage(img image.Image, path string, originalFormat string, quality int) error {
+	_, err := p.saveImageTimed(img, path, originalFormat, quality)
+	return err
+}
+
+// save an image, returning the time spent creating the file and writing
+// the encoded bytes to it, apart from encoding them
+func (p *Processor) saveImageTimed(img image.Image, path string, originalFormat string, quality int) (time.Duration, error) {
+	start := time.Now()
 	file, err := os.Create(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer file.Close()
 
+	out := &timedWriter{w: file, d: time.Since(start)}
+	err = p.encodeImage(out, img, path, originalFormat, quality)
+	return out.d, err
+}
+
+// encode an image in the format of path's extension, or originalFormat
+// for other extensions
+func (p *Processor) encodeImage(file io.Writer, img image.Image, path string, originalFormat string, quality int) error {
 	ext := strings.ToLower(filepath.Ext(path))
 	format := originalFormat
 
@@ -253,32 +1267,111 @@ func (p *Processor) saveImage(img image.Image, path string, originalFormat strin
 		format = "jpeg"
 	} else if ext == ".png" {
 		format = "png"
+	} else if isTIFF(path) {
+		format = "tiff"
 	}
 
 	switch format{
 		case "jpeg":
+			// jpeg has no alpha, so flatten onto the configured background
+			if p.background != nil {
+				img = p.background.Composite(img)
+			}
 			options := &jpeg.Options{Quality: quality}
 			return jpeg.Encode(file, img, options)
 		case "png":
-			encoder:= &png.Encoder{CompressionLevel: png.BestCompression}
+			encoder:= &png.Encoder{CompressionLevel: pngCompression(p.config.PNGCompression)}
 			return encoder.Encode(file, img)
+		case "tiff":
+			return tiff.Encode(file, img, tiffOptions(p.config.TIFFCompression))
 		default:
-			encoder:= &png.Encoder{CompressionLevel: png.BestCompression}
+			encoder:= &png.Encoder{CompressionLevel: pngCompression(p.config.PNGCompression)}
 			return encoder.Encode(file, img)
 	}
 }
 
-func (p *Processor) generateOutputPath(inputPath string) string{
+// png compression level of a png_compression setting
+func pngCompression(level string) png.CompressionLevel {
+	switch level {
+	case "none":
+		return png.NoCompression
+	case "speed":
+		return png.BestSpeed
+	case "default":
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
+}
+
+// tiff encoder options of a tiff_compression setting
+func tiffOptions(compression string) *tiff.Options {
+	if compression == "none" {
+		return &tiff.Options{Compression: tiff.Uncompressed}
+	}
+	return &tiff.Options{Compression: tiff.Deflate, Predictor: true}
+}
+
+func isTIFF(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".tif" || ext == ".tiff"
+}
+
+// carry georeferencing through the job's filter; size-changing operations
+// other than resize and crop can't be mapped, so their output loses it
+func (p *Processor) transformGeo(geo *models.GeoMetadata, job models.ImageJob, before, after image.Rectangle, log logger.Logger) *models.GeoMetadata {
+	switch job.Filter {
+	case models.FilterCrop:
+		rect := CropRect(before, job.Params)
+		cropGeo(geo, rect.Min.X, rect.Min.Y)
+	case models.FilterResize:
+		scaleGeo(geo, float64(before.Dx())/float64(after.Dx()), float64(before.Dy())/float64(after.Dy()))
+	default:
+		if before.Size() != after.Size() {
+			log.Warn("Filter changes the canvas, dropping GeoTIFF georeferencing")
+			return nil
+		}
+	}
+
+	return geo
+}
+
+// output path of a pipeline output: <name>_<output name> for named outputs,
+// <name>_<pipeline> for the single implicit one, or <name> when there are
+// no filters to name
+func (p *Processor) generateOutputPath(inputPath, outputDir string, output config.PipelineOutput) string{
 	dir := filepath.Dir(inputPath)
 	filename:=filepath.Base(inputPath)
 	ext:=filepath.Ext(inputPath)
 	name:=strings.TrimSuffix(filename, ext)
 
-	outputDir := p.config.OutputDir
 	if outputDir == "" {
 		outputDir = dir
 	}
 
-	outputFilename:= fmt.Sprintf("%s_%s%s", name, p.config.Filter, ext)
+	// transparent results can't be stored in formats without alpha, unless
+	// an explicit output format asks for them to be flattened
+	switch {
+	case output.Format == "jpeg":
+		ext = ".jpg"
+	case output.Format == "png":
+		ext = ".png"
+	case output.Format == "tiff":
+		ext = ".tif"
+	case p.alphaUpstream(output.From):
+		ext = ".png"
+	case readOnlyExts[strings.ToLower(ext)]:
+		ext = ".png"
+	}
+
+	suffix := output.Name
+	if suffix == "" {
+		suffix = p.pipelineName()
+	}
+
+	outputFilename:= name + ext
+	if suffix != "" {
+		outputFilename = fmt.Sprintf("%s_%s%s", name, suffix, ext)
+	}
 	return filepath.Join(outputDir, outputFilename)
 }
@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/ssim"
+)
+
+// qualityTarget reports whether JPEG quality is searched per image instead
+// of fixed
+func (p *Processor) qualityTarget() bool {
+	return p.config.TargetSize > 0 || p.config.TargetSSIM > 0
+}
+
+// searchQuality binary-searches the JPEG quality of img, up to maxQuality,
+// for the smallest file that still reaches target_ssim, within target_size
+// bytes when set. It returns the quality and whether both targets were met;
+// when the size can't be reached even at quality 1, that's the quality used
+func (p *Processor) searchQuality(img image.Image, maxQuality int) (int, bool, error) {
+	// JPEG is written flattened, so measure the flattened pixels
+	if p.background != nil {
+		img = p.background.Composite(img)
+	}
+
+	type measure struct {
+		size int64
+		ssim float64
+	}
+	measures := map[int]measure{}
+	encode := func(quality int) (measure, error) {
+		if m, ok := measures[quality]; ok {
+			return m, nil
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return measure{}, err
+		}
+		m := measure{size: int64(buf.Len())}
+		if p.config.TargetSSIM > 0 {
+			decoded, err := jpeg.Decode(&buf)
+			if err != nil {
+				return measure{}, err
+			}
+			if m.ssim, err = ssim.Luma(img, decoded); err != nil {
+				return measure{}, err
+			}
+		}
+		measures[quality] = m
+		return m, nil
+	}
+
+	// the first quality in lo..hi for which ok holds, assuming it holds for
+	// every quality above that one; hi+1 when it holds for none
+	search := func(lo, hi int, ok func(measure) bool) (int, error) {
+		for lo <= hi {
+			mid := (lo + hi) / 2
+			m, err := encode(mid)
+			if err != nil {
+				return 0, err
+			}
+			if ok(m) {
+				hi = mid - 1
+			} else {
+				lo = mid + 1
+			}
+		}
+		return lo, nil
+	}
+
+	met := true
+	quality := max(1, min(maxQuality, 100))
+	if p.config.TargetSize > 0 {
+		// the highest quality within the size is one below the first that
+		// exceeds it
+		over, err := search(1, quality, func(m measure) bool { return m.size > p.config.TargetSize })
+		if err != nil {
+			return 0, false, err
+		}
+		if over == 1 {
+			met = false
+		}
+		quality = max(1, over-1)
+	}
+	if p.config.TargetSSIM > 0 {
+		reached, err := search(1, quality, func(m measure) bool { return m.ssim >= p.config.TargetSSIM })
+		if err != nil {
+			return 0, false, err
+		}
+		if reached > quality {
+			met = false
+		}
+		quality = min(reached, quality)
+	}
+	return quality, met, nil
+}
@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"sort"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// scheduling policies for the order jobs are submitted in
+const (
+	ScheduleFIFO          = "fifo"
+	ScheduleSmallestFirst = "smallest-first"
+	ScheduleLargestFirst  = "largest-first"
+	ScheduleInterleaved   = "interleaved"
+)
+
+// orderJobs returns the jobs in the order the policy submits them. Sizes are
+// estimated decoded pixel bytes, so a huge TIFF and a huge PNG rank alike.
+// Largest-first keeps a few giant images from starting last and leaving
+// one worker busy long after the rest are idle; interleaved alternates
+// large and small jobs so both make progress throughout the run
+func orderJobs(jobs []models.ImageJob, policy string, size func(path string) int64) []models.ImageJob {
+	if policy == ScheduleFIFO || policy == "" || len(jobs) < 2 {
+		return jobs
+	}
+
+	sizes := make(map[string]int64, len(jobs))
+	for _, job := range jobs {
+		sizes[job.InputPath] = size(job.InputPath)
+	}
+
+	ordered := append([]models.ImageJob(nil), jobs...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return sizes[ordered[i].InputPath] < sizes[ordered[j].InputPath]
+	})
+
+	switch policy {
+	case ScheduleLargestFirst:
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	case ScheduleInterleaved:
+		interleaved := make([]models.ImageJob, 0, len(ordered))
+		for lo, hi := 0, len(ordered)-1; lo <= hi; lo, hi = lo+1, hi-1 {
+			interleaved = append(interleaved, ordered[hi])
+			if lo != hi {
+				interleaved = append(interleaved, ordered[lo])
+			}
+		}
+		ordered = interleaved
+	}
+
+	return ordered
+}
+
+// index of the pool queue jobs of a priority wait in, 0 for the highest
+func priorityRank(priority models.Priority) int {
+	switch priority {
+	case models.PriorityHigh:
+		return 0
+	case models.PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// byPriority returns the jobs with higher priorities first, keeping the
+// schedule's order within each priority, so a full low queue doesn't hold
+// back the submission of high jobs behind it
+func byPriority(jobs []models.ImageJob) []models.ImageJob {
+	ordered := append([]models.ImageJob(nil), jobs...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return priorityRank(ordered[i].Priority) < priorityRank(ordered[j].Priority)
+	})
+	return ordered
+}
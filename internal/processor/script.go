@@ -0,0 +1,264 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// global function of the pipeline script called for every image
+const scriptFunction = "pipeline"
+
+// what the pipeline script is told about an image, as a table
+type scriptInput struct {
+	Input    string              `json:"input"`
+	Format   string              `json:"format"`
+	Width    int                 `json:"width"`
+	Height   int                 `json:"height"`
+	Size     int64               `json:"size"`
+	Modified time.Time           `json:"modified"`
+	Exif     *models.ExifSummary `json:"exif,omitempty"`
+	Pipeline []scriptStep        `json:"pipeline"`
+}
+
+type scriptStep struct {
+	ID     string `json:"id"`
+	Input  string `json:"input"`
+	Filter string `json:"filter"`
+}
+
+// compile the Lua pipeline script at path, and check it defines the
+// pipeline function
+func loadScript(path string) (*lua.FunctionProto, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	L, err := newScriptState(context.Background(), proto)
+	if err != nil {
+		return nil, err
+	}
+	L.Close()
+	return proto, nil
+}
+
+// a Lua state with the script run, so its functions are defined. It has the
+// base, string, table and math libraries, without those reaching files,
+// the environment or a random source, so a script's answer only depends on
+// the image it's given
+func newScriptState(ctx context.Context, proto *lua.FunctionProto) (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module", "print", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if math, ok := L.GetGlobal(lua.MathLibName).(*lua.LTable); ok {
+		math.RawSetString("random", lua.LNil)
+		math.RawSetString("randomseed", lua.LNil)
+	}
+
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if L.GetGlobal(scriptFunction).Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("the script defines no %s function", scriptFunction)
+	}
+	return L, nil
+}
+
+// ask the pipeline script which pipeline runs on the job's image. Its
+// pipeline function gets the image's metadata and the pipeline it would
+// run as a table, and returns nil to keep that pipeline or a manifest
+// entry to replace it: filter or pipeline, params and output_dir. Each
+// image gets a fresh state, so nothing one call leaves in globals reaches
+// the next
+func (p *Processor) scriptedJob(ctx context.Context, job models.ImageJob, info os.FileInfo) (models.ImageJob, error) {
+	input := scriptInput{
+		Input:    job.InputPath,
+		Format:   strings.TrimPrefix(strings.ToLower(filepath.Ext(job.InputPath)), "."),
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+	}
+	if header, err := p.decodeConfig(job.InputPath); err == nil {
+		input.Width, input.Height = header.Width, header.Height
+	}
+	input.Exif, _ = readExif(job.InputPath)
+	for _, step := range job.Steps {
+		input.Pipeline = append(input.Pipeline, scriptStep{ID: step.ID, Input: step.Input, Filter: string(step.Filter)})
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return job, err
+	}
+	var fields interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return job, err
+	}
+
+	if p.config.PipelineScriptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.PipelineScriptTimeout)
+		defer cancel()
+	}
+	L, err := newScriptState(ctx, p.script)
+	if err != nil {
+		return job, p.scriptError(ctx, err)
+	}
+	defer L.Close()
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal(scriptFunction), NRet: 1, Protect: true}, luaValue(L, fields)); err != nil {
+		return job, p.scriptError(ctx, err)
+	}
+	answer := L.Get(-1)
+	L.Pop(1)
+	if answer == lua.LNil {
+		return job, nil
+	}
+
+	value, err := goValue(answer)
+	if err != nil {
+		return job, fmt.Errorf("invalid answer: %w", err)
+	}
+	if data, err = json.Marshal(value); err != nil {
+		return job, fmt.Errorf("invalid answer: %w", err)
+	}
+	var entry config.ManifestEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&entry); err != nil {
+		return job, fmt.Errorf("invalid answer: %w", err)
+	}
+	entry.Input = job.InputPath
+	if entry.OutputDir == "" {
+		entry.OutputDir = filepath.Dir(job.OutputPath)
+	}
+	scripted, err := p.manifestJob(job.Index, entry)
+	if err != nil {
+		return job, fmt.Errorf("invalid answer: %w", err)
+	}
+	if entry.Output == "" {
+		p.claimJob(&scripted)
+	}
+	for _, output := range scripted.Outputs {
+		if err := os.MkdirAll(filepath.Dir(output.Path), 0755); err != nil {
+			return job, fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	scripted.ID, scripted.SubmittedAt, scripted.TraceParent = job.ID, job.SubmittedAt, job.TraceParent
+	return scripted, nil
+}
+
+// an error of the script, ErrTimeout when it ran out of time
+func (p *Processor) scriptError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s", ErrTimeout, p.config.PipelineScriptTimeout)
+	}
+	return err
+}
+
+// the Lua value of v, decoded from JSON
+func luaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.NewTable()
+		for _, item := range v {
+			table.Append(luaValue(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.NewTable()
+		for key, item := range v {
+			table.RawSetString(key, luaValue(L, item))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
+
+// the Go value of an answer of the script, for encoding as JSON. A table
+// with the keys 1 to n is a list, and any other an object with string keys
+func goValue(v lua.LValue) (interface{}, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		entries := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { entries++ })
+		if n := v.MaxN(); n > 0 && n == entries {
+			list := make([]interface{}, n)
+			for i := range list {
+				item, err := goValue(v.RawGetInt(i + 1))
+				if err != nil {
+					return nil, err
+				}
+				list[i] = item
+			}
+			return list, nil
+		}
+
+		object := map[string]interface{}{}
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			name, ok := key.(lua.LString)
+			if !ok {
+				err = fmt.Errorf("table key %s is not a string", key)
+				return
+			}
+			object[string(name)], err = goValue(value)
+		})
+		return object, err
+	default:
+		return nil, fmt.Errorf("can't return a %s", v.Type())
+	}
+}
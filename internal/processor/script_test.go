@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// a processor running the Lua source as its pipeline script
+func scriptProcessor(t *testing.T, source string) (*Processor, error) {
+	t.Helper()
+	dir := t.TempDir()
+	script := filepath.Join(dir, "pipeline.lua")
+	if err := os.WriteFile(script, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.InputDir, cfg.OutputDir = dir, filepath.Join(dir, "out")
+	cfg.Filter = "grayscale"
+	cfg.PipelineScript = script
+	cfg.PipelineScriptTimeout = 100 * time.Millisecond
+	return New(WithConfig(cfg), WithLogger(logger.NewLoggerWithOutput(false, "text", io.Discard)))
+}
+
+func scriptJob(t *testing.T, p *Processor, width int) (models.ImageJob, error) {
+	t.Helper()
+	path := filepath.Join(p.config.InputDir, "in.png")
+	writePNG(t, path, image.NewRGBA(image.Rect(0, 0, width, 4)))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.scriptedJob(context.Background(), p.batchJob(0, path), info)
+}
+
+func TestPipelineScript(t *testing.T) {
+	p, err := scriptProcessor(t, `
+function pipeline(image)
+  if image.width > 10 and image.pipeline[1].filter == "grayscale" then
+    return {pipeline = {{filter = "resize", params = {width = 10}}, {filter = "invert"}}}
+  end
+end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := scriptJob(t, p, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.Steps) != 2 || job.Steps[0].Filter != models.FilterResize || job.Steps[0].Params.ResizeWidth != 10 || job.Steps[1].Filter != models.FilterInvert {
+		t.Errorf("got steps %+v, want resize to 10 then invert", job.Steps)
+	}
+
+	job, err = scriptJob(t, p, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.Steps) != 1 || job.Steps[0].Filter != models.FilterGrayScale {
+		t.Errorf("a nil answer changed the pipeline to %+v", job.Steps)
+	}
+}
+
+func TestPipelineScriptErrors(t *testing.T) {
+	for _, source := range []string{
+		"x = 1",
+		"function pipeline(image) end\nos.exit(1)",
+		"function pipeline(image) end\nio.open('/etc/passwd')",
+		"function pipeline(image) end\nrequire('os')",
+		"function pipeline(image",
+	} {
+		if _, err := scriptProcessor(t, source); err == nil {
+			t.Errorf("script %q loaded", source)
+		}
+	}
+
+	p, err := scriptProcessor(t, "function pipeline(image) while true do end end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scriptJob(t, p, 5); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v from an endless script, want a timeout", err)
+	}
+
+	p, err = scriptProcessor(t, `function pipeline(image) return {filter = "nope"} end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scriptJob(t, p, 5); err == nil || !strings.Contains(err.Error(), "invalid answer") {
+		t.Errorf("got %v for an unknown filter, want an invalid answer", err)
+	}
+}
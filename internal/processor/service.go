@@ -0,0 +1,277 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tracing"
+)
+
+// ErrStopped is returned by Service.Process once the service has stopped
+var ErrStopped = errors.New("service stopped")
+
+// Service keeps the worker pool running so daemons can submit images one at
+// a time and wait for each result, instead of processing a fixed batch
+type Service struct {
+	ctx  context.Context
+	next atomic.Int64
+	mu   sync.RWMutex
+	// the processor new jobs go to, replaced by Reload
+	p       *Processor
+	pending map[int]chan models.ProcessingResult
+	stopped bool
+	quit    chan struct{}
+	// closed once the pools of every processor have stopped
+	done        chan struct{}
+	dispatchers sync.WaitGroup
+	once        sync.Once
+
+	// the processors whose pools haven't stopped, and whether Pause holds
+	// their queued jobs
+	pools  map[*Processor]bool
+	paused bool
+}
+
+// StartService starts the worker pool for a long-running daemon. The
+// processor can't also run ProcessImages
+func (p *Processor) StartService(ctx context.Context) *Service {
+	p.workerPool.Start(ctx)
+
+	s := &Service{
+		ctx:     ctx,
+		p:       p,
+		pending: map[int]chan models.ProcessingResult{},
+		pools:   map[*Processor]bool{p: true},
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.dispatchers.Add(1)
+	go s.dispatch(p)
+	go func() {
+		s.dispatchers.Wait()
+		close(s.done)
+	}()
+	return s
+}
+
+// Reload replaces the service's processor with one built from cfg, so
+// changes to the pipeline, its parameters and the worker counts apply
+// without a restart; the logger, storage, metrics, hooks and subscribers
+// stay. New jobs go to the new worker pool while the old one finishes the
+// jobs it has, then stops
+func (s *Service) Reload(cfg *config.Config) error {
+	current := s.processor()
+	p, err := New(WithConfig(cfg), WithLogger(current.logger), WithStorage(current.storage), WithMetrics(current.metrics),
+		WithHooks(current.hooks...), WithSubscribers(current.subscribers...))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return ErrStopped
+	}
+	if s.paused {
+		p.Pause()
+	}
+	p.workerPool.Start(s.ctx)
+	s.pools[p] = true
+	s.dispatchers.Add(1)
+	go s.dispatch(p)
+	old := s.p
+	s.p = p
+	s.mu.Unlock()
+
+	// submit sends to the current pool under the read lock, so nothing is
+	// sent to the old one once it's replaced
+	go old.workerPool.Stop()
+	return nil
+}
+
+// the processor new jobs go to
+func (s *Service) processor() *Processor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.p
+}
+
+// hand each result of p's pool to the caller waiting for it, until the
+// pool stops
+func (s *Service) dispatch(p *Processor) {
+	defer s.dispatchers.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pools, p)
+		s.mu.Unlock()
+	}()
+	// the pool's failures may still be notifying webhooks
+	defer p.webhooks.Wait()
+	for result := range p.workerPool.Results() {
+		if err := p.deadLetter(result); err != nil {
+			p.logger.WithError(err).WithField("file", result.InputPath).Warn("Failed to quarantine input")
+		}
+
+		s.mu.Lock()
+		ch, ok := s.pending[result.Index]
+		delete(s.pending, result.Index)
+		s.mu.Unlock()
+		if ok {
+			ch <- result
+		}
+	}
+}
+
+// Process runs the pipeline on one input, writing its outputs to outputDir,
+// and waits for the result. The job's spans join the trace carried by ctx.
+// Cancelling ctx stops waiting, not the job
+func (s *Service) Process(ctx context.Context, inputPath, outputDir string) (models.ProcessingResult, error) {
+	return s.run(ctx, s.processor().newJob(int(s.next.Add(1)), inputPath, outputDir))
+}
+
+// ProcessEntry runs one job described like a manifest entry, with its own
+// output, pipeline and parameters, and waits for the result
+func (s *Service) ProcessEntry(ctx context.Context, entry config.ManifestEntry) (models.ProcessingResult, error) {
+	job, err := s.processor().manifestJob(int(s.next.Add(1)), entry)
+	if err != nil {
+		return models.ProcessingResult{}, err
+	}
+	for _, output := range job.Outputs {
+		if err := os.MkdirAll(filepath.Dir(output.Path), 0755); err != nil {
+			return models.ProcessingResult{}, fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	return s.run(ctx, job)
+}
+
+// submit job and wait for its result
+func (s *Service) run(ctx context.Context, job models.ImageJob) (models.ProcessingResult, error) {
+	job.TraceParent = tracing.SpanContextFromContext(ctx).TraceParent()
+	ch := make(chan models.ProcessingResult, 1)
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return models.ProcessingResult{}, ErrStopped
+	}
+	s.pending[job.Index] = ch
+	s.mu.Unlock()
+
+	if err := s.submit(ctx, job); err != nil {
+		s.forget(job.Index)
+		return models.ProcessingResult{}, err
+	}
+
+	select {
+	case result := <-ch:
+		return result, nil
+	case <-ctx.Done():
+		s.forget(job.Index)
+		return models.ProcessingResult{}, ctx.Err()
+	case <-s.done:
+		return models.ProcessingResult{}, ErrStopped
+	}
+}
+
+// Tracer returns the tracer the service's jobs are instrumented with
+func (s *Service) Tracer() tracing.Tracer {
+	return s.processor().tracer
+}
+
+// Stats returns a snapshot of the service's current worker pool
+func (s *Service) Stats() PoolStats {
+	return s.processor().Stats()
+}
+
+// Pause holds queued jobs until Resume, in the current pool and those a
+// Reload replaced that are still finishing theirs. Jobs in flight finish,
+// and Process keeps accepting jobs, which wait in the queue. Reports
+// whether the service was running
+func (s *Service) Pause() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.pools {
+		p.Pause()
+	}
+	wasPaused := s.paused
+	s.paused = true
+	return !wasPaused
+}
+
+// Resume starts the jobs held by Pause. Reports whether the service was
+// paused
+func (s *Service) Resume() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.pools {
+		p.Resume()
+	}
+	wasPaused := s.paused
+	s.paused = false
+	return wasPaused
+}
+
+// Resize changes the worker counts of the current pool, as
+// Processor.Resize does. A Reload starts the new pool with the configured
+// counts
+func (s *Service) Resize(sizes PoolSizes) (PoolSizes, error) {
+	return s.processor().Resize(sizes)
+}
+
+// Stopped reports whether Stop was called
+func (s *Service) Stopped() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stopped
+}
+
+// queue a job, holding the read lock so Stop can't close the queue under it
+func (s *Service) submit(ctx context.Context, job models.ImageJob) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stopped {
+		return ErrStopped
+	}
+
+	job.SubmittedAt = time.Now()
+	s.p.bus.publish(EventQueued, job, Event{})
+	select {
+	case s.p.workerPool.queue(job) <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.quit:
+		return ErrStopped
+	}
+}
+
+// stop waiting for a job's result
+func (s *Service) forget(index int) {
+	s.mu.Lock()
+	delete(s.pending, index)
+	s.mu.Unlock()
+}
+
+// Stop rejects new images, lets queued and in-flight ones finish and stops
+// the worker pool
+func (s *Service) Stop() {
+	s.once.Do(func() {
+		close(s.quit)
+		s.mu.Lock()
+		s.stopped = true
+		p := s.p
+		s.mu.Unlock()
+
+		// pools replaced by Reload are stopping already
+		p.workerPool.Stop()
+		<-s.done
+	})
+}
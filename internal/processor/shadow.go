@@ -0,0 +1,100 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// ApplyDropShadow extends the canvas and renders a blurred, offset copy of the
+// image's alpha silhouette behind it
+func ApplyDropShadow(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	return renderSilhouette(img, params.ShadowOffsetX, params.ShadowOffsetY, params.ShadowBlur, params.ShadowColor, params.ShadowOpacity, 1)
+}
+
+// ApplyOuterGlow extends the canvas and renders a soft halo around the image's
+// alpha silhouette
+func ApplyOuterGlow(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	// the glow is boosted so the halo stays visible right up to the edge
+	return renderSilhouette(img, 0, 0, params.GlowRadius, params.GlowColor, params.GlowOpacity, 2)
+}
+
+// renderSilhouette draws the blurred alpha silhouette of img in a solid color
+// on an enlarged canvas, then composites the original image over it
+func renderSilhouette(img *image.RGBA, dx, dy int, spread float64, c color.NRGBA, opacity, gain float64) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	r := int(math.Ceil(spread))
+
+	// grow the canvas so neither the offset nor the blur gets clipped
+	left, top := max(0, r-dx), max(0, r-dy)
+	right, bottom := max(0, r+dx), max(0, r+dy)
+	cw, ch := width+left+right, height+top+bottom
+
+	alpha := make([]float64, cw*ch)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := img.Pix[img.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)+3]
+			alpha[(y+top+dy)*cw+x+left+dx] = float64(a) / 255
+		}
+	}
+	blurPlane(alpha, cw, ch, r)
+
+	dst := image.NewRGBA(image.Rect(0, 0, cw, ch))
+	strength := opacity * float64(c.A) / 255
+	for i, a := range alpha {
+		a = math.Min(1, a*gain) * strength
+		dst.Pix[i*4] = uint8(float64(c.R) * a)
+		dst.Pix[i*4+1] = uint8(float64(c.G) * a)
+		dst.Pix[i*4+2] = uint8(float64(c.B) * a)
+		dst.Pix[i*4+3] = uint8(255 * a)
+	}
+
+	draw.Draw(dst, image.Rect(left, top, left+width, top+height), img, bounds.Min, draw.Over)
+	return dst
+}
+
+// blurPlane approximates a gaussian blur spreading roughly radius pixels using
+// three passes of a separable box blur
+func blurPlane(plane []float64, width, height, radius int) {
+	box := radius / 3
+	if box < 1 {
+		if radius <= 0 {
+			return
+		}
+		box = 1
+	}
+
+	tmp := make([]float64, len(plane))
+	for pass := 0; pass < 3; pass++ {
+		boxBlur1D(plane, tmp, width, height, 1, width, box)
+		boxBlur1D(tmp, plane, height, width, width, 1, box)
+	}
+}
+
+// boxBlur1D blurs lines of n samples spaced by step, with lines spaced by
+// stride, treating samples outside the plane as zero
+func boxBlur1D(src, dst []float64, n, lines, step, stride, radius int) {
+	norm := 1 / float64(2*radius+1)
+
+	for line := 0; line < lines; line++ {
+		base := line * stride
+		sum := 0.0
+		for i := 0; i < radius && i < n; i++ {
+			sum += src[base+i*step]
+		}
+
+		for i := 0; i < n; i++ {
+			if j := i + radius; j < n {
+				sum += src[base+j*step]
+			}
+			if j := i - radius - 1; j >= 0 {
+				sum -= src[base+j*step]
+			}
+			dst[base+i*step] = sum * norm
+		}
+	}
+}
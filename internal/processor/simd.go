@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// The vectorized point filters load two RGBA pixels into a 64-bit word and
+// spread each channel over two 32-bit lanes, one per pixel, so every
+// multiply, add and clamp works on both pixels at once. Results may differ
+// from the scalar loops by one level, where the fixed-point arithmetic rounds
+// a value the floating point truncates
+
+// whether the CPU has 64-bit words; with narrower ones the lanes would be
+// split across registers and the scalar loops are faster
+var vectorFilters = bits.UintSize == 64
+
+const (
+	// the low byte, 16 bits and bit of each lane
+	laneByte = 0x000000ff_000000ff
+	laneWord = 0x0000ffff_0000ffff
+	laneBit  = 0x00000001_00000001
+
+	// the alpha bytes of two pixels
+	pixelAlpha = 0xff000000_ff000000
+)
+
+// Rec. 601 luminance weights in 16.16 fixed point, summing to 1<<16 so white
+// stays white
+const (
+	grayR = 19595
+	grayG = 38470
+	grayB = 7471
+)
+
+// grayscaleVector writes the luminance of each pixel of src to dst
+func grayscaleVector(dst, src []uint8) {
+	n := len(src) &^ 7
+	for i := 0; i < n; i += 8 {
+		p := binary.LittleEndian.Uint64(src[i:])
+		y := (p&laneByte)*grayR + (p>>8&laneByte)*grayG + (p>>16&laneByte)*grayB
+		y = y >> 16 & laneByte
+		binary.LittleEndian.PutUint64(dst[i:], y*0x010101|p&pixelAlpha)
+	}
+	if n < len(src) {
+		var last [8]uint8
+		copy(last[:], src[n:])
+		grayscaleVector(last[:], last[:])
+		copy(dst[n:], last[:])
+	}
+}
+
+// linearOp maps each color channel v to v*factor+offset, clamped to 0-255
+// and truncated, in 16.16 fixed point. The offsets hold their constant in
+// both lanes
+type linearOp struct {
+	// factor, made positive by inverting v when it's negative; a multiplier
+	// scales both lanes as it is
+	factor uint64
+	invert bool
+	// offset, raised by lift whole levels when negative so lanes never borrow
+	offset uint64
+	// 1<<17 less the lift, which sets bit 17 of a level at or above the lift
+	floor uint64
+}
+
+// the op for factor and offset, false when the products wouldn't fit the
+// lanes and the scalar loop has to run
+func newLinearOp(factor, offset float64) (linearOp, bool) {
+	var op linearOp
+	if factor < 0 {
+		// v*f+o is (255-v)*-f + 255*f+o
+		op.invert = true
+		factor, offset = -factor, offset+255*factor
+	}
+	if !(factor < 64) || !(math.Abs(offset) < 8192) {
+		return op, false
+	}
+
+	// nudge the offset up by the multiplier's worst rounding error over 255
+	// levels, so products landing on a whole level, as they do for round
+	// factors, aren't truncated one short
+	k := int64(math.Round(factor * (1 << 16)))
+	o := int64(math.Round(offset*(1<<16))) + 1<<7
+	lift := int64(0)
+	if o < 0 {
+		lift = (-o + 0xffff) >> 16
+	}
+
+	op.factor = uint64(k)
+	op.offset = uint64(o+lift<<16) * laneBit
+	op.floor = uint64(1<<17-lift) * laneBit
+	return op, true
+}
+
+// apply the op to a channel value in the low byte of each lane
+func (op linearOp) lanes(v uint64) uint64 {
+	if op.invert {
+		v ^= laneByte
+	}
+	// level plus lift, below 1<<16
+	w := (v*op.factor + op.offset) >> 16 & laneWord
+	// bit 17 is clear in the lanes below zero, which are cleared; the rest
+	// keep the level
+	z := w + op.floor
+	under := ^z >> 17 & laneBit
+	level := z & 0x0001ffff_0001ffff &^ (under * 0x1ffff)
+	// bit 16 is set in the lanes above 255, which saturate
+	over := (level + 0xff00*laneBit) >> 16 & laneBit
+	return (level | over*0xff) & laneByte
+}
+
+// apply writes the op on the color channels of each pixel of src to dst,
+// keeping alpha
+func (op linearOp) apply(dst, src []uint8) {
+	n := len(src) &^ 7
+	for i := 0; i < n; i += 8 {
+		p := binary.LittleEndian.Uint64(src[i:])
+		r := op.lanes(p & laneByte)
+		g := op.lanes(p >> 8 & laneByte)
+		b := op.lanes(p >> 16 & laneByte)
+		binary.LittleEndian.PutUint64(dst[i:], r|g<<8|b<<16|p&pixelAlpha)
+	}
+	if n < len(src) {
+		var last [8]uint8
+		copy(last[:], src[n:])
+		op.apply(last[:], last[:])
+		copy(dst[n:], last[:])
+	}
+}
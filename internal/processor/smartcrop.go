@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// blocks along the longer side of the grid regions are scored on
+const smartCropGrid = 64
+
+// ApplySmartCrop cuts the largest rectangle of the configured aspect ratio
+// out of the image, placed over the most interesting region rather than the
+// centre: the one with the most detail (entropy) or the colors that stand
+// out most from the rest of the image (saliency)
+func ApplySmartCrop(img *image.RGBA, params models.FilterParams) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if params.SmartCropAspect <= 0 || width == 0 || height == 0 {
+		return img
+	}
+
+	cropWidth, cropHeight := width, height
+	if float64(width)/float64(height) > params.SmartCropAspect {
+		cropWidth = max(1, int(math.Round(float64(height)*params.SmartCropAspect)))
+	} else {
+		cropHeight = max(1, int(math.Round(float64(width)/params.SmartCropAspect)))
+	}
+	if cropWidth == width && cropHeight == height {
+		return img
+	}
+
+	rect := smartCropRect(img, cropWidth, cropHeight, params.SmartCropStrategy)
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min.Add(rect.Min), draw.Src)
+	return dst
+}
+
+// the crop rectangle relative to the image origin; the crop spans the image
+// along one axis, so only its offset along the other is chosen
+func smartCropRect(img *image.RGBA, cropWidth, cropHeight int, strategy string) image.Rectangle {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	horizontal := cropWidth < width
+	length, size := height, cropHeight
+	if horizontal {
+		length, size = width, cropWidth
+	}
+	centre := (length - size) / 2
+
+	offset := centre
+	if strategy != "center" {
+		profile := smartCropProfile(img, strategy, horizontal)
+
+		// score of the window at each offset from prefix sums, ties going
+		// to the offset nearest the centre
+		prefix := make([]float64, length+1)
+		for i, score := range profile {
+			prefix[i+1] = prefix[i] + score
+		}
+		best := math.Inf(-1)
+		for o := 0; o+size <= length; o++ {
+			score := prefix[o+size] - prefix[o]
+			if score > best+1e-9 || math.Abs(score-best) <= 1e-9 && abs(o-centre) < abs(offset-centre) {
+				best, offset = score, o
+			}
+		}
+	}
+
+	if horizontal {
+		return image.Rect(offset, 0, offset+size, height)
+	}
+	return image.Rect(0, offset, width, offset+size)
+}
+
+// how interesting each column (horizontal) or row of the image is: the
+// scores of the grid blocks it crosses, shared among their pixels
+func smartCropProfile(img *image.RGBA, strategy string, horizontal bool) []float64 {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	block := max(1, (max(width, height)+smartCropGrid-1)/smartCropGrid)
+	columns, rows := (width+block-1)/block, (height+block-1)/block
+
+	scores := make([]float64, columns*rows)
+	switch strategy {
+	case "saliency":
+		saliencyScores(img, block, columns, scores)
+	default:
+		entropyScores(img, block, columns, scores)
+	}
+
+	length := height
+	if horizontal {
+		length = width
+	}
+	profile := make([]float64, length)
+	for i := range profile {
+		var total float64
+		if horizontal {
+			for row := 0; row < rows; row++ {
+				total += scores[row*columns+i/block]
+			}
+		} else {
+			for column := 0; column < columns; column++ {
+				total += scores[(i/block)*columns+column]
+			}
+		}
+		profile[i] = total / float64(block)
+	}
+	return profile
+}
+
+// Shannon entropy of the luma of each block: flat regions score zero,
+// textured ones and edges high
+func entropyScores(img *image.RGBA, block, columns int, scores []float64) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	histograms := make([][16]int, len(scores))
+	counts := make([]int, len(scores))
+	for y := 0; y < height; y++ {
+		row := img.Pix[img.PixOffset(img.Bounds().Min.X, img.Bounds().Min.Y+y):]
+		for x := 0; x < width; x++ {
+			i := x * 4
+			luma := (299*int(row[i]) + 587*int(row[i+1]) + 114*int(row[i+2])) / 1000
+			b := (y/block)*columns + x/block
+			histograms[b][luma/16]++
+			counts[b]++
+		}
+	}
+
+	for b, histogram := range histograms {
+		for _, n := range histogram {
+			if n == 0 {
+				continue
+			}
+			p := float64(n) / float64(counts[b])
+			scores[b] -= p * math.Log2(p)
+		}
+	}
+}
+
+// distance of each block's mean color from the image's mean color, a
+// frequency-tuned saliency on a coarse grid: subjects standing out from
+// the background score high
+func saliencyScores(img *image.RGBA, block, columns int, scores []float64) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	sums := make([][3]float64, len(scores))
+	counts := make([]int, len(scores))
+	var mean [3]float64
+	for y := 0; y < height; y++ {
+		row := img.Pix[img.PixOffset(img.Bounds().Min.X, img.Bounds().Min.Y+y):]
+		for x := 0; x < width; x++ {
+			i := x * 4
+			b := (y/block)*columns + x/block
+			for c := 0; c < 3; c++ {
+				sums[b][c] += float64(row[i+c])
+				mean[c] += float64(row[i+c])
+			}
+			counts[b]++
+		}
+	}
+	for c := range mean {
+		mean[c] /= float64(width * height)
+	}
+
+	for b, sum := range sums {
+		var distance float64
+		for c := 0; c < 3; c++ {
+			d := sum[c]/float64(counts[b]) - mean[c]
+			distance += d * d
+		}
+		scores[b] = math.Sqrt(distance)
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
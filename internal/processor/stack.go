@@ -0,0 +1,298 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Stack combines all images into a single output by averaging or
+// median-combining each pixel, optionally aligning every frame to the first
+func (p *Processor) Stack(ctx context.Context, imagePaths []string) (models.ProcessingResult, error) {
+	startTime := time.Now()
+	outputPath := p.config.StackOutput
+	if outputPath == "" {
+		outputPath = filepath.Join(p.config.OutputDir, fmt.Sprintf("stack_%s.png", p.config.StackMethod))
+	}
+
+	result := models.ProcessingResult{
+		InputPath:  p.config.InputDir,
+		OutputPath: outputPath,
+	}
+
+	if len(imagePaths) < 2 {
+		return result, fmt.Errorf("stacking needs at least 2 images, got %d", len(imagePaths))
+	}
+
+	p.logger.WithFields(map[string]interface{}{
+		"count":  len(imagePaths),
+		"method": p.config.StackMethod,
+		"align":  p.config.StackAlign,
+	}).Info("Starting image stacking")
+
+	frames, format, err := p.loadFrames(ctx, imagePaths)
+	if err != nil {
+		return result, err
+	}
+
+	bounds := frames[0].Bounds()
+	for i, frame := range frames {
+		if frame.Bounds().Size() != bounds.Size() {
+			return result, fmt.Errorf("%s is %dx%d, expected %dx%d", imagePaths[i],
+				frame.Bounds().Dx(), frame.Bounds().Dy(), bounds.Dx(), bounds.Dy())
+		}
+	}
+
+	offsets := make([]image.Point, len(frames))
+	if p.config.StackAlign {
+		reference := luminanceGrid(frames[0])
+		for i := 1; i < len(frames); i++ {
+			coarse := findOffset(reference, luminanceGrid(frames[i]), p.config.StackAlignRadius)
+			offsets[i] = refineOffset(frames[0], frames[i], coarse, reference.step)
+			p.logger.WithFields(map[string]interface{}{
+				"file": imagePaths[i],
+				"dx":   offsets[i].X,
+				"dy":   offsets[i].Y,
+			}).Debug("Frame aligned")
+		}
+	}
+
+	stacked := p.combineFrames(ctx, frames, offsets)
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	if err := p.saveImage(stacked, outputPath, format, p.config.Quality); err != nil {
+		return result, fmt.Errorf("failed to save stacked image: %w", err)
+	}
+
+	result.Metadata = models.ImageMetadata{
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		Format:        format,
+		RowsProcessed: bounds.Dy(),
+	}
+	if outputInfo, err := os.Stat(outputPath); err == nil {
+		result.Metadata.ProcessedSize = outputInfo.Size()
+	}
+	result.ProcessingTime = time.Since(startTime)
+
+	return result, nil
+}
+
+// decode all frames concurrently, bounded by the configured worker count
+func (p *Processor) loadFrames(ctx context.Context, imagePaths []string) ([]*image.RGBA, string, error) {
+	frames := make([]*image.RGBA, len(imagePaths))
+	errs := make([]error, len(imagePaths))
+	var format string
+
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+	for i, path := range imagePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			img, f, err := p.loadImage(path)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to load %s: %w", path, err)
+				return
+			}
+			if i == 0 {
+				format = f
+			}
+			frames[i] = ImageToRGBA(img)
+		}(i, path)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return frames, format, nil
+}
+
+// combine frames row by row using the configured number of row workers
+func (p *Processor) combineFrames(ctx context.Context, frames []*image.RGBA, offsets []image.Point) *image.RGBA {
+	bounds := frames[0].Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	median := p.config.StackMethod == "median"
+
+	rows := make(chan int, height)
+	for y := 0; y < height; y++ {
+		rows <- y
+	}
+	close(rows)
+
+	var wg sync.WaitGroup
+	for w := 0; w < p.config.RowWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			samples := make([][]float64, 4)
+			for y := range rows {
+				if ctx.Err() != nil {
+					return
+				}
+
+				for x := 0; x < width; x++ {
+					for c := range samples {
+						samples[c] = samples[c][:0]
+					}
+
+					for i, frame := range frames {
+						fx, fy := x+offsets[i].X, y+offsets[i].Y
+						if fx < 0 || fx >= width || fy < 0 || fy >= height {
+							continue
+						}
+						// frames have the reference's size, not its origin
+						origin := frame.Bounds().Min
+						idx := frame.PixOffset(origin.X+fx, origin.Y+fy)
+						for c := range samples {
+							samples[c] = append(samples[c], float64(frame.Pix[idx+c]))
+						}
+					}
+
+					idx := dst.PixOffset(x, y)
+					for c := range samples {
+						dst.Pix[idx+c] = uint8(math.Round(combine(samples[c], median)))
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return dst
+}
+
+// mean or median of the samples
+func combine(samples []float64, median bool) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	if median {
+		sort.Float64s(samples)
+		mid := len(samples) / 2
+		if len(samples)%2 == 0 {
+			return (samples[mid-1] + samples[mid]) / 2
+		}
+		return samples[mid]
+	}
+
+	sum := 0.0
+	for _, s := range samples {
+		sum += s
+	}
+	return sum / float64(len(samples))
+}
+
+// luminance sampled on a coarse grid, which keeps the alignment search cheap
+type lumaGrid struct {
+	step          int
+	width, height int
+	values        []float64
+}
+
+func luminanceGrid(img *image.RGBA) lumaGrid {
+	bounds := img.Bounds()
+	step := max(1, min(bounds.Dx(), bounds.Dy())/128)
+	grid := lumaGrid{step: step, width: bounds.Dx() / step, height: bounds.Dy() / step}
+	grid.values = make([]float64, grid.width*grid.height)
+
+	for y := 0; y < grid.height; y++ {
+		for x := 0; x < grid.width; x++ {
+			idx := img.PixOffset(bounds.Min.X+x*step, bounds.Min.Y+y*step)
+			grid.values[y*grid.width+x] = 0.299*float64(img.Pix[idx]) + 0.587*float64(img.Pix[idx+1]) + 0.114*float64(img.Pix[idx+2])
+		}
+	}
+
+	return grid
+}
+
+// findOffset searches translations within radius pixels for the one that
+// minimises the mean absolute luminance difference against the reference
+func findOffset(reference, frame lumaGrid, radius int) image.Point {
+	r := radius / reference.step
+	best := image.Point{}
+	bestScore := math.Inf(1)
+
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			sum, count := 0.0, 0
+			for y := max(0, -dy); y < min(reference.height, frame.height-dy); y++ {
+				for x := max(0, -dx); x < min(reference.width, frame.width-dx); x++ {
+					sum += math.Abs(reference.values[y*reference.width+x] - frame.values[(y+dy)*frame.width+x+dx])
+					count++
+				}
+			}
+
+			if count > 0 && sum/float64(count) < bestScore {
+				bestScore = sum / float64(count)
+				best = image.Pt(dx*reference.step, dy*reference.step)
+			}
+		}
+	}
+
+	return best
+}
+
+// refineOffset searches single-pixel translations around a coarse offset,
+// still sampling every step pixels so large frames stay cheap
+func refineOffset(reference, frame *image.RGBA, coarse image.Point, step int) image.Point {
+	if step <= 1 {
+		return coarse
+	}
+
+	bounds := reference.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// x and y are relative to each image's own origin
+	luma := func(img *image.RGBA, x, y int) float64 {
+		origin := img.Bounds().Min
+		idx := img.PixOffset(origin.X+x, origin.Y+y)
+		return 0.299*float64(img.Pix[idx]) + 0.587*float64(img.Pix[idx+1]) + 0.114*float64(img.Pix[idx+2])
+	}
+
+	best := coarse
+	bestScore := math.Inf(1)
+	for dy := coarse.Y - step; dy <= coarse.Y+step; dy++ {
+		for dx := coarse.X - step; dx <= coarse.X+step; dx++ {
+			sum, count := 0.0, 0
+			for y := max(0, -dy); y < min(height, height-dy); y += step {
+				for x := max(0, -dx); x < min(width, width-dx); x += step {
+					sum += math.Abs(luma(reference, x, y) - luma(frame, x+dx, y+dy))
+					count++
+				}
+			}
+
+			if count > 0 && sum/float64(count) < bestScore {
+				bestScore = sum / float64(count)
+				best = image.Pt(dx, dy)
+			}
+		}
+	}
+
+	return best
+}
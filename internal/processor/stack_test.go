@@ -0,0 +1,42 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+)
+
+// frames of the same size at different origins are read from their own
+// pixels, not from the reference frame's coordinates
+func TestStackFramesWithOwnOrigin(t *testing.T) {
+	reference := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	frame := image.NewRGBA(image.Rect(100, 50, 164, 114))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{uint8(x * 4), uint8(y * 4), uint8((x * y) % 251), 255}
+			reference.SetRGBA(x, y, c)
+			frame.SetRGBA(100+x, 50+y, c)
+		}
+	}
+
+	if offset := refineOffset(reference, frame, image.Point{}, 2); offset != (image.Point{}) {
+		t.Errorf("offset %v between identical frames, want none", offset)
+	}
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Processor{config: cfg}
+	stacked := p.combineFrames(context.Background(), []*image.RGBA{reference, frame}, make([]image.Point, 2))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if got, want := stacked.RGBAAt(x, y), reference.RGBAAt(x, y); got != want {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
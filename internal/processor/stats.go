@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"math"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// ImageStats decodes each image and passes its statistics to emit as soon as
+// they're ready, so large archives aren't held in memory; emit is never
+// called concurrently
+func (p *Processor) ImageStats(ctx context.Context, imagePaths []string, emit func(models.ImageStats)) error {
+	sem := make(chan struct{}, p.config.Workers)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, path := range imagePaths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			stats := p.imageStats(path)
+			mu.Lock()
+			defer mu.Unlock()
+			emit(stats)
+		}(path)
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// statistics of one file
+func (p *Processor) imageStats(path string) models.ImageStats {
+	stats := models.ImageStats{Path: path}
+
+	img, _, err := p.loadImage(path)
+	if err != nil {
+		stats.Error = err.Error()
+		return stats
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = ImageToRGBA(img)
+	}
+	bounds := rgba.Bounds()
+	stats.Width, stats.Height = bounds.Dx(), bounds.Dy()
+
+	var histograms [4][256]int
+	var shadows, highlights, pixels int
+	luma := make([]float64, stats.Width*stats.Height)
+	for y := 0; y < stats.Height; y++ {
+		row := rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < stats.Width; x++ {
+			i := x * 4
+			r, g, b := row[i], row[i+1], row[i+2]
+			l := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			luma[y*stats.Width+x] = l
+
+			// transparent pixels have no color to measure
+			if row[i+3] == 0 {
+				continue
+			}
+			pixels++
+			histograms[0][r]++
+			histograms[1][g]++
+			histograms[2][b]++
+			histograms[3][uint8(math.Round(l))]++
+			if r == 255 || g == 255 || b == 255 {
+				highlights++
+			}
+			if r == 0 && g == 0 && b == 0 {
+				shadows++
+			}
+		}
+	}
+
+	channels := []**models.ChannelStats{&stats.Red, &stats.Green, &stats.Blue, &stats.Luminance}
+	for c, channel := range channels {
+		*channel = channelStats(histograms[c], pixels, p.config.StatsHistograms)
+	}
+	if pixels > 0 {
+		stats.ClippedShadows = round2(100 * float64(shadows) / float64(pixels))
+		stats.ClippedHighlights = round2(100 * float64(highlights) / float64(pixels))
+	}
+	stats.Sharpness = round2(laplacianVariance(luma, stats.Width, stats.Height))
+	return stats
+}
+
+// mean and standard deviation of a channel from its histogram
+func channelStats(histogram [256]int, pixels int, keepHistogram bool) *models.ChannelStats {
+	stats := &models.ChannelStats{}
+	if keepHistogram {
+		stats.Histogram = histogram[:]
+	}
+	if pixels == 0 {
+		return stats
+	}
+
+	var sum, squares float64
+	for value, n := range histogram {
+		sum += float64(value * n)
+		squares += float64(value * value * n)
+	}
+	mean := sum / float64(pixels)
+	stats.Mean = round2(mean)
+	stats.Std = round2(math.Sqrt(math.Max(0, squares/float64(pixels)-mean*mean)))
+	return stats
+}
+
+// variance of the 4-neighbour Laplacian of the luma, a focus measure: blurry
+// images have few strong edges and score low
+func laplacianVariance(luma []float64, width, height int) float64 {
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	var sum, squares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			l := luma[i-width] + luma[i+width] + luma[i-1] + luma[i+1] - 4*luma[i]
+			sum += l
+			squares += l * l
+		}
+	}
+	n := float64((width - 2) * (height - 2))
+	mean := sum / n
+	return squares/n - mean*mean
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,373 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// returned by the row readers for layouts they don't stream, which are
+// decoded whole instead
+var errStreamUnsupported = errors.New("layout not supported for streaming")
+
+// rowStream hands out an image's rows top to bottom
+type rowStream interface {
+	// the next n rows as packed premultiplied RGBA, fewer at the bottom
+	// and none once every row has been read
+	next(n int) ([]uint8, error)
+}
+
+// rowSource streams the rows of an input file
+type rowSource interface {
+	rowStream
+	size() image.Point
+	Close() error
+}
+
+// rowSink encodes rows into an output file
+type rowSink interface {
+	write(rows []uint8) error
+	// finish the file after the last row
+	Close() error
+}
+
+// open a row reader for a PNG or TIFF input
+func openRowSource(path string) (rowSource, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(file, header); err != nil {
+		file.Close()
+		return nil, "", errStreamUnsupported
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	var src rowSource
+	format := sniffFormat(header)
+	switch format {
+	case "png":
+		src, err = newPNGRows(file)
+	case "tiff":
+		src, err = newTIFFRows(file)
+	default:
+		err = errStreamUnsupported
+	}
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+	return src, format, nil
+}
+
+// whether a job's pipeline can run a band of rows at a time: a chain of row
+// filters, each reading the step before, with every output read from the
+// last step and written as PNG or TIFF. Output validation and quality
+// searches need the whole image, so they rule it out
+func (p *Processor) streamablePipeline(job models.ImageJob) bool {
+	if p.config.ValidateOutputs || p.qualityTarget() {
+		return false
+	}
+
+	last := config.SourceNode
+	for _, step := range job.Steps {
+		if _, ok := FilterRegistry[step.Filter]; !ok || step.Input != last {
+			return false
+		}
+		last = step.ID
+	}
+	for _, output := range job.Outputs {
+		if output.From != last || encodedFormat(output.Path) == "jpeg" {
+			return false
+		}
+	}
+	return true
+}
+
+// open the input of a job for streaming when it has at least
+// stream_min_pixels and its pipeline and layout allow it
+func (p *Processor) openStream(job models.ImageJob) (rowSource, string, bool) {
+	if p.config.StreamMinPixels <= 0 || !p.streamablePipeline(job) {
+		return nil, "", false
+	}
+	src, format, err := openRowSource(job.InputPath)
+	if err != nil {
+		return nil, "", false
+	}
+	size := src.size()
+	if int64(size.X)*int64(size.Y) < p.config.StreamMinPixels {
+		src.Close()
+		return nil, "", false
+	}
+	// 16-bit grayscale through grayscale filters keeps its depth when
+	// decoded whole
+	if rows, ok := src.(interface{ gray16() bool }); ok && rows.gray16() && grayscaleOnly(job) {
+		src.Close()
+		return nil, "", false
+	}
+	return src, format, true
+}
+
+// rows held by a streamed pipeline at once: a batch for each step and its
+// input, with the overlap of neighborhood filters
+func (p *Processor) streamBatch() int {
+	return p.config.StripHeight * max(1, p.config.RowWorkers)
+}
+
+// estimated bytes of rows a streamed job holds
+func (p *Processor) streamMemory(job models.ImageJob, width int) int64 {
+	rows := p.streamBatch()
+	for _, step := range job.Steps {
+		rows += p.streamBatch()
+		if fn, ok := FilterOverlap[step.Filter]; ok {
+			rows += 2 * fn(step.Params)
+		}
+	}
+	return int64(rows) * int64(width) * 4
+}
+
+// streamJob runs the job's row filters over bands of the input and writes
+// every output as the rows come out, so only a few bands are ever held.
+// Outputs carry no ICC profile or GeoTIFF tags; a failed job's partial
+// outputs are removed
+func (p *Processor) streamJob(sj *stageJob, src rowSource, format string) {
+	defer src.Close()
+	size := src.size()
+	sj.format = format
+	sj.srcBounds = image.Rectangle{Max: size}
+	sj.result.Metadata.SourceWidth, sj.result.Metadata.SourceHeight = size.X, size.Y
+	sj.log.WithFields(map[string]interface{}{
+		"width":  size.X,
+		"height": size.Y,
+		"format": format,
+	}).Debug("Streaming image")
+
+	var stream rowStream = src
+	var steps []*streamStep
+	for _, step := range fusePointSteps(sj.job.Steps, sj.job.Outputs) {
+		s := &streamStep{
+			p:      p,
+			sj:     sj,
+			input:  stream,
+			step:   step,
+			filter: FilterRegistry[step.Filter],
+			size:   size,
+		}
+		if fn, ok := FilterOverlap[step.Filter]; ok {
+			s.overlap = fn(step.Params)
+		}
+		stream = s
+		steps = append(steps, s)
+	}
+	defer func() {
+		for _, s := range steps {
+			sj.usage.free(s.held)
+		}
+	}()
+
+	var sinks []rowSink
+	fail := func(err error) {
+		for i, sink := range sinks {
+			sink.Close()
+			os.Remove(sj.job.Outputs[i].Path)
+		}
+		sj.result.Error = err
+	}
+	for _, output := range sj.job.Outputs {
+		sink, err := p.createRowSink(output.Path, size)
+		if err != nil {
+			fail(fmt.Errorf("failed to create output: %w", err))
+			return
+		}
+		sinks = append(sinks, sink)
+	}
+
+	for y := 0; y < size.Y; {
+		if p.stageCancelled(sj) {
+			fail(sj.result.Error)
+			return
+		}
+		rows, err := stream.next(p.streamBatch())
+		if err == nil && len(rows) == 0 {
+			err = fmt.Errorf("image ended at row %d of %d", y, size.Y)
+		}
+		if err != nil {
+			fail(fmt.Errorf("failed to stream image: %w", err))
+			return
+		}
+		start := time.Now()
+		for _, sink := range sinks {
+			if err := sink.write(rows); err != nil {
+				fail(fmt.Errorf("failed to save image: %w", err))
+				return
+			}
+		}
+		sj.usage.since(start)
+		y += len(rows) / (size.X * 4)
+	}
+
+	for i, output := range sj.job.Outputs {
+		if err := sinks[i].Close(); err != nil {
+			fail(fmt.Errorf("failed to save image: %w", err))
+			return
+		}
+		file := models.OutputFile{Name: output.Name, Path: output.Path, Width: size.X, Height: size.Y}
+		if err := p.addOutput(sj, file); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	sj.result.Streamed = true
+	sj.result.Metadata.Width, sj.result.Metadata.Height = size.X, size.Y
+	sj.result.Metadata.Format = format
+	sj.result.Metadata.RowsProcessed = size.Y
+	p.finishJob(sj)
+}
+
+// create the encoder of an output by its extension
+func (p *Processor) createRowSink(path string, size image.Point) (rowSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if encodedFormat(path) == "tiff" {
+		return newTIFFSink(file, size, p.config.TIFFCompression != "none")
+	}
+	return newPNGSink(file, size, pngCompression(p.config.PNGCompression))
+}
+
+// streamStep runs a row filter over the bands of its input, holding the
+// input rows the next band still needs as context
+type streamStep struct {
+	p       *Processor
+	sj      *stageJob
+	input   rowStream
+	step    models.PipelineStep
+	filter  Filter
+	overlap int
+	size    image.Point
+
+	// input rows [start, end), and the next row to produce
+	window     []uint8
+	start, end int
+	y          int
+	// bytes accounted to the job's usage
+	held int64
+}
+
+// filter the next n rows, split into strips run on the row workers
+func (s *streamStep) next(n int) ([]uint8, error) {
+	width, height := s.size.X, s.size.Y
+	if s.y >= height {
+		return nil, nil
+	}
+	rowBytes := width * 4
+	y0, y1 := s.y, min(s.y+n, height)
+	lo, hi := max(0, y0-s.overlap), min(height, y1+s.overlap)
+
+	// drop the rows above the context of this band
+	if lo > s.start {
+		s.window = append([]uint8(nil), s.window[(lo-s.start)*rowBytes:]...)
+		s.start = lo
+	}
+	for s.end < hi {
+		rows, err := s.input.next(hi - s.end)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, fmt.Errorf("step %s: input ended at row %d of %d", s.step.ID, s.end, height)
+		}
+		s.window = append(s.window, rows...)
+		s.end += len(rows) / rowBytes
+	}
+
+	stripHeight := s.p.config.StripHeight
+	out := make([]uint8, (y1-y0)*rowBytes)
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for start := y0; start < y1; start += stripHeight {
+		end := min(start+stripHeight, y1)
+		top, bottom := min(s.overlap, start), min(s.overlap, height-end)
+		strip := models.StripJob{
+			ImageID:  s.sj.job.ID,
+			StartRow: start,
+			EndRow:   end,
+			Top:      top,
+			Bottom:   bottom,
+			Pixels:   s.window[(start-top-s.start)*rowBytes : (end+bottom-s.start)*rowBytes],
+			Width:    width,
+			Filter:   s.step.Filter,
+			Params:   s.step.Params,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := processStrip(strip, s.filter)
+			mu.Lock()
+			defer mu.Unlock()
+			if result.Error != nil {
+				if firstErr == nil {
+					firstErr = result.Error
+				}
+				return
+			}
+			copy(out[(start-y0)*rowBytes:], result.Pixels)
+			s.sj.usage.work(result.Duration)
+			s.sj.usage.strip(s.step.ID, result)
+			s.p.bus.chunk(s.sj.job, result)
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, fmt.Errorf("step %s: %w", s.step.ID, firstErr)
+	}
+
+	held := int64(len(s.window) + len(out))
+	s.sj.usage.alloc(held - s.held)
+	s.held = held
+	s.y = y1
+	return out, nil
+}
+
+// copy n rows of a band reader's buffer, refilling it with fill as it runs
+// out; shared by the PNG and TIFF readers
+type bandBuffer struct {
+	rowBytes int
+	rows     []uint8
+	// rows read so far and in all
+	y, height int
+}
+
+// take up to n rows, calling fill while the buffer is empty
+func (b *bandBuffer) take(n int, fill func() error) ([]uint8, error) {
+	var out bytes.Buffer
+	for n > 0 && b.y < b.height {
+		if len(b.rows) == 0 {
+			if err := fill(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		k := min(n, len(b.rows)/b.rowBytes)
+		out.Write(b.rows[:k*b.rowBytes])
+		b.rows = b.rows[k*b.rowBytes:]
+		b.y += k
+		n -= k
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,434 @@
+package processor
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+)
+
+// PNG color types
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngPalette   = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// pngRows reads a non-interlaced PNG with 8 or 16-bit samples, or an 8-bit
+// palette, a row at a time, inflating the IDAT data as rows are needed
+type pngRows struct {
+	file      *os.File
+	width     int
+	height    int
+	depth     int
+	colorType int
+	palette   [256]color.NRGBA
+	// bytes per pixel of the filtered data
+	bpp  int
+	idat *idatReader
+	z    io.ReadCloser
+	// the previous and current rows, after their filter type byte
+	prev, cur []uint8
+	band      bandBuffer
+}
+
+// samples per pixel of each color type
+var pngSamples = map[int]int{pngGray: 1, pngRGB: 3, pngPalette: 1, pngGrayAlpha: 2, pngRGBA: 4}
+
+// read the chunks up to the first IDAT
+func newPNGRows(file *os.File) (*pngRows, error) {
+	r := &pngRows{file: file}
+	br := bufio.NewReader(file)
+	if _, err := br.Discard(8); err != nil {
+		return nil, err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint32(header[:4]))
+		name := string(header[4:])
+		if name == "IDAT" {
+			r.idat = &idatReader{r: br, left: length}
+			break
+		}
+
+		data := make([]byte, length+4)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		data = data[:length]
+		switch name {
+		case "IHDR":
+			if length != 13 {
+				return nil, fmt.Errorf("bad IHDR length %d", length)
+			}
+			r.width = int(binary.BigEndian.Uint32(data[0:]))
+			r.height = int(binary.BigEndian.Uint32(data[4:]))
+			r.depth, r.colorType = int(data[8]), int(data[9])
+			samples, ok := pngSamples[r.colorType]
+			if data[12] != 0 || !ok || r.width <= 0 || r.height <= 0 {
+				return nil, errStreamUnsupported
+			}
+			switch {
+			case r.colorType == pngPalette && r.depth == 8, r.colorType != pngPalette && (r.depth == 8 || r.depth == 16):
+			default:
+				return nil, errStreamUnsupported
+			}
+			r.bpp = samples * r.depth / 8
+		case "PLTE":
+			for i := 0; i < len(data)/3 && i < 256; i++ {
+				r.palette[i] = color.NRGBA{data[i*3], data[i*3+1], data[i*3+2], 0xff}
+			}
+		case "tRNS":
+			// a transparent color key needs comparing whole samples
+			if r.colorType != pngPalette {
+				return nil, errStreamUnsupported
+			}
+			for i := 0; i < len(data) && i < 256; i++ {
+				r.palette[i].A = data[i]
+			}
+		}
+	}
+	if r.bpp == 0 {
+		return nil, fmt.Errorf("missing IHDR")
+	}
+
+	z, err := zlib.NewReader(r.idat)
+	if err != nil {
+		return nil, err
+	}
+	r.z = z
+	rowBytes := r.width * r.bpp
+	r.prev, r.cur = make([]uint8, rowBytes+1), make([]uint8, rowBytes+1)
+	r.band = bandBuffer{rowBytes: r.width * 4, height: r.height}
+	return r, nil
+}
+
+func (r *pngRows) size() image.Point {
+	return image.Pt(r.width, r.height)
+}
+
+// whether the samples are 16-bit gray, kept at full depth when decoded whole
+func (r *pngRows) gray16() bool {
+	return r.colorType == pngGray && r.depth == 16
+}
+
+func (r *pngRows) Close() error {
+	if r.z != nil {
+		r.z.Close()
+	}
+	return r.file.Close()
+}
+
+func (r *pngRows) next(n int) ([]uint8, error) {
+	return r.band.take(n, r.readRow)
+}
+
+// inflate, unfilter and convert one row into the band
+func (r *pngRows) readRow() error {
+	if _, err := io.ReadFull(r.z, r.cur); err != nil {
+		return fmt.Errorf("reading row %d: %w", r.band.y, err)
+	}
+	row := r.cur[1:]
+	if err := unfilterPNG(r.cur[0], row, r.prev[1:], r.bpp); err != nil {
+		return err
+	}
+
+	out := make([]uint8, r.width*4)
+	for x := 0; x < r.width; x++ {
+		var c color.Color
+		switch r.depth {
+		case 8:
+			s := row[x*r.bpp:]
+			switch r.colorType {
+			case pngGray:
+				c = color.Gray{s[0]}
+			case pngRGB:
+				c = color.RGBA{s[0], s[1], s[2], 0xff}
+			case pngPalette:
+				c = r.palette[s[0]]
+			case pngGrayAlpha:
+				c = color.NRGBA{s[0], s[0], s[0], s[1]}
+			case pngRGBA:
+				c = color.NRGBA{s[0], s[1], s[2], s[3]}
+			}
+		default:
+			s := row[x*r.bpp:]
+			v := func(i int) uint16 { return binary.BigEndian.Uint16(s[i*2:]) }
+			switch r.colorType {
+			case pngGray:
+				c = color.Gray16{v(0)}
+			case pngRGB:
+				c = color.RGBA64{v(0), v(1), v(2), 0xffff}
+			case pngGrayAlpha:
+				c = color.NRGBA64{v(0), v(0), v(0), v(1)}
+			case pngRGBA:
+				c = color.NRGBA64{v(0), v(1), v(2), v(3)}
+			}
+		}
+		// as decoding whole and converting with ImageToRGBA would
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = rgba.R, rgba.G, rgba.B, rgba.A
+	}
+
+	r.prev, r.cur = r.cur, r.prev
+	r.band.rows = out
+	return nil
+}
+
+// undo a row's PNG filter in place, given the unfiltered row above
+func unfilterPNG(filter uint8, row, prev []uint8, bpp int) error {
+	switch filter {
+	case 0:
+	case 1:
+		for i := bpp; i < len(row); i++ {
+			row[i] += row[i-bpp]
+		}
+	case 2:
+		for i := range row {
+			row[i] += prev[i]
+		}
+	case 3:
+		for i := range row {
+			left := 0
+			if i >= bpp {
+				left = int(row[i-bpp])
+			}
+			row[i] += uint8((left + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range row {
+			var a, c int
+			if i >= bpp {
+				a, c = int(row[i-bpp]), int(prev[i-bpp])
+			}
+			row[i] += uint8(paeth(a, int(prev[i]), c))
+		}
+	default:
+		return fmt.Errorf("bad PNG filter %d", filter)
+	}
+	return nil
+}
+
+// the PNG Paeth predictor of left a, above b and upper left c
+func paeth(a, b, c int) int {
+	p := a + b - c
+	pa, pb, pc := abs(p-a), abs(p-b), abs(p-c)
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+// idatReader reads the data of consecutive IDAT chunks as one stream
+type idatReader struct {
+	r    *bufio.Reader
+	left int
+	done bool
+}
+
+func (d *idatReader) Read(p []byte) (int, error) {
+	for d.left == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		// skip the CRC and read the next chunk's header
+		var header [12]byte
+		if _, err := io.ReadFull(d.r, header[:]); err != nil {
+			return 0, err
+		}
+		if string(header[8:]) != "IDAT" {
+			d.done = true
+			return 0, io.EOF
+		}
+		d.left = int(binary.BigEndian.Uint32(header[4:8]))
+	}
+	n, err := d.r.Read(p[:min(len(p), d.left)])
+	d.left -= n
+	return n, err
+}
+
+// pngSink writes rows as an 8-bit RGBA PNG, filtering each row like the
+// standard encoder and deflating into IDAT chunks as they fill
+type pngSink struct {
+	file   *os.File
+	w      *bufio.Writer
+	chunks *chunkWriter
+	z      *zlib.Writer
+	width  int
+	level  png.CompressionLevel
+	// the previous row, and the candidate filtered rows
+	prev     []uint8
+	filtered [5][]uint8
+}
+
+// write the signature and header
+func newPNGSink(file *os.File, size image.Point, level png.CompressionLevel) (*pngSink, error) {
+	s := &pngSink{file: file, w: bufio.NewWriter(file), width: size.X, level: level}
+	s.w.WriteString("\x89PNG\r\n\x1a\n")
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(size.X))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(size.Y))
+	ihdr[8], ihdr[9] = 8, pngRGBA
+	writePNGChunk(s.w, "IHDR", ihdr)
+
+	zlevel := zlib.DefaultCompression
+	switch level {
+	case png.NoCompression:
+		zlevel = zlib.NoCompression
+	case png.BestSpeed:
+		zlevel = zlib.BestSpeed
+	case png.BestCompression:
+		zlevel = zlib.BestCompression
+	}
+	s.chunks = &chunkWriter{w: s.w}
+	z, err := zlib.NewWriterLevel(s.chunks, zlevel)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.z = z
+	s.prev = make([]uint8, size.X*4)
+	for i := range s.filtered {
+		s.filtered[i] = make([]uint8, size.X*4+1)
+	}
+	return s, nil
+}
+
+func (s *pngSink) write(rows []uint8) error {
+	rowBytes := s.width * 4
+	for len(rows) > 0 {
+		row := s.filtered[0][1:]
+		for x := 0; x < s.width; x++ {
+			px := rows[x*4 : x*4+4 : x*4+4]
+			switch px[3] {
+			case 0xff:
+				copy(row[x*4:], px)
+			case 0:
+				copy(row[x*4:], []uint8{0, 0, 0, 0})
+			default:
+				c := color.NRGBAModel.Convert(color.RGBA{px[0], px[1], px[2], px[3]}).(color.NRGBA)
+				row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] = c.R, c.G, c.B, c.A
+			}
+		}
+
+		best := s.filterRow(row)
+		if _, err := s.z.Write(best); err != nil {
+			return err
+		}
+		copy(s.prev, row)
+		rows = rows[rowBytes:]
+	}
+	return nil
+}
+
+// the filtered row with the smallest sum of absolute values, as the
+// standard encoder picks; unfiltered without compression
+func (s *pngSink) filterRow(row []uint8) []uint8 {
+	s.filtered[0][0] = 0
+	if s.level == png.NoCompression {
+		return s.filtered[0]
+	}
+
+	const bpp = 4
+	for f := 1; f < 5; f++ {
+		out := s.filtered[f]
+		out[0] = uint8(f)
+		for i := range row {
+			var a, b, c int
+			if i >= bpp {
+				a, c = int(row[i-bpp]), int(s.prev[i-bpp])
+			}
+			b = int(s.prev[i])
+			switch f {
+			case 1:
+				out[i+1] = row[i] - uint8(a)
+			case 2:
+				out[i+1] = row[i] - uint8(b)
+			case 3:
+				out[i+1] = row[i] - uint8((a+b)/2)
+			case 4:
+				out[i+1] = row[i] - uint8(paeth(a, b, c))
+			}
+		}
+	}
+
+	best, bestSum := 0, -1
+	for f := range s.filtered {
+		sum := 0
+		for _, v := range s.filtered[f][1:] {
+			sum += abs(int(int8(v)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return s.filtered[best]
+}
+
+// flush the compressed data and end the file
+func (s *pngSink) Close() error {
+	err := s.z.Close()
+	if err == nil {
+		err = s.chunks.flush()
+	}
+	if err == nil {
+		writePNGChunk(s.w, "IEND", nil)
+		err = s.w.Flush()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// chunkWriter collects deflated data into IDAT chunks of up to 64 KiB
+type chunkWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= 1<<16 {
+		writePNGChunk(c.w, "IDAT", c.buf[:1<<16])
+		c.buf = append(c.buf[:0], c.buf[1<<16:]...)
+	}
+	return len(p), nil
+}
+
+func (c *chunkWriter) flush() error {
+	if len(c.buf) > 0 {
+		writePNGChunk(c.w, "IDAT", c.buf)
+		c.buf = c.buf[:0]
+	}
+	return nil
+}
+
+// write a chunk with its length and CRC; errors surface on Flush
+func writePNGChunk(w *bufio.Writer, name string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], name)
+	w.Write(header[:])
+	w.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
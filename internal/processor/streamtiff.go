@@ -0,0 +1,525 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+
+	"golang.org/x/image/tiff/lzw"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/tiffmeta"
+)
+
+// TIFF tags read and written by the streaming codecs
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagXResolution     = 282
+	tagYResolution     = 283
+	tagPlanarConfig    = 284
+	tagResolutionUnit  = 296
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+	tagExtraSamples    = 338
+)
+
+// compressions and predictors
+const (
+	tiffNone        = 1
+	tiffLZW         = 5
+	tiffDeflate     = 8
+	tiffDeflateOld  = 32946
+	tiffPackBits    = 32773
+	tiffNoPredictor = 1
+	tiffHorizontal  = 2
+)
+
+// rows in each strip of a streamed TIFF output
+const tiffStripRows = 64
+
+// how the samples of a pixel map onto a color
+const (
+	tiffGray = iota
+	tiffGrayInvert
+	tiffRGB
+	tiffRGBA
+	tiffNRGBA
+)
+
+// tiffRows reads a chunky 8 or 16-bit gray or RGB TIFF a band at a time:
+// a row at a time from strips, or a row of tiles at once
+type tiffRows struct {
+	file      *os.File
+	order     binary.ByteOrder
+	width     int
+	height    int
+	bits      int
+	samples   int
+	mode      int
+	compress  uint32
+	predictor uint32
+	offsets   []uint32
+	counts    []uint32
+	// strip or tile size; strips span the width
+	tiled          bool
+	blockW, blockH int
+	band           bandBuffer
+
+	// the strip being read and its rows left
+	strip     io.Reader
+	closer    io.Closer
+	stripRows int
+}
+
+// read the layout of the first IFD
+func newTIFFRows(file *os.File) (*tiffRows, error) {
+	dir, err := tiffmeta.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	value := func(tag uint16, def uint32) uint32 {
+		if e, ok := dir.Find(tag); ok {
+			if values := dir.Longs(e); len(values) > 0 {
+				return values[0]
+			}
+		}
+		return def
+	}
+	values := func(tag uint16) []uint32 {
+		if e, ok := dir.Find(tag); ok {
+			return dir.Longs(e)
+		}
+		return nil
+	}
+
+	t := &tiffRows{
+		file:      file,
+		order:     dir.Order,
+		width:     int(value(tagImageWidth, 0)),
+		height:    int(value(tagImageLength, 0)),
+		samples:   int(value(tagSamplesPerPixel, 1)),
+		compress:  value(tagCompression, tiffNone),
+		predictor: value(tagPredictor, tiffNoPredictor),
+	}
+	if t.width <= 0 || t.height <= 0 {
+		return nil, fmt.Errorf("missing image size")
+	}
+
+	bits := values(tagBitsPerSample)
+	if len(bits) == 0 || len(bits) != t.samples || value(tagPlanarConfig, 1) != 1 {
+		return nil, errStreamUnsupported
+	}
+	for _, b := range bits {
+		if b != bits[0] || (b != 8 && b != 16) {
+			return nil, errStreamUnsupported
+		}
+	}
+	t.bits = int(bits[0])
+
+	switch photometric := value(tagPhotometric, math.MaxUint32); {
+	case photometric <= 1 && t.samples == 1:
+		t.mode = tiffGray
+		if photometric == 0 {
+			t.mode = tiffGrayInvert
+		}
+	case photometric == 2 && t.samples == 3:
+		t.mode = tiffRGB
+	case photometric == 2 && t.samples == 4 && value(tagExtraSamples, 0) == 1:
+		t.mode = tiffRGBA
+	case photometric == 2 && t.samples == 4 && value(tagExtraSamples, 0) == 2:
+		t.mode = tiffNRGBA
+	default:
+		return nil, errStreamUnsupported
+	}
+	switch t.compress {
+	case tiffNone, tiffLZW, tiffDeflate, tiffDeflateOld, tiffPackBits:
+	default:
+		return nil, errStreamUnsupported
+	}
+	if t.predictor != tiffNoPredictor && t.predictor != tiffHorizontal {
+		return nil, errStreamUnsupported
+	}
+
+	if _, ok := dir.Find(tagTileWidth); ok {
+		t.tiled = true
+		t.blockW, t.blockH = int(value(tagTileWidth, 0)), int(value(tagTileLength, 0))
+		t.offsets, t.counts = values(tagTileOffsets), values(tagTileByteCounts)
+	} else {
+		t.blockW, t.blockH = t.width, int(min(value(tagRowsPerStrip, math.MaxUint32), uint32(t.height)))
+		t.offsets, t.counts = values(tagStripOffsets), values(tagStripByteCounts)
+	}
+	if t.blockW <= 0 || t.blockH <= 0 {
+		return nil, fmt.Errorf("bad block size %dx%d", t.blockW, t.blockH)
+	}
+	across, down := (t.width+t.blockW-1)/t.blockW, (t.height+t.blockH-1)/t.blockH
+	if len(t.offsets) < across*down || len(t.counts) < across*down {
+		return nil, fmt.Errorf("missing offsets of %d blocks", across*down)
+	}
+
+	t.band = bandBuffer{rowBytes: t.width * 4, height: t.height}
+	return t, nil
+}
+
+func (t *tiffRows) size() image.Point {
+	return image.Pt(t.width, t.height)
+}
+
+// whether the samples are 16-bit gray, kept at full depth when decoded whole
+func (t *tiffRows) gray16() bool {
+	return t.bits == 16 && (t.mode == tiffGray || t.mode == tiffGrayInvert)
+}
+
+func (t *tiffRows) Close() error {
+	if t.closer != nil {
+		t.closer.Close()
+	}
+	return t.file.Close()
+}
+
+func (t *tiffRows) next(n int) ([]uint8, error) {
+	if t.tiled {
+		return t.band.take(n, t.readTiles)
+	}
+	return t.band.take(n, t.readRow)
+}
+
+// a decompressing reader of block i
+func (t *tiffRows) block(i int) (io.Reader, io.Closer, error) {
+	section := io.NewSectionReader(t.file, int64(t.offsets[i]), int64(t.counts[i]))
+	switch t.compress {
+	case tiffLZW:
+		r := lzw.NewReader(section, lzw.MSB, 8)
+		return r, r, nil
+	case tiffDeflate, tiffDeflateOld:
+		r, err := zlib.NewReader(section)
+		return r, r, err
+	case tiffPackBits:
+		return &packBits{r: bufio.NewReader(section)}, nil, nil
+	}
+	return section, nil, nil
+}
+
+// read the next row of the current strip, opening the next strip when it
+// runs out
+func (t *tiffRows) readRow() error {
+	y := t.band.y
+	if t.stripRows == 0 {
+		if t.closer != nil {
+			t.closer.Close()
+		}
+		var err error
+		t.strip, t.closer, err = t.block(y / t.blockH)
+		if err != nil {
+			return fmt.Errorf("opening strip at row %d: %w", y, err)
+		}
+		t.stripRows = min(t.blockH, t.height-y)
+	}
+
+	row := make([]uint8, t.width*t.samples*t.bits/8)
+	if _, err := io.ReadFull(t.strip, row); err != nil {
+		return fmt.Errorf("reading row %d: %w", y, err)
+	}
+	t.stripRows--
+	t.band.rows = t.convert(row, t.width)
+	return nil
+}
+
+// read the tiles across the next band, whose rows are tile length apart
+func (t *tiffRows) readTiles() error {
+	y := t.band.y
+	tileRow := y / t.blockH
+	across := (t.width + t.blockW - 1) / t.blockW
+	rows := min(t.blockH, t.height-y)
+	rowBytes := t.width * 4
+	band := make([]uint8, rows*rowBytes)
+
+	tileRowBytes := t.blockW * t.samples * t.bits / 8
+	tile := make([]uint8, t.blockH*tileRowBytes)
+	for i := 0; i < across; i++ {
+		r, closer, err := t.block(tileRow*across + i)
+		if err != nil {
+			return fmt.Errorf("opening tile %d,%d: %w", i, tileRow, err)
+		}
+		_, err = io.ReadFull(r, tile)
+		if closer != nil {
+			closer.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("reading tile %d,%d: %w", i, tileRow, err)
+		}
+
+		// tiles past the right edge are padded
+		x0 := i * t.blockW
+		w := min(t.blockW, t.width-x0)
+		for ty := 0; ty < rows; ty++ {
+			pixels := t.convert(tile[ty*tileRowBytes:(ty+1)*tileRowBytes], t.blockW)
+			copy(band[ty*rowBytes+x0*4:], pixels[:w*4])
+		}
+	}
+	t.band.rows = band
+	return nil
+}
+
+// undo the predictor of a row of n pixels in place and convert it to
+// premultiplied RGBA as decoding whole and ImageToRGBA would
+func (t *tiffRows) convert(row []uint8, n int) []uint8 {
+	if t.predictor == tiffHorizontal {
+		step := t.samples * t.bits / 8
+		if t.bits == 16 {
+			for i := step; i+2 <= n*step; i += 2 {
+				t.order.PutUint16(row[i:], t.order.Uint16(row[i:])+t.order.Uint16(row[i-step:]))
+			}
+		} else {
+			for i := step; i < n*step; i++ {
+				row[i] += row[i-step]
+			}
+		}
+	}
+
+	out := make([]uint8, n*4)
+	for x := 0; x < n; x++ {
+		var c color.Color
+		if t.bits == 8 {
+			s := row[x*t.samples:]
+			switch t.mode {
+			case tiffGray:
+				c = color.Gray{s[0]}
+			case tiffGrayInvert:
+				c = color.Gray{0xff - s[0]}
+			case tiffRGB:
+				c = color.RGBA{s[0], s[1], s[2], 0xff}
+			case tiffRGBA:
+				c = color.RGBA{s[0], s[1], s[2], s[3]}
+			case tiffNRGBA:
+				c = color.NRGBA{s[0], s[1], s[2], s[3]}
+			}
+		} else {
+			s := row[x*t.samples*2:]
+			v := func(i int) uint16 { return t.order.Uint16(s[i*2:]) }
+			switch t.mode {
+			case tiffGray:
+				c = color.Gray16{v(0)}
+			case tiffGrayInvert:
+				c = color.Gray16{0xffff - v(0)}
+			case tiffRGB:
+				c = color.RGBA64{v(0), v(1), v(2), 0xffff}
+			case tiffRGBA:
+				c = color.RGBA64{v(0), v(1), v(2), v(3)}
+			case tiffNRGBA:
+				c = color.NRGBA64{v(0), v(1), v(2), v(3)}
+			}
+		}
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = rgba.R, rgba.G, rgba.B, rgba.A
+	}
+	return out
+}
+
+// packBits expands PackBits runs
+type packBits struct {
+	r *bufio.Reader
+	// bytes left of a literal run, or of a repeated byte
+	literal int
+	repeat  int
+	value   byte
+}
+
+func (p *packBits) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		switch {
+		case p.literal > 0:
+			k, err := p.r.Read(b[n:min(len(b), n+p.literal)])
+			n += k
+			p.literal -= k
+			if err != nil {
+				return n, err
+			}
+		case p.repeat > 0:
+			k := min(len(b)-n, p.repeat)
+			for i := 0; i < k; i++ {
+				b[n+i] = p.value
+			}
+			n += k
+			p.repeat -= k
+		default:
+			header, err := p.r.ReadByte()
+			if err != nil {
+				return n, err
+			}
+			switch code := int8(header); {
+			case code >= 0:
+				p.literal = int(code) + 1
+			case code != -128:
+				if p.value, err = p.r.ReadByte(); err != nil {
+					return n, err
+				}
+				p.repeat = 1 - int(code)
+			}
+		}
+	}
+	return n, nil
+}
+
+// tiffSink writes rows as a little-endian RGBA TIFF of 64-row strips,
+// deflated with the horizontal predictor or uncompressed, with the IFD
+// after the last strip
+type tiffSink struct {
+	file    *os.File
+	w       *bufio.Writer
+	size    image.Point
+	deflate bool
+	// bytes written, and the strips so far
+	offset  int64
+	offsets []uint32
+	counts  []uint32
+	pending []uint8
+}
+
+// write the header, pointing at an IFD filled in on Close
+func newTIFFSink(file *os.File, size image.Point, deflate bool) (*tiffSink, error) {
+	s := &tiffSink{file: file, w: bufio.NewWriter(file), size: size, deflate: deflate}
+	if _, err := s.w.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.offset = 8
+	return s, nil
+}
+
+func (s *tiffSink) write(rows []uint8) error {
+	stripBytes := tiffStripRows * s.size.X * 4
+	s.pending = append(s.pending, rows...)
+	for len(s.pending) >= stripBytes {
+		if err := s.writeStrip(s.pending[:stripBytes]); err != nil {
+			return err
+		}
+		s.pending = s.pending[stripBytes:]
+	}
+	// keep the leftover rows without holding the consumed ones
+	s.pending = append([]uint8(nil), s.pending...)
+	return nil
+}
+
+func (s *tiffSink) writeStrip(strip []uint8) error {
+	data := strip
+	if s.deflate {
+		rowBytes := s.size.X * 4
+		diff := make([]uint8, len(strip))
+		for i := range strip {
+			diff[i] = strip[i]
+			if i%rowBytes >= 4 {
+				diff[i] -= strip[i-4]
+			}
+		}
+		var buf bytes.Buffer
+		z := zlib.NewWriter(&buf)
+		z.Write(diff)
+		if err := z.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	if s.offset+int64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("TIFF output exceeds 4 GiB")
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, uint32(s.offset))
+	s.counts = append(s.counts, uint32(len(data)))
+	s.offset += int64(len(data))
+	return nil
+}
+
+// write the last strip and the IFD, and point the header at it
+func (s *tiffSink) Close() error {
+	err := s.finish()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *tiffSink) finish() error {
+	if len(s.pending) > 0 {
+		if err := s.writeStrip(s.pending); err != nil {
+			return err
+		}
+		s.pending = nil
+	}
+	if s.offset%2 == 1 {
+		s.w.WriteByte(0)
+		s.offset++
+	}
+
+	order := binary.LittleEndian
+	short := func(tag uint16, values ...uint16) tiffmeta.Entry {
+		return tiffmeta.ShortsEntry(order, tag, values)
+	}
+	long := func(tag uint16, values ...uint32) tiffmeta.Entry {
+		return tiffmeta.LongsEntry(order, tag, values)
+	}
+	resolution := make([]byte, 8)
+	order.PutUint32(resolution, 72)
+	order.PutUint32(resolution[4:], 1)
+	rational := func(tag uint16) tiffmeta.Entry {
+		return tiffmeta.Entry{Tag: tag, Type: tiffmeta.TypeRational, Count: 1, Data: resolution}
+	}
+
+	compression, predictor := uint16(tiffNone), uint16(tiffNoPredictor)
+	if s.deflate {
+		compression, predictor = tiffDeflate, tiffHorizontal
+	}
+	entries := []tiffmeta.Entry{
+		long(tagImageWidth, uint32(s.size.X)),
+		long(tagImageLength, uint32(s.size.Y)),
+		short(tagBitsPerSample, 8, 8, 8, 8),
+		short(tagCompression, compression),
+		short(tagPhotometric, 2),
+		long(tagStripOffsets, s.offsets...),
+		short(tagSamplesPerPixel, 4),
+		long(tagRowsPerStrip, tiffStripRows),
+		long(tagStripByteCounts, s.counts...),
+		rational(tagXResolution),
+		rational(tagYResolution),
+		short(tagPlanarConfig, 1),
+		short(tagResolutionUnit, 2),
+		short(tagPredictor, predictor),
+		// associated alpha, as the pixels are premultiplied
+		short(tagExtraSamples, 1),
+	}
+	ifd := tiffmeta.MarshalIFD(order, entries, uint32(s.offset), 0)
+	if s.offset+int64(len(ifd)) > math.MaxUint32 {
+		return fmt.Errorf("TIFF output exceeds 4 GiB")
+	}
+	if _, err := s.w.Write(ifd); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	order.PutUint32(header, uint32(s.offset))
+	_, err := s.file.WriteAt(header, 4)
+	return err
+}
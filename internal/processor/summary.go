@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"sort"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Summary describes the images a run processed: latency percentiles,
+// throughput and how much the outputs shrank or grew
+type Summary struct {
+	Processed        int
+	P50              time.Duration
+	P90              time.Duration
+	P99              time.Duration
+	ImagesPerSec     float64
+	MBPerSec         float64
+	Pixels           int64
+	InputBytes       int64
+	OutputBytes      int64
+	CompressionRatio float64
+	// time spent in each stage by every image together, see
+	// models.StageTimings
+	Decode time.Duration
+	Filter time.Duration
+	Encode time.Duration
+	Write  time.Duration
+}
+
+// Summarize the successful results of a run that took elapsed. Resumed
+// and up-to-date results did no work in this run and are left out; cache hits count as
+// processed but decode no pixels
+func Summarize(results []models.ProcessingResult, elapsed time.Duration) Summary {
+	var s Summary
+	var times []time.Duration
+
+	for _, result := range results {
+		if result.Error != nil || result.Resumed || result.UpToDate || result.DuplicateOf != "" {
+			continue
+		}
+		s.Processed++
+		times = append(times, result.ProcessingTime)
+		s.Pixels += int64(result.Metadata.SourceWidth) * int64(result.Metadata.SourceHeight)
+		s.InputBytes += result.Metadata.OriginalSize
+		for _, output := range result.Outputs {
+			s.OutputBytes += output.Size
+		}
+		timings := result.Metadata.Timings
+		s.Decode += timings.Decode
+		for _, step := range timings.Steps {
+			s.Filter += step.Duration
+		}
+		s.Encode += timings.Encode
+		s.Write += timings.Write
+	}
+	if s.Processed == 0 {
+		return s
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	s.P50 = percentile(times, 50)
+	s.P90 = percentile(times, 90)
+	s.P99 = percentile(times, 99)
+
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		s.ImagesPerSec = float64(s.Processed) / seconds
+		s.MBPerSec = float64(s.InputBytes) / (1 << 20) / seconds
+	}
+	if s.OutputBytes > 0 {
+		s.CompressionRatio = float64(s.InputBytes) / float64(s.OutputBytes)
+	}
+	return s
+}
+
+// nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
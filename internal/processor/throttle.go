@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Throttle spreads work out to a rate in units per second, such as images
+// or bytes, letting a second's worth through at once. Each caller waits
+// for the units it takes, so work larger than a second's worth waits for
+// what it overdraws. A nil throttle doesn't limit
+type Throttle struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// create throttle, returns nil when rate is not positive
+func NewThrottle(rate float64) *Throttle {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := math.Max(rate, 1)
+	return &Throttle{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n units, blocking until the rate allows them or ctx is done
+func (t *Throttle) Wait(ctx context.Context, n float64) error {
+	if t == nil || n <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= n
+	wait := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hold a job until the image rate admits it and the disk rate admits
+// reading its input. Returns an error only when ctx is done
+func (wp *WorkerPool) throttleInput(ctx context.Context, path string) error {
+	if err := wp.images.Wait(ctx, 1); err != nil {
+		return err
+	}
+	if wp.io == nil {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		// the decode stage reports it
+		return nil
+	}
+	return wp.io.Wait(ctx, float64(info.Size()))
+}
+
+// charge the outputs a job wrote to the disk rate, holding the worker that
+// wrote them until the rate allows more
+func (wp *WorkerPool) throttleOutputs(ctx context.Context, sj *stageJob) {
+	var written int64
+	for _, output := range sj.result.Outputs {
+		written += output.Size
+	}
+	wp.io.Wait(ctx, float64(written))
+}
@@ -0,0 +1,207 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Tiles compares each image in the input directory with the file of the same
+// relative path in the compare directory, re-processes only the tiles of the
+// new version that changed and returns a manifest describing them
+func (p *Processor) Tiles(ctx context.Context, baseline, compare []string) (models.TileReport, error) {
+	report := models.TileReport{
+		TileSize: p.config.TileSize,
+		Filter:   models.FilterType(p.pipelineName()),
+	}
+
+	pairs, err := pairFiles(p.config.InputDir, baseline, p.config.CompareDir, compare)
+	if err != nil {
+		return report, err
+	}
+
+	p.logger.WithFields(map[string]interface{}{
+		"pairs":     len(pairs),
+		"tile_size": p.config.TileSize,
+	}).Info("Starting tile change detection")
+
+	manifests := make([]models.TileManifest, len(pairs))
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+
+	for i, pair := range pairs {
+		wg.Add(1)
+		go func(i int, pair filePair) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				manifests[i] = models.TileManifest{Name: pair.name, Status: models.DiffError, Error: ctx.Err().Error()}
+				return
+			}
+
+			manifests[i] = p.tilePair(ctx, pair)
+		}(i, pair)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	report.Images = manifests
+	return report, nil
+}
+
+// detect and emit changed tiles for one pair; when dimensions differ every
+// tile of the new version is emitted
+func (p *Processor) tilePair(ctx context.Context, pair filePair) models.TileManifest {
+	manifest := models.TileManifest{Name: pair.name}
+
+	ctx, cancel := p.jobContext(ctx)
+	defer cancel()
+
+	switch {
+	case pair.compare == "":
+		manifest.Status = models.DiffMissing
+		return manifest
+	case pair.baseline == "":
+		// a new image has no previous version, so all of it is new
+		manifest.Full = true
+	}
+
+	fail := func(err error) models.TileManifest {
+		manifest.Status = models.DiffError
+		manifest.Error = err.Error()
+		return manifest
+	}
+
+	afterImg, _, err := p.loadImage(pair.compare)
+	if err != nil {
+		return fail(fmt.Errorf("failed to load comparison: %w", err))
+	}
+	after := ImageToRGBA(afterImg)
+
+	var before *image.RGBA
+	if !manifest.Full {
+		beforeImg, _, err := p.loadImage(pair.baseline)
+		if err != nil {
+			return fail(fmt.Errorf("failed to load baseline: %w", err))
+		}
+		before = ImageToRGBA(beforeImg)
+		manifest.Full = before.Bounds().Size() != after.Bounds().Size()
+	}
+
+	bounds := after.Bounds()
+	size := p.config.TileSize
+	columns := (bounds.Dx() + size - 1) / size
+	rows := (bounds.Dy() + size - 1) / size
+	manifest.Width, manifest.Height = bounds.Dx(), bounds.Dy()
+	manifest.TotalTiles = columns * rows
+
+	// a neighborhood filter carries a change into the tiles around it, so
+	// each tile is compared with the context the pipeline reads
+	overlap := 0
+	for _, step := range p.steps {
+		if fn, ok := FilterOverlap[step.Filter]; ok {
+			overlap += fn(step.Params)
+		}
+	}
+	area := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+
+	var changed []image.Rectangle
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns; column++ {
+			rect := image.Rect(column*size, row*size, min((column+1)*size, bounds.Dx()), min((row+1)*size, bounds.Dy()))
+			if manifest.Full || tileChanged(before, after, rect.Inset(-overlap).Intersect(area), p.config.DiffThreshold) {
+				changed = append(changed, rect)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		manifest.Status = models.DiffUnchanged
+		return manifest
+	}
+
+	// the whole image is filtered, not each tile, so neighborhood filters
+	// see across tile edges and filters such as round-corners apply to the
+	// image rather than to every tile
+	job := models.ImageJob{
+		ID:      pair.name,
+		Filter:  models.FilterType(p.pipelineName()),
+		Params:  p.filterParams(),
+		Steps:   p.steps,
+		Outputs: p.jobOutputs(pair.compare, p.config.OutputDir)[:1],
+	}
+	nodes, err := p.runPipeline(ctx, job, after, nil, nil, p.logger)
+	if err != nil {
+		return fail(err)
+	}
+	// tiles are emitted from the first output of the pipeline
+	processed := nodes[job.Outputs[0].From].img
+	if processed.Bounds().Size() != bounds.Size() {
+		return fail(fmt.Errorf("the pipeline changed the image size from %dx%d to %dx%d, so tiles can't be cut from it",
+			bounds.Dx(), bounds.Dy(), processed.Bounds().Dx(), processed.Bounds().Dy()))
+	}
+	name := strings.TrimSuffix(pair.name, filepath.Ext(pair.name))
+
+	for _, rect := range changed {
+		column, row := rect.Min.X/size, rect.Min.Y/size
+		tile := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		draw.Draw(tile, tile.Bounds(), processed, processed.Bounds().Min.Add(rect.Min), draw.Src)
+
+		path := filepath.Join(p.config.OutputDir, name, fmt.Sprintf("%d_%d.png", column, row))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fail(err)
+		}
+		if err := p.saveImage(tile, path, "png", p.config.Quality); err != nil {
+			return fail(fmt.Errorf("failed to save tile: %w", err))
+		}
+
+		manifest.Tiles = append(manifest.Tiles, models.TileChange{
+			Column: column,
+			Row:    row,
+			X:      rect.Min.X,
+			Y:      rect.Min.Y,
+			Width:  rect.Dx(),
+			Height: rect.Dy(),
+			Path:   path,
+		})
+	}
+
+	if pair.baseline == "" {
+		manifest.Status = models.DiffAdded
+	} else {
+		manifest.Status = models.DiffChanged
+	}
+
+	return manifest
+}
+
+// report whether any channel of any pixel in rect differs by more than threshold
+func tileChanged(before, after *image.RGBA, rect image.Rectangle, threshold int) bool {
+	bb, ab := before.Bounds(), after.Bounds()
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := before.PixOffset(bb.Min.X+rect.Min.X, bb.Min.Y+y)
+		j := after.PixOffset(ab.Min.X+rect.Min.X, ab.Min.Y+y)
+
+		for n := 0; n < rect.Dx()*4; n++ {
+			d := int(before.Pix[i+n]) - int(after.Pix[j+n])
+			if d > threshold || -d > threshold {
+				return true
+			}
+		}
+	}
+
+	return false
+}
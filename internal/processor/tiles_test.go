@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+func writePNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the tiles of a blurred image are those of the whole image blurred, and
+// include the tiles a change blurs into
+func TestTilesBlurWithoutSeams(t *testing.T) {
+	dir := t.TempDir()
+	in, compare, out := filepath.Join(dir, "v1"), filepath.Join(dir, "v2"), filepath.Join(dir, "out")
+	for _, d := range []string{in, compare} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for i := range before.Pix {
+		before.Pix[i] = uint8(i * 37)
+		if i%4 == 3 {
+			before.Pix[i] = 255
+		}
+	}
+	after := image.NewRGBA(before.Rect)
+	copy(after.Pix, before.Pix)
+	// next to the edge of tile 1,1, within a blur of tile 0,1
+	after.Set(8, 12, color.RGBA{255, 0, 0, 255})
+	writePNG(t, filepath.Join(in, "map.png"), before)
+	writePNG(t, filepath.Join(compare, "map.png"), after)
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Mode = "tiles"
+	cfg.InputDir, cfg.CompareDir, cfg.OutputDir = in, compare, out
+	cfg.Filter = "blur"
+	cfg.BlurRadius = 2
+	cfg.TileSize = 8
+	cfg.OutputFormat = "png"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(WithConfig(cfg), WithLogger(logger.NewLoggerWithOutput(false, "text", io.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := p.Tiles(context.Background(), []string{filepath.Join(in, "map.png")}, []string{filepath.Join(compare, "map.png")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := report.Images[0]
+	if manifest.Status != models.DiffChanged {
+		t.Fatalf("status %s (%s), want changed", manifest.Status, manifest.Error)
+	}
+	var tiles [][2]int
+	for _, tile := range manifest.Tiles {
+		tiles = append(tiles, [2]int{tile.Column, tile.Row})
+	}
+	if len(tiles) != 2 || tiles[0] != [2]int{0, 1} || tiles[1] != [2]int{1, 1} {
+		t.Fatalf("tiles %v, want 0,1 and 1,1", tiles)
+	}
+
+	want := ApplyBlur(after.Pix, 32, models.FilterParams{BlurRadius: 2})
+	for _, tile := range manifest.Tiles {
+		file, err := os.Open(tile.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ImageToRGBA(img)
+		for y := 0; y < tile.Height; y++ {
+			for x := 0; x < tile.Width; x++ {
+				i := ((tile.Y+y)*32 + tile.X + x) * 4
+				if c := got.RGBAAt(x, y); c != (color.RGBA{want[i], want[i+1], want[i+2], want[i+3]}) {
+					t.Fatalf("tile %d,%d pixel %d,%d is %v, want %v", tile.Column, tile.Row, x, y, c, want[i:i+4])
+				}
+			}
+		}
+	}
+}
+
+func TestTilesRejectsResizing(t *testing.T) {
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Mode = "tiles"
+	cfg.CompareDir = "v2"
+	cfg.Filter = "resize"
+	cfg.ResizeWidth = 100
+	if err := cfg.Validate(); err == nil {
+		t.Error("tiles mode accepted a resize")
+	}
+}
@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/tracing"
+)
+
+// tracer exporting spans to trace_file, or one recording nothing
+func newTracer(path string) (tracing.Tracer, error) {
+	if path == "" {
+		return tracing.Noop, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// the file stays open for the life of the process; spans are written
+	// whole as they end
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return tracing.NewJSONTracer(file), nil
+}
+
+// Tracer returns the tracer jobs are instrumented with
+func (p *Processor) Tracer() tracing.Tracer {
+	return p.tracer
+}
+
+// start the span covering a job from decode to its result, as a child of
+// the span the job was submitted under. It ends when the job's context is
+// cancelled, which happens once its result is emitted
+func (p *Processor) startJobSpan(sj *stageJob) {
+	if sc, ok := tracing.ParseTraceParent(sj.job.TraceParent); ok {
+		sj.ctx = tracing.ContextWithSpanContext(sj.ctx, sc)
+	}
+
+	var span tracing.Span
+	sj.ctx, span = p.tracer.Start(sj.ctx, "job")
+	span.SetAttribute("job_id", sj.job.ID)
+	span.SetAttribute("input_path", sj.job.InputPath)
+	span.SetAttribute("pipeline", string(sj.job.Filter))
+	if !sj.job.SubmittedAt.IsZero() {
+		span.SetAttribute("queued_at", sj.job.SubmittedAt)
+	}
+
+	cancel := sj.cancel
+	sj.cancel = func() {
+		span.SetAttribute("cached", sj.result.Cached)
+		span.SetAttribute("outputs", len(sj.result.Outputs))
+		endSpan(span, sj.result.Error)
+		cancel()
+	}
+}
+
+// end a stage's span, recording err if it failed
+func endSpan(span tracing.Span, err error) {
+	span.RecordError(err)
+	span.End()
+}
@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// whether a step leaves an image of the given size exactly as it is: a
+// resize to its own size, a crop of all of it, a point filter whose table
+// maps every level to itself or a blur of radius 0
+func identityStep(step models.PipelineStep, size image.Point) bool {
+	bounds := image.Rectangle{Max: size}
+	switch step.Filter {
+	case models.FilterResize:
+		return ResizeTarget(bounds, step.Params) == size
+	case models.FilterCrop:
+		return CropRect(bounds, step.Params) == bounds
+	case models.FilterBlur:
+		return int(step.Params.BlurRadius) <= 0
+	}
+	table := step.Params.Table
+	if table == nil {
+		return false
+	}
+	for level, mapped := range table {
+		if int(mapped) != level {
+			return false
+		}
+	}
+	return true
+}
+
+// whether every output of a job is the input unchanged: written in the
+// input's format from a step reached only through identity steps
+func unchangedJob(job models.ImageJob, size image.Point, format string) bool {
+	steps := map[string]models.PipelineStep{}
+	for _, step := range job.Steps {
+		steps[step.ID] = step
+	}
+	for _, output := range job.Outputs {
+		if encodedFormat(output.Path) != format {
+			return false
+		}
+		for id := output.From; id != config.SourceNode; {
+			step, ok := steps[id]
+			if !ok || !identityStep(step, size) {
+				return false
+			}
+			id = step.Input
+		}
+	}
+	return true
+}
+
+// copy or hard link the input to every output when the pipeline would
+// leave its pixels unchanged, sparing the decode and a lossy re-encode.
+// Returns false, with nothing written, when the job has to run
+func (p *Processor) copyUnchanged(sj *stageJob) bool {
+	if p.config.UnchangedOutputs == "encode" || p.qualityTarget() {
+		return false
+	}
+	file, err := os.Open(sj.job.InputPath)
+	if err != nil {
+		return false
+	}
+	cfg, format, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		return false
+	}
+	size := image.Pt(cfg.Width, cfg.Height)
+	if !unchangedJob(sj.job, size, format) {
+		return false
+	}
+
+	for _, output := range sj.job.Outputs {
+		if err := p.copyInput(sj.job.InputPath, output.Path); err != nil {
+			sj.result.Error = fmt.Errorf("failed to copy unchanged image: %w", err)
+			return true
+		}
+		file := models.OutputFile{Name: output.Name, Path: output.Path, Width: size.X, Height: size.Y}
+		if err := p.addOutput(sj, file); err != nil {
+			sj.result.Error = err
+			return true
+		}
+	}
+
+	sj.log.WithField("mode", p.config.UnchangedOutputs).Debug("Pipeline leaves image unchanged, copying input")
+	sj.result.Unchanged = true
+	sj.format = format
+	sj.result.Metadata.SourceWidth, sj.result.Metadata.SourceHeight = size.X, size.Y
+	sj.result.Metadata.Width, sj.result.Metadata.Height = size.X, size.Y
+	sj.result.Metadata.Format = format
+	p.finishJob(sj)
+	return true
+}
+
+// replace path with a hard link to the input under unchanged_outputs: link,
+// or a copy of it; links across file systems fall back to copies
+func (p *Processor) copyInput(input, path string) error {
+	if in, err := os.Stat(input); err == nil {
+		if out, err := os.Stat(path); err == nil && os.SameFile(in, out) {
+			return nil
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if p.config.UnchangedOutputs == "link" && os.Link(input, path) == nil {
+		return nil
+	}
+	return copyFile(input, path)
+}
@@ -0,0 +1,204 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// accounts the resources of one job across the goroutines that work on it
+type jobUsage struct {
+	mu      sync.Mutex
+	live    int64
+	peak    int64
+	busy    time.Duration
+	gcCount int64
+	gcPause time.Duration
+
+	// time of each stage, with the strips of row filters when strips is
+	// set. Strips recorded with no step belong to the step running
+	timings models.StageTimings
+	strips  bool
+}
+
+type usageKey struct{}
+
+// start accounting a job, noting the collections run so far, and
+// recording each strip's time if strips is set
+func newJobUsage(strips bool) *jobUsage {
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+	return &jobUsage{gcCount: stats.NumGC, gcPause: stats.PauseTotal, strips: strips}
+}
+
+func withUsage(ctx context.Context, u *jobUsage) context.Context {
+	return context.WithValue(ctx, usageKey{}, u)
+}
+
+// the usage of the job ctx belongs to; nil, which records nothing, outside
+// of a job
+func usageFrom(ctx context.Context) *jobUsage {
+	u, _ := ctx.Value(usageKey{}).(*jobUsage)
+	return u
+}
+
+// record n bytes of pixel buffers allocated by the job
+func (u *jobUsage) alloc(n int64) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.live += n
+	u.peak = max(u.peak, u.live)
+	u.mu.Unlock()
+}
+
+// record n bytes of pixel buffers released by the job
+func (u *jobUsage) free(n int64) {
+	u.alloc(-n)
+}
+
+// record time a goroutine spent working on the job
+func (u *jobUsage) work(d time.Duration) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.busy += d
+	u.mu.Unlock()
+}
+
+// record the time since start as work
+func (u *jobUsage) since(start time.Time) {
+	u.work(time.Since(start))
+}
+
+// record the time since start as the job's decode
+func (u *jobUsage) decoded(start time.Time) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.timings.Decode += time.Since(start)
+	u.mu.Unlock()
+}
+
+// record the time since start as a pipeline step, and the strips filtered
+// since the last step as its own
+func (u *jobUsage) step(step models.PipelineStep, start time.Time) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.timings.Steps = append(u.timings.Steps, models.StepTiming{ID: step.ID, Filter: step.Filter, Duration: time.Since(start)})
+	for i := range u.timings.Strips {
+		if u.timings.Strips[i].Step == "" {
+			u.timings.Strips[i].Step = step.ID
+		}
+	}
+}
+
+// record a filtered strip of the given step, "" for the one running
+func (u *jobUsage) strip(step string, strip models.StripResult) {
+	if u == nil || !u.strips {
+		return
+	}
+	u.mu.Lock()
+	u.timings.Strips = append(u.timings.Strips, models.StripTiming{
+		Step:     step,
+		StartRow: strip.StartRow,
+		EndRow:   strip.EndRow,
+		Duration: strip.Duration,
+	})
+	u.mu.Unlock()
+}
+
+// record time spent encoding an output and writing its bytes
+func (u *jobUsage) encoded(encode, write time.Duration) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.timings.Encode += encode
+	u.timings.Write += write
+	u.mu.Unlock()
+}
+
+// the job's stage timings so far
+func (u *jobUsage) stageTimings() models.StageTimings {
+	if u == nil {
+		return models.StageTimings{}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	timings := u.timings
+	timings.Steps = append([]models.StepTiming(nil), u.timings.Steps...)
+	timings.Strips = append([]models.StripTiming(nil), u.timings.Strips...)
+	return timings
+}
+
+// the job's usage so far, with the collections run since it started
+func (u *jobUsage) result() models.ResourceUsage {
+	if u == nil {
+		return models.ResourceUsage{}
+	}
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return models.ResourceUsage{
+		PeakMemory: u.peak,
+		CPUTime:    u.busy,
+		GCCycles:   stats.NumGC - u.gcCount,
+		GCPause:    stats.PauseTotal - u.gcPause,
+	}
+}
+
+// bytes of an image's pixel buffers, for the decoded types
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.RGBA64:
+		return int64(len(img.Pix))
+	case *image.NRGBA64:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.Gray16:
+		return int64(len(img.Pix))
+	case *image.CMYK:
+		return int64(len(img.Pix))
+	case *image.Paletted:
+		return int64(len(img.Pix))
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	case *image.NYCbCrA:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr) + len(img.A))
+	case nil:
+		return 0
+	}
+	return int64(img.Bounds().Dx()) * int64(img.Bounds().Dy()) * 4
+}
+
+// a writer adding the time spent in its Write calls to d
+type timedWriter struct {
+	w io.Writer
+	d time.Duration
+}
+
+func (t *timedWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(b)
+	t.d += time.Since(start)
+	return n, err
+}
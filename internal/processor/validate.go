@@ -0,0 +1,158 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+)
+
+// Validate decodes every image without writing anything and reports corrupt
+// or truncated files, files whose contents don't match their extension, and
+// the dimensions of those that decode
+func (p *Processor) Validate(ctx context.Context, imagePaths []string) (models.ValidationReport, error) {
+	report := models.ValidationReport{
+		InputDir: p.config.InputDir,
+		Summary:  map[string]int{},
+	}
+
+	p.logger.WithField("count", len(imagePaths)).Info("Starting image validation")
+
+	results := make([]models.ValidationResult, len(imagePaths))
+	sem := make(chan struct{}, p.config.Workers)
+	var wg sync.WaitGroup
+
+	for i, path := range imagePaths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = models.ValidationResult{Path: path, Status: models.ValidationCorrupt, Error: ctx.Err().Error()}
+				return
+			}
+
+			results[i] = p.validateImage(path)
+		}(i, path)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	report.Results = results
+	for _, r := range results {
+		report.Summary[r.Status]++
+	}
+
+	return report, nil
+}
+
+// sniff and fully decode one file
+func (p *Processor) validateImage(path string) models.ValidationResult {
+	result := models.ValidationResult{
+		Path:            path,
+		ExtensionFormat: extensionFormats[strings.ToLower(filepath.Ext(path))],
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		result.Size = info.Size()
+	}
+
+	header := make([]byte, 512)
+	file, err := os.Open(path)
+	if err != nil {
+		result.Status, result.Error = models.ValidationCorrupt, err.Error()
+		return result
+	}
+	n, _ := io.ReadFull(file, header)
+	file.Close()
+
+	result.Format = sniffFormat(header[:n])
+	if result.Format == "" {
+		result.Status, result.Error = models.ValidationCorrupt, "unrecognized file signature"
+		return result
+	}
+
+	// decode with the decoder for the actual contents, so a misnamed file
+	// still reports its dimensions
+	img, _, err := p.loadImageAs(path, formatExtensions[result.Format])
+	if err != nil {
+		result.Status, result.Error = models.ValidationCorrupt, err.Error()
+		return result
+	}
+	result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	if result.Format != result.ExtensionFormat {
+		result.Status = models.ValidationMismatched
+	} else {
+		result.Status = models.ValidationValid
+	}
+	return result
+}
+
+// format implied by each supported extension
+var extensionFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".bmp":  "bmp",
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".webp": "webp",
+	".dcm":  "dicom",
+	".fits": "fits",
+	".fit":  "fits",
+	".fts":  "fits",
+}
+
+// extension whose decoder reads each format
+var formatExtensions = map[string]string{
+	"jpeg":  ".jpg",
+	"png":   ".png",
+	"gif":   ".gif",
+	"bmp":   ".bmp",
+	"tiff":  ".tif",
+	"webp":  ".webp",
+	"dicom": ".dcm",
+	"fits":  ".fits",
+}
+
+// format of a file from its leading bytes, "" if unrecognized
+func sniffFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff}):
+		return "jpeg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(header, []byte("BM")):
+		return "bmp"
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "tiff"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return "webp"
+	case len(header) >= 132 && bytes.Equal(header[128:132], []byte("DICM")):
+		return "dicom"
+	case bytes.HasPrefix(header, []byte("SIMPLE  =")):
+		return "fits"
+	}
+	return ""
+}
+
+// DetectExtension returns the extension whose decoder reads a file starting
+// with header, "" if the format isn't supported
+func DetectExtension(header []byte) string {
+	return formatExtensions[sniffFormat(header)]
+}
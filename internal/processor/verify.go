@@ -0,0 +1,67 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/ssim"
+)
+
+// verifyOutput re-decodes a written output and checks it against the pixels
+// that were encoded: the file must decode in the format its extension names,
+// with the same dimensions, within validate_max_size, and with an SSIM of at
+// least validate_min_ssim
+func (p *Processor) verifyOutput(path string, encoded image.Image) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if p.config.ValidateMaxSize > 0 && info.Size() > p.config.ValidateMaxSize {
+		return fmt.Errorf("size %d exceeds maximum %d", info.Size(), p.config.ValidateMaxSize)
+	}
+
+	decoded, format, err := p.loadImage(path)
+	if err != nil {
+		return fmt.Errorf("output does not decode: %w", err)
+	}
+	if expected := encodedFormat(path); format != expected {
+		return fmt.Errorf("decoded as %s, expected %s", format, expected)
+	}
+	if decoded.Bounds().Size() != encoded.Bounds().Size() {
+		return fmt.Errorf("dimensions %dx%d, expected %dx%d",
+			decoded.Bounds().Dx(), decoded.Bounds().Dy(), encoded.Bounds().Dx(), encoded.Bounds().Dy())
+	}
+
+	if p.config.ValidateMinSSIM > 0 {
+		// JPEG is written flattened, so compare against the flattened pixels
+		reference := encoded
+		if format == "jpeg" && p.background != nil {
+			reference = p.background.Composite(encoded)
+		}
+
+		score, err := ssim.Luma(reference, decoded)
+		if err != nil {
+			return err
+		}
+		if score < p.config.ValidateMinSSIM {
+			return fmt.Errorf("SSIM %.4f below minimum %.4f", score, p.config.ValidateMinSSIM)
+		}
+	}
+
+	return nil
+}
+
+// format saveImage writes for the extension of path
+func encodedFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".tif", ".tiff":
+		return "tiff"
+	default:
+		return "png"
+	}
+}
@@ -2,109 +2,623 @@ package processor
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/arsalan9702/concurrent-image-processor/internal/models"
 	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
 )
 
-// manage pool of workers for jobs
+// ErrSkipped is the error of results for images that were never started
+// because the pool was draining
+var ErrSkipped = errors.New("skipped while draining")
+
+// PoolSizes sets the number of workers in each pipeline stage
+type PoolSizes struct {
+	Decode int `json:"decode"`
+	Filter int `json:"filter"`
+	Encode int `json:"encode"`
+}
+
+// PoolStats is a snapshot of the worker pool for diagnosing stalls: jobs
+// waiting between stages, jobs each stage is working on, and memory use
+type PoolStats struct {
+	Workers      PoolSizes `json:"workers"`
+	Queued       int       `json:"queued"`
+	Decoded      int       `json:"decoded"`
+	Filtered     int       `json:"filtered"`
+	Results      int       `json:"results"`
+	Decoding     int64     `json:"decoding"`
+	Filtering    int64     `json:"filtering"`
+	Encoding     int64     `json:"encoding"`
+	Completed    int64     `json:"completed"`
+	MemoryInUse  int64     `json:"memory_in_use"`
+	MemoryBudget int64     `json:"memory_budget"`
+	Draining     bool      `json:"draining"`
+	Paused       bool      `json:"paused"`
+}
+
+// manage pool of workers for jobs. Jobs flow through a decode, a filter and
+// an encode stage connected by bounded channels, so slow reads and writes
+// don't hold up pixel work
 type WorkerPool struct {
-	workerCount int
-	jobQueue    chan models.ImageJob
+	sizes       PoolSizes
+	queues      [3]chan models.ImageJob // by priority, see priorityRank
+	decoded     chan *stageJob
+	filtered    chan *stageJob
 	resultQueue chan models.ProcessingResult
-	rowResults  chan models.RowResult
 	quit        chan bool
+	draining    chan struct{}
+	drainOnce   sync.Once
 	wg          sync.WaitGroup
 	logger      logger.Logger
 	processor   *Processor
+	memory      *MemoryGate
+	// set by Start, for Resize
+	stagesMu sync.Mutex
+	ctx      context.Context
+	stages   [3]*poolStage
+	// limits on images started and bytes read and written per second
+	images *Throttle
+	io     *Throttle
+
+	// jobs in each stage and results emitted, for Stats
+	decoding  atomic.Int64
+	filtering atomic.Int64
+	encoding  atomic.Int64
+	completed atomic.Int64
+
+	// closed while the pool runs, open while Pause holds decode workers
+	pauseMu sync.Mutex
+	resumed chan struct{}
 }
 
 // create new worker pool
-func NewWorkerPool(workerCount int, bufferSize int, log logger.Logger, processor *Processor) *WorkerPool {
-	return &WorkerPool{
-		workerCount: workerCount,
-		jobQueue:    make(chan models.ImageJob, bufferSize),
+func NewWorkerPool(sizes PoolSizes, bufferSize int, memoryBudget int64, log logger.Logger, processor *Processor) *WorkerPool {
+	wp := &WorkerPool{
+		sizes: sizes,
+		// hand-off channels hold one job per downstream worker, which keeps
+		// decoded images from piling up ahead of a slower stage
+		decoded:     make(chan *stageJob, sizes.Filter),
+		filtered:    make(chan *stageJob, sizes.Encode),
 		resultQueue: make(chan models.ProcessingResult, bufferSize),
-		rowResults:  make(chan models.RowResult, bufferSize*10),
 		quit:        make(chan bool),
+		draining:    make(chan struct{}),
+		resumed:     make(chan struct{}),
 		logger:      log,
 		processor:   processor,
+		memory:      NewMemoryGate(memoryBudget),
+	}
+	for i := range wp.queues {
+		wp.queues[i] = make(chan models.ImageJob, bufferSize)
 	}
+	close(wp.resumed)
+	return wp
+}
+
+// the workers of one pipeline stage, which Resize adds to and retires
+type poolStage struct {
+	name   string
+	worker func(ctx context.Context, stop <-chan struct{}, id int, log logger.Logger)
+
+	mu sync.Mutex
+	wg sync.WaitGroup
+	// one per running worker, closed to retire it after its current job
+	stops  []chan struct{}
+	nextID int
+	// set once every worker returned and the stage's output is closed
+	ended bool
 }
 
 // intitalize and start workers
 func (wp *WorkerPool) Start(ctx context.Context) {
-	wp.logger.WithField("workers", wp.workerCount).Info("Starting worker pool")
+	wp.logger.WithFields(map[string]interface{}{
+		"decode_workers": wp.sizes.Decode,
+		"filter_workers": wp.sizes.Filter,
+		"encode_workers": wp.sizes.Encode,
+	}).Info("Starting worker pool")
 
-	for i := 0; i < wp.workerCount; i++ {
-		wp.wg.Add(1)
-		go wp.imageWorker(ctx, i)
+	stages := [3]*poolStage{
+		{name: "decode", worker: wp.decodeWorker},
+		{name: "filter", worker: wp.filterWorker},
+		{name: "encode", worker: wp.encodeWorker},
 	}
+	wp.stagesMu.Lock()
+	wp.ctx, wp.stages = ctx, stages
+	wp.stagesMu.Unlock()
+
+	wp.startStage(stages[0], wp.sizes.Decode, func() { close(wp.decoded) })
+	wp.startStage(stages[1], wp.sizes.Filter, func() { close(wp.filtered) })
+	wp.startStage(stages[2], wp.sizes.Encode, func() { close(wp.resultQueue) })
+}
+
+// start count workers for a stage; done runs once they have all returned,
+// closing the stage's output so the next stage drains and stops
+func (wp *WorkerPool) startStage(st *poolStage, count int, done func()) {
+	st.mu.Lock()
+	for i := 0; i < count; i++ {
+		wp.addWorker(st)
+	}
+	st.mu.Unlock()
+
+	wp.wg.Add(1)
+	go func() {
+		defer wp.wg.Done()
+		st.wg.Wait()
+		st.mu.Lock()
+		st.ended = true
+		st.mu.Unlock()
+		done()
+	}()
 }
 
-// gracefully stop workers
+// start another worker in st, whose lock is held
+func (wp *WorkerPool) addWorker(st *poolStage) {
+	stop := make(chan struct{})
+	st.stops = append(st.stops, stop)
+	id := st.nextID
+	st.nextID++
+
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+
+		log := wp.logger.WithFields(workerFields(st.name, id))
+		log.Debug("Image worker started")
+		st.worker(wp.ctx, stop, id, log)
+		log.Debug("Image worker stopped")
+
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		for i, s := range st.stops {
+			if s == stop {
+				st.stops = append(st.stops[:i], st.stops[i+1:]...)
+				break
+			}
+		}
+	}()
+}
+
+// start or retire workers until st has count of them. Retired workers
+// finish the job they're on first
+func (wp *WorkerPool) resizeStage(st *poolStage, count int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ended {
+		return
+	}
+	for len(st.stops) < count {
+		wp.addWorker(st)
+	}
+	for len(st.stops) > count {
+		last := len(st.stops) - 1
+		close(st.stops[last])
+		st.stops = st.stops[:last]
+	}
+}
+
+// the number of workers st has
+func (st *poolStage) size() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.stops)
+}
+
+// Resize changes the number of workers of each stage of a started pool to
+// sizes, leaving those of zero sizes as they are. Workers are added at
+// once; retired ones finish the job they're on. Returns the new sizes
+func (wp *WorkerPool) Resize(sizes PoolSizes) (PoolSizes, error) {
+	if sizes.Decode < 0 || sizes.Filter < 0 || sizes.Encode < 0 {
+		return wp.workers(), errors.New("worker counts cannot be negative")
+	}
+	stages, ok := wp.startedStages()
+	if !ok {
+		return wp.workers(), errors.New("worker pool not started")
+	}
+	for i, count := range []int{sizes.Decode, sizes.Filter, sizes.Encode} {
+		if count > 0 {
+			wp.resizeStage(stages[i], count)
+		}
+	}
+
+	workers := wp.workers()
+	wp.logger.WithFields(map[string]interface{}{
+		"decode_workers": workers.Decode,
+		"filter_workers": workers.Filter,
+		"encode_workers": workers.Encode,
+	}).Info("Resized worker pool")
+	return workers, nil
+}
+
+// the stages of the pool, false before Start
+func (wp *WorkerPool) startedStages() ([3]*poolStage, bool) {
+	wp.stagesMu.Lock()
+	defer wp.stagesMu.Unlock()
+	return wp.stages, wp.stages[0] != nil
+}
+
+// the current number of workers in each stage, the configured ones before
+// the pool starts
+func (wp *WorkerPool) workers() PoolSizes {
+	stages, ok := wp.startedStages()
+	if !ok {
+		return wp.sizes
+	}
+	return PoolSizes{
+		Decode: stages[0].size(),
+		Filter: stages[1].size(),
+		Encode: stages[2].size(),
+	}
+}
+
+// a context done with ctx or once stop is closed, for a worker to wait for
+// its next job with
+func stopContext(ctx context.Context, stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// fields identifying a worker in its logs and those of the jobs it runs
+func workerFields(stage string, id int) map[string]interface{} {
+	return map[string]interface{}{
+		"stage":     stage,
+		"worker_id": id,
+	}
+}
+
+// gracefully stop workers, running the jobs still queued, even when paused
 func (wp *WorkerPool) Stop() {
 	wp.logger.Info("Stopping worker pool")
+	wp.Resume()
 	close(wp.quit)
-	close(wp.jobQueue)
+	for _, queue := range wp.queues {
+		close(queue)
+	}
 	wp.wg.Wait()
-	close(wp.resultQueue)
 }
 
-// submit an image processing job
+// stop admitting jobs; in-flight jobs run to completion and queued ones are
+// reported with ErrSkipped
+func (wp *WorkerPool) Drain() {
+	wp.drainOnce.Do(func() {
+		wp.logger.Info("Draining worker pool")
+		close(wp.draining)
+	})
+}
+
+// stop starting queued jobs until Resume; jobs already decoding, filtering
+// or encoding finish, and queued ones keep their place. Reports whether the
+// pool was running
+func (wp *WorkerPool) Pause() bool {
+	wp.pauseMu.Lock()
+	defer wp.pauseMu.Unlock()
+	select {
+	case <-wp.resumed:
+		wp.resumed = make(chan struct{})
+		return true
+	default:
+		return false
+	}
+}
+
+// start queued jobs again after Pause. Reports whether the pool was paused
+func (wp *WorkerPool) Resume() bool {
+	wp.pauseMu.Lock()
+	defer wp.pauseMu.Unlock()
+	select {
+	case <-wp.resumed:
+		return false
+	default:
+		close(wp.resumed)
+		return true
+	}
+}
+
+// the channel closed once the pool isn't paused
+func (wp *WorkerPool) running() <-chan struct{} {
+	wp.pauseMu.Lock()
+	defer wp.pauseMu.Unlock()
+	return wp.resumed
+}
+
+// report whether the pool is paused
+func (wp *WorkerPool) isPaused() bool {
+	select {
+	case <-wp.running():
+		return false
+	default:
+		return true
+	}
+}
+
+// wait while the pool is paused. A drain ends the wait so queued jobs are
+// skipped; returns false if ctx is done
+func (wp *WorkerPool) waitRunning(ctx context.Context) bool {
+	select {
+	case <-wp.running():
+	case <-wp.draining:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// report whether Drain has been called
+func (wp *WorkerPool) isDraining() bool {
+	select {
+	case <-wp.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// the queue a job waits in for a decode worker
+func (wp *WorkerPool) queue(job models.ImageJob) chan models.ImageJob {
+	return wp.queues[priorityRank(job.Priority)]
+}
+
+// submit an image processing job to the queue of its priority
 func (wp *WorkerPool) SubmitJob(job models.ImageJob) {
 	select {
-	case wp.jobQueue <- job:
+	case wp.queue(job) <- job:
 	case <-wp.quit:
 		wp.logger.Warn("Worker pool shutting down, job rejected")
 	}
 }
 
+// Stats reports the pool's queue depths and in-flight jobs
+func (wp *WorkerPool) Stats() PoolStats {
+	queued := 0
+	for _, queue := range wp.queues {
+		queued += len(queue)
+	}
+	return PoolStats{
+		Workers:      wp.workers(),
+		Queued:       queued,
+		Decoded:      len(wp.decoded),
+		Filtered:     len(wp.filtered),
+		Results:      len(wp.resultQueue),
+		Decoding:     wp.decoding.Load(),
+		Filtering:    wp.filtering.Load(),
+		Encoding:     wp.encoding.Load(),
+		Completed:    wp.completed.Load(),
+		MemoryInUse:  wp.memory.InUse(),
+		MemoryBudget: wp.memory.Budget(),
+		Draining:     wp.isDraining(),
+		Paused:       wp.isPaused(),
+	}
+}
+
 // return the results channel
 func (wp *WorkerPool) Results() <-chan models.ProcessingResult {
 	return wp.resultQueue
 }
 
-// process image jobs
-func (wp *WorkerPool) imageWorker(ctx context.Context, workerID int) {
-	defer wp.wg.Done()
-
-	log := wp.logger.WithField("worker_id", workerID)
-	log.Debug("Image worker started")
+// take the highest priority job queued. queues is the worker's copy of the
+// pool's queues, each set to nil once closed and drained. Returns false once
+// all are, or ctx is done
+func (wp *WorkerPool) nextJob(ctx context.Context, queues *[3]chan models.ImageJob) (models.ImageJob, bool) {
+	for ctx.Err() == nil {
+		for i, queue := range queues {
+			if queue == nil {
+				continue
+			}
+			select {
+			case job, ok := <-queue:
+				if ok {
+					return job, true
+				}
+				queues[i] = nil
+			default:
+			}
+		}
+		if queues[0] == nil && queues[1] == nil && queues[2] == nil {
+			break
+		}
 
-	for {
+		// nothing queued: wait for the first job of any priority
+		var job models.ImageJob
+		ok, i := false, 0
 		select {
 		case <-ctx.Done():
-			log.Debug("Image worker stopped due to context cancellation")
+			return models.ImageJob{}, false
+		case job, ok = <-queues[0]:
+		case job, ok = <-queues[1]:
+			i = 1
+		case job, ok = <-queues[2]:
+			i = 2
+		}
+		if ok {
+			return job, true
+		}
+		queues[i] = nil
+	}
+	return models.ImageJob{}, false
+}
+
+// admit jobs against the memory budget and decode them, higher priorities
+// first
+func (wp *WorkerPool) decodeWorker(ctx context.Context, stop <-chan struct{}, id int, log logger.Logger) {
+	// a retired worker stops waiting for jobs, but runs one it has taken
+	idle, cancel := stopContext(ctx, stop)
+	defer cancel()
+
+	queues := wp.queues
+	for {
+		if !wp.waitRunning(idle) {
 			return
-		case <-wp.quit:
-			log.Debug("Image worker stopped")
+		}
+		job, ok := wp.nextJob(idle, &queues)
+		if !ok {
 			return
-		case job, ok := <-wp.jobQueue:
-			if !ok {
-				log.Debug("Image worker stopped, job queue closed")
-				return
-			}
-
-			log.WithFields(map[string]interface{}{
-				"job_id":     job.ID,
-				"input_path": job.InputPath,
-				"filter":     job.Filter,
-			}).Debug("Processing image job")
+		}
+		// a job taken as the pool paused waits with it
+		if !wp.waitRunning(ctx) {
+			return
+		}
+		if !wp.isDraining() && wp.throttleInput(ctx, job.InputPath) != nil {
+			return
+		}
 
-			result := wp.processor.ProcessSingleImage(ctx, job)
+		log.WithFields(map[string]interface{}{
+			"job_id":     job.ID,
+			"input_path": job.InputPath,
+			"filter":     job.Filter,
+		}).Debug("Processing image job")
 
-			select {
-			case wp.resultQueue <- result:
-			case <-ctx.Done():
+		if wp.isDraining() {
+			if !wp.skip(ctx, job) {
 				return
-			case <-wp.quit:
+			}
+			continue
+		}
+
+		cost := wp.processor.estimateMemory(job.InputPath)
+		if err := wp.memory.Acquire(ctx, cost); err != nil {
+			return
+		}
+		// the pool may have started draining while waiting for memory
+		if wp.isDraining() {
+			wp.memory.Release(cost)
+			if !wp.skip(ctx, job) {
 				return
 			}
+			continue
+		}
+
+		log.WithFields(map[string]interface{}{
+			"job_id":          job.ID,
+			"estimated_bytes": cost,
+			"in_flight_bytes": wp.memory.InUse(),
+			"queue_wait":      time.Since(job.SubmittedAt),
+		}).Debug("Job admitted")
+
+		queueWait := time.Since(job.SubmittedAt)
+		wp.processor.bus.publish(EventStarted, job, Event{QueueWaitMs: milliseconds(queueWait)})
+		wp.decoding.Add(1)
+		sj := wp.processor.decodeStage(ctx, job, log)
+		wp.decoding.Add(-1)
+		sj.cost = cost
+		sj.result.QueueWait = queueWait
+		if !wp.forward(ctx, sj, wp.decoded) {
+			return
+		}
+	}
+}
+
+// apply filters to decoded images
+func (wp *WorkerPool) filterWorker(ctx context.Context, stop <-chan struct{}, id int, log logger.Logger) {
+	for {
+		var sj *stageJob
+		var ok bool
+		select {
+		case sj, ok = <-wp.decoded:
+		case <-stop:
+			return
+		}
+		if !ok {
+			return
+		}
+		sj.log = sj.log.WithFields(workerFields("filter", id))
+		if sj.result.Error == nil {
+			wp.filtering.Add(1)
+			wp.processor.runStage(sj, wp.processor.filterStage)
+			wp.filtering.Add(-1)
+		}
+		if !wp.forward(ctx, sj, wp.filtered) {
+			return
+		}
+	}
+}
+
+// encode filtered images and emit results
+func (wp *WorkerPool) encodeWorker(ctx context.Context, stop <-chan struct{}, id int, log logger.Logger) {
+	for {
+		var sj *stageJob
+		var ok bool
+		select {
+		case sj, ok = <-wp.filtered:
+		case <-stop:
+			return
+		}
+		if !ok {
+			return
+		}
+		sj.log = sj.log.WithFields(workerFields("encode", id))
+		if sj.result.Error == nil {
+			wp.encoding.Add(1)
+			wp.processor.runStage(sj, wp.processor.encodeStage)
+			wp.encoding.Add(-1)
+		}
+		if !wp.forward(ctx, sj, nil) {
+			return
+		}
+	}
+}
+
+// emit a skipped result for a job that was never started. Returns false if
+// ctx is done
+func (wp *WorkerPool) skip(ctx context.Context, job models.ImageJob) bool {
+	result := models.ProcessingResult{
+		Index:      job.Index,
+		InputPath:  job.InputPath,
+		OutputPath: job.OutputPath,
+		Error:      ErrSkipped,
+	}
+	wp.processor.finished(job, result)
+	select {
+	case wp.resultQueue <- result:
+		wp.completed.Add(1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// pass a job to the next stage, or emit its result once it has failed or
+// been encoded, releasing its memory. Returns false if ctx is done
+func (wp *WorkerPool) forward(ctx context.Context, sj *stageJob, next chan *stageJob) bool {
+	if err := ctx.Err(); err != nil && sj.result.Error == nil {
+		sj.result.Error = err
+	}
+
+	if next != nil && !sj.finished() {
+		select {
+		case next <- sj:
+			return true
+		case <-ctx.Done():
+			wp.memory.Release(sj.cost)
+			sj.cancel()
+			return false
 		}
 	}
+
+	wp.memory.Release(sj.cost)
+	sj.cancel()
+	sj.img, sj.gray16 = nil, nil
+	wp.processor.replaceInput(sj)
+	wp.throttleOutputs(ctx, sj)
+	wp.processor.storeOutputs(ctx, sj)
+	sj.result.Resources = sj.usage.result()
+	sj.result.Metadata.Timings = sj.usage.stageTimings()
+	wp.processor.finished(sj.job, sj.result)
+	select {
+	case wp.resultQueue <- sj.result:
+		wp.completed.Add(1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // ImageProcessor handles the actual image processing logic
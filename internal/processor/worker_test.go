@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// queued jobs are taken high first and low last, in submission order
+// within a priority, whatever order they were queued in
+func TestNextJobByPriority(t *testing.T) {
+	wp := NewWorkerPool(PoolSizes{Decode: 1, Filter: 1, Encode: 1}, 8, 0, logger.NewLoggerWithOutput(false, "text", io.Discard), nil)
+	jobs := []models.ImageJob{
+		{ID: "low", Priority: models.PriorityLow},
+		{ID: "normal-1"},
+		{ID: "high", Priority: models.PriorityHigh},
+		{ID: "normal-2", Priority: models.PriorityNormal},
+	}
+	for _, job := range jobs {
+		wp.SubmitJob(job)
+	}
+	if stats := wp.Stats(); stats.Queued != len(jobs) {
+		t.Errorf("%d queued, want %d", stats.Queued, len(jobs))
+	}
+	for _, queue := range wp.queues {
+		close(queue)
+	}
+
+	queues := wp.queues
+	var order []string
+	for {
+		job, ok := wp.nextJob(context.Background(), &queues)
+		if !ok {
+			break
+		}
+		order = append(order, job.ID)
+	}
+	want := []string{"high", "normal-1", "normal-2", "low"}
+	if len(order) != len(want) {
+		t.Fatalf("took %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("took %v, want %v", order, want)
+		}
+	}
+}
+
+func TestByPriority(t *testing.T) {
+	jobs := []models.ImageJob{
+		{ID: "a", Priority: models.PriorityLow},
+		{ID: "b"},
+		{ID: "c", Priority: models.PriorityHigh},
+		{ID: "d", Priority: models.PriorityLow},
+		{ID: "e", Priority: models.PriorityHigh},
+	}
+	ordered := byPriority(jobs)
+	got := ""
+	for _, job := range ordered {
+		got += job.ID
+	}
+	if got != "cebad" {
+		t.Errorf("order %s, want cebad", got)
+	}
+	if jobs[0].ID != "a" {
+		t.Error("the jobs given were reordered")
+	}
+}
+
+// jobs get the configured priority unless their manifest entry sets one
+func TestJobPriority(t *testing.T) {
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Priority = "low"
+	p, err := New(WithConfig(cfg), WithLogger(logger.NewLoggerWithOutput(false, "text", io.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job := p.newJob(0, "a.png", t.TempDir()); job.Priority != models.PriorityLow {
+		t.Errorf("priority %q, want the configured low", job.Priority)
+	}
+	job, err := p.manifestJob(1, config.ManifestEntry{Input: "b.png", OutputDir: t.TempDir(), Priority: "high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Priority != models.PriorityHigh {
+		t.Errorf("priority %q, want the entry's high", job.Priority)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	wp := NewWorkerPool(PoolSizes{Decode: 1, Filter: 1, Encode: 1}, 8, 0, logger.NewLoggerWithOutput(false, "text", io.Discard), nil)
+	if wp.Stats().Paused || wp.Resume() {
+		t.Fatal("a new pool is paused")
+	}
+	if !wp.Pause() || wp.Pause() {
+		t.Error("Pause reported the wrong previous state")
+	}
+	if !wp.Stats().Paused {
+		t.Error("stats don't report the pause")
+	}
+	if !wp.Resume() || wp.Resume() {
+		t.Error("Resume reported the wrong previous state")
+	}
+	if wp.Stats().Paused {
+		t.Error("stats report a pause after Resume")
+	}
+}
+
+// a paused service holds the jobs it's given until resumed, and loses none
+func TestServicePauseHoldsJobs(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "a.png")
+	writePNG(t, input, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.InputDir, cfg.OutputDir = dir, filepath.Join(dir, "out")
+	p, err := New(WithConfig(cfg), WithLogger(logger.NewLoggerWithOutput(false, "text", io.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service := p.StartService(ctx)
+
+	if !service.Pause() {
+		t.Fatal("the service wasn't running")
+	}
+	done := make(chan error, 1)
+	go func() {
+		result, err := service.ProcessEntry(ctx, config.ManifestEntry{Input: input})
+		if err == nil {
+			err = result.Error
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("a job ran while paused: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if !service.Stats().Paused {
+		t.Error("stats don't report the pause")
+	}
+
+	if !service.Resume() {
+		t.Error("the service wasn't paused")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the held job didn't run after Resume")
+	}
+}
@@ -0,0 +1,256 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// id of the connection's one subscription
+const natsSID = "1"
+
+// a connection speaking the NATS client protocol. Core NATS delivers each
+// message at most once: a job in flight when the consumer dies is lost, and
+// a consumer falling far behind is disconnected as a slow consumer
+type natsConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	messages chan Message
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	errMu sync.Mutex
+	err   error
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func dialNATS(ctx context.Context, u *url.URL, opts Options) (*natsConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	dialer := net.Dialer{Timeout: opts.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+
+	c := &natsConn{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		messages: make(chan Message, opts.Buffer),
+		closed:   make(chan struct{}),
+	}
+	if err := c.handshake(u, opts.Timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sub := "SUB " + opts.Subject
+	if opts.Group != "" {
+		sub += " " + opts.Group
+	}
+	if err := c.write(sub + " " + natsSID + "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.read()
+	return c, nil
+}
+
+// read the server's INFO, log in with the URL's credentials and wait for
+// the server to answer a PING, which it only does once CONNECT succeeded
+func (c *natsConn) handshake(u *url.URL, timeout time.Duration) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	line, err := c.readLine()
+	if err != nil {
+		return fmt.Errorf("failed to read server info: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q: not a NATS server", line)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "concurrent-image-processor",
+		"lang":     "go",
+		"protocol": 0,
+	}
+	if u.User != nil {
+		// a user without a password is a token
+		if password, ok := u.User.Password(); ok {
+			options["user"], options["pass"] = u.User.Username(), password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if err := c.write("CONNECT " + string(data) + "\r\nPING\r\n"); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("failed to connect: %s", natsError(line))
+		}
+	}
+}
+
+// deliver messages and answer the server's pings until the connection ends
+func (c *natsConn) read() {
+	defer close(c.messages)
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		switch {
+		case line == "PING":
+			if err := c.write("PONG\r\n"); err != nil {
+				c.fail(err)
+				return
+			}
+		case strings.HasPrefix(line, "MSG "):
+			msg, err := c.readMessage(line)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			select {
+			case c.messages <- msg:
+			case <-c.closed:
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			// the server closes the connection after most errors, and
+			// that ends the loop
+			c.fail(errors.New(natsError(line)))
+		}
+	}
+}
+
+// the payload of a "MSG <subject> <sid> [reply] <size>" line
+func (c *natsConn) readMessage(line string) (Message, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 && len(fields) != 5 {
+		return Message{}, fmt.Errorf("invalid message line %q", line)
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return Message{}, fmt.Errorf("invalid message line %q", line)
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return Message{}, err
+	}
+	msg := Message{Subject: fields[1], Data: data[:size]}
+	if len(fields) == 5 {
+		msg.Reply = fields[3]
+	}
+	return msg, nil
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *natsConn) write(s string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.writer.WriteString(s); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// record the first error that ended the connection, unless it was closed
+func (c *natsConn) fail(err error) {
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+}
+
+func (c *natsConn) Messages() <-chan Message {
+	return c.messages
+}
+
+func (c *natsConn) Publish(subject string, data []byte) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("invalid subject %q", subject)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	fmt.Fprintf(c.writer, "PUB %s %d\r\n", subject, len(data))
+	c.writer.Write(data)
+	c.writer.WriteString("\r\n")
+	return c.writer.Flush()
+}
+
+func (c *natsConn) Unsubscribe() error {
+	return c.write("UNSUB " + natsSID + "\r\n")
+}
+
+func (c *natsConn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+func (c *natsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		// flush what was published before closing
+		c.writeMu.Lock()
+		c.writer.Flush()
+		c.writeMu.Unlock()
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// the message of an "-ERR '<message>'" line
+func natsError(line string) string {
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'")
+}
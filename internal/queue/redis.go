@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNil is the reply to a command with no value, such as a blocking pop
+// that timed out
+var ErrNil = errors.New("redis: nil reply")
+
+// RedisClient is one connection to a Redis server, speaking enough of the
+// RESP protocol for the work queue. Commands are serialized. A command that
+// fails on the connection, rather than with an error reply, leaves it in an
+// unknown state, such as with a late reply still to come, so the connection
+// is closed and the next command dials a new one
+type RedisClient struct {
+	mu      sync.Mutex
+	url     *url.URL
+	host    string
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+// an error reply from the server, after which the connection is still in
+// step
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// DialRedis connects to rawURL, such as redis://:password@host:6379/0,
+// logging in and selecting the database when the URL gives them. timeout
+// limits connecting and each command, on top of the time a blocking
+// command may wait
+func DialRedis(ctx context.Context, rawURL string, timeout time.Duration) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis scheme %q: must be redis", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	c := &RedisClient{url: u, host: host, timeout: timeout}
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open the connection, logging in and selecting the database
+func (c *RedisClient) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.host)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", c.host, err)
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
+
+	if u := c.url; u.User != nil {
+		args := []string{"AUTH"}
+		password, ok := u.User.Password()
+		if name := u.User.Username(); name != "" && ok {
+			args = append(args, name)
+		}
+		if !ok {
+			password = u.User.Username()
+		}
+		if _, err := c.exec(0, append(args, password)...); err != nil {
+			c.drop()
+			return fmt.Errorf("redis login failed: %w", err)
+		}
+	}
+	if db := strings.Trim(c.url.Path, "/"); db != "" {
+		if _, err := c.exec(0, "SELECT", db); err != nil {
+			c.drop()
+			return fmt.Errorf("failed to select database %s: %w", db, err)
+		}
+	}
+	return nil
+}
+
+// close the connection, for the next command to dial a new one
+func (c *RedisClient) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Do sends a command and returns its reply: a string, an int64, a slice
+// of replies, or ErrNil
+func (c *RedisClient) Do(args ...string) (interface{}, error) {
+	return c.do(0, args...)
+}
+
+// run a command that may block for up to wait on the server
+func (c *RedisClient) do(wait time.Duration, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	return c.exec(wait, args...)
+}
+
+// send a command on the open connection and read its reply, dropping the
+// connection on any error but an error reply
+func (c *RedisClient) exec(wait time.Duration, args ...string) (interface{}, error) {
+	reply, err := c.send(wait, args...)
+	var replyErr redisError
+	if err != nil && !errors.Is(err, ErrNil) && !errors.As(err, &replyErr) {
+		c.drop()
+	}
+	return reply, err
+}
+
+func (c *RedisClient) send(wait time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout + wait))
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *RedisClient) reply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		// every item is read, even after an error reply, so the next
+		// reply starts where it should
+		items := make([]interface{}, n)
+		var itemErr error
+		for i := range items {
+			item, err := c.reply()
+			var replyErr redisError
+			switch {
+			case errors.As(err, &replyErr):
+				if itemErr == nil {
+					itemErr = err
+				}
+			case err != nil && !errors.Is(err, ErrNil):
+				return nil, err
+			}
+			items[i] = item
+		}
+		if itemErr != nil {
+			return nil, itemErr
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+}
+
+// Close closes the connection
+func (c *RedisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a server that answers each command with its first argument, and SLOW
+// only after delay
+func fakeRedis(t *testing.T, delay time.Duration) (string, *int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var conns int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go serveFake(conn, delay)
+		}
+	}()
+	return "redis://" + ln.Addr().String(), &conns
+}
+
+func serveFake(conn net.Conn, delay time.Duration) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		var args []string
+		for i := 0; i < n; i++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args = append(args, strings.TrimSpace(arg))
+		}
+		if args[0] == "SLOW" {
+			time.Sleep(delay)
+		}
+		conn.Write([]byte("+" + args[0] + "\r\n"))
+	}
+}
+
+func TestRedisRedialsAfterTimeout(t *testing.T) {
+	addr, conns := fakeRedis(t, 300*time.Millisecond)
+	client, err := DialRedis(context.Background(), addr, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Do("SLOW"); err == nil {
+		t.Fatal("SLOW succeeded past the timeout")
+	}
+	// the late reply to SLOW must not be taken for the reply to PING
+	time.Sleep(400 * time.Millisecond)
+	reply, err := client.Do("PING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "PING" {
+		t.Errorf("PING got %v, want PING", reply)
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+func TestRedisErrorReplyKeepsConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{"*2\r\n-ERR first\r\n:7\r\n", "+OK\r\n"} {
+			// *1, $4, PING
+			for i := 0; i < 3; i++ {
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			conn.Write([]byte(reply))
+		}
+	}()
+
+	client, err := DialRedis(context.Background(), "redis://"+ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Do("PING"); err == nil || !strings.Contains(err.Error(), "first") {
+		t.Fatalf("got %v, want the error reply", err)
+	}
+	reply, err := client.Do("PING")
+	if err != nil || reply != "OK" {
+		t.Errorf("got %v, %v after an error item, want OK", reply, err)
+	}
+}
@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// jobs pushed per command
+const pushBatch = 500
+
+// WorkQueue is a queue of jobs in Redis shared by a fleet of workers. A job
+// taken by a worker is leased for the visibility timeout, which the worker
+// renews while it runs; a job whose lease runs out, because its worker
+// died, is put back for another worker by Reap. Delivery is at least once,
+// so a job can be reported twice
+type WorkQueue struct {
+	client     *RedisClient
+	name       string
+	visibility time.Duration
+}
+
+// NewWorkQueue returns the queue stored under keys starting with name
+func NewWorkQueue(client *RedisClient, name string, visibility time.Duration) *WorkQueue {
+	return &WorkQueue{client: client, name: name, visibility: visibility}
+}
+
+// keys of the waiting jobs, the taken ones, their lease deadlines and the
+// results
+func (q *WorkQueue) pending() string    { return q.name + ":pending" }
+func (q *WorkQueue) processing() string { return q.name + ":processing" }
+func (q *WorkQueue) leases() string     { return q.name + ":leases" }
+func (q *WorkQueue) results() string    { return q.name + ":results" }
+
+// Reset empties the queue and its results for a new batch
+func (q *WorkQueue) Reset() error {
+	_, err := q.client.Do("DEL", q.pending(), q.processing(), q.leases(), q.results())
+	return err
+}
+
+// Push queues jobs, taken in the order given
+func (q *WorkQueue) Push(jobs ...string) error {
+	for len(jobs) > 0 {
+		n := min(len(jobs), pushBatch)
+		// jobs are taken from the right
+		if _, err := q.client.Do(append([]string{"LPUSH", q.pending()}, jobs[:n]...)...); err != nil {
+			return err
+		}
+		jobs = jobs[n:]
+	}
+	return nil
+}
+
+// Take waits up to wait for a job and leases it; ErrNil when none came
+func (q *WorkQueue) Take(wait time.Duration) (string, error) {
+	seconds := max(1, int(wait.Round(time.Second)/time.Second))
+	reply, err := q.client.do(wait, "BRPOPLPUSH", q.pending(), q.processing(), strconv.Itoa(seconds))
+	if err != nil {
+		return "", err
+	}
+	job, ok := reply.(string)
+	if !ok {
+		return "", errors.New("redis: unexpected reply to BRPOPLPUSH")
+	}
+	_, err = q.client.Do("ZADD", q.leases(), q.deadline(), job)
+	return job, err
+}
+
+// Renew extends the lease of a taken job by the visibility timeout; a job
+// put back by Reap in the meantime stays with its new worker
+func (q *WorkQueue) Renew(job string) error {
+	_, err := q.client.Do("ZADD", q.leases(), "XX", q.deadline(), job)
+	return err
+}
+
+// Complete removes a finished job and records its result
+func (q *WorkQueue) Complete(job, result string) error {
+	if _, err := q.client.Do("LREM", q.processing(), "1", job); err != nil {
+		return err
+	}
+	if _, err := q.client.Do("ZREM", q.leases(), job); err != nil {
+		return err
+	}
+	_, err := q.client.Do("RPUSH", q.results(), result)
+	return err
+}
+
+// Reap puts the taken jobs whose lease ran out back at the front of the
+// queue and returns how many there were
+func (q *WorkQueue) Reap() (int, error) {
+	// a worker that died between taking a job and leasing it left a job
+	// without a lease, which gets one now
+	reply, err := q.client.Do("LRANGE", q.processing(), "0", "-1")
+	if err != nil {
+		return 0, err
+	}
+	taken, _ := reply.([]interface{})
+	for _, job := range taken {
+		if job, ok := job.(string); ok {
+			if _, err := q.client.Do("ZADD", q.leases(), "NX", q.deadline(), job); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	reply, err = q.client.Do("ZRANGEBYSCORE", q.leases(), "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	if err != nil {
+		return 0, err
+	}
+	expired, _ := reply.([]interface{})
+	requeued := 0
+	for _, job := range expired {
+		job, ok := job.(string)
+		if !ok {
+			continue
+		}
+		// whoever removes the lease puts the job back, so it's done once
+		removed, err := q.client.Do("ZREM", q.leases(), job)
+		if err != nil {
+			return requeued, err
+		}
+		if removed != int64(1) {
+			continue
+		}
+		if _, err := q.client.Do("LREM", q.processing(), "1", job); err != nil {
+			return requeued, err
+		}
+		if _, err := q.client.Do("RPUSH", q.pending(), job); err != nil {
+			return requeued, err
+		}
+		requeued++
+	}
+	return requeued, nil
+}
+
+// Result waits up to wait for the next result; ErrNil when none came
+func (q *WorkQueue) Result(wait time.Duration) (string, error) {
+	seconds := max(1, int(wait.Round(time.Second)/time.Second))
+	reply, err := q.client.do(wait, "BLPOP", q.results(), strconv.Itoa(seconds))
+	if err != nil {
+		return "", err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return "", errors.New("redis: unexpected reply to BLPOP")
+	}
+	result, _ := items[1].(string)
+	return result, nil
+}
+
+// Pending returns the number of jobs waiting and taken
+func (q *WorkQueue) Pending() (waiting, taken int64, err error) {
+	reply, err := q.client.Do("LLEN", q.pending())
+	if err != nil {
+		return 0, 0, err
+	}
+	waiting, _ = reply.(int64)
+	reply, err = q.client.Do("LLEN", q.processing())
+	if err != nil {
+		return 0, 0, err
+	}
+	taken, _ = reply.(int64)
+	return waiting, taken, nil
+}
+
+// Ping checks the connection to Redis
+func (q *WorkQueue) Ping() error {
+	_, err := q.client.Do("PING")
+	return err
+}
+
+// lease deadline of a job taken or renewed now, in Unix milliseconds
+func (q *WorkQueue) deadline() string {
+	return strconv.FormatInt(time.Now().Add(q.visibility).UnixMilli(), 10)
+}
@@ -0,0 +1,346 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an FTP directory; listings use MLSD (RFC 3659) and transfers passive
+// mode, so the server has to support both
+type ftpBackend struct {
+	url     *url.URL
+	timeout time.Duration
+}
+
+func (b *ftpBackend) Download(ctx context.Context, dst string) error {
+	c, err := b.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+	return c.download(ctx, remotePath(b.url), dst)
+}
+
+func (b *ftpBackend) Upload(ctx context.Context, src string) error {
+	c, err := b.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+
+	root := remotePath(b.url)
+	c.mkdirAll(root)
+	return filepath.WalkDir(src, func(local string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, local)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := path.Join(root, filepath.ToSlash(rel))
+		if entry.IsDir() {
+			c.mkdir(target)
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return c.store(ctx, local, target)
+	})
+}
+
+// a logged in control connection
+type ftpConn struct {
+	text    *textproto.Conn
+	host    string
+	timeout time.Duration
+	// stops closing the connection when the context is done
+	stop func() bool
+}
+
+// connect and log in, anonymously unless the URL has a user
+func (b *ftpBackend) dial(ctx context.Context) (*ftpConn, error) {
+	host := b.url.Host
+	if b.url.Port() == "" {
+		host = net.JoinHostPort(b.url.Hostname(), "21")
+	}
+	dialer := net.Dialer{Timeout: b.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+
+	c := &ftpConn{
+		text:    textproto.NewConn(idleConn{Conn: conn, timeout: b.timeout}),
+		host:    b.url.Hostname(),
+		timeout: b.timeout,
+		// a cancelled run shouldn't wait out a stalled transfer
+		stop: context.AfterFunc(ctx, func() { conn.Close() }),
+	}
+	if err := c.login(b.url.User); err != nil {
+		c.quit()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ftpConn) login(user *url.Userinfo) error {
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return fmt.Errorf("unexpected FTP greeting: %w", err)
+	}
+
+	name, password := "anonymous", "anonymous@"
+	if user != nil {
+		name = user.Username()
+		if p, ok := user.Password(); ok {
+			password = p
+		}
+	}
+	code, _, err := c.cmd(0, "USER %s", name)
+	if err != nil {
+		return fmt.Errorf("FTP login failed: %w", err)
+	}
+	if code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", password)
+		if err != nil {
+			return fmt.Errorf("FTP login failed: %w", err)
+		}
+	}
+	if code != 230 && code != 202 {
+		return fmt.Errorf("FTP login failed with status %d", code)
+	}
+
+	_, _, err = c.cmd(2, "TYPE I")
+	return err
+}
+
+// send a command and read its reply, which fails unless it matches expect
+// as textproto.ReadResponse checks it; 0 accepts any reply
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return 0, "", fmt.Errorf("invalid FTP argument %q", s)
+		}
+	}
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(expect)
+}
+
+func (c *ftpConn) quit() {
+	c.cmd(0, "QUIT")
+	c.stop()
+	c.text.Close()
+}
+
+// open a passive data connection and send the command that uses it
+func (c *ftpConn) data(ctx context.Context, format string, args ...interface{}) (net.Conn, error) {
+	port, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+	// the control connection's host is used rather than the address in a
+	// PASV reply, which is often private behind NAT
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open FTP data connection: %w", err)
+	}
+
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return idleConn{Conn: conn, timeout: c.timeout}, nil
+}
+
+// the data port of the next transfer, from EPSV or, on older servers, PASV
+func (c *ftpConn) passive() (int, error) {
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		// "Entering Extended Passive Mode (|||port|)"
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			if port, err := strconv.Atoi(msg[start+4 : end]); err == nil {
+				return port, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, fmt.Errorf("FTP passive mode failed: %w", err)
+	}
+	// "Entering Passive Mode (h1,h2,h3,h4,p1,p2)"
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	hi, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	lo, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	return hi<<8 | lo, nil
+}
+
+// an entry of a directory listing
+type ftpEntry struct {
+	name string
+	dir  bool
+}
+
+// the files and subdirectories of dir
+func (c *ftpConn) list(ctx context.Context, dir string) ([]ftpEntry, error) {
+	conn, err := c.data(ctx, "MLSD %s", dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	data, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	var entries []ftpEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		// "type=file;size=1024;modify=20240131120000; name.jpg"
+		facts, name, ok := strings.Cut(strings.TrimRight(line, "\r"), " ")
+		if !ok || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+		for _, fact := range strings.Split(strings.ToLower(facts), ";") {
+			switch fact {
+			case "type=file":
+				entries = append(entries, ftpEntry{name: name})
+			case "type=dir":
+				entries = append(entries, ftpEntry{name: name, dir: true})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// copy the tree under the remote dir into dst
+func (c *ftpConn) download(ctx context.Context, dir, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	entries, err := c.list(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		remote, local := path.Join(dir, entry.name), filepath.Join(dst, entry.name)
+		if entry.dir {
+			err = c.download(ctx, remote, local)
+		} else {
+			err = c.retrieve(ctx, remote, local)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ftpConn) retrieve(ctx context.Context, remote, local string) error {
+	conn, err := c.data(ctx, "RETR %s", remote)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", remote, err)
+	}
+	file, err := os.Create(local)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	_, err = io.Copy(file, conn)
+	conn.Close()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_, _, err = c.text.ReadResponse(2)
+	}
+	if err != nil {
+		os.Remove(local)
+		return fmt.Errorf("failed to download %s: %w", remote, err)
+	}
+	return nil
+}
+
+func (c *ftpConn) store(ctx context.Context, local, remote string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	conn, err := c.data(ctx, "STOR %s", remote)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", remote, err)
+	}
+	_, err = io.Copy(conn, file)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_, _, err = c.text.ReadResponse(2)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", remote, err)
+	}
+	return nil
+}
+
+// create dir; failures are ignored since it may exist already, and a
+// missing directory fails the uploads into it anyway
+func (c *ftpConn) mkdir(dir string) {
+	c.cmd(0, "MKD %s", dir)
+}
+
+// create dir and its parents
+func (c *ftpConn) mkdirAll(dir string) {
+	if dir == "." || dir == "/" {
+		return
+	}
+	c.mkdirAll(path.Dir(dir))
+	c.mkdir(dir)
+}
+
+// a connection whose deadline moves forward with every read and write, so
+// the timeout bounds a stall rather than a whole transfer
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,60 @@
+// Package remote copies directory trees between local disk and FTP or SFTP
+// servers, so the input and output directories can live on the servers of
+// print shops and media partners
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Backend moves a remote directory tree to and from local disk
+type Backend interface {
+	// Download copies the remote tree into the directory dst, which is
+	// created
+	Download(ctx context.Context, dst string) error
+	// Upload copies the tree under the local directory src to the remote
+	// one, creating directories as needed and replacing existing files
+	Upload(ctx context.Context, src string) error
+}
+
+// IsRemote reports whether dir is an ftp:// or sftp:// URL rather than a
+// local path
+func IsRemote(dir string) bool {
+	return strings.HasPrefix(dir, "ftp://") || strings.HasPrefix(dir, "sftp://")
+}
+
+// Open returns the backend for an ftp:// or sftp:// directory URL. Network
+// operations are limited to timeout each
+func Open(rawURL string, timeout time.Duration) (Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote directory: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid remote directory %q: missing host", u.Redacted())
+	}
+
+	switch u.Scheme {
+	case "ftp":
+		return &ftpBackend{url: u, timeout: timeout}, nil
+	case "sftp":
+		return &sftpBackend{url: u, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported remote scheme %q: must be ftp or sftp", u.Scheme)
+	}
+}
+
+// the directory of a URL on the server; the path is relative to the login
+// directory, with an extra leading slash ("ftp://host//srv") for an
+// absolute one, as in curl
+func remotePath(u *url.URL) string {
+	p := strings.TrimPrefix(u.Path, "/")
+	if p == "" {
+		return "."
+	}
+	return strings.TrimSuffix(p, "/")
+}
@@ -0,0 +1,86 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an SFTP directory, reached through the OpenSSH sftp client in batch mode
+// so keys, agents, known hosts and ~/.ssh/config work as for ssh; password
+// logins aren't supported
+type sftpBackend struct {
+	url     *url.URL
+	timeout time.Duration
+}
+
+func (b *sftpBackend) Download(ctx context.Context, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	// entries of an existing local directory are copied into it
+	return b.run(ctx,
+		"lcd "+quote(dst),
+		"cd "+quote(remotePath(b.url)),
+		"get -R *",
+	)
+}
+
+func (b *sftpBackend) Upload(ctx context.Context, src string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	// the leading dash ignores the error of a directory that exists already
+	commands := []string{"lcd " + quote(src)}
+	dir := ""
+	for _, part := range strings.Split(remotePath(b.url), "/") {
+		if dir += part; part != "" && part != "." {
+			commands = append(commands, "-mkdir "+quote(dir))
+		}
+		dir += "/"
+	}
+	commands = append(commands, "cd "+quote(remotePath(b.url)), "put -R *")
+	return b.run(ctx, commands...)
+}
+
+// run commands in one sftp session, which stops at the first that fails
+func (b *sftpBackend) run(ctx context.Context, commands ...string) error {
+	target := b.url.Hostname()
+	if b.url.User != nil {
+		target = b.url.User.Username() + "@" + target
+	}
+	args := []string{
+		"-b", "-",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=" + strconv.Itoa(int(b.timeout.Seconds())),
+	}
+	if port := b.url.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	args = append(args, target)
+
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("sftp %s failed: %w: %s", b.url.Redacted(), err, msg)
+		}
+		return fmt.Errorf("sftp %s failed: %w", b.url.Redacted(), err)
+	}
+	return nil
+}
+
+// a path as an sftp batch argument
+func quote(path string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path) + `"`
+}
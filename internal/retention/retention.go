@@ -0,0 +1,272 @@
+// Package retention keeps long-running output and cache directories within
+// an age and size limit by periodically deleting the oldest files
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/lockfile"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// files a run keeps in its output directory, as state rather than outputs
+var stateFiles = map[string]bool{
+	lockfile.Name:           true,
+	"renames.json":          true,
+	"content_manifest.json": true,
+}
+
+// the file marking a directory of the processing cache as one entry
+const cacheEntryFile = "entry.json"
+
+// Policy limits the files kept under a directory. A zero MaxAge or MaxSize
+// disables that limit
+type Policy struct {
+	MaxAge  time.Duration
+	MaxSize int64
+	// files never deleted wherever they are, such as the incremental index
+	// and state file
+	Keep []string
+	// directories a swept directory may neither be nor contain, such as
+	// the input directory
+	Protect []string
+}
+
+// Enabled reports whether the policy limits anything
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxSize > 0
+}
+
+// Stats describes one sweep of a directory
+type Stats struct {
+	Removed      int
+	RemovedBytes int64
+	Kept         int
+	KeptBytes    int64
+}
+
+// Janitor applies a policy to a set of directories on an interval
+type Janitor struct {
+	dirs     []string
+	policy   Policy
+	interval time.Duration
+	logger   logger.Logger
+}
+
+// NewJanitor creates a janitor for dirs; each directory is swept on its own,
+// so MaxSize applies per directory
+func NewJanitor(policy Policy, interval time.Duration, log logger.Logger, dirs ...string) *Janitor {
+	return &Janitor{
+		dirs:     dirs,
+		policy:   policy,
+		interval: interval,
+		logger:   log,
+	}
+}
+
+// Run sweeps every directory immediately and then on each interval until ctx
+// is done
+func (j *Janitor) Run(ctx context.Context) {
+	if !j.policy.Enabled() {
+		return
+	}
+
+	j.logger.WithFields(map[string]interface{}{
+		"dirs":     j.dirs,
+		"max_age":  j.policy.MaxAge,
+		"max_size": j.policy.MaxSize,
+		"interval": j.interval,
+	}).Info("Starting retention janitor")
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.sweepAll()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep every directory, logging the outcome
+func (j *Janitor) sweepAll() {
+	for _, dir := range j.dirs {
+		stats, err := Sweep(dir, j.policy, time.Now())
+		log := j.logger.WithFields(map[string]interface{}{
+			"dir":           dir,
+			"removed":       stats.Removed,
+			"removed_bytes": stats.RemovedBytes,
+			"kept":          stats.Kept,
+			"kept_bytes":    stats.KeptBytes,
+		})
+		if err != nil {
+			log.WithError(err).Warn("Retention sweep failed")
+			continue
+		}
+		if stats.Removed > 0 {
+			log.Info("Retention sweep removed files")
+		} else {
+			log.Debug("Retention sweep completed")
+		}
+	}
+}
+
+// one regular file under a swept directory, or a whole cache entry
+type entry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	cached  bool
+}
+
+// Sweep deletes files under dir older than the policy's MaxAge, then the
+// least recently modified ones until the rest fit in MaxSize, and finally
+// any directories left empty. A cache entry is deleted whole, by its newest
+// file, so no entry is left without its outputs; the lock, renames.json,
+// content_manifest.json and the policy's Keep files are never deleted. A
+// dir that is or contains one of Protect isn't swept. A missing directory
+// is not an error
+func Sweep(dir string, policy Policy, now time.Time) (Stats, error) {
+	var stats Stats
+	var entries []entry
+	var dirs []string
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, protected := range policy.Protect {
+		abs, err := filepath.Abs(protected)
+		if err != nil {
+			return stats, err
+		}
+		if rel, err := filepath.Rel(absDir, abs); err == nil && filepath.IsLocal(rel) {
+			return stats, fmt.Errorf("refusing to sweep %s, which holds %s", dir, protected)
+		}
+	}
+	keep := map[string]bool{}
+	for _, path := range policy.Keep {
+		if abs, err := filepath.Abs(path); err == nil {
+			keep[abs] = true
+		}
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path == dir {
+				return nil
+			}
+			if _, err := os.Stat(filepath.Join(path, cacheEntryFile)); err == nil {
+				if e, err := cacheEntry(path); err == nil {
+					entries = append(entries, e)
+				}
+				return fs.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		// the lock of the run writing the directory and its state aren't
+		// outputs
+		if !d.Type().IsRegular() || stateFiles[d.Name()] {
+			return nil
+		}
+		if abs, err := filepath.Abs(path); err == nil && keep[abs] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	remove := func(e entry) {
+		err := os.Remove(e.path)
+		if e.cached {
+			err = os.RemoveAll(e.path)
+		}
+		if err == nil {
+			stats.Removed++
+			stats.RemovedBytes += e.size
+		}
+	}
+
+	// oldest first, so the size limit removes the least recent files
+	sort.Slice(entries, func(i, k int) bool {
+		return entries[i].modTime.Before(entries[k].modTime)
+	})
+
+	var kept []entry
+	var total int64
+	for _, e := range entries {
+		if policy.MaxAge > 0 && now.Sub(e.modTime) > policy.MaxAge {
+			remove(e)
+			continue
+		}
+		kept = append(kept, e)
+		total += e.size
+	}
+
+	for len(kept) > 0 && policy.MaxSize > 0 && total > policy.MaxSize {
+		remove(kept[0])
+		total -= kept[0].size
+		kept = kept[1:]
+	}
+
+	stats.Kept = len(kept)
+	stats.KeptBytes = total
+
+	// deepest first, so parents are empty by the time they are reached;
+	// Remove fails on directories that still hold files
+	sort.Slice(dirs, func(i, k int) bool {
+		return len(dirs[i]) > len(dirs[k])
+	})
+	for _, d := range dirs {
+		os.Remove(d)
+	}
+
+	return stats, nil
+}
+
+// the cache entry in dir as one entry, as large as its files and as recent
+// as the newest
+func cacheEntry(dir string) (entry, error) {
+	e := entry{path: dir, cached: true}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e.size += info.Size()
+		if info.ModTime().After(e.modTime) {
+			e.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return e, err
+}
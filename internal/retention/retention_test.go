@@ -0,0 +1,160 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/lockfile"
+)
+
+// write size bytes to path, last modified age before now
+func writeFile(t *testing.T, path string, size int, now time.Time, age time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestSweepMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "old.png"), 10, now, 2*time.Hour)
+	writeFile(t, filepath.Join(dir, "sub", "old.png"), 10, now, 2*time.Hour)
+	writeFile(t, filepath.Join(dir, "new.png"), 10, now, time.Minute)
+
+	stats, err := Sweep(dir, Policy{MaxAge: time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 2 || stats.RemovedBytes != 20 || stats.Kept != 1 {
+		t.Errorf("stats %+v, want 2 removed and 1 kept", stats)
+	}
+	if exists(filepath.Join(dir, "old.png")) || !exists(filepath.Join(dir, "new.png")) {
+		t.Error("wrong files removed")
+	}
+	if exists(filepath.Join(dir, "sub")) {
+		t.Error("empty directory left behind")
+	}
+}
+
+func TestSweepMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"a.png", "b.png", "c.png"} {
+		writeFile(t, filepath.Join(dir, name), 100, now, time.Duration(3-i)*time.Minute)
+	}
+
+	stats, err := Sweep(dir, Policy{MaxSize: 250}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 1 || stats.KeptBytes != 200 {
+		t.Errorf("stats %+v, want the oldest file removed", stats)
+	}
+	if exists(filepath.Join(dir, "a.png")) || !exists(filepath.Join(dir, "c.png")) {
+		t.Error("the oldest file wasn't the one removed")
+	}
+}
+
+// the lock, the reports and index of a run and the policy's Keep files
+// outlive any limit
+func TestSweepKeepsStateFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	state := []string{
+		filepath.Join(dir, lockfile.Name),
+		filepath.Join(dir, "renames.json"),
+		filepath.Join(dir, "content_manifest.json"),
+		filepath.Join(dir, "index.json"),
+		filepath.Join(dir, "state", "checkpoint.json"),
+	}
+	for _, path := range state {
+		writeFile(t, path, 10, now, 48*time.Hour)
+	}
+	writeFile(t, filepath.Join(dir, "out.png"), 10, now, 48*time.Hour)
+
+	policy := Policy{
+		MaxAge: time.Hour,
+		Keep:   []string{filepath.Join(dir, "index.json"), filepath.Join(dir, "state", "checkpoint.json")},
+	}
+	stats, err := Sweep(dir, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 1 || exists(filepath.Join(dir, "out.png")) {
+		t.Errorf("stats %+v, want only out.png removed", stats)
+	}
+	for _, path := range state {
+		if !exists(path) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+}
+
+// a cache entry goes whole or not at all, by its newest file
+func TestSweepCacheEntries(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := filepath.Join(dir, "ab", "ab12")
+	writeFile(t, filepath.Join(old, "entry.json"), 10, now, 48*time.Hour)
+	writeFile(t, filepath.Join(old, "0.png"), 100, now, 48*time.Hour)
+	recent := filepath.Join(dir, "cd", "cd34")
+	writeFile(t, filepath.Join(recent, "entry.json"), 10, now, 48*time.Hour)
+	writeFile(t, filepath.Join(recent, "0.png"), 100, now, time.Minute)
+
+	stats, err := Sweep(dir, Policy{MaxAge: time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 1 || stats.RemovedBytes != 110 || stats.Kept != 1 || stats.KeptBytes != 110 {
+		t.Errorf("stats %+v, want one entry removed and one kept", stats)
+	}
+	if exists(filepath.Join(dir, "ab")) {
+		t.Error("the old entry was left behind")
+	}
+	if !exists(filepath.Join(recent, "entry.json")) || !exists(filepath.Join(recent, "0.png")) {
+		t.Error("part of the recent entry was removed")
+	}
+}
+
+// a directory that is or holds the input directory is never swept
+func TestSweepRefusesProtected(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	input := filepath.Join(root, "images")
+	writeFile(t, filepath.Join(input, "photo.jpg"), 10, now, 48*time.Hour)
+
+	for _, dir := range []string{input, root} {
+		_, err := Sweep(dir, Policy{MaxAge: time.Hour, Protect: []string{input}}, now)
+		if err == nil || !strings.Contains(err.Error(), "refusing") {
+			t.Errorf("%s: error %v, want the sweep refused", dir, err)
+		}
+	}
+	if !exists(filepath.Join(input, "photo.jpg")) {
+		t.Fatal("an input was removed")
+	}
+
+	// a sibling of the input is swept as usual
+	output := filepath.Join(root, "output")
+	writeFile(t, filepath.Join(output, "photo.jpg"), 10, now, 48*time.Hour)
+	if _, err := Sweep(output, Policy{MaxAge: time.Hour, Protect: []string{input}}, now); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(output, "photo.jpg")) {
+		t.Error("the output wasn't removed")
+	}
+}
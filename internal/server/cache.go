@@ -0,0 +1,106 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats are the metrics of the response cache
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// responseCache keeps the most recently used responses in memory, up to
+// maxBytes of them, so a repeated request skips decoding, filtering and
+// encoding altogether. It sits in front of cache_dir, which still has to
+// read the input to find an entry
+type responseCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// most recently used first
+	order *list.List
+	stats CacheStats
+}
+
+type cachedResponse struct {
+	key  string
+	name string
+	body []byte
+}
+
+// newResponseCache returns a cache of up to maxBytes, nil when it is 0
+func newResponseCache(maxBytes int64) *responseCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &responseCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		stats:    CacheStats{MaxBytes: maxBytes},
+	}
+}
+
+// get returns the response cached under key. A nil cache has none
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedResponse), true
+}
+
+// put caches a response, evicting the least recently used ones to make
+// room. Responses larger than a quarter of the cache aren't kept, so one
+// doesn't flush the rest
+func (c *responseCache) put(key, name string, body []byte) {
+	if c == nil || int64(len(body)) > c.maxBytes/4 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&cachedResponse{key: key, name: name, body: body})
+	c.stats.Bytes += int64(len(body))
+	for c.stats.Bytes > c.maxBytes {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *responseCache) remove(e *list.Element) {
+	r := c.order.Remove(e).(*cachedResponse)
+	delete(c.entries, r.key)
+	c.stats.Bytes -= int64(len(r.body))
+}
+
+// snapshot of the metrics, nil for a nil cache
+func (c *responseCache) snapshot() *CacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return &stats
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUnauthorized = errors.New("missing or invalid API key")
+	errRateLimited  = errors.New("rate limit exceeded")
+)
+
+// how often buckets of clients gone quiet are dropped
+const sweepInterval = time.Minute
+
+// apply the client's rate limit before next and, with requireKey, check
+// its API key
+func (s *Server) guard(next http.Handler, requireKey bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.current()
+		if (!requireKey || len(st.config.APIKeys) == 0) && st.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, ok := authenticate(r, st.config.APIKeys)
+		if !requireKey {
+			ok = true
+		}
+		// failed attempts count against the address, which slows guessing
+		if wait, allowed := st.limiter.allow(client, time.Now()); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.fail(w, http.StatusTooManyRequests, errRateLimited)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="image-processor"`)
+			s.fail(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// the client making the request, by key fingerprint when it sent a valid
+// API key of keys and by address otherwise, and whether it may proceed
+func authenticate(r *http.Request, keys []string) (string, bool) {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	if len(keys) == 0 {
+		return "addr:" + address, true
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		key = strings.TrimSpace(auth[7:])
+	}
+	if key == "" {
+		return "addr:" + address, false
+	}
+	valid := false
+	for _, k := range keys {
+		// every key is compared, so timing doesn't tell which one matched
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	if !valid {
+		return "addr:" + address, false
+	}
+	return "key:" + fingerprint(key), true
+}
+
+// a short identifier of key that is safe to log
+func fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// rateLimiter is a token bucket per client: each holds up to burst tokens,
+// refilled at rate per second, and a request takes one
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter of rate requests per second with bursts
+// of burst, nil when rate is 0
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// take a token from client's bucket, or report how long until one is
+// available. A nil limiter allows everything
+func (l *rateLimiter) allow(client string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// drop the buckets that have refilled, which behave like new ones, so
+// clients that went away don't pile up
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
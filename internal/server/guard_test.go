@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+func TestAuthenticate(t *testing.T) {
+	keys := []string{"first-key", "second-key"}
+	request := func(header, value string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/process", nil)
+		r.RemoteAddr = "192.0.2.7:51234"
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name          string
+		header, value string
+		keys          []string
+		client        string
+		ok            bool
+	}{
+		{"no keys configured", "", "", nil, "addr:192.0.2.7", true},
+		{"missing key", "", "", keys, "addr:192.0.2.7", false},
+		{"wrong key", "X-API-Key", "guess", keys, "addr:192.0.2.7", false},
+		{"X-API-Key", "X-API-Key", "second-key", keys, "key:" + fingerprint("second-key"), true},
+		{"bearer", "Authorization", "bearer first-key", keys, "key:" + fingerprint("first-key"), true},
+		{"other scheme", "Authorization", "Basic first-key", keys, "addr:192.0.2.7", false},
+	}
+	for _, tt := range tests {
+		client, ok := authenticate(request(tt.header, tt.value), tt.keys)
+		if client != tt.client || ok != tt.ok {
+			t.Errorf("%s: got %s, %v, want %s, %v", tt.name, client, ok, tt.client, tt.ok)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if _, ok := (*rateLimiter)(nil).allow("anyone", time.Now()); !ok {
+		t.Error("a nil limiter refused a request")
+	}
+
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allow("a", now); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	wait, ok := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("got %v, %v past the burst, want a 500ms wait", wait, ok)
+	}
+	// each client has its own bucket
+	if _, ok := l.allow("b", now); !ok {
+		t.Error("another client was refused")
+	}
+	if _, ok := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("refused after a token refilled")
+	}
+
+	// full buckets are dropped once a sweep is due
+	l.allow("c", now.Add(time.Minute+10*time.Second))
+	if _, kept := l.buckets["b"]; kept {
+		t.Error("a refilled bucket was kept")
+	}
+}
+
+// uploads need a key while other routes only count against the limit, and
+// failed attempts are limited like any other request
+func TestGuard(t *testing.T) {
+	cfg := &config.Config{APIKeys: []string{"secret"}, RateLimit: 1, RateBurst: 2}
+	s := New(cfg, nil, logger.NewLoggerWithOutput(false, "text", io.Discard))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(h http.Handler, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/process", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	upload := s.guard(ok, true)
+	if w := serve(upload, ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("without a key: %d, want 401 with a challenge", w.Code)
+	}
+	if w := serve(upload, "secret"); w.Code != http.StatusOK {
+		t.Errorf("with the key: %d, want 200", w.Code)
+	}
+	// the missing and wrong keys share the address's bucket, apart from
+	// the valid key's
+	if w := serve(upload, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("with a wrong key: %d, want 401", w.Code)
+	}
+	if w := serve(upload, "wrong"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("past the burst: %d, Retry-After %q, want 429 after 1s", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	s.Reload(&config.Config{APIKeys: []string{"secret"}})
+	if w := serve(s.guard(ok, false), ""); w.Code != http.StatusOK {
+		t.Errorf("unlimited route without a key: %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,270 @@
+// Package server exposes the processing pipeline over HTTP for the serve
+// command
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+	"github.com/arsalan9702/concurrent-image-processor/internal/models"
+	"github.com/arsalan9702/concurrent-image-processor/internal/processor"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tracing"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// Server runs uploaded images through a processor service
+type Server struct {
+	service *processor.Service
+	logger  logger.Logger
+	// replaced as a whole by Reload, so a request sees one configuration
+	state atomic.Pointer[state]
+}
+
+// the configuration of a server and what's built from it
+type state struct {
+	config  *config.Config
+	limiter *rateLimiter
+	cache   *responseCache
+}
+
+// New creates a server submitting to service
+func New(cfg *config.Config, service *processor.Service, log logger.Logger) *Server {
+	s := &Server{
+		service: service,
+		logger:  log,
+	}
+	s.Reload(cfg)
+	return s
+}
+
+// Reload applies a new configuration to the requests that follow: API keys,
+// rate limits, URL signing and the response cache, which starts empty since
+// its responses may come from the old pipeline. The listen address and TLS
+// files are only read at startup
+func (s *Server) Reload(cfg *config.Config) {
+	s.state.Store(&state{
+		config:  cfg,
+		limiter: newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+		cache:   newResponseCache(cfg.ResponseCacheSize),
+	})
+}
+
+// the current configuration
+func (s *Server) current() *state {
+	return s.state.Load()
+}
+
+// Handler adds the server's routes to mux, which may hold others such as
+// the health probes, and returns the handler to serve. Uploads need an API
+// key when api_keys is set; signed URLs carry their own authorization.
+// Both are rate limited, as is the list of filters
+func (s *Server) Handler(mux *http.ServeMux) http.Handler {
+	mux.Handle("POST /process", s.guard(http.HandlerFunc(s.handleProcess), true))
+	mux.Handle("GET /filters", s.guard(http.HandlerFunc(s.handleFilters), false))
+
+	transform := s.guard(http.HandlerFunc(s.handleTransform), false)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the source URL of a transformation has slashes ServeMux would clean
+		// away, so those requests go around it: any GET of a path with more
+		// than one segment, when URLs are signed
+		if s.current().config.URLSigningKey != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(strings.Trim(r.URL.Path, "/"), "/") {
+			transform.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// respond with the registered filters and their settings as JSON, so
+// clients can build pipelines without hardcoding them
+func (s *Server) handleFilters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(filterspec.All())
+}
+
+// process the request body as an image and respond with the output named by
+// the output query parameter, or the first one. Uploads and outputs live in
+// a temporary directory removed once the response is written
+func (s *Server) handleProcess(w http.ResponseWriter, r *http.Request) {
+	// continue the caller's trace, and tell it which span served the request
+	ctx := r.Context()
+	if sc, ok := tracing.ParseTraceParent(r.Header.Get("traceparent")); ok {
+		ctx = tracing.ContextWithSpanContext(ctx, sc)
+	}
+	ctx, span := s.service.Tracer().Start(ctx, "POST /process")
+	defer span.End()
+	if traceParent := tracing.SpanContextFromContext(ctx).TraceParent(); traceParent != "" {
+		w.Header().Set("traceparent", traceParent)
+	}
+
+	dir, err := os.MkdirTemp("", "imgproc-")
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	st := s.current()
+	input, digest, status, err := s.saveUpload(w, r, dir, st.config.MaxFileSize)
+	if err != nil {
+		s.fail(w, status, err)
+		return
+	}
+	key := "process\x00" + digest + "\x00" + r.URL.Query().Get("output")
+	if s.serveCached(w, r, st.cache, key, "") {
+		span.SetAttribute("cache_hit", true)
+		return
+	}
+
+	outputDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result, err := s.service.Process(ctx, input, outputDir)
+	if err != nil {
+		span.RecordError(err)
+		s.fail(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		s.fail(w, http.StatusUnprocessableEntity, result.Error)
+		return
+	}
+
+	output, ok := selectOutput(result.Outputs, r.URL.Query().Get("output"))
+	if !ok {
+		s.fail(w, http.StatusNotFound, errors.New("unknown output"))
+		return
+	}
+
+	s.logger.WithFields(map[string]interface{}{
+		"output":   output.Name,
+		"size":     output.Size,
+		"duration": result.ProcessingTime,
+	}).Info("Processed upload")
+	s.serveOutput(w, r, st.cache, key, output, "")
+}
+
+// CacheStats returns the metrics of the response cache, nil without one
+func (s *Server) CacheStats() *CacheStats {
+	return s.current().cache.snapshot()
+}
+
+// respond with the response cached under key, if any, with the
+// Cache-Control header cacheControl unless it's empty
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, cache *responseCache, key, cacheControl string) bool {
+	cached, ok := cache.get(key)
+	if !ok {
+		return false
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.Header().Set("X-Cache", "HIT")
+	http.ServeContent(w, r, cached.name, time.Time{}, bytes.NewReader(cached.body))
+	return true
+}
+
+// respond with an output file, caching it under key
+func (s *Server) serveOutput(w http.ResponseWriter, r *http.Request, cache *responseCache, key string, output models.OutputFile, cacheControl string) {
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if cache == nil {
+		http.ServeFile(w, r, output.Path)
+		return
+	}
+	body, err := os.ReadFile(output.Path)
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	cache.put(key, output.Name, body)
+	w.Header().Set("X-Cache", "MISS")
+	http.ServeContent(w, r, output.Name, time.Time{}, bytes.NewReader(body))
+}
+
+// write the request body to dir, named for its detected format so the
+// right decoder reads it, and return its path and SHA-256. Bodies over
+// maxSize are refused
+func (s *Server) saveUpload(w http.ResponseWriter, r *http.Request, dir string, maxSize int64) (string, string, int, error) {
+	body := http.MaxBytesReader(w, r.Body, maxSize)
+
+	// DICOM is recognized by a marker 128 bytes in
+	header := make([]byte, 132)
+	n, err := io.ReadFull(body, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", uploadStatus(err), err
+	}
+	header = header[:n]
+
+	ext := processor.DetectExtension(header)
+	if ext == "" {
+		return "", "", http.StatusUnsupportedMediaType, processor.ErrUnsupportedFormat
+	}
+
+	path := filepath.Join(dir, "upload"+ext)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	dst := io.MultiWriter(file, h)
+	if _, err := dst.Write(header); err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		return "", "", uploadStatus(err), err
+	}
+	return path, hex.EncodeToString(h.Sum(nil)), http.StatusOK, file.Close()
+}
+
+// status for an error reading the request body
+func uploadStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// output with the given name, or the first one when name is empty
+func selectOutput(outputs []models.OutputFile, name string) (models.OutputFile, bool) {
+	if len(outputs) == 0 {
+		return models.OutputFile{}, false
+	}
+	if name == "" {
+		return outputs[0], true
+	}
+	for _, output := range outputs {
+		if output.Name == name {
+			return output, true
+		}
+	}
+	return models.OutputFile{}, false
+}
+
+// log a failed request and respond with its error
+func (s *Server) fail(w http.ResponseWriter, status int, err error) {
+	s.logger.WithError(err).WithField("status", status).Warn("Request failed")
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/internal/fetch"
+	"github.com/arsalan9702/concurrent-image-processor/internal/filterspec"
+	"github.com/arsalan9702/concurrent-image-processor/internal/tracing"
+)
+
+// limit on the options of a transformation URL
+const maxOptions = 16
+
+var errBadSignature = errors.New("invalid signature")
+
+// Transformation is what a signed GET URL asks for: the source image, the
+// pipeline steps its options make, in order, and overrides of the job's
+// output such as quality and format
+type Transformation struct {
+	Source string
+	Steps  []config.PipelineStep
+	Params map[string]interface{}
+}
+
+// SignPath returns the signature of a transformation path, such as
+// /resize:800x600/plain/https://example.com/a.jpg: the unpadded URL-safe
+// base64 HMAC-SHA256 of the path under key. The URL served is
+// /<signature><path>
+func SignPath(key, path string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseTransformation checks the signature of a /<signature>/<options>/<source>
+// path, as sent, and parses the rest. Options are name:arg[:arg] segments,
+// each a pipeline step (resize, crop, filter, blur, brightness, contrast) or
+// an output setting (quality, format). The source is plain/ followed by the
+// percent-encoded URL, or the URL encoded as unpadded URL-safe base64; either
+// may end with the output format, as @png or .png
+func ParseTransformation(key, path string) (*Transformation, error) {
+	signature, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return nil, errors.New("missing source")
+	}
+	expected := SignPath(key, "/"+rest)
+	if !hmac.Equal([]byte(strings.TrimRight(signature, "=")), []byte(expected)) {
+		return nil, errBadSignature
+	}
+
+	t := &Transformation{Params: map[string]interface{}{}}
+	segments := strings.Split(rest, "/")
+	for i, segment := range segments {
+		if segment == "plain" {
+			return t, t.plainSource(strings.Join(segments[i+1:], "/"))
+		}
+		name, args, isOption := strings.Cut(segment, ":")
+		if !isOption {
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("invalid option %q", segment)
+			}
+			return t, t.encodedSource(segment)
+		}
+		if i >= maxOptions {
+			return nil, fmt.Errorf("more than %d options", maxOptions)
+		}
+		if err := t.option(name, strings.Split(args, ":")); err != nil {
+			return nil, fmt.Errorf("invalid option %q: %w", segment, err)
+		}
+	}
+	return nil, errors.New("missing source")
+}
+
+// apply one name:args option
+func (t *Transformation) option(name string, args []string) error {
+	step := func(filter string, params map[string]interface{}) {
+		t.Steps = append(t.Steps, config.PipelineStep{Filter: filter, Params: params})
+	}
+
+	switch name {
+	case "resize", "rs":
+		// 800x600 reads like 800:600
+		if len(args) == 1 {
+			args = strings.Split(args[0], "x")
+		}
+		size, err := ints(args, 2, 2)
+		if err != nil {
+			return err
+		}
+		step("resize", map[string]interface{}{"resize_width": size[0], "resize_height": size[1]})
+	case "crop", "c":
+		rect, err := ints(args, 2, 4)
+		if err != nil {
+			return err
+		}
+		params := map[string]interface{}{"crop_width": rect[0], "crop_height": rect[1]}
+		if len(rect) == 4 {
+			params["crop_x"], params["crop_y"] = rect[2], rect[3]
+		}
+		step("crop", params)
+	case "filter":
+		if len(args) != 1 || args[0] == "" {
+			return errors.New("takes a filter name")
+		}
+		if !urlFilter(args[0]) {
+			return fmt.Errorf("filter %s can't be used in a URL", args[0])
+		}
+		step(args[0], nil)
+	case "blur", "bl", "brightness", "br", "contrast", "co":
+		if len(args) != 1 {
+			return errors.New("takes one value")
+		}
+		v, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "blur", "bl":
+			step("blur", map[string]interface{}{"blur_radius": v})
+		case "brightness", "br":
+			step("brightness", map[string]interface{}{"brightness": v})
+		default:
+			step("contrast", map[string]interface{}{"contrast": v})
+		}
+	case "quality", "q":
+		q, err := ints(args, 1, 1)
+		if err != nil {
+			return err
+		}
+		t.Params["quality"] = q[0]
+	case "format", "ext":
+		if len(args) != 1 {
+			return errors.New("takes a format")
+		}
+		t.Params["output_format"] = args[0]
+	default:
+		return errors.New("unknown option")
+	}
+	return nil
+}
+
+// whether a URL may name filter: the built-in filters that run no command.
+// Custom filters are left out too, since they run whatever their plugin
+// does
+func urlFilter(name string) bool {
+	f, ok := filterspec.Lookup(name)
+	if !ok || f.Custom {
+		return false
+	}
+	for _, param := range f.Params {
+		if param.Type == filterspec.Command {
+			return false
+		}
+	}
+	return true
+}
+
+// args as non-negative integers, of which there must be least to most
+func ints(args []string, least, most int) ([]int, error) {
+	if len(args) < least || len(args) > most {
+		if least == most {
+			return nil, fmt.Errorf("takes %d values", least)
+		}
+		return nil, fmt.Errorf("takes %d to %d values", least, most)
+	}
+	values := make([]int, len(args))
+	for i, arg := range args {
+		v, err := strconv.Atoi(arg)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid value %q", arg)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// the source of a plain/ path: a percent-encoded URL, maybe ending in @ext
+func (t *Transformation) plainSource(escaped string) error {
+	source, err := url.PathUnescape(escaped)
+	if err != nil {
+		return fmt.Errorf("invalid source: %w", err)
+	}
+	if i := strings.LastIndex(source, "@"); i > strings.LastIndex(source, "/") {
+		t.Params["output_format"] = source[i+1:]
+		source = source[:i]
+	}
+	return t.setSource(source)
+}
+
+// the source of a base64 segment, maybe ending in .ext
+func (t *Transformation) encodedSource(segment string) error {
+	encoded, ext, hasExt := strings.Cut(segment, ".")
+	if hasExt {
+		t.Params["output_format"] = ext
+	}
+	source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return fmt.Errorf("invalid source: %w", err)
+	}
+	return t.setSource(string(source))
+}
+
+func (t *Transformation) setSource(source string) error {
+	if !fetch.IsURL(source) {
+		return fmt.Errorf("invalid source %q: must be an http or https URL", source)
+	}
+	t.Source = source
+	// jpg is the usual extension of jpeg
+	if t.Params["output_format"] == "jpg" {
+		t.Params["output_format"] = "jpeg"
+	}
+	return nil
+}
+
+// download the source of a signed transformation URL and respond with the
+// result of its pipeline
+func (s *Server) handleTransform(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if sc, ok := tracing.ParseTraceParent(r.Header.Get("traceparent")); ok {
+		ctx = tracing.ContextWithSpanContext(ctx, sc)
+	}
+	ctx, span := s.service.Tracer().Start(ctx, "GET transformation")
+	defer span.End()
+	if traceParent := tracing.SpanContextFromContext(ctx).TraceParent(); traceParent != "" {
+		w.Header().Set("traceparent", traceParent)
+	}
+
+	// the path as sent is what was signed
+	st := s.current()
+	t, err := ParseTransformation(st.config.URLSigningKey, r.URL.EscapedPath())
+	if errors.Is(err, errBadSignature) {
+		s.fail(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	// the same signed URL gives the same image, as long as its source
+	// doesn't change
+	cacheControl := fmt.Sprintf("public, max-age=%d", int(st.config.URLMaxAge.Seconds()))
+	_, transformation, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	key := "url\x00" + transformation
+	if s.serveCached(w, r, st.cache, key, cacheControl) {
+		span.SetAttribute("cache_hit", true)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "imgproc-")
+	if err != nil {
+		s.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// sources are kept in download_dir for later requests, or only for this
+	// one
+	downloads := st.config.DownloadDir
+	if downloads == "" {
+		downloads = filepath.Join(dir, "src")
+	}
+	downloader := fetch.NewDownloader(downloads, 1, st.config.DownloadRetries, st.config.DownloadTimeout, st.config.MaxFileSize)
+	input, err := downloader.Download(ctx, t.Source)
+	if err != nil {
+		span.RecordError(err)
+		s.fail(w, http.StatusBadGateway, fmt.Errorf("failed to download source: %w", err))
+		return
+	}
+
+	entry := config.ManifestEntry{
+		Input:     input,
+		OutputDir: filepath.Join(dir, "out"),
+		Pipeline:  t.Steps,
+		Params:    t.Params,
+	}
+	// without steps the image is only converted, rather than run through
+	// the configured pipeline
+	if len(t.Steps) == 0 {
+		entry.Params["filter"] = ""
+		entry.Params["pipeline"] = []config.PipelineStep{}
+		entry.Params["outputs"] = []config.PipelineOutput{}
+	}
+	result, err := s.service.ProcessEntry(ctx, entry)
+	if err != nil {
+		span.RecordError(err)
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		s.fail(w, http.StatusUnprocessableEntity, result.Error)
+		return
+	}
+	output, ok := selectOutput(result.Outputs, "")
+	if !ok {
+		s.fail(w, http.StatusInternalServerError, errors.New("no output"))
+		return
+	}
+
+	s.logger.WithFields(map[string]interface{}{
+		"source":   t.Source,
+		"steps":    len(t.Steps),
+		"size":     output.Size,
+		"duration": result.ProcessingTime,
+	}).Info("Processed transformation")
+	s.serveOutput(w, r, st.cache, key, output, cacheControl)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// a signed URL can name built-in filters, but none that runs a command
+func TestTransformationFilters(t *testing.T) {
+	const key = "secret"
+	parse := func(path string) (*Transformation, error) {
+		return ParseTransformation(key, "/"+SignPath(key, path)+path)
+	}
+
+	for _, name := range []string{"exec", "no-such-filter"} {
+		_, err := parse("/filter:" + name + "/plain/https://example.com/a.jpg")
+		if err == nil || !strings.Contains(err.Error(), "can't be used in a URL") {
+			t.Errorf("filter:%s: error %v, want it refused", name, err)
+		}
+	}
+
+	tr, err := parse("/filter:grayscale/plain/https://example.com/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Steps) != 1 || tr.Steps[0].Filter != "grayscale" {
+		t.Errorf("steps %+v, want grayscale", tr.Steps)
+	}
+}
+
+func TestSignPath(t *testing.T) {
+	got := SignPath("secret", "/resize:800x600/plain/https://example.com/a.jpg")
+	if want := "SdZNS_E8_Uw1nYScXUhkNryythZnmnNV0fXRIpB10HY"; got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+}
+
+func TestParseTransformation(t *testing.T) {
+	const key = "secret"
+	signed := func(path string) string { return "/" + SignPath(key, path) + path }
+
+	tr, err := ParseTransformation(key, signed("/rs:800x600/c:100:50:10:20/bl:1.5/q:80/plain/https://example.com/a%3Fb.jpg@jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Source != "https://example.com/a?b.jpg" {
+		t.Errorf("source %q", tr.Source)
+	}
+	var filters []string
+	for _, step := range tr.Steps {
+		filters = append(filters, step.Filter)
+	}
+	if strings.Join(filters, ",") != "resize,crop,blur" {
+		t.Errorf("steps %v, want resize, crop and blur", filters)
+	}
+	if tr.Steps[0].Params["resize_width"] != 800 || tr.Steps[1].Params["crop_y"] != 20 || tr.Steps[2].Params["blur_radius"] != 1.5 {
+		t.Errorf("step params %+v", tr.Steps)
+	}
+	if tr.Params["quality"] != 80 || tr.Params["output_format"] != "jpeg" {
+		t.Errorf("params %v, want quality 80 and jpeg", tr.Params)
+	}
+
+	// a base64 source with its format as an extension, and a padded
+	// signature
+	path := "/format:webp/aHR0cHM6Ly9leGFtcGxlLmNvbS9iLnBuZz92PTI.png"
+	tr, err = ParseTransformation(key, "/"+SignPath(key, path)+"="+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Source != "https://example.com/b.png?v=2" || tr.Params["output_format"] != "png" {
+		t.Errorf("got %q as %v, want b.png as png", tr.Source, tr.Params["output_format"])
+	}
+
+	refused := map[string]string{
+		"/" + SignPath("other", "/plain/https://example.com/a.jpg") + "/plain/https://example.com/a.jpg": "invalid signature",
+		signed("/plain/file:///etc/passwd"):                     "must be an http or https URL",
+		signed("/rotate:90/plain/https://example.com/a.jpg"):    "unknown option",
+		signed("/rs:800/plain/https://example.com/a.jpg"):       "takes 2 values",
+		signed("/q:-1/plain/https://example.com/a.jpg"):         "invalid value",
+		signed("/rs:1x1" + strings.Repeat("/q:80", maxOptions)): "more than",
+		signed("/rs:1x1"): "missing source",
+	}
+	for path, want := range refused {
+		_, err := ParseTransformation(key, path)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", path, err, want)
+		}
+	}
+	if _, err := ParseTransformation(key, "/x"+signed("/plain/https://example.com/a.jpg")[1:]); !errors.Is(err, errBadSignature) {
+		t.Errorf("altered signature: error %v, want errBadSignature", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Package ssim measures the structural similarity of two images, for
+// quality searches, output validation and golden image tests
+package ssim
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// window size and stride; overlapping windows smooth the score without the
+// cost of a per-pixel window
+const (
+	window = 8
+	stride = 4
+)
+
+// Luma returns the mean structural similarity of the luminance of two
+// images of the same size, 1 for identical images
+func Luma(a, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, fmt.Errorf("size mismatch: %v vs %v", a.Bounds().Size(), b.Bounds().Size())
+	}
+
+	la, lb := lumaPlane(a), lumaPlane(b)
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	size := min(window, width, height)
+	if size == 0 {
+		return 1, nil
+	}
+
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	total, count := 0.0, 0
+	for y := 0; y+size <= height; y += stride {
+		for x := 0; x+size <= width; x += stride {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+size; wy++ {
+				for wx := x; wx < x+size; wx++ {
+					va, vb := la[wy*width+wx], lb[wy*width+wx]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+
+			n := float64(size * size)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			count++
+		}
+	}
+
+	return total / float64(count), nil
+}
+
+// luminance of every pixel on a 0-255 scale, premultiplied so transparent
+// pixels read as black
+func lumaPlane(img image.Image) []float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	luma := make([]float64, width*height)
+
+	if rgba, ok := img.(*image.RGBA); ok {
+		for y := 0; y < height; y++ {
+			i := rgba.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			for x := 0; x < width; x, i = x+1, i+4 {
+				luma[y*width+x] = 0.299*float64(rgba.Pix[i]) + 0.587*float64(rgba.Pix[i+1]) + 0.114*float64(rgba.Pix[i+2])
+			}
+		}
+		return luma
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			g := color.Gray16Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+			luma[y*width+x] = float64(g.Y) / 257
+		}
+	}
+	return luma
+}
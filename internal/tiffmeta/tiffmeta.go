@@ -0,0 +1,366 @@
+// Package tiffmeta reads and rewrites the tags of the first IFD of a TIFF
+// file, which the standard decoders and encoders don't expose
+package tiffmeta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// field types
+const (
+	TypeByte      uint16 = 1
+	TypeASCII     uint16 = 2
+	TypeShort     uint16 = 3
+	TypeLong      uint16 = 4
+	TypeRational  uint16 = 5
+	TypeUndefined uint16 = 7
+	TypeSLong     uint16 = 9
+	TypeSRational uint16 = 10
+	TypeFloat     uint16 = 11
+	TypeDouble    uint16 = 12
+)
+
+var typeSize = map[uint16]uint32{
+	TypeByte:      1,
+	TypeASCII:     1,
+	TypeShort:     2,
+	TypeLong:      4,
+	TypeRational:  8,
+	TypeUndefined: 1,
+	TypeSLong:     4,
+	TypeSRational: 8,
+	TypeFloat:     4,
+	TypeDouble:    8,
+}
+
+var ErrNotTIFF = errors.New("not a TIFF file")
+
+// largest value read for one entry. Arrays of strip offsets or GeoTIFF keys
+// stay far below it, so a larger count is a corrupt or hostile file
+const maxValueSize = 64 << 20
+
+// Entry is a single IFD field with its raw value bytes in the file's byte order
+type Entry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Data  []byte
+}
+
+// Directory is the first IFD of a TIFF file
+type Directory struct {
+	Order   binary.ByteOrder
+	Entries []Entry
+}
+
+// Read parses the header and first IFD
+func Read(r io.ReaderAt) (*Directory, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, ErrNotTIFF
+	}
+
+	order, err := byteOrder(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadIFD(r, order, int64(order.Uint32(header[4:])))
+}
+
+// ReadIFD parses the IFD at offset, such as an EXIF or GPS sub-IFD pointed
+// to by a LONG entry of the first IFD
+func ReadIFD(r io.ReaderAt, order binary.ByteOrder, offset int64) (*Directory, error) {
+	dir := &Directory{Order: order}
+	size := readerSize(r)
+
+	countBuf := make([]byte, 2)
+	if _, err := r.ReadAt(countBuf, offset); err != nil {
+		return nil, fmt.Errorf("reading IFD: %w", err)
+	}
+	count := int(order.Uint16(countBuf))
+
+	raw := make([]byte, count*12)
+	if _, err := r.ReadAt(raw, offset+2); err != nil {
+		return nil, fmt.Errorf("reading IFD entries: %w", err)
+	}
+
+	for i := 0; i < count; i++ {
+		e := raw[i*12 : i*12+12]
+		entry := Entry{
+			Tag:   order.Uint16(e[0:]),
+			Type:  order.Uint16(e[2:]),
+			Count: order.Uint32(e[4:]),
+		}
+
+		valueSize, ok := typeSize[entry.Type]
+		if !ok {
+			// unknown types can't be sized, so they can't be carried over
+			continue
+		}
+
+		// 64 bits so a huge count can't wrap around to a small size
+		n := uint64(valueSize) * uint64(entry.Count)
+		if n <= 4 {
+			entry.Data = append([]byte(nil), e[8:8+n]...)
+		} else {
+			valueOffset := int64(order.Uint32(e[8:]))
+			if n > maxValueSize || size >= 0 && (valueOffset > size || n > uint64(size-valueOffset)) {
+				return nil, fmt.Errorf("tag %d: %d bytes of values at offset %d run past the end of the file", entry.Tag, n, valueOffset)
+			}
+			entry.Data = make([]byte, n)
+			if _, err := r.ReadAt(entry.Data, valueOffset); err != nil {
+				return nil, fmt.Errorf("reading tag %d: %w", entry.Tag, err)
+			}
+		}
+
+		dir.Entries = append(dir.Entries, entry)
+	}
+
+	return dir, nil
+}
+
+// the size of the data behind r, or -1 when r doesn't tell
+func readerSize(r io.ReaderAt) int64 {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+// whether e holds the Count values of size bytes it claims, which entries
+// built by hand or read from a corrupt file may not
+func (e Entry) holds(size int) bool {
+	return uint64(len(e.Data)) >= uint64(e.Count)*uint64(size)
+}
+
+// Find returns the entry for tag, if present
+func (d *Directory) Find(tag uint16) (Entry, bool) {
+	for _, e := range d.Entries {
+		if e.Tag == tag {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Shorts decodes SHORT values
+func (d *Directory) Shorts(e Entry) []uint16 {
+	if e.Type != TypeShort || !e.holds(2) {
+		return nil
+	}
+	values := make([]uint16, e.Count)
+	for i := range values {
+		values[i] = d.Order.Uint16(e.Data[i*2:])
+	}
+	return values
+}
+
+// Longs decodes SHORT or LONG values
+func (d *Directory) Longs(e Entry) []uint32 {
+	if e.Type != TypeShort && e.Type != TypeLong || !e.holds(int(typeSize[e.Type])) {
+		return nil
+	}
+	values := make([]uint32, e.Count)
+	switch e.Type {
+	case TypeShort:
+		for i := range values {
+			values[i] = uint32(d.Order.Uint16(e.Data[i*2:]))
+		}
+	case TypeLong:
+		for i := range values {
+			values[i] = d.Order.Uint32(e.Data[i*4:])
+		}
+	}
+	return values
+}
+
+// Rationals decodes RATIONAL or SRATIONAL values as numerator and
+// denominator pairs
+func (d *Directory) Rationals(e Entry) [][2]int64 {
+	if e.Type != TypeRational && e.Type != TypeSRational || !e.holds(8) {
+		return nil
+	}
+	values := make([][2]int64, e.Count)
+	for i := range values {
+		num, den := d.Order.Uint32(e.Data[i*8:]), d.Order.Uint32(e.Data[i*8+4:])
+		if e.Type == TypeSRational {
+			values[i] = [2]int64{int64(int32(num)), int64(int32(den))}
+		} else {
+			values[i] = [2]int64{int64(num), int64(den)}
+		}
+	}
+	return values
+}
+
+// Doubles decodes DOUBLE values
+func (d *Directory) Doubles(e Entry) []float64 {
+	if e.Type != TypeDouble || !e.holds(8) {
+		return nil
+	}
+	values := make([]float64, e.Count)
+	for i := range values {
+		values[i] = math.Float64frombits(d.Order.Uint64(e.Data[i*8:]))
+	}
+	return values
+}
+
+// ASCII decodes an ASCII value, dropping the trailing NUL
+func (d *Directory) ASCII(e Entry) string {
+	if e.Type != TypeASCII {
+		return ""
+	}
+	s := string(e.Data)
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// ShortsEntry builds a SHORT entry in the given byte order
+func ShortsEntry(order binary.ByteOrder, tag uint16, values []uint16) Entry {
+	data := make([]byte, len(values)*2)
+	for i, v := range values {
+		order.PutUint16(data[i*2:], v)
+	}
+	return Entry{Tag: tag, Type: TypeShort, Count: uint32(len(values)), Data: data}
+}
+
+// LongsEntry builds a LONG entry in the given byte order
+func LongsEntry(order binary.ByteOrder, tag uint16, values []uint32) Entry {
+	data := make([]byte, len(values)*4)
+	for i, v := range values {
+		order.PutUint32(data[i*4:], v)
+	}
+	return Entry{Tag: tag, Type: TypeLong, Count: uint32(len(values)), Data: data}
+}
+
+// DoublesEntry builds a DOUBLE entry in the given byte order
+func DoublesEntry(order binary.ByteOrder, tag uint16, values []float64) Entry {
+	data := make([]byte, len(values)*8)
+	for i, v := range values {
+		order.PutUint64(data[i*8:], math.Float64bits(v))
+	}
+	return Entry{Tag: tag, Type: TypeDouble, Count: uint32(len(values)), Data: data}
+}
+
+// ASCIIEntry builds a NUL-terminated ASCII entry
+func ASCIIEntry(tag uint16, value string) Entry {
+	data := append([]byte(value), 0)
+	return Entry{Tag: tag, Type: TypeASCII, Count: uint32(len(data)), Data: data}
+}
+
+// AddTags returns a copy of a TIFF file whose first IFD also holds extra,
+// replacing existing entries with the same tag. The new IFD and out-of-line
+// values are appended to the end of the file, so existing strip and tile data
+// keeps its offsets
+func AddTags(data []byte, extra []Entry) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, ErrNotTIFF
+	}
+
+	dir, err := Read(byteReaderAt(data))
+	if err != nil {
+		return nil, err
+	}
+	order := dir.Order
+
+	byTag := map[uint16]Entry{}
+	for _, e := range dir.Entries {
+		byTag[e.Tag] = e
+	}
+	for _, e := range extra {
+		byTag[e.Tag] = e
+	}
+
+	entries := make([]Entry, 0, len(byTag))
+	for _, e := range byTag {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Tag < entries[j].Tag })
+
+	// keep the next-IFD pointer of the original first IFD
+	oldOffset := order.Uint32(data[4:])
+	oldCount := uint32(order.Uint16(data[oldOffset:]))
+	var next uint32
+	if end := oldOffset + 2 + oldCount*12; int(end)+4 <= len(data) {
+		next = order.Uint32(data[end:])
+	}
+
+	out := append([]byte(nil), data...)
+	if len(out)%2 == 1 {
+		out = append(out, 0)
+	}
+
+	ifdOffset := uint32(len(out))
+	out = append(out, MarshalIFD(order, entries, ifdOffset, next)...)
+	order.PutUint32(out[4:], ifdOffset)
+
+	return out, nil
+}
+
+// MarshalIFD encodes entries, sorted by tag, as an IFD written at offset
+// and followed by the values that don't fit in their fields; next is the
+// offset of the following IFD, 0 for none
+func MarshalIFD(order binary.ByteOrder, entries []Entry, offset, next uint32) []byte {
+	ifd := make([]byte, 2+len(entries)*12+4)
+	valueOffset := offset + uint32(len(ifd))
+	var values []byte
+
+	order.PutUint16(ifd, uint16(len(entries)))
+	for i, e := range entries {
+		field := ifd[2+i*12:]
+		order.PutUint16(field[0:], e.Tag)
+		order.PutUint16(field[2:], e.Type)
+		order.PutUint32(field[4:], e.Count)
+
+		if len(e.Data) <= 4 {
+			copy(field[8:12], e.Data)
+			continue
+		}
+
+		order.PutUint32(field[8:], valueOffset+uint32(len(values)))
+		values = append(values, e.Data...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	order.PutUint32(ifd[2+len(entries)*12:], next)
+
+	return append(ifd, values...)
+}
+
+func byteOrder(header []byte) (binary.ByteOrder, error) {
+	switch {
+	case header[0] == 'I' && header[1] == 'I' && header[2] == 42 && header[3] == 0:
+		return binary.LittleEndian, nil
+	case header[0] == 'M' && header[1] == 'M' && header[2] == 0 && header[3] == 42:
+		return binary.BigEndian, nil
+	default:
+		return nil, ErrNotTIFF
+	}
+}
+
+type byteReaderAt []byte
+
+func (b byteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,81 @@
+package tiffmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// a little-endian TIFF whose first IFD, at offset 8, holds entries
+func tiffWith(entries ...Entry) []byte {
+	data := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	return append(data, MarshalIFD(binary.LittleEndian, entries, 8, 0)...)
+}
+
+// a count whose size wraps around 32 bits must not pass for a short value
+func TestReadOverflowingCount(t *testing.T) {
+	data := tiffWith(Entry{Tag: 274, Type: TypeLong, Count: 0x40000001, Data: []byte{1, 0, 0, 0}})
+	if len(data) > 64 {
+		t.Fatalf("test file is %d bytes", len(data))
+	}
+	if _, err := Read(bytes.NewReader(data)); err == nil {
+		t.Fatal("no error for a count past the end of the file")
+	}
+
+	// a count over the file's size, without wrapping
+	data = tiffWith(Entry{Tag: 33550, Type: TypeDouble, Count: 1000, Data: make([]byte, 16)})
+	if _, err := Read(bytes.NewReader(data)); err == nil {
+		t.Fatal("no error for values past the end of the file")
+	}
+}
+
+// accessors return nothing for entries claiming more values than they hold
+func TestShortEntries(t *testing.T) {
+	d := &Directory{Order: binary.LittleEndian}
+	short := func(typ uint16) Entry { return Entry{Type: typ, Count: 0x40000001, Data: make([]byte, 4)} }
+	if v := d.Longs(short(TypeLong)); v != nil {
+		t.Errorf("Longs: %d values", len(v))
+	}
+	if v := d.Longs(short(TypeShort)); v != nil {
+		t.Errorf("Longs of SHORT: %d values", len(v))
+	}
+	if v := d.Shorts(short(TypeShort)); v != nil {
+		t.Errorf("Shorts: %d values", len(v))
+	}
+	if v := d.Rationals(short(TypeRational)); v != nil {
+		t.Errorf("Rationals: %d values", len(v))
+	}
+	if v := d.Doubles(short(TypeDouble)); v != nil {
+		t.Errorf("Doubles: %d values", len(v))
+	}
+
+	e := LongsEntry(binary.LittleEndian, 1, []uint32{7, 9})
+	if v := d.Longs(e); len(v) != 2 || v[0] != 7 || v[1] != 9 {
+		t.Errorf("Longs of a whole entry: %v", v)
+	}
+}
+
+// no file, however corrupt, makes reading its tags panic
+func FuzzRead(f *testing.F) {
+	f.Add(tiffWith(Entry{Tag: 274, Type: TypeLong, Count: 0x40000001, Data: []byte{1, 0, 0, 0}}))
+	f.Add(tiffWith(
+		ShortsEntry(binary.LittleEndian, 274, []uint16{6}),
+		DoublesEntry(binary.LittleEndian, 33550, []float64{0.5, 0.5, 0}),
+		ASCIIEntry(271, "camera"),
+		Entry{Tag: 282, Type: TypeRational, Count: 1, Data: []byte{72, 0, 0, 0, 1, 0, 0, 0}},
+	))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir, err := Read(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, e := range dir.Entries {
+			dir.Shorts(e)
+			dir.Longs(e)
+			dir.Rationals(e)
+			dir.Doubles(e)
+			dir.ASCII(e)
+		}
+		AddTags(data, []Entry{ASCIIEntry(305, "fuzz")})
+	})
+}
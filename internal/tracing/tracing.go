@@ -0,0 +1,220 @@
+// Package tracing records spans for the job lifecycle. Its Tracer and Span
+// mirror the OpenTelemetry trace API, and trace context travels as W3C
+// traceparent values, so an OpenTelemetry SDK can be plugged in behind
+// Tracer without touching the instrumented code. The built-in exporter
+// writes finished spans as JSON lines
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether the trace and span IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats sc as a W3C traceparent value, "" if it isn't valid
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// ParseTraceParent parses a W3C traceparent value
+func ParseTraceParent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	trace, err := hex.DecodeString(parts[1])
+	if err != nil || len(trace) != len(sc.TraceID) {
+		return sc, false
+	}
+	span, err := hex.DecodeString(parts[2])
+	if err != nil || len(span) != len(sc.SpanID) {
+		return sc, false
+	}
+	copy(sc.TraceID[:], trace)
+	copy(sc.SpanID[:], span)
+	return sc, sc.IsValid()
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext returns ctx with sc as the parent of spans started
+// from it
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx, if any
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// Span is one timed operation
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts spans as children of the span carried by ctx, returning a
+// context carrying the new span
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Noop is a tracer that records nothing. Spans it starts still carry their
+// parent's context, so propagation works with tracing disabled
+var Noop Tracer = noopTracer{}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{SpanContextFromContext(ctx)}
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext                 { return s.sc }
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// JSONTracer writes each span as a JSON line to its writer when it ends
+type JSONTracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONTracer creates a tracer exporting to w
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{w: w}
+}
+
+// a finished span as exported
+type spanRecord struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	DurationMs   float64                `json:"duration_ms"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Status       string                 `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Start begins a span, in a new trace if ctx carries none
+func (t *JSONTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+
+	s := &jsonSpan{tracer: t, name: name, start: time.Now(), parent: parent}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+	}
+	rand.Read(s.sc.SpanID[:])
+
+	return ContextWithSpanContext(ctx, s.sc), s
+}
+
+type jsonSpan struct {
+	tracer *JSONTracer
+	name   string
+	start  time.Time
+	sc     SpanContext
+	parent SpanContext
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (s *jsonSpan) SpanContext() SpanContext {
+	return s.sc
+}
+
+func (s *jsonSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = map[string]interface{}{}
+	}
+	s.attrs[key] = value
+}
+
+func (s *jsonSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End exports the span; later calls do nothing
+func (s *jsonSpan) End() {
+	end := time.Now()
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	record := spanRecord{
+		TraceID:    hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:     hex.EncodeToString(s.sc.SpanID[:]),
+		Name:       s.name,
+		Start:      s.start,
+		End:        end,
+		DurationMs: float64(end.Sub(s.start)) / float64(time.Millisecond),
+		Attributes: s.attrs,
+		Status:     "ok",
+	}
+	if s.err != nil {
+		record.Status, record.Error = "error", s.err.Error()
+	}
+	s.mu.Unlock()
+
+	if s.parent.IsValid() {
+		record.ParentSpanID = hex.EncodeToString(s.parent.SpanID[:])
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.w.Write(append(data, '\n'))
+}
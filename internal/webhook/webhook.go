@@ -0,0 +1,223 @@
+// Package webhook notifies HTTP endpoints of job failures and completed
+// batches, so pipelines and chat integrations can react without scraping
+// logs
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/config"
+	"github.com/arsalan9702/concurrent-image-processor/pkg/logger"
+)
+
+// requests in flight at once; further notifications wait their turn
+const maxInFlight = 8
+
+// first wait between attempts, doubled after each failed one
+const retryBackoff = time.Second
+
+// Payload is what a webhook receives: the JSON body, or the data its
+// template is executed with
+type Payload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// the failed job of a job_failed event
+	JobID      string  `json:"job_id,omitempty"`
+	Input      string  `json:"input,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms,omitempty"`
+
+	// the run summary of a batch_completed event, as logged, with
+	// durations in milliseconds under <key>_ms, and the run's exit_code
+	Summary map[string]interface{} `json:"summary,omitempty"`
+}
+
+// Notifier delivers events to the configured webhooks in the background.
+// A nil Notifier notifies nothing
+type Notifier struct {
+	hooks   []hook
+	client  *http.Client
+	retries int
+	logger  logger.Logger
+
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+// a webhook with its template parsed
+type hook struct {
+	config.Webhook
+	template *template.Template
+}
+
+// New returns a notifier for the webhooks of cfg, nil if there are none
+func New(cfg *config.Config, log logger.Logger) (*Notifier, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	n := &Notifier{
+		client:   &http.Client{Timeout: cfg.WebhookTimeout},
+		retries:  cfg.WebhookRetries,
+		logger:   log,
+		inFlight: make(chan struct{}, maxInFlight),
+	}
+	for _, w := range cfg.Webhooks {
+		tmpl, err := w.ParseTemplate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+		n.hooks = append(n.hooks, hook{Webhook: w, template: tmpl})
+	}
+	return n, nil
+}
+
+// JobFailed notifies the webhooks of a failed job
+func (n *Notifier) JobFailed(jobID, input string, err error, duration time.Duration) {
+	n.send(Payload{
+		Event:      config.WebhookJobFailed,
+		JobID:      jobID,
+		Input:      input,
+		Error:      err.Error(),
+		DurationMs: float64(duration) / float64(time.Millisecond),
+	})
+}
+
+// BatchCompleted notifies the webhooks that a batch run ended with summary
+// and is exiting with exitCode
+func (n *Notifier) BatchCompleted(summary map[string]interface{}, exitCode int) {
+	converted := map[string]interface{}{"exit_code": exitCode}
+	for key, value := range summary {
+		if d, ok := value.(time.Duration); ok {
+			converted[key+"_ms"] = float64(d) / float64(time.Millisecond)
+			continue
+		}
+		converted[key] = value
+	}
+	n.send(Payload{Event: config.WebhookBatchCompleted, Summary: converted})
+}
+
+// Wait blocks until the notifications sent so far are delivered or given up
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// deliver p to every webhook taking its event
+func (n *Notifier) send(p Payload) {
+	if n == nil {
+		return
+	}
+	p.Time = time.Now()
+
+	for _, h := range n.hooks {
+		if !h.wants(p.Event) {
+			continue
+		}
+		body, err := h.body(p)
+		if err != nil {
+			n.logger.WithError(err).WithField("url", h.URL).Warn("Failed to render webhook body")
+			continue
+		}
+
+		n.wg.Add(1)
+		go func(h hook) {
+			defer n.wg.Done()
+			n.inFlight <- struct{}{}
+			defer func() { <-n.inFlight }()
+			if err := n.deliver(h, body); err != nil {
+				n.logger.WithError(err).WithFields(map[string]interface{}{
+					"url":   h.URL,
+					"event": p.Event,
+				}).Warn("Failed to call webhook")
+			}
+		}(h)
+	}
+}
+
+func (h hook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h hook) body(p Payload) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(p)
+	}
+	var buf bytes.Buffer
+	if err := h.template.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// POST body to the webhook, retrying network errors, 429 and 5xx
+// responses with exponential backoff
+func (n *Notifier) deliver(h hook, body []byte) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := n.post(h, body)
+		if err == nil {
+			return nil
+		}
+		if attempt >= n.retries || !retryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// a response other than 2xx
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+}
+
+func retryable(err error) bool {
+	if status, ok := err.(*statusError); ok {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	return true
+}
+
+func (n *Notifier) post(h hook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// templates for other formats set their own Content-Type
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "concurrent-image-processor")
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package imagetest helps test filters and pipelines against golden
+// images: it generates synthetic inputs, compares outputs with a tolerance
+// on each channel and on SSIM, and rewrites the golden files when asked
+//
+//	func TestSepia(t *testing.T) {
+//		got := sepia(imagetest.Gradient(64, 64))
+//		imagetest.AssertGolden(t, imagetest.Golden("sepia"), got, imagetest.Tolerance{MaxDelta: 1})
+//	}
+//
+// IMAGETEST_UPDATE=1 go test writes the outputs as the new goldens instead
+// of comparing with them
+package imagetest
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arsalan9702/concurrent-image-processor/internal/ssim"
+)
+
+// Update makes AssertGolden write its image as the golden file instead of
+// comparing with it. It is set by IMAGETEST_UPDATE=1 rather than a flag, so
+// importing the package adds no flags to the test binary
+var Update = os.Getenv("IMAGETEST_UPDATE") == "1"
+
+// Gradient returns a w×h opaque image whose red rises from left to right,
+// green from top to bottom and blue along the diagonal, so every pixel
+// differs and filters that shift or blend pixels show
+func Gradient(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: level(x, w),
+				G: level(y, h),
+				B: level(x+y, w+h-1),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// Checkerboard returns a w×h image of size×size squares of a and b, starting
+// with a at the top left, for edges in both directions
+func Checkerboard(w, h, size int, a, b color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := a
+			if (x/size+y/size)%2 == 1 {
+				c = b
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// Noise returns a w×h image of random opaque colors, the same for the same
+// seed on every run
+func Noise(w, h int, seed int64) *image.RGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = uint8(rng.Intn(256))
+		img.Pix[i+1] = uint8(rng.Intn(256))
+		img.Pix[i+2] = uint8(rng.Intn(256))
+		img.Pix[i+3] = 255
+	}
+	return img
+}
+
+// Solid returns a w×h image of c
+func Solid(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// i of n spread over 0 to 255
+func level(i, n int) uint8 {
+	if n <= 1 {
+		return 0
+	}
+	return uint8(i * 255 / (n - 1))
+}
+
+// Tolerance is how far an image may be from its golden
+type Tolerance struct {
+	// largest difference allowed in any channel of any pixel, 0 for an
+	// exact match
+	MaxDelta uint8
+	// lowest SSIM allowed, 0 to skip the check
+	MinSSIM float64
+}
+
+// Diff is how two images of the same size differ
+type Diff struct {
+	// largest difference of any channel, in 8-bit levels
+	MaxDelta uint8
+	// pixels with any channel differing, and the first of them in row order
+	Pixels int
+	First  image.Point
+	// structural similarity of the luminance, 1 for identical images
+	SSIM float64
+}
+
+// Within reports whether d is inside tol
+func (d Diff) Within(tol Tolerance) bool {
+	return d.MaxDelta <= tol.MaxDelta && (tol.MinSSIM == 0 || d.SSIM >= tol.MinSSIM)
+}
+
+func (d Diff) String() string {
+	if d.Pixels == 0 {
+		return "identical"
+	}
+	return fmt.Sprintf("%d pixels differ, first at %v, by up to %d levels, SSIM %.4f", d.Pixels, d.First, d.MaxDelta, d.SSIM)
+}
+
+// Compare returns how got differs from want, compared as 8-bit
+// non-premultiplied RGBA. Images of different sizes are an error
+func Compare(got, want image.Image) (Diff, error) {
+	if got.Bounds().Size() != want.Bounds().Size() {
+		return Diff{}, fmt.Errorf("size %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+
+	a, b := nrgba(got), nrgba(want)
+	diff := Diff{SSIM: 1}
+	for i := 0; i < len(a.Pix); i += 4 {
+		differs := false
+		for c := 0; c < 4; c++ {
+			delta := a.Pix[i+c] - b.Pix[i+c]
+			if b.Pix[i+c] > a.Pix[i+c] {
+				delta = b.Pix[i+c] - a.Pix[i+c]
+			}
+			if delta > 0 {
+				differs = true
+				diff.MaxDelta = max(diff.MaxDelta, delta)
+			}
+		}
+		if differs {
+			if diff.Pixels == 0 {
+				w := a.Bounds().Dx()
+				diff.First = image.Pt(i/4%w, i/4/w)
+			}
+			diff.Pixels++
+		}
+	}
+	if diff.Pixels > 0 {
+		score, err := ssim.Luma(a, b)
+		if err != nil {
+			return Diff{}, err
+		}
+		diff.SSIM = score
+	}
+	return diff, nil
+}
+
+// img as NRGBA with its origin at 0,0
+func nrgba(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+	return out
+}
+
+// Golden returns the path of the golden image of the given name,
+// testdata/golden/<name>.png in the package under test
+func Golden(name string) string {
+	return filepath.Join("testdata", "golden", name+".png")
+}
+
+// AssertGolden fails t unless got is within tol of the PNG at path. With
+// Update set it writes got to path instead, creating its directory
+func AssertGolden(t testing.TB, path string, got image.Image, tol Tolerance) {
+	t.Helper()
+	if Update {
+		if err := WritePNG(path, got); err != nil {
+			t.Fatalf("failed to update golden %s: %v", path, err)
+		}
+		t.Logf("updated golden %s", path)
+		return
+	}
+
+	want, err := ReadImage(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("golden %s doesn't exist; run IMAGETEST_UPDATE=1 go test to create it", path)
+	}
+	if err != nil {
+		t.Fatalf("failed to read golden %s: %v", path, err)
+	}
+	diff, err := Compare(got, want)
+	if err != nil {
+		t.Fatalf("golden %s: %v", path, err)
+	}
+	if !diff.Within(tol) {
+		t.Errorf("golden %s: %s; run IMAGETEST_UPDATE=1 go test if the change is intended", path, diff)
+	}
+}
+
+// ReadImage decodes the image file at path, in any format registered with
+// the image package
+func ReadImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// WritePNG encodes img as a PNG file at path, creating its directory
+func WritePNG(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,77 @@
+package imagetest
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	a := Gradient(32, 32)
+	diff, err := Compare(a, Gradient(32, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Pixels != 0 || diff.SSIM != 1 || !diff.Within(Tolerance{}) {
+		t.Errorf("identical images differ: %s", diff)
+	}
+
+	b := Gradient(32, 32)
+	b.SetRGBA(5, 3, color.RGBA{0, 0, 0, 255})
+	b.SetRGBA(7, 3, color.RGBA{255, 255, 255, 255})
+	diff, err = Compare(b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Pixels != 2 || diff.First != image.Pt(5, 3) {
+		t.Errorf("got %d pixels from %v, want 2 from (5,3)", diff.Pixels, diff.First)
+	}
+	if diff.SSIM >= 1 || diff.SSIM < 0.9 {
+		t.Errorf("SSIM %g for two changed pixels", diff.SSIM)
+	}
+	if diff.Within(Tolerance{MaxDelta: 1}) || !diff.Within(Tolerance{MaxDelta: 255, MinSSIM: 0.9}) {
+		t.Errorf("tolerances misjudge %s", diff)
+	}
+
+	if _, err := Compare(a, Gradient(32, 31)); err == nil {
+		t.Error("images of different sizes compared")
+	}
+}
+
+func TestNoiseRepeats(t *testing.T) {
+	diff, err := Compare(Noise(16, 16, 7), Noise(16, 16, 7))
+	if err != nil || diff.Pixels != 0 {
+		t.Errorf("the same seed gave different noise: %s, %v", diff, err)
+	}
+	if diff, _ := Compare(Noise(16, 16, 7), Noise(16, 16, 8)); diff.Pixels == 0 {
+		t.Error("different seeds gave the same noise")
+	}
+}
+
+func TestCheckerboard(t *testing.T) {
+	black, white := color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}
+	img := Checkerboard(8, 8, 2, black, white)
+	for _, c := range []struct {
+		x, y int
+		want color.RGBA
+	}{{0, 0, black}, {1, 1, black}, {2, 0, white}, {0, 2, white}, {2, 2, black}} {
+		if got := img.RGBAAt(c.x, c.y); got != c.want {
+			t.Errorf("pixel %d,%d is %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+}
+
+func TestAssertGoldenUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "golden", "gradient.png")
+	defer func(update bool) { Update = update }(Update)
+
+	Update = true
+	AssertGolden(t, path, Gradient(16, 16), Tolerance{})
+	Update = false
+	AssertGolden(t, path, Gradient(16, 16), Tolerance{})
+
+	if _, err := ReadImage(path); err != nil {
+		t.Fatal(err)
+	}
+}
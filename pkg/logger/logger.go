@@ -1,7 +1,9 @@
 package logger
 
 import (
+	"io"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -26,8 +28,20 @@ type LogrusLogger struct {
 
 // creating new logger instance
 func NewLogger(verbose bool) Logger {
+	return NewLoggerWithFormat(verbose, "text")
+}
+
+// NewLoggerWithFormat creates a logger writing colored text, or one JSON
+// object per line for log collectors when format is "json"
+func NewLoggerWithFormat(verbose bool, format string) Logger {
+	return NewLoggerWithOutput(verbose, format, os.Stdout)
+}
+
+// NewLoggerWithOutput creates a logger like NewLoggerWithFormat writing to
+// out, such as stderr when stdout carries data
+func NewLoggerWithOutput(verbose bool, format string, out io.Writer) Logger {
 	logger := logrus.New()
-	logger.SetOutput(os.Stdout)
+	logger.SetOutput(out)
 
 	if verbose {
 		logger.SetLevel(logrus.DebugLevel)
@@ -35,11 +49,18 @@ func NewLogger(verbose bool) Logger {
 		logger.SetLevel(logrus.InfoLevel)
 	}
 
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: "2006-01-02 15:04:05",
-		ForceColors:     true,
-	})
+	if format == "json" {
+		logger.SetFormatter(&jsonFormatter{
+			JSONFormatter: logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano},
+		})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02 15:04:05",
+			// log files get plain text
+			ForceColors: out == os.Stdout || out == os.Stderr,
+		})
+	}
 
 	return &LogrusLogger{
 		logger: logger,
@@ -47,6 +68,24 @@ func NewLogger(verbose bool) Logger {
 	}
 }
 
+// jsonFormatter writes duration fields as milliseconds under <key>_ms,
+// which log collectors can aggregate, instead of integer nanoseconds
+type jsonFormatter struct {
+	logrus.JSONFormatter
+}
+
+func (f *jsonFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	converted := entry.Dup()
+	converted.Level, converted.Message, converted.Caller = entry.Level, entry.Message, entry.Caller
+	for key, value := range entry.Data {
+		if d, ok := value.(time.Duration); ok {
+			delete(converted.Data, key)
+			converted.Data[key+"_ms"] = float64(d) / float64(time.Millisecond)
+		}
+	}
+	return f.JSONFormatter.Format(converted)
+}
+
 // holds debug message
 func (l *LogrusLogger) Debug(args ...interface{}) {
 	l.entry.Debug(args...)
@@ -95,3 +134,10 @@ func (l *LogrusLogger) WithError(err error) Logger {
 		entry:  l.entry.WithError(err),
 	}
 }
+
+// OnFatal runs fn when Fatal is about to exit the process, such as to
+// restore the terminal. It can't be undone, so fn should do nothing once
+// it's no longer needed
+func OnFatal(fn func()) {
+	logrus.RegisterExitHandler(fn)
+}
@@ -24,7 +24,7 @@ echo "Go version: $GO_VERSION"
 
 # Build for current platform
 echo "Building for current platform..."
-go build -ldflags "$LDFLAGS" -o bin/processor cmd/processor/main.go
+go build -ldflags "$LDFLAGS" -o bin/processor ./cmd/processor
 
 # Build for multiple platforms (optional)
 if [ "$1" = "all" ]; then
@@ -32,23 +32,23 @@ if [ "$1" = "all" ]; then
     
     # Linux AMD64
     echo "Building for Linux AMD64..."
-    GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS" -o bin/processor-linux-amd64 cmd/processor/main.go
+    GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS" -o bin/processor-linux-amd64 ./cmd/processor
     
     # Linux ARM64
     echo "Building for Linux ARM64..."
-    GOOS=linux GOARCH=arm64 go build -ldflags "$LDFLAGS" -o bin/processor-linux-arm64 cmd/processor/main.go
+    GOOS=linux GOARCH=arm64 go build -ldflags "$LDFLAGS" -o bin/processor-linux-arm64 ./cmd/processor
     
     # Windows AMD64
     echo "Building for Windows AMD64..."
-    GOOS=windows GOARCH=amd64 go build -ldflags "$LDFLAGS" -o bin/processor-windows-amd64.exe cmd/processor/main.go
+    GOOS=windows GOARCH=amd64 go build -ldflags "$LDFLAGS" -o bin/processor-windows-amd64.exe ./cmd/processor
     
     # macOS AMD64
     echo "Building for macOS AMD64..."
-    GOOS=darwin GOARCH=amd64 go build -ldflags "$LDFLAGS" -o bin/processor-darwin-amd64 cmd/processor/main.go
+    GOOS=darwin GOARCH=amd64 go build -ldflags "$LDFLAGS" -o bin/processor-darwin-amd64 ./cmd/processor
     
     # macOS ARM64 (Apple Silicon)
     echo "Building for macOS ARM64..."
-    GOOS=darwin GOARCH=arm64 go build -ldflags "$LDFLAGS" -o bin/processor-darwin-arm64 cmd/processor/main.go
+    GOOS=darwin GOARCH=arm64 go build -ldflags "$LDFLAGS" -o bin/processor-darwin-arm64 ./cmd/processor
 fi
 
 echo "Build completed successfully!"
@@ -58,4 +58,4 @@ echo "Binary location: $(pwd)/bin/processor"
 chmod +x bin/processor*
 
 echo "To run the processor:"
-echo "  ./bin/processor -help"
\ No newline at end of file
+echo "  ./bin/processor help"
\ No newline at end of file
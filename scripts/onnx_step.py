@@ -0,0 +1,273 @@
+#!/usr/bin/env python3
+"""Run an ONNX model as an exec pipeline step.
+
+Reads the image the exec filter sends as PNG on stdin, scales it to the
+model's input size, runs the model with onnxruntime and writes the result as
+PNG on stdout. A model with a one-channel output, such as a background
+matte, has it scaled back to the image and applied as its alpha; one with
+three channels, such as super-resolution or style transfer, replaces the
+image, at the size the model produced unless --restore-size is given.
+
+    python3 onnx_step.py --model models/u2net.onnx --size 320
+
+Images are handled with the standard library, so only onnxruntime and its
+numpy are needed. Inputs are NCHW float32 RGB scaled to 0-1, optionally
+normalized with --mean and --std; outputs are read as 0-1 unless
+--output-scale says otherwise.
+"""
+
+import argparse
+import struct
+import sys
+import zlib
+
+PNG_SIGNATURE = b"\x89PNG\r\n\x1a\n"
+
+
+class Image:
+    """8-bit RGBA pixels, row by row"""
+
+    def __init__(self, width, height, pixels=None):
+        self.width = width
+        self.height = height
+        self.pixels = pixels if pixels is not None else bytearray(width * height * 4)
+
+
+def read_png(data):
+    """decode an 8-bit, non-interlaced gray, RGB or RGBA PNG"""
+    if not data.startswith(PNG_SIGNATURE):
+        raise ValueError("input is not a PNG")
+    pos = len(PNG_SIGNATURE)
+    header = None
+    compressed = bytearray()
+    while pos + 8 <= len(data):
+        length, kind = struct.unpack(">I4s", data[pos:pos + 8])
+        body = data[pos + 8:pos + 8 + length]
+        pos += 12 + length
+        if kind == b"IHDR":
+            header = struct.unpack(">IIBBBBB", body)
+        elif kind == b"IDAT":
+            compressed += body
+        elif kind == b"IEND":
+            break
+    if header is None:
+        raise ValueError("PNG has no header")
+
+    width, height, depth, color, _, _, interlace = header
+    channels = {0: 1, 2: 3, 4: 2, 6: 4}.get(color)
+    if depth != 8 or channels is None or interlace:
+        raise ValueError("unsupported PNG: depth %d, color type %d, interlace %d" % (depth, color, interlace))
+
+    raw = zlib.decompress(bytes(compressed))
+    stride = width * channels
+    if len(raw) < height * (stride + 1):
+        raise ValueError("PNG data is truncated")
+    rows = []
+    previous = bytearray(stride)
+    for y in range(height):
+        start = y * (stride + 1)
+        row = unfilter(raw[start], bytearray(raw[start + 1:start + 1 + stride]), previous, channels)
+        rows.append(row)
+        previous = row
+
+    img = Image(width, height)
+    out = img.pixels
+    for y, row in enumerate(rows):
+        base = y * width * 4
+        if channels == 4:
+            out[base:base + width * 4] = row
+            continue
+        for x in range(width):
+            i = x * channels
+            if channels == 3:
+                out[base + x * 4:base + x * 4 + 4] = bytes((row[i], row[i + 1], row[i + 2], 255))
+            elif channels == 2:
+                out[base + x * 4:base + x * 4 + 4] = bytes((row[i], row[i], row[i], row[i + 1]))
+            else:
+                out[base + x * 4:base + x * 4 + 4] = bytes((row[i], row[i], row[i], 255))
+    return img
+
+
+def unfilter(kind, row, previous, bpp):
+    """undo a PNG row filter in place"""
+    if kind == 0:
+        return row
+    for i in range(len(row)):
+        left = row[i - bpp] if i >= bpp else 0
+        up = previous[i]
+        if kind == 1:
+            predictor = left
+        elif kind == 2:
+            predictor = up
+        elif kind == 3:
+            predictor = (left + up) // 2
+        elif kind == 4:
+            corner = previous[i - bpp] if i >= bpp else 0
+            p = left + up - corner
+            pa, pb, pc = abs(p - left), abs(p - up), abs(p - corner)
+            predictor = left if pa <= pb and pa <= pc else up if pb <= pc else corner
+        else:
+            raise ValueError("unknown PNG filter %d" % kind)
+        row[i] = (row[i] + predictor) & 0xFF
+    return row
+
+
+def write_png(img):
+    """encode img as an RGBA PNG"""
+    stride = img.width * 4
+    raw = bytearray()
+    for y in range(img.height):
+        raw.append(0)
+        raw += img.pixels[y * stride:(y + 1) * stride]
+
+    def chunk(kind, body):
+        return struct.pack(">I", len(body)) + kind + body + struct.pack(">I", zlib.crc32(kind + body) & 0xFFFFFFFF)
+
+    header = struct.pack(">IIBBBBB", img.width, img.height, 8, 6, 0, 0, 0)
+    return PNG_SIGNATURE + chunk(b"IHDR", header) + chunk(b"IDAT", zlib.compress(bytes(raw), 6)) + chunk(b"IEND", b"")
+
+
+def resize(img, width, height):
+    """scale img to width×height with bilinear sampling"""
+    out = Image(width, height)
+    src, dst = img.pixels, out.pixels
+    sx, sy = img.width / width, img.height / height
+    for y in range(height):
+        fy = min(max((y + 0.5) * sy - 0.5, 0), img.height - 1)
+        y0 = int(fy)
+        y1 = min(y0 + 1, img.height - 1)
+        wy = fy - y0
+        for x in range(width):
+            fx = min(max((x + 0.5) * sx - 0.5, 0), img.width - 1)
+            x0 = int(fx)
+            x1 = min(x0 + 1, img.width - 1)
+            wx = fx - x0
+            a = (y0 * img.width + x0) * 4
+            b = (y0 * img.width + x1) * 4
+            c = (y1 * img.width + x0) * 4
+            d = (y1 * img.width + x1) * 4
+            o = (y * width + x) * 4
+            for ch in range(4):
+                top = src[a + ch] + (src[b + ch] - src[a + ch]) * wx
+                bottom = src[c + ch] + (src[d + ch] - src[c + ch]) * wx
+                dst[o + ch] = int(top + (bottom - top) * wy + 0.5)
+    return out
+
+
+def to_tensor(img, mean, std):
+    """planar RGB floats of img, channel by channel, normalized"""
+    values = []
+    for ch in range(3):
+        values.extend((img.pixels[i + ch] / 255.0 - mean[ch]) / std[ch] for i in range(0, len(img.pixels), 4))
+    return values
+
+
+def clamp(v):
+    return 0 if v < 0 else 255 if v > 255 else int(v + 0.5)
+
+
+def apply_output(img, shape, values, scale, restore_size):
+    """the image made from a model output of the given NCHW shape"""
+    if len(shape) == 3:
+        shape = (1,) + tuple(shape)
+    if len(shape) != 4 or shape[0] != 1 or shape[1] not in (1, 3):
+        raise ValueError("unsupported model output shape %s: want 1, 1 or 3 channels, height and width" % (tuple(shape),))
+    channels, height, width = shape[1], shape[2], shape[3]
+    plane = width * height
+    factor = 255.0 / scale
+
+    if channels == 1:
+        mask = Image(width, height)
+        for i in range(plane):
+            level = clamp(values[i] * factor)
+            mask.pixels[i * 4:i * 4 + 4] = bytes((level, level, level, 255))
+        mask = resize(mask, img.width, img.height)
+        out = Image(img.width, img.height, bytearray(img.pixels))
+        for i in range(3, len(out.pixels), 4):
+            out.pixels[i] = out.pixels[i] * mask.pixels[i - 3] // 255
+        return out
+
+    out = Image(width, height)
+    for i in range(plane):
+        out.pixels[i * 4:i * 4 + 4] = bytes((
+            clamp(values[i] * factor),
+            clamp(values[plane + i] * factor),
+            clamp(values[2 * plane + i] * factor),
+            255,
+        ))
+    if restore_size:
+        out = resize(out, img.width, img.height)
+    return out
+
+
+def parse_size(text):
+    """a model input size given as N or WxH"""
+    parts = text.lower().split("x")
+    if len(parts) == 1:
+        parts = parts * 2
+    if len(parts) != 2:
+        raise ValueError("size must be N or WxH, such as 320 or 512x256")
+    width, height = (int(p) for p in parts)
+    if width <= 0 or height <= 0:
+        raise ValueError("size must be N or WxH, such as 320 or 512x256")
+    return width, height
+
+
+def parse_triple(text):
+    values = [float(v) for v in text.split(",")]
+    if len(values) != 3:
+        raise ValueError("want three comma-separated numbers, one for each of R, G and B")
+    return values
+
+
+class Session:
+    """a model loaded with onnxruntime"""
+
+    def __init__(self, path):
+        import onnxruntime
+
+        self.session = onnxruntime.InferenceSession(path, providers=onnxruntime.get_available_providers())
+        self.input = self.session.get_inputs()[0].name
+
+    def run(self, shape, values):
+        import numpy
+
+        tensor = numpy.asarray(values, dtype=numpy.float32).reshape(shape)
+        output = self.session.run(None, {self.input: tensor})[0]
+        return output.shape, output.astype(numpy.float32).ravel().tolist()
+
+
+def run(args, data, session):
+    """the PNG the step writes for the PNG data it reads"""
+    img = read_png(data)
+    width, height = args.size
+    model_input = resize(img, width, height)
+    shape, values = session.run((1, 3, height, width), to_tensor(model_input, args.mean, args.std))
+    return write_png(apply_output(img, shape, values, args.output_scale, args.restore_size))
+
+
+def arguments(argv):
+    parser = argparse.ArgumentParser(description="Run an ONNX model on the PNG on stdin, writing a PNG to stdout.")
+    parser.add_argument("--model", required=True, help="path of the .onnx model")
+    parser.add_argument("--size", required=True, type=parse_size, help="model input size, N or WxH")
+    parser.add_argument("--mean", type=parse_triple, default=[0.0, 0.0, 0.0], help="R,G,B subtracted from inputs in 0-1")
+    parser.add_argument("--std", type=parse_triple, default=[1.0, 1.0, 1.0], help="R,G,B inputs are divided by")
+    parser.add_argument("--output-scale", type=float, default=1.0, help="output value of full intensity, such as 255")
+    parser.add_argument("--restore-size", action="store_true", help="scale a three-channel output back to the input size")
+    return parser.parse_args(argv)
+
+
+def main(argv=None, session_type=Session):
+    args = arguments(argv)
+    try:
+        data = sys.stdin.buffer.read()
+        output = run(args, data, session_type(args.model))
+    except Exception as err:
+        print("onnx_step: %s" % err, file=sys.stderr)
+        return 1
+    sys.stdout.buffer.write(output)
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
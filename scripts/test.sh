@@ -26,6 +26,14 @@ go tool cover -func=test/coverage/coverage.out
 echo "Running race condition tests..."
 go test -race ./...
 
+# Test the ONNX step runner, with a stand-in for the model
+if command -v python3 &> /dev/null; then
+    echo "Running ONNX step runner tests..."
+    python3 -m unittest discover -s "$PROJECT_ROOT/scripts"
+else
+    echo "python3 not found, skipping ONNX step runner tests"
+fi
+
 # Run benchmarks
 echo "Running benchmarks..."
 go test -bench=. -benchmem ./...
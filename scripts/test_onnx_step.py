@@ -0,0 +1,110 @@
+"""Tests of onnx_step.py with a stand-in for the model: python3 -m unittest discover -s scripts"""
+
+import io
+import os
+import sys
+import unittest
+from unittest import mock
+
+sys.path.insert(0, os.path.dirname(os.path.abspath(__file__)))
+
+import onnx_step  # noqa: E402
+
+GOLDEN = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "internal", "processor", "testdata", "golden", "blur.png")
+
+
+def gradient(width, height):
+    img = onnx_step.Image(width, height)
+    for y in range(height):
+        for x in range(width):
+            i = (y * width + x) * 4
+            img.pixels[i:i + 4] = bytes((x * 255 // max(width - 1, 1), y * 255 // max(height - 1, 1), 128, 255))
+    return img
+
+
+class FakeSession:
+    """answers every run with a constant output of the given channels and size"""
+
+    def __init__(self, channels, width, height, value):
+        self.channels, self.width, self.height, self.value = channels, width, height, value
+        self.calls = []
+
+    def run(self, shape, values):
+        self.calls.append((shape, values))
+        return (1, self.channels, self.height, self.width), [self.value] * (self.channels * self.width * self.height)
+
+
+def args(*argv):
+    return onnx_step.arguments(["--model", "m.onnx"] + list(argv))
+
+
+class OnnxStepTest(unittest.TestCase):
+    def test_png_round_trip(self):
+        img = gradient(7, 5)
+        img.pixels[3] = 10
+        decoded = onnx_step.read_png(onnx_step.write_png(img))
+        self.assertEqual((decoded.width, decoded.height), (7, 5))
+        self.assertEqual(decoded.pixels, img.pixels)
+
+    def test_reads_filtered_rgb(self):
+        # written by Go's encoder, which filters rows and drops alpha from
+        # opaque images
+        with open(GOLDEN, "rb") as f:
+            img = onnx_step.read_png(f.read())
+        self.assertEqual((img.width, img.height), (48, 32))
+        self.assertTrue(all(a == 255 for a in img.pixels[3::4]))
+        again = onnx_step.read_png(onnx_step.write_png(img))
+        self.assertEqual(again.pixels, img.pixels)
+
+    def test_resize(self):
+        img = gradient(8, 6)
+        self.assertEqual(onnx_step.resize(img, 8, 6).pixels, img.pixels)
+        small = onnx_step.resize(img, 4, 3)
+        self.assertEqual((small.width, small.height), (4, 3))
+        self.assertLess(small.pixels[0], small.pixels[(3) * 4])
+
+    def test_tensor_is_planar(self):
+        img = onnx_step.Image(2, 1, bytearray((255, 0, 51, 255, 0, 255, 102, 255)))
+        values = onnx_step.to_tensor(img, [0.5, 0, 0], [0.5, 1, 1])
+        self.assertEqual([round(v, 3) for v in values], [1.0, -1.0, 0.0, 1.0, 0.2, 0.4])
+
+    def test_mask_sets_alpha(self):
+        session = FakeSession(1, 4, 4, 0.5)
+        out = onnx_step.read_png(onnx_step.run(args("--size", "4"), onnx_step.write_png(gradient(10, 6)), session))
+        self.assertEqual((out.width, out.height), (10, 6))
+        self.assertEqual(set(out.pixels[3::4]), {128})
+        self.assertEqual(out.pixels[0:3], gradient(10, 6).pixels[0:3])
+        shape, values = session.calls[0]
+        self.assertEqual(shape, (1, 3, 4, 4))
+        self.assertEqual(len(values), 3 * 4 * 4)
+
+    def test_image_output(self):
+        session = FakeSession(3, 20, 12, 255.0)
+        data = onnx_step.write_png(gradient(5, 3))
+        out = onnx_step.read_png(onnx_step.run(args("--size", "5x3", "--output-scale", "255"), data, session))
+        self.assertEqual((out.width, out.height), (20, 12))
+        self.assertEqual(set(out.pixels), {255})
+
+        out = onnx_step.read_png(onnx_step.run(args("--size", "5x3", "--restore-size"), data, FakeSession(3, 20, 12, 0.0)))
+        self.assertEqual((out.width, out.height), (5, 3))
+
+    def test_rejects(self):
+        for size in ["0", "3x", "2x3x4", "big"]:
+            with self.assertRaises(ValueError, msg=size):
+                onnx_step.parse_size(size)
+        with self.assertRaises(ValueError):
+            onnx_step.read_png(b"GIF89a")
+        with self.assertRaises(ValueError):
+            onnx_step.apply_output(gradient(2, 2), (1, 2, 2, 2), [0.0] * 8, 1.0, False)
+
+    def test_main_reports_errors(self):
+        stdin = mock.Mock(buffer=io.BytesIO(b"not a png"))
+        stderr = io.StringIO()
+        with mock.patch.object(sys, "stdin", stdin), mock.patch.object(sys, "stderr", stderr):
+            code = onnx_step.main(["--model", "m.onnx", "--size", "4"], session_type=lambda path: FakeSession(1, 4, 4, 1.0))
+        self.assertEqual(code, 1)
+        self.assertIn("onnx_step: input is not a PNG", stderr.getvalue())
+
+
+if __name__ == "__main__":
+    unittest.main()